@@ -0,0 +1,433 @@
+package audit
+
+import (
+	"bufio"
+	"code.cloudfoundry.org/lager"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+//Operations recorded in the audit log
+const (
+	Provision         = "provision"
+	Update            = "update"
+	Deprovision       = "deprovision"
+	Bind              = "bind"
+	Unbind            = "unbind"
+	RotateCredentials = "rotate-credentials"
+	//Recorded by instance for the sweeps deleting rotated out credentials once their grace period is over
+	DeleteRetiredCredentials = "delete-retired-credentials"
+	Reconcile                = "reconcile"
+	ForceDelete              = "force-delete"
+	SyncQuota                = "sync-quota"
+	ImportState              = "import-state"
+	//Recorded whenever an auditor is created, so every chain of records starts with one. It holds the hash of the last
+	//record written before, so the chains are linked as well
+	Started = "audit-started"
+)
+
+//Results of the audited operations. Asynchronous operations are recorded once they completed, with their outcome
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+//Record is an entry of the audit log. Each record holds the hash of the previous one, so removed or
+//modified records break the chain, which Verify detects
+type Record struct {
+	//Random ID of the auditor that wrote the record, as several brokers or admin commands may write to the same sink
+	Chain        string           `json:"chain"`
+	Seq          uint64           `json:"seq"`
+	Time         time.Time        `json:"time"`
+	Operation    string           `json:"operation"`
+	Identity     *Identity        `json:"identity,omitempty"`
+	Context      *PlatformContext `json:"context,omitempty"`
+	InstanceID   string           `json:"instanceID,omitempty"`
+	BindingID    string           `json:"bindingID,omitempty"`
+	PlanID       string           `json:"planID,omitempty"`
+	OperationID  string           `json:"operationID,omitempty"`
+	Result       string           `json:"result"`
+	Error        string           `json:"error,omitempty"`
+	RadosgwCalls []RadosgwCall    `json:"radosgwCalls,omitempty"`
+	PrevHash     string           `json:"prevHash"`
+	Hash         string           `json:"hash"`
+}
+
+//RadosgwCall is a call to the radosgw admin API made by an audited operation
+type RadosgwCall struct {
+	Call  string `json:"call"`
+	Error string `json:"error,omitempty"`
+}
+
+//Sink writes audit records to where they're kept. Writes are serialized by the auditor
+type Sink interface {
+	Write(rec *Record) error
+	Close() error
+}
+
+//FlushingSink is a sink that buffers the records and writes them later. The auditor only saves the head once the sink
+//flushed the record, so the head never points past the records the sink holds
+type FlushingSink interface {
+	Sink
+	//OnFlush sets the function called with the sequence number and hash of the last record whenever records were flushed
+	OnFlush(f func(seq uint64, hash string))
+}
+
+//HeadStore keeps the hash of the last record written by any auditor sharing it, which the next auditor starts its chain from
+type HeadStore interface {
+	//Returns an empty hash if no record was written yet
+	GetAuditHead(ctx context.Context) (string, error)
+	PutAuditHead(ctx context.Context, hash string) error
+}
+
+//Auditor chains the records of the audited operations and writes them to all of its sinks.
+//It's kept apart from the lager logs, which are neither complete nor tamper-evident
+type Auditor struct {
+	chain    string
+	logger   lager.Logger
+	head     HeadStore
+	sinks    []Sink
+	mutex    sync.Mutex
+	seq      uint64
+	lastHash string
+	closed   bool
+
+	//The head is saved in the background, so operations don't wait for the head store. Records written while it's saved
+	//are coalesced into the next save
+	headMutex   sync.Mutex
+	nextHead    string
+	headClosed  bool
+	headChanged chan struct{}
+	headSaved   chan struct{}
+	//Last record flushed by each flushing sink, nil if there are none
+	flushed map[Sink]flushedRecord
+}
+
+type flushedRecord struct {
+	seq  uint64
+	hash string
+}
+
+//New creates an auditor writing to the given sinks and records that auditing started. The chain of the auditor starts
+//from the head of the store, which it then keeps up to date in the background. With flushing sinks the head follows the
+//records they flushed. Without a store the chain is linked to none before it
+func New(logger lager.Logger, head HeadStore, sinks ...Sink) (*Auditor, error) {
+	prevHash := ""
+	if head != nil {
+		var err error
+		if prevHash, err = head.GetAuditHead(context.Background()); err != nil {
+			return nil, fmt.Errorf("Failed to read the hash of the last audit record. %v", err)
+		}
+	}
+
+	chain := make([]byte, 8)
+	rand.Read(chain)
+
+	a := &Auditor{chain: hex.EncodeToString(chain), logger: logger.Session("audit"), head: head, sinks: sinks, lastHash: prevHash}
+	if head != nil {
+		a.headChanged, a.headSaved = make(chan struct{}, 1), make(chan struct{})
+		for _, s := range sinks {
+			if fs, ok := s.(FlushingSink); ok {
+				if a.flushed == nil {
+					a.flushed = map[Sink]flushedRecord{}
+				}
+				a.flushed[fs] = flushedRecord{}
+				fs.OnFlush(func(seq uint64, hash string) { a.sinkFlushed(fs, seq, hash) })
+			}
+		}
+		go a.saveHeads()
+	}
+	a.write(&Record{Time: time.Now().UTC(), Operation: Started, Result: ResultSuccess})
+	return a, nil
+}
+
+//Start begins the record of an operation on behalf of the identity in the context, along with its platform context. Methods of the returned
+//event do nothing if the auditor is nil, so auditing can be left unconfigured
+func (a *Auditor) Start(ctx context.Context, operation string, instanceID string, bindingID string, planID string) *Event {
+	if a == nil {
+		return nil
+	}
+
+	return &Event{auditor: a, record: Record{
+		Operation:  operation,
+		Identity:   IdentityFromContext(ctx),
+		Context:    PlatformContextFromContext(ctx),
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+		PlanID:     planID,
+	}}
+}
+
+//Close closes all sinks, flushing records they buffer, and waits for the head to be saved
+func (a *Auditor) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+
+	var firstErr error
+	for _, s := range a.sinks {
+		if err := s.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if a.headChanged != nil {
+		a.headMutex.Lock()
+		a.headClosed = true
+		close(a.headChanged)
+		a.headMutex.Unlock()
+		<-a.headSaved
+	}
+	return firstErr
+}
+
+//Chains the record to the previous one and writes it to all sinks. Failing sinks are logged, as an operation that
+//already happened can't be undone because its record couldn't be written
+func (a *Auditor) write(rec *Record) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.seq++
+	rec.Chain = a.chain
+	rec.Seq = a.seq
+	rec.PrevHash = a.lastHash
+	rec.Hash = ""
+	hash, err := hashRecord(rec)
+	if err != nil {
+		a.logger.Error("failed-to-hash-record", err, lager.Data{"seq": rec.Seq})
+		return
+	}
+	rec.Hash = hash
+	a.lastHash = hash
+
+	for _, s := range a.sinks {
+		if err := s.Write(rec); err != nil {
+			a.logger.Error("failed-to-write-record", err, lager.Data{"seq": rec.Seq, "sink": fmt.Sprintf("%T", s)})
+		}
+	}
+
+	if a.head != nil && a.flushed == nil {
+		a.setHead(hash)
+	}
+}
+
+//Records the last flushed record of the sink. The head moves to the earliest record all flushing sinks flushed
+func (a *Auditor) sinkFlushed(s Sink, seq uint64, hash string) {
+	a.headMutex.Lock()
+	a.flushed[s] = flushedRecord{seq: seq, hash: hash}
+	earliest := flushedRecord{}
+	for _, f := range a.flushed {
+		if f.seq == 0 {
+			a.headMutex.Unlock()
+			return
+		}
+		if earliest.seq == 0 || f.seq < earliest.seq {
+			earliest = f
+		}
+	}
+	a.headMutex.Unlock()
+
+	a.setHead(earliest.hash)
+}
+
+//Has the head saved in the background. Heads set after the auditor was closed are dropped
+func (a *Auditor) setHead(hash string) {
+	a.headMutex.Lock()
+	defer a.headMutex.Unlock()
+	if a.headClosed {
+		return
+	}
+
+	a.nextHead = hash
+	select {
+	case a.headChanged <- struct{}{}:
+	default:
+	}
+}
+
+//Saves the head whenever it changed, until the auditor is closed. A head that failed to be saved is retried with the
+//next change, and once more when the auditor is closed
+func (a *Auditor) saveHeads() {
+	defer close(a.headSaved)
+
+	saved := ""
+	save := func() {
+		a.headMutex.Lock()
+		hash := a.nextHead
+		a.headMutex.Unlock()
+		if hash == "" || hash == saved {
+			return
+		}
+
+		if err := a.head.PutAuditHead(context.Background(), hash); err != nil {
+			a.logger.Error("failed-to-save-head", err)
+			return
+		}
+		saved = hash
+	}
+
+	for range a.headChanged {
+		save()
+	}
+	save()
+}
+
+//Returns the hash of the record along with the hash of its predecessor, with the record's own hash left empty
+func hashRecord(rec *Record) (string, error) {
+	r := *rec
+	r.Hash = ""
+	j, err := json.Marshal(&r)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(j)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+//Event is the record of an operation while it is running
+type Event struct {
+	auditor *Auditor
+	mutex   sync.Mutex
+	record  Record
+	async   bool
+}
+
+//RadosgwCall adds a call to the radosgw admin API to the record
+func (ev *Event) RadosgwCall(call string, err error) {
+	if ev == nil {
+		return
+	}
+
+	ev.mutex.Lock()
+	defer ev.mutex.Unlock()
+
+	c := RadosgwCall{Call: call}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	ev.record.RadosgwCalls = append(ev.record.RadosgwCalls, c)
+}
+
+//Async marks the operation as continuing in the background, so the record is only written by FinishAsync
+func (ev *Event) Async(operationID string) {
+	if ev == nil {
+		return
+	}
+
+	ev.mutex.Lock()
+	defer ev.mutex.Unlock()
+
+	ev.async = true
+	ev.record.OperationID = operationID
+}
+
+//Finish writes the record with the outcome of the request, unless the operation continues in the background
+func (ev *Event) Finish(err error) {
+	if ev == nil {
+		return
+	}
+
+	ev.mutex.Lock()
+	async := ev.async
+	ev.mutex.Unlock()
+
+	if !async {
+		ev.finish(err)
+	}
+}
+
+//FinishAsync writes the record of an operation that continued in the background with its outcome
+func (ev *Event) FinishAsync(err error) {
+	if ev == nil {
+		return
+	}
+
+	ev.finish(err)
+}
+
+func (ev *Event) finish(err error) {
+	ev.mutex.Lock()
+	rec := ev.record
+	ev.mutex.Unlock()
+
+	rec.Time = time.Now().UTC()
+	rec.Result = ResultSuccess
+	if err != nil {
+		rec.Result = ResultFailure
+		rec.Error = err.Error()
+	}
+
+	ev.auditor.write(&rec)
+}
+
+//Verify checks the chains of the audit records read from JSON lines, as written by the file sink or read by NewS3Reader,
+//and returns the number of records. Each auditor writes its own chain, which starts with a record of auditing being
+//started that links to a record before it. Only the first chain may link to a record that isn't read, as the log may
+//have been rotated
+func Verify(r io.Reader) (int, error) {
+	return VerifyHead(r, "")
+}
+
+//VerifyHead checks the chains like Verify, and that the log reaches the head saved by the auditors, so records removed
+//from the end of the log are detected as well. Records after the head are accepted, as auditors that are still running
+//save the head after writing their records. An empty head isn't checked
+func VerifyHead(r io.Reader, head string) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	n := 0
+	last := map[string]*Record{}
+	seen := map[string]bool{}
+	for scanner.Scan() {
+		n++
+		rec := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			return n, fmt.Errorf("Record on line %d is invalid. %v", n, err)
+		}
+
+		hash, err := hashRecord(rec)
+		if err != nil {
+			return n, err
+		}
+		if hash != rec.Hash {
+			return n, fmt.Errorf("Record %d on line %d was modified", rec.Seq, n)
+		}
+
+		prev := last[rec.Chain]
+		if prev == nil {
+			if rec.Seq != 1 || rec.Operation != Started {
+				return n, fmt.Errorf("Record %d on line %d doesn't start with auditing being started, so records were removed", rec.Seq, n)
+			}
+			if rec.PrevHash != "" && n > 1 && !seen[rec.PrevHash] {
+				return n, fmt.Errorf("Record %d on line %d starts a chain after a record that isn't in the log, so records were removed", rec.Seq, n)
+			}
+		} else if rec.Seq != prev.Seq+1 || rec.PrevHash != prev.Hash {
+			return n, fmt.Errorf("Record %d on line %d doesn't follow the previous record of its chain, so records were removed", rec.Seq, n)
+		}
+		last[rec.Chain] = rec
+		seen[rec.Hash] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return n, err
+	}
+
+	if head != "" && !seen[head] {
+		return n, fmt.Errorf("The log doesn't reach the head %s saved by the auditors, so records were removed from its end", head)
+	}
+	return n, nil
+}
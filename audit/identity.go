@@ -0,0 +1,127 @@
+package audit
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+//Header the platform sends with OSB requests to identify the user on whose behalf a request is made
+const OriginatingIdentityHeader = "X-Broker-API-Originating-Identity"
+
+//Identity is the originating identity of a request: the platform, e.g. 'cloudfoundry' or 'kubernetes', and the
+//platform specific properties of the user, such as the 'user_id' on Cloud Foundry or the 'username' on Kubernetes
+type Identity struct {
+	Platform string `json:"platform"`
+	//Decoded JSON object sent by the platform. Missing if it couldn't be decoded, in which case Raw is set
+	Value json.RawMessage `json:"value,omitempty"`
+	Raw   string          `json:"raw,omitempty"`
+}
+
+//PlatformContext is the context object platforms send with provision, update and bind requests, describing where the
+//instance lives: the organization and space on Cloud Foundry, or the namespace and cluster on Kubernetes
+type PlatformContext struct {
+	Platform         string `json:"platform"`
+	OrganizationGUID string `json:"organizationGUID,omitempty"`
+	SpaceGUID        string `json:"spaceGUID,omitempty"`
+	InstanceName     string `json:"instanceName,omitempty"`
+	Namespace        string `json:"namespace,omitempty"`
+	ClusterID        string `json:"clusterID,omitempty"`
+}
+
+type identityKey struct{}
+
+type platformContextKey struct{}
+
+//ParseIdentity parses the value of the originating identity header, which is the platform followed by the
+//base64 encoded JSON object of the user. An empty header returns nil
+func ParseIdentity(header string) *Identity {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return nil
+	}
+
+	parts := strings.SplitN(header, " ", 2)
+	id := &Identity{Platform: parts[0]}
+	if len(parts) < 2 {
+		return id
+	}
+
+	value := strings.TrimSpace(parts[1])
+	if j, err := base64.StdEncoding.DecodeString(value); err == nil && json.Valid(j) {
+		id.Value = j
+	} else {
+		id.Raw = value
+	}
+	return id
+}
+
+//ParsePlatformContext parses the context object of a request, as sent by Cloud Foundry and Kubernetes.
+//A missing or invalid object, or one without a platform, returns nil
+func ParsePlatformContext(raw json.RawMessage) *PlatformContext {
+	if len(raw) == 0 {
+		return nil
+	}
+
+	c := struct {
+		Platform         string `json:"platform"`
+		OrganizationGUID string `json:"organization_guid"`
+		SpaceGUID        string `json:"space_guid"`
+		InstanceName     string `json:"instance_name"`
+		Namespace        string `json:"namespace"`
+		ClusterID        string `json:"clusterid"`
+	}{}
+	if err := json.Unmarshal(raw, &c); err != nil || c.Platform == "" {
+		return nil
+	}
+
+	pc := PlatformContext(c)
+	return &pc
+}
+
+//NewContext returns a context holding the identity
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+//IdentityFromContext returns the identity held by the context, or nil if there is none
+func IdentityFromContext(ctx context.Context) *Identity {
+	if ctx == nil {
+		return nil
+	}
+
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
+
+//NewPlatformContext returns a context holding the parsed platform context of a request, or ctx if it has none
+func NewPlatformContext(ctx context.Context, raw json.RawMessage) context.Context {
+	pc := ParsePlatformContext(raw)
+	if pc == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, platformContextKey{}, pc)
+}
+
+//PlatformContextFromContext returns the platform context held by the context, or nil if there is none
+func PlatformContextFromContext(ctx context.Context) *PlatformContext {
+	if ctx == nil {
+		return nil
+	}
+
+	pc, _ := ctx.Value(platformContextKey{}).(*PlatformContext)
+	return pc
+}
+
+//IdentityHandler passes the originating identity of the requests to the wrapped handler through their context
+func IdentityHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if id := ParseIdentity(req.Header.Get(OriginatingIdentityHeader)); id != nil {
+			req = req.WithContext(NewContext(req.Context(), id))
+		}
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,206 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/icclab/ceph-objectstore-broker/s3"
+	"io"
+	"log/syslog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Names of the sinks as used in the broker config
+const (
+	FileSinkName   = "file"
+	SyslogSinkName = "syslog"
+	S3SinkName     = "s3"
+)
+
+//FileSink appends the records as JSON lines to a local file, which can be checked with Verify
+type FileSink struct {
+	file *os.File
+}
+
+//NewFileSink opens the file for appending, creating it if it doesn't exist yet
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSink{file: f}, nil
+}
+
+//Write appends the record and syncs the file, so written records survive a crash of the broker
+func (fs *FileSink) Write(rec *Record) error {
+	j, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fs.file.Write(append(j, '\n')); err != nil {
+		return err
+	}
+
+	return fs.file.Sync()
+}
+
+func (fs *FileSink) Close() error {
+	return fs.file.Close()
+}
+
+//SyslogSink sends the records as JSON to the local syslog daemon with the auth facility. Verify can only check them once
+//the messages are extracted from the files of the daemon, one per line and in order
+type SyslogSink struct {
+	writer *syslog.Writer
+}
+
+func NewSyslogSink(tag string) (*SyslogSink, error) {
+	w, err := syslog.New(syslog.LOG_NOTICE|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SyslogSink{writer: w}, nil
+}
+
+func (ss *SyslogSink) Write(rec *Record) error {
+	j, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	return ss.writer.Notice(string(j))
+}
+
+func (ss *SyslogSink) Close() error {
+	return ss.writer.Close()
+}
+
+//S3Sink streams the records into a bucket as a series of JSON lines objects, which NewS3Reader reads back for Verify. As objects can't be appended to,
+//records are buffered and written as a new object whenever the flush interval passed, named by the time and
+//sequence number of their first record so they list in order
+type S3Sink struct {
+	s3         *s3.S3
+	bucketName string
+	prefix     string
+
+	mutex    sync.Mutex
+	buffer   bytes.Buffer
+	firstSeq uint64
+	first    time.Time
+	lastSeq  uint64
+	lastHash string
+	onFlush  func(seq uint64, hash string)
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+//NewS3Sink creates the sink and starts flushing it at every interval
+func NewS3Sink(s *s3.S3, bucketName string, prefix string, flushInterval time.Duration) *S3Sink {
+	ss := &S3Sink{s3: s, bucketName: bucketName, prefix: prefix, done: make(chan struct{}), stopped: make(chan struct{})}
+	go ss.run(flushInterval)
+	return ss
+}
+
+func (ss *S3Sink) Write(rec *Record) error {
+	j, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	if ss.buffer.Len() == 0 {
+		ss.firstSeq = rec.Seq
+		ss.first = rec.Time
+	}
+	ss.buffer.Write(append(j, '\n'))
+	ss.lastSeq, ss.lastHash = rec.Seq, rec.Hash
+	return nil
+}
+
+//OnFlush sets the function called with the last record written whenever the buffered records were flushed
+func (ss *S3Sink) OnFlush(f func(seq uint64, hash string)) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.onFlush = f
+}
+
+//Close stops the periodic flushing and writes the buffered records
+func (ss *S3Sink) Close() error {
+	close(ss.done)
+	<-ss.stopped
+	return ss.Flush()
+}
+
+//Flush writes the buffered records as a new object. They're kept if writing fails, so the next flush retries them
+func (ss *S3Sink) Flush() error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	if ss.buffer.Len() == 0 {
+		return nil
+	}
+
+	objName := fmt.Sprintf("%s%s-%020d.jsonl", ss.prefix, ss.first.UTC().Format("20060102T150405.000000000Z"), ss.firstSeq)
+	if err := ss.s3.PutObject(context.Background(), ss.bucketName, objName, ss.buffer.String()); err != nil {
+		return err
+	}
+
+	ss.buffer.Reset()
+	if ss.onFlush != nil {
+		ss.onFlush(ss.lastSeq, ss.lastHash)
+	}
+	return nil
+}
+
+//NewS3Reader returns the records the S3 sinks with the prefix wrote to the bucket, in the order of their objects
+func NewS3Reader(ctx context.Context, s *s3.S3, bucketName string, prefix string) (io.Reader, error) {
+	objs, done := s.GetObjects(ctx, bucketName, prefix, false)
+	defer close(done)
+
+	names := []string{}
+	for o := range objs {
+		if o.Err != nil {
+			return nil, o.Err
+		}
+		if strings.HasSuffix(o.Key, ".jsonl") {
+			names = append(names, o.Key)
+		}
+	}
+	sort.Strings(names)
+
+	records := bytes.Buffer{}
+	for _, name := range names {
+		data, err := s.GetObjectString(ctx, bucketName, name)
+		if err != nil {
+			return nil, err
+		}
+		records.WriteString(data)
+	}
+	return &records, nil
+}
+
+func (ss *S3Sink) run(interval time.Duration) {
+	defer close(ss.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			//Failures are retried with the next flush and reported by Close
+			ss.Flush()
+		case <-ss.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package broker
+
+import (
+	"code.cloudfoundry.org/lager"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/icclab/ceph-objectstore-broker/audit"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/auth"
+	"net/http"
+	"time"
+)
+
+//Path of the credential rotation endpoint of the admin API
+const RotateCredentialsPath = "/admin/service_instances/{instance_id}/service_bindings/{binding_id}/rotate_credentials"
+
+//Path of the endpoint of the admin API that reconciles the radosgw users with the state of the broker
+const ReconcilePath = "/admin/reconcile"
+
+//Path of the endpoint of the admin API that deletes an instance regardless of its bindings and deletion policy
+const ForceDeletePath = "/admin/service_instances/{instance_id}/force_delete"
+
+//Path of the endpoint of the admin API that sets the quotas of instances back to their plans
+const SyncQuotasPath = "/admin/sync_quotas"
+
+//Path of the endpoint of the admin API that imports a state export into the state store
+const ImportStatePath = "/admin/import_state"
+
+//Path of the endpoint of the admin API that returns the last collected storage usage of all instances
+const UsagePath = "/admin/usage"
+
+//Path of the endpoint of the admin API that returns metering reports of the traffic and storage of the instances
+const MeteringPath = "/admin/metering"
+
+//RotateCredentialsRequest is the optional body of a credential rotation request
+type RotateCredentialsRequest struct {
+	//Go duration, e.g. '1h30m'. The configured grace period is used if empty
+	GracePeriod string `json:"grace_period"`
+}
+
+//RotateCredentialsResponse holds the new credentials of a binding
+type RotateCredentialsResponse struct {
+	Credentials *BindCreds `json:"credentials"`
+	GracePeriod string     `json:"grace_period"`
+}
+
+//ReconcileRequest is the optional body of a reconciliation request
+type ReconcileRequest struct {
+	//Orphans are only reported unless this is set to false
+	DryRun *bool `json:"dry_run"`
+	//Go duration. Users modified more recently are skipped. Defaults to DefaultOrphanMinAge
+	MinAge string `json:"min_age"`
+}
+
+//SyncQuotasRequest is the optional body of a quota sync request
+type SyncQuotasRequest struct {
+	//All instances are synced if empty
+	InstanceIDs []string `json:"instance_ids"`
+	//Only returns the quotas that would change if set
+	DryRun bool `json:"dry_run"`
+}
+
+//ImportStateResponse holds the number of instances imported, out of those in the export
+type ImportStateResponse struct {
+	Imported  int `json:"imported"`
+	Instances int `json:"instances"`
+}
+
+//NewAdminHandler returns the handler of the broker's admin API, which isn't part of the OSB API and
+//is protected by the same credentials
+func NewAdminHandler(b *Broker, logger lager.Logger, username string, password string) http.Handler {
+	router := mux.NewRouter()
+	router.HandleFunc(RotateCredentialsPath, func(w http.ResponseWriter, req *http.Request) {
+		rotateCredentials(b, logger, w, req)
+	}).Methods("POST")
+	router.HandleFunc(ReconcilePath, func(w http.ResponseWriter, req *http.Request) {
+		reconcile(b, logger, w, req)
+	}).Methods("POST")
+	router.HandleFunc(ForceDeletePath, func(w http.ResponseWriter, req *http.Request) {
+		forceDelete(b, logger, w, req)
+	}).Methods("POST")
+	router.HandleFunc(SyncQuotasPath, func(w http.ResponseWriter, req *http.Request) {
+		syncQuotas(b, logger, w, req)
+	}).Methods("POST")
+	router.HandleFunc(ImportStatePath, func(w http.ResponseWriter, req *http.Request) {
+		importState(b, logger, w, req)
+	}).Methods("POST")
+	router.HandleFunc(UsagePath, func(w http.ResponseWriter, req *http.Request) {
+		usage(b, logger, w, req)
+	}).Methods("GET")
+	router.HandleFunc(MeteringPath, func(w http.ResponseWriter, req *http.Request) {
+		metering(b, logger, w, req)
+	}).Methods("GET")
+
+	return auth.NewWrapper(username, password).Wrap(audit.IdentityHandler(router))
+}
+
+func rotateCredentials(b *Broker, logger lager.Logger, w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	logger = logger.Session("rotate-credentials", lager.Data{"instance-id": vars["instance_id"], "binding-id": vars["binding_id"]})
+
+	body := RotateCredentialsRequest{}
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			respondAdmin(w, logger, http.StatusBadRequest, brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		}
+	}
+
+	grace := b.config().RotationGracePeriod
+	if body.GracePeriod != "" {
+		d, err := time.ParseDuration(body.GracePeriod)
+		if err != nil || d < 0 {
+			respondAdmin(w, logger, http.StatusBadRequest, brokerapi.ErrorResponse{Description: "Invalid grace period '" + body.GracePeriod + "'"})
+			return
+		}
+		grace = d
+	}
+
+	ab, ev := b.StartAudit(req.Context(), audit.RotateCredentials, vars["instance_id"], vars["binding_id"], "")
+	creds, err := ab.RotateBindingCredentials(req.Context(), vars["instance_id"], vars["binding_id"], grace)
+	ev.Finish(err)
+	if err != nil {
+		respondAdminError(w, logger, err)
+		return
+	}
+
+	respondAdmin(w, logger, http.StatusOK, RotateCredentialsResponse{Credentials: creds, GracePeriod: grace.String()})
+}
+
+func reconcile(b *Broker, logger lager.Logger, w http.ResponseWriter, req *http.Request) {
+	logger = logger.Session("reconcile")
+
+	body := ReconcileRequest{}
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			respondAdmin(w, logger, http.StatusBadRequest, brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		}
+	}
+
+	dryRun := body.DryRun == nil || *body.DryRun
+	minAge := DefaultOrphanMinAge
+	if body.MinAge != "" {
+		d, err := time.ParseDuration(body.MinAge)
+		if err != nil || d < 0 {
+			respondAdmin(w, logger, http.StatusBadRequest, brokerapi.ErrorResponse{Description: "Invalid minimum age '" + body.MinAge + "'"})
+			return
+		}
+		minAge = d
+	}
+
+	//Dry runs change nothing, so only reconciliations removing orphans are audited
+	ab, ev := b, (*audit.Event)(nil)
+	if !dryRun {
+		ab, ev = b.StartAudit(req.Context(), audit.Reconcile, "", "", "")
+	}
+	report, err := ab.Reconcile(req.Context(), dryRun, minAge)
+	ev.Finish(err)
+	if err != nil {
+		logger.Error("failed", err)
+		respondAdmin(w, logger, http.StatusInternalServerError, brokerapi.ErrorResponse{Description: err.Error()})
+		return
+	}
+
+	respondAdmin(w, logger, http.StatusOK, report)
+}
+
+func forceDelete(b *Broker, logger lager.Logger, w http.ResponseWriter, req *http.Request) {
+	instID := mux.Vars(req)["instance_id"]
+	logger = logger.Session("force-delete", lager.Data{"instance-id": instID})
+
+	ab, ev := b.StartAudit(req.Context(), audit.ForceDelete, instID, "", "")
+	err := ab.ForceDeleteInstance(req.Context(), instID)
+	ev.Finish(err)
+	if err != nil {
+		respondAdminError(w, logger, err)
+		return
+	}
+
+	respondAdmin(w, logger, http.StatusOK, brokerapi.EmptyResponse{})
+}
+
+func syncQuotas(b *Broker, logger lager.Logger, w http.ResponseWriter, req *http.Request) {
+	logger = logger.Session("sync-quotas")
+
+	body := SyncQuotasRequest{}
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			respondAdmin(w, logger, http.StatusBadRequest, brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		}
+	}
+
+	syncs, err := b.SyncQuotas(req.Context(), body.InstanceIDs, body.DryRun)
+	if err != nil {
+		respondAdminError(w, logger, err)
+		return
+	}
+
+	respondAdmin(w, logger, http.StatusOK, syncs)
+}
+
+//Imports the state export of the body. Instances already in the store are skipped unless the 'overwrite' query parameter is true
+func importState(b *Broker, logger lager.Logger, w http.ResponseWriter, req *http.Request) {
+	logger = logger.Session("import-state")
+
+	exp := &StateExport{}
+	if err := json.NewDecoder(req.Body).Decode(exp); err != nil {
+		respondAdmin(w, logger, http.StatusBadRequest, brokerapi.ErrorResponse{Description: "Failed to parse state. " + err.Error()})
+		return
+	}
+
+	ev := b.Audit.Start(req.Context(), audit.ImportState, "", "", "")
+	n, err := b.ImportState(req.Context(), exp, req.URL.Query().Get("overwrite") == "true")
+	ev.Finish(err)
+	if err != nil {
+		respondAdminError(w, logger, err)
+		return
+	}
+
+	respondAdmin(w, logger, http.StatusOK, ImportStateResponse{Imported: n, Instances: len(exp.Instances)})
+}
+
+func usage(b *Broker, logger lager.Logger, w http.ResponseWriter, req *http.Request) {
+	var report *UsageReport
+	if b.Usage != nil {
+		report = b.Usage.Report()
+	}
+
+	if report == nil {
+		respondAdmin(w, logger, http.StatusServiceUnavailable, brokerapi.ErrorResponse{Description: "The usage of the instances was not collected yet"})
+		return
+	}
+
+	respondAdmin(w, logger, http.StatusOK, report)
+}
+
+//Responds with the metering report of the window given by the 'start' and 'end' query parameters, or with the last
+//metered period if neither is set. The report is aggregated by 'group_by' and returned as JSON or, with 'format=csv', as CSV
+func metering(b *Broker, logger lager.Logger, w http.ResponseWriter, req *http.Request) {
+	logger = logger.Session("metering")
+	query := req.URL.Query()
+
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		respondAdmin(w, logger, http.StatusBadRequest, brokerapi.ErrorResponse{Description: "Format must be 'json' or 'csv'"})
+		return
+	}
+
+	var report *MeteringReport
+	if query.Get("start") == "" && query.Get("end") == "" {
+		if b.Metering != nil {
+			report = b.Metering.Report()
+		}
+		if report == nil {
+			respondAdmin(w, logger, http.StatusServiceUnavailable, brokerapi.ErrorResponse{Description: "The usage of the instances was not metered yet"})
+			return
+		}
+	} else {
+		start, err := time.Parse(time.RFC3339, query.Get("start"))
+		if err != nil {
+			respondAdmin(w, logger, http.StatusBadRequest, brokerapi.ErrorResponse{Description: "Invalid start '" + query.Get("start") + "'. Expected an RFC 3339 time"})
+			return
+		}
+		end, err := time.Parse(time.RFC3339, query.Get("end"))
+		if err != nil {
+			respondAdmin(w, logger, http.StatusBadRequest, brokerapi.ErrorResponse{Description: "Invalid end '" + query.Get("end") + "'. Expected an RFC 3339 time"})
+			return
+		}
+		if !start.Before(end) {
+			respondAdmin(w, logger, http.StatusBadRequest, brokerapi.ErrorResponse{Description: "The start must be before the end"})
+			return
+		}
+
+		if report, err = b.Meter(req.Context(), start, end); err != nil {
+			logger.Error("failed", err)
+			respondAdmin(w, logger, http.StatusInternalServerError, brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		}
+	}
+
+	groupBy := query.Get("group_by")
+	if groupBy == "" {
+		groupBy = GroupByInstance
+	}
+	report, err := report.Aggregate(groupBy)
+	if err != nil {
+		respondAdmin(w, logger, http.StatusBadRequest, brokerapi.ErrorResponse{Description: err.Error()})
+		return
+	}
+
+	if format != "csv" {
+		respondAdmin(w, logger, http.StatusOK, report)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.WriteHeader(http.StatusOK)
+	if err := report.WriteCSV(w); err != nil {
+		logger.Error("encoding-response", err)
+	}
+}
+
+//Responds with the status and body of a *brokerapi.FailureResponse, and with 500 for other errors
+func respondAdminError(w http.ResponseWriter, logger lager.Logger, err error) {
+	logger.Error("failed", err)
+	if f, ok := err.(*brokerapi.FailureResponse); ok {
+		respondAdmin(w, logger, f.ValidatedStatusCode(logger), f.ErrorResponse())
+	} else {
+		respondAdmin(w, logger, http.StatusInternalServerError, brokerapi.ErrorResponse{Description: err.Error()})
+	}
+}
+
+func respondAdmin(w http.ResponseWriter, logger lager.Logger, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger.Error("encoding-response", err)
+	}
+}
@@ -0,0 +1,189 @@
+package broker
+
+import (
+	"code.cloudfoundry.org/lager"
+	"context"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/icclab/ceph-objectstore-broker/metrics"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/auth"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//The minor version of OSB API 2.x from which instances and bindings can be fetched
+const fetchMinorVersion = 14
+
+var ErrInstanceNotFound = brokerapi.NewFailureResponse(errors.New("instance not found"), http.StatusNotFound, "instance-not-found")
+
+var ErrBindingNotFound = brokerapi.NewFailureResponse(errors.New("binding not found"), http.StatusNotFound, "binding-not-found")
+
+//InstanceDetails is the response to fetching an instance
+type InstanceDetails struct {
+	ServiceID    string      `json:"service_id"`
+	PlanID       string      `json:"plan_id"`
+	DashboardURL string      `json:"dashboard_url,omitempty"`
+	Parameters   interface{} `json:"parameters,omitempty"`
+}
+
+//BindingDetails is the response to fetching a binding
+type BindingDetails struct {
+	Credentials interface{} `json:"credentials"`
+	Parameters  interface{} `json:"parameters,omitempty"`
+}
+
+//Fetcher fetches instances and bindings, which the vendored brokerapi has no endpoints for
+type Fetcher interface {
+	GetInstance(ctx context.Context, instanceID string) (InstanceDetails, error)
+	GetBinding(ctx context.Context, instanceID, bindingID string) (BindingDetails, error)
+}
+
+//NewAPIHandler returns the handler of the OSB API of the broker. Requests for an instance or binding that already exists
+//with identical details are answered with 200 instead of the 201 brokerapi always sends for a successful provision or bind.
+//The catalog and the endpoints fetching instances and bindings are served here, everything else by brokerapi
+func NewAPIHandler(b brokerapi.ServiceBroker, f Fetcher, logger lager.Logger, creds brokerapi.BrokerCredentials) http.Handler {
+	h := apiHandler{broker: b, fetcher: f, logger: logger}
+	api := brokerapi.New(b, logger, creds)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/catalog", h.catalog).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}", h.getInstance).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", h.getBinding).Methods("GET")
+	router.Use(auth.NewWrapper(creds.Username, creds.Password).Wrap)
+	router.NotFoundHandler = api
+	router.MethodNotAllowedHandler = api
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		existing := false
+		ctx := context.WithValue(req.Context(), existingKey{}, &existing)
+		router.ServeHTTP(&existingResponseWriter{ResponseWriter: w, existing: &existing}, req.WithContext(ctx))
+	})
+}
+
+type apiHandler struct {
+	broker  brokerapi.ServiceBroker
+	fetcher Fetcher
+	logger  lager.Logger
+}
+
+//A service of the catalog along with the fields of OSB API 2.14 brokerapi.Service doesn't have
+type catalogService struct {
+	brokerapi.Service
+	InstancesRetrievable bool `json:"instances_retrievable"`
+	BindingsRetrievable  bool `json:"bindings_retrievable"`
+}
+
+func (h apiHandler) catalog(w http.ResponseWriter, req *http.Request) {
+	logger := h.logger.Session("catalog")
+	if err := checkAPIVersion(req, 0); err != nil {
+		logger.Error("broker-api-version-invalid", err)
+		respondAdmin(w, logger, http.StatusPreconditionFailed, brokerapi.ErrorResponse{Description: err.Error()})
+		return
+	}
+
+	services, err := h.broker.Services(req.Context())
+	if err != nil {
+		h.respondError(w, logger, err)
+		return
+	}
+
+	catalog := struct {
+		Services []catalogService `json:"services"`
+	}{Services: []catalogService{}}
+	for _, s := range services {
+		catalog.Services = append(catalog.Services, catalogService{Service: s, InstancesRetrievable: true, BindingsRetrievable: s.Bindable})
+	}
+	respondAdmin(w, logger, http.StatusOK, catalog)
+}
+
+func (h apiHandler) getInstance(w http.ResponseWriter, req *http.Request) {
+	instanceID := mux.Vars(req)["instance_id"]
+	logger := h.logger.Session("get-instance", lager.Data{"instance-id": instanceID})
+	if err := checkAPIVersion(req, fetchMinorVersion); err != nil {
+		logger.Error("broker-api-version-invalid", err)
+		respondAdmin(w, logger, http.StatusPreconditionFailed, brokerapi.ErrorResponse{Description: err.Error()})
+		return
+	}
+
+	start := time.Now()
+	inst, err := h.fetcher.GetInstance(req.Context(), instanceID)
+	metrics.ObserveOSBRequest("get_instance", start, err)
+	if err != nil {
+		h.respondError(w, logger, err)
+		return
+	}
+	respondAdmin(w, logger, http.StatusOK, inst)
+}
+
+func (h apiHandler) getBinding(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	logger := h.logger.Session("get-binding", lager.Data{"instance-id": vars["instance_id"], "binding-id": vars["binding_id"]})
+	if err := checkAPIVersion(req, fetchMinorVersion); err != nil {
+		logger.Error("broker-api-version-invalid", err)
+		respondAdmin(w, logger, http.StatusPreconditionFailed, brokerapi.ErrorResponse{Description: err.Error()})
+		return
+	}
+
+	start := time.Now()
+	bind, err := h.fetcher.GetBinding(req.Context(), vars["instance_id"], vars["binding_id"])
+	metrics.ObserveOSBRequest("get_binding", start, err)
+	if err != nil {
+		h.respondError(w, logger, err)
+		return
+	}
+	respondAdmin(w, logger, http.StatusOK, bind)
+}
+
+//Responds with the status and body of a *brokerapi.FailureResponse the way brokerapi does, and with 500 for other errors
+func (h apiHandler) respondError(w http.ResponseWriter, logger lager.Logger, err error) {
+	if failure, ok := err.(*brokerapi.FailureResponse); ok {
+		logger.Error(failure.LoggerAction(), err)
+		respondAdmin(w, logger, failure.ValidatedStatusCode(logger), failure.ErrorResponse())
+		return
+	}
+
+	logger.Error("unknown-error", err)
+	respondAdmin(w, logger, http.StatusInternalServerError, brokerapi.ErrorResponse{Description: err.Error()})
+}
+
+//Checks that the request uses version 2.x of the OSB API, with x at least the given minor version
+func checkAPIVersion(req *http.Request, minMinor int) error {
+	version := req.Header.Get("X-Broker-API-Version")
+	if version == "" {
+		return errors.New("X-Broker-API-Version Header not set")
+	}
+	if !strings.HasPrefix(version, "2.") {
+		return errors.New("X-Broker-API-Version Header must be 2.x")
+	}
+
+	minor, err := strconv.Atoi(strings.TrimPrefix(version, "2."))
+	if minMinor > 0 && (err != nil || minor < minMinor) {
+		return errors.New("X-Broker-API-Version Header must be 2." + strconv.Itoa(minMinor) + " or later")
+	}
+	return nil
+}
+
+type existingKey struct{}
+
+//Marks the request of the context as one for an instance or binding that already exists, see NewAPIHandler
+func markExisting(ctx context.Context) {
+	if existing, ok := ctx.Value(existingKey{}).(*bool); ok {
+		*existing = true
+	}
+}
+
+//Sends 200 instead of 201 once the request is marked as one for an existing instance or binding
+type existingResponseWriter struct {
+	http.ResponseWriter
+	existing *bool
+}
+
+func (w *existingResponseWriter) WriteHeader(status int) {
+	if status == http.StatusCreated && *w.existing {
+		status = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
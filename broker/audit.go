@@ -0,0 +1,76 @@
+package broker
+
+import (
+	"code.cloudfoundry.org/lager"
+	"context"
+	"errors"
+	"github.com/icclab/ceph-objectstore-broker/audit"
+	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
+	"github.com/icclab/ceph-objectstore-broker/s3"
+)
+
+//Tag of the audit records sent to syslog
+const auditSyslogTag = "cosb-audit"
+
+//NewAuditor creates an auditor writing to the sinks selected in the broker config, or returns nil if none is selected.
+//The S3 client is only used by the S3 sink, which writes to the broker bucket. The chains of the auditors are linked
+//through the state store, which the broker and cosb-admin share
+func NewAuditor(bc *brokerConfig.BrokerConfig, s *s3.S3, store StateStore, logger lager.Logger) (*audit.Auditor, error) {
+	if len(bc.AuditSinks) == 0 {
+		return nil, nil
+	}
+
+	sinks := []audit.Sink{}
+	for _, name := range bc.AuditSinks {
+		var sink audit.Sink
+		var err error
+		switch name {
+		case audit.FileSinkName:
+			sink, err = audit.NewFileSink(bc.AuditFile)
+		case audit.SyslogSinkName:
+			sink, err = audit.NewSyslogSink(auditSyslogTag)
+		case audit.S3SinkName:
+			sink = audit.NewS3Sink(s, bc.BucketName, bc.AuditPrefix, bc.AuditFlushInterval)
+		default:
+			err = errors.New("Unknown audit sink '" + name + "'")
+		}
+		if err != nil {
+			for _, s := range sinks {
+				s.Close()
+			}
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	auditor, err := audit.New(logger, store, sinks...)
+	if err != nil {
+		for _, s := range sinks {
+			s.Close()
+		}
+		return nil, err
+	}
+	return auditor, nil
+}
+
+//StartAudit starts the audit record of an operation. The returned copy of the broker logs the originating identity and
+//platform context of the request and reports its radosgw calls to the record, so the operation has to be run on the copy.
+//Without an auditor the returned event is nil
+func (b *Broker) StartAudit(ctx context.Context, operation string, instID string, bindID string, planID string) (*Broker, *audit.Event) {
+	c := *b
+	id, pc := audit.IdentityFromContext(ctx), audit.PlatformContextFromContext(ctx)
+	if id != nil || pc != nil {
+		c.Logger = b.Logger.WithData(lager.Data{"originating-identity": id, "platform-context": pc})
+	}
+
+	ev := b.Audit.Start(ctx, operation, instID, bindID, planID)
+	if ev == nil {
+		return &c, nil
+	}
+
+	c.event = ev
+	if b.Rados != nil {
+		c.Rados = b.Rados.WithObserver(ev.RadosgwCall)
+	}
+	return &c, ev
+}
@@ -0,0 +1,188 @@
+package broker
+
+import (
+	"errors"
+	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
+	"github.com/icclab/ceph-objectstore-broker/radosgw"
+	"github.com/pivotal-cf/brokerapi"
+	"net/http"
+)
+
+//Returned for requests naming a service that is not in the catalog, or a plan that is not a plan of the service
+var ErrUnknownServicePlan = brokerapi.NewFailureResponse(
+	errors.New("The service is not in the catalog of the broker, or the plan is not a plan of the service"), http.StatusBadRequest, "unknown-service-plan")
+
+//BackendClients holds the radosgw clients of the backends of the config by name, besides the default backend, whose client is
+//the Rados of the broker
+type BackendClients map[string]*radosgw.Radosgw
+
+//NewBackendClients sets up the radosgw clients of the backends of the config besides the default one
+func NewBackendClients(bc *brokerConfig.BrokerConfig) (BackendClients, error) {
+	clients := BackendClients{}
+	for name, backend := range bc.Backends {
+		rados := &radosgw.Radosgw{}
+		if err := rados.Setup(backend.RadosEndpoint, backend.RadosAdminPath, backend.RadosAccessKey, backend.RadosSecretKey); err != nil {
+			return nil, errors.New("Failed to setup the radosgw client of backend '" + name + "'. " + err.Error())
+		}
+		clients[name] = rados
+	}
+
+	return clients, nil
+}
+
+//Returns a copy of the broker working on the backend with the name, whose radosgw client replaces Rados. Calls of the
+//client are reported to the audit record of the broker. Only called on brokers that are not on a backend yet
+func (b *Broker) onBackend(name string) (*Broker, error) {
+	backend, ok := b.config().Backend(name)
+	if !ok {
+		return nil, errors.New("Unknown backend '" + name + "'")
+	}
+
+	c := *b
+	c.backend = backend
+	if backend.Name == brokerConfig.DefaultBackend {
+		return &c, nil
+	}
+
+	rados := b.Backends[backend.Name]
+	if rados == nil {
+		return nil, errors.New("No radosgw client for backend '" + name + "', which needs a restart of the broker")
+	}
+	if b.event != nil {
+		rados = rados.WithObserver(b.event.RadosgwCall)
+	}
+	c.Rados = rados
+	return &c, nil
+}
+
+//Returns a copy of the broker working on the backend of the instance
+func (b *Broker) forInstance(inst *Instance) (*Broker, error) {
+	return b.onBackend(inst.Backend)
+}
+
+//InstanceRadosgw returns the radosgw client of the backend of the instance
+func (b *Broker) InstanceRadosgw(inst *Instance) (*radosgw.Radosgw, error) {
+	ib, err := b.forInstance(inst)
+	if err != nil {
+		return nil, err
+	}
+	return ib.Rados, nil
+}
+
+//Returns the backend the broker works on, which is the default backend unless it's a copy made by onBackend
+func (b *Broker) getBackend() *brokerConfig.Backend {
+	if b.backend != nil {
+		return b.backend
+	}
+
+	backend, _ := b.config().Backend(brokerConfig.DefaultBackend)
+	return backend
+}
+
+//Returns the service with the ID from the catalog
+func (b *Broker) getService(serviceID string) (*brokerapi.Service, error) {
+	for _, s := range b.config().Services {
+		if s.ID == serviceID {
+			return &s, nil
+		}
+	}
+
+	return nil, errors.New("Service with ID '" + serviceID + "' not found")
+}
+
+//Returns the backends the instances of the plan can be created on, of which the first is the default. Returns
+//ErrUnknownServicePlan if the service or plan is not in the catalog
+func (b *Broker) getPlanBackends(serviceID string, planID string) ([]*brokerConfig.Backend, error) {
+	s, err := b.getService(serviceID)
+	if err != nil {
+		return nil, ErrUnknownServicePlan
+	}
+
+	for _, p := range s.Plans {
+		if p.ID != planID {
+			continue
+		}
+
+		names, err := brokerConfig.PlanBackends(*s, p)
+		if err != nil {
+			return nil, err
+		}
+
+		backends := []*brokerConfig.Backend{}
+		for _, name := range names {
+			backend, ok := b.config().Backend(name)
+			if !ok {
+				return nil, errors.New("Unknown backend '" + name + "'")
+			}
+			backends = append(backends, backend)
+		}
+		return backends, nil
+	}
+
+	return nil, ErrUnknownServicePlan
+}
+
+//Returns the regions the instances of the plan can be provisioned in, which is none if its backends have no region
+func (b *Broker) getPlanRegions(planID string) []string {
+	for _, s := range b.config().Services {
+		for _, p := range s.Plans {
+			if p.ID != planID {
+				continue
+			}
+
+			backends, err := b.getPlanBackends(s.ID, planID)
+			if err != nil {
+				return nil
+			}
+
+			regions := []string{}
+			for _, backend := range backends {
+				if backend.Region != "" {
+					regions = append(regions, backend.Region)
+				}
+			}
+			return regions
+		}
+	}
+
+	return nil
+}
+
+//Returns the name of the backend a new instance of the plan is created on: the one in the requested region, or else the first
+//backend of the plan
+func (b *Broker) selectBackend(serviceID string, planID string, region *string) (string, error) {
+	backends, err := b.getPlanBackends(serviceID, planID)
+	if err != nil {
+		return "", err
+	}
+
+	if region == nil {
+		return backends[0].Name, nil
+	}
+
+	for _, backend := range backends {
+		if backend.Region == *region {
+			return backend.Name, nil
+		}
+	}
+
+	return "", newInvalidParametersError("the plan is not offered in the region '" + *region + "'")
+}
+
+//Returns true if instances of the plan can be on the backend with the name
+func (b *Broker) planOffersBackend(serviceID string, planID string, name string) bool {
+	backends, err := b.getPlanBackends(serviceID, planID)
+	if err != nil {
+		return false
+	}
+
+	if name == "" {
+		name = brokerConfig.DefaultBackend
+	}
+	for _, backend := range backends {
+		if backend.Name == name {
+			return true
+		}
+	}
+	return false
+}
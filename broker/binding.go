@@ -0,0 +1,222 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
+	"github.com/icclab/ceph-objectstore-broker/radosgw"
+	rgw "github.com/myENA/radosgwadmin"
+	"strings"
+)
+
+//Returned when the keys referenced by a stored binding no longer exist on the radosgw
+var ErrBindingCredentialsMissing = errors.New("The credentials of the binding no longer exist on the object store")
+
+//Creates a subuser of the instance user and an S3 key for the binding, registering their deletion with the rollback
+func (b *Broker) createBind(ctx context.Context, inst *Instance, bindingID string, access string, rb *rollback) (*Bind, error) {
+	//Swift info
+	subuserAccess := access
+	if subuserAccess == "" {
+		subuserAccess = AccessReadWrite
+	}
+
+	if _, err := b.Rados.CreateSubuser(ctx, inst.User, bindingID, inst.Tenant, subuserAccess); err != nil {
+		return nil, err
+	}
+	rb.add("delete-subuser", func(ctx context.Context) error { return b.Rados.DeleteSubuser(ctx, inst.User, bindingID, inst.Tenant) })
+
+	//S3 info. Restricted binds get a key of the subuser, which radosgw limits to the subuser's access
+	var s3Key *rgw.UserKey
+	var err error
+	if access == "" {
+		s3Key, err = b.Rados.CreateS3Key(ctx, inst.User, inst.Tenant)
+	} else {
+		s3Key, err = b.Rados.CreateSubuserS3Key(ctx, inst.User, bindingID, inst.Tenant)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rb.add("delete-s3-key", func(ctx context.Context) error {
+		return b.Rados.DeleteS3Key(ctx, inst.User, inst.Tenant, s3Key.AccessKey)
+	})
+
+	return &Bind{
+		User:        inst.User,
+		Subuser:     bindingID,
+		Tenant:      inst.Tenant,
+		S3AccessKey: s3Key.AccessKey,
+		Access:      access,
+	}, nil
+}
+
+func (b *Broker) deleteBind(ctx context.Context, bind *Bind) error {
+	if err := b.Rados.DeleteS3Key(ctx, bind.User, bind.Tenant, bind.S3AccessKey); err != nil {
+		return err
+	}
+
+	return b.Rados.DeleteSubuser(ctx, bind.User, bind.Subuser, bind.Tenant)
+}
+
+//Creates a radosgw user for the binding in the tenant of the instance, and grants it access to the scopes through the policies of their buckets.
+//The user may not create buckets of its own, which would not count towards the quota of the instance
+func (b *Broker) createScopedBind(ctx context.Context, inst *Instance, bindingID string, access string, scopes []BindScope, rb *rollback) (*Bind, error) {
+	if !b.getBackend().Offers(brokerConfig.S3Credentials) {
+		return nil, newInvalidParametersError("bindings scoped to buckets need S3 credentials, which the service doesn't offer")
+	}
+
+	s, err := b.getUserS3(ctx, inst)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sc := range scopes {
+		exists, err := s.BucketExists(ctx, sc.Bucket)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, newInvalidParametersError("bucket '" + sc.Bucket + "' does not exist")
+		}
+	}
+
+	if err := b.Rados.CreateUser(ctx, bindingID, inst.ID, inst.Tenant, -1); err != nil {
+		return nil, err
+	}
+	rb.add("delete-binding-user", func(ctx context.Context) error { return b.Rados.DeleteUser(ctx, bindingID, inst.Tenant) })
+
+	userInfo, err := b.Rados.GetUser(ctx, bindingID, inst.Tenant, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(userInfo.Keys) == 0 {
+		return nil, ErrBindingCredentialsMissing
+	}
+
+	bind := &Bind{
+		User:        bindingID,
+		Tenant:      inst.Tenant,
+		S3AccessKey: userInfo.Keys[0].AccessKey,
+		Access:      access,
+		Scopes:      scopes,
+		Statements:  newScopeStatements(bindingID, inst.Tenant, bindingID, access, scopes),
+	}
+
+	for bucket, statements := range bind.Statements {
+		if err := addPolicyStatements(ctx, s, bucket, statements); err != nil {
+			return nil, err
+		}
+
+		bucket, statements := bucket, statements
+		rb.add("remove-policy-statements", func(ctx context.Context) error { return removePolicyStatements(ctx, s, bucket, statements) })
+	}
+
+	return bind, nil
+}
+
+//Removes exactly the policy statements recorded for the binding and then its user
+func (b *Broker) deleteScopedBind(ctx context.Context, instID string, bind *Bind) error {
+	inst, err := b.getInstance(ctx, instID)
+	if err != nil {
+		return err
+	}
+
+	s, err := b.getUserS3(ctx, inst)
+	if err != nil {
+		return err
+	}
+
+	for bucket, statements := range bind.Statements {
+		if err := removePolicyStatements(ctx, s, bucket, statements); err != nil {
+			return err
+		}
+	}
+
+	if err := b.Rados.DeleteUser(ctx, bind.User, bind.Tenant); err != nil && !radosgw.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+//Re-derives the credentials of a binding from the keys currently held by its radosgw user
+func (b *Broker) getBindCreds(ctx context.Context, inst *Instance, bind *Bind) (*BindCreds, error) {
+	userInfo, err := b.Rados.GetUser(ctx, bind.User, bind.Tenant, false)
+	if err != nil {
+		return nil, err
+	}
+
+	backend := b.getBackend()
+	user := bind.Tenant + "$" + bind.User
+	creds := &BindCreds{
+		S3User:        user,
+		S3AccessKey:   bind.S3AccessKey,
+		S3Endpoint:    backend.S3Endpoint,
+		SwiftUser:     user + ":" + bind.Subuser,
+		SwiftEndpoint: backend.SwiftEndpoint,
+		Buckets:       inst.Buckets,
+		Access:        bind.Access,
+	}
+	creds.Placement, creds.StorageClass = b.getInstancePlacement(inst)
+
+	//Keys of restricted binds belong to the subuser, while scoped binds only get S3 credentials limited to their buckets
+	if len(bind.Scopes) > 0 {
+		creds.SwiftUser = ""
+		creds.SwiftEndpoint = ""
+		creds.Buckets = []string{}
+		for _, sc := range bind.Scopes {
+			creds.Buckets = append(creds.Buckets, sc.Bucket)
+		}
+	} else if bind.Access != "" {
+		creds.S3User = creds.SwiftUser
+	}
+
+	if len(creds.Buckets) > 0 {
+		creds.Bucket = creds.Buckets[0]
+	}
+
+	for _, k := range userInfo.Keys {
+		if k.AccessKey == bind.S3AccessKey {
+			creds.S3SecretKey = k.SecretKey
+		}
+	}
+
+	for _, k := range userInfo.SwiftKeys {
+		if k.User == creds.SwiftUser {
+			creds.SwiftSecretKey = k.SecretKey
+		}
+	}
+
+	if creds.S3SecretKey == "" || (creds.SwiftUser != "" && creds.SwiftSecretKey == "") {
+		return nil, ErrBindingCredentialsMissing
+	}
+
+	//Bindings have both kinds of keys, so they're managed alike, but only get the credentials their backend offers
+	if !backend.Offers(brokerConfig.S3Credentials) {
+		creds.S3User, creds.S3AccessKey, creds.S3SecretKey, creds.S3Endpoint = "", "", "", ""
+	}
+	if !backend.Offers(brokerConfig.SwiftCredentials) {
+		creds.SwiftUser, creds.SwiftSecretKey, creds.SwiftEndpoint = "", "", ""
+	}
+
+	return creds, nil
+}
+
+//Decodes raw request parameters for returning them to the platform. Empty parameters decode to nil
+func decodeParameters(raw json.RawMessage) (interface{}, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	var params interface{}
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, err
+	}
+
+	return params, nil
+}
+
+//Returns the dashboard URL of an instance, or an empty string if no dashboard is configured
+func (b *Broker) getDashboardURL(instID string) string {
+	return strings.Replace(b.config().DashboardURL, "{instance_id}", instID, -1)
+}
@@ -5,19 +5,35 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"github.com/icclab/ceph-objectstore-broker/audit"
 	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
 	"github.com/icclab/ceph-objectstore-broker/radosgw"
-	"github.com/icclab/ceph-objectstore-broker/s3"
-	"github.com/icclab/ceph-objectstore-broker/utils"
 	"github.com/pivotal-cf/brokerapi"
+	"time"
 )
 
 type Bind struct {
-	S3AccessKey string `json:"s3AccessKey"`
-	SwiftKey    string `json:"swiftKey"`
-	User        string `json:"user"`
-	Subuser     string `json:"subuser"`
-	Tenant      string `json:"tenant"`
+	S3AccessKey   string          `json:"s3AccessKey"`
+	SwiftKey      string          `json:"swiftKey"`
+	User          string          `json:"user"`
+	Subuser       string          `json:"subuser"`
+	Tenant        string          `json:"tenant"`
+	ServiceID     string          `json:"serviceID,omitempty"`
+	PlanID        string          `json:"planID,omitempty"`
+	AppGUID       string          `json:"appGUID,omitempty"`
+	RawParameters json.RawMessage `json:"parameters,omitempty"`
+	//Access of the subuser and its S3 key. Empty for binds using an S3 key of the instance user
+	Access string `json:"access,omitempty"`
+	//Originating identity of the bind request
+	CreatedBy *audit.Identity `json:"createdBy,omitempty"`
+
+	//Scoped binds have their own radosgw user, which is granted access to the scopes through the recorded bucket policy statements
+	Scopes     []BindScope                  `json:"scopes,omitempty"`
+	Statements map[string][]PolicyStatement `json:"statements,omitempty"`
+
+	//Credentials replaced by rotations that have not been deleted yet
+	Rotations int                  `json:"rotations,omitempty"`
+	Retired   []RetiredCredentials `json:"retired,omitempty"`
 }
 
 type BindCreds struct {
@@ -29,321 +45,668 @@ type BindCreds struct {
 	SwiftUser      string `json:"swiftUser"`
 	SwiftSecretKey string `json:"swiftSecretKey"`
 	SwiftEndpoint  string `json:"swiftEndpoint"`
+
+	//The first of the buckets created with the instance, and all of them
+	Bucket  string   `json:"bucket,omitempty"`
+	Buckets []string `json:"buckets,omitempty"`
+
+	Access string `json:"access,omitempty"`
+
+	//Placement target and default storage class of the buckets of the instance, if they aren't the defaults of the radosgw
+	Placement    string `json:"placement,omitempty"`
+	StorageClass string `json:"storageClass,omitempty"`
 }
 
 type Broker struct {
-	ProvisionDetails    brokerapi.ProvisionDetails
-	UpdateDetails       brokerapi.UpdateDetails
-	DeprovisionDetails  brokerapi.DeprovisionDetails
-	BoundBindingDetails brokerapi.BindDetails
-	UnbindingDetails    brokerapi.UnbindDetails
-
-	ProvisionError     error
-	BindError          error
-	UnbindError        error
-	DeprovisionError   error
-	LastOperationError error
-	UpdateError        error
-
-	BrokerCalled             bool
-	LastOperationState       brokerapi.LastOperationState
-	LastOperationDescription string
-
-	AsyncAllowed bool
-
-	ShouldReturnAsync     bool
-	OperationDataToReturn string
-
-	LastOperationInstanceID string
-	LastOperationData       string
-
-	Rados         *radosgw.Radosgw
-	Logger        lager.Logger
-	ServiceConfig []brokerapi.Service
-	BrokerConfig  *brokerConfig.BrokerConfig
-	//Maps a bindID to a bind struct
-	S3 *s3.S3
+	Rados  *radosgw.Radosgw
+	Logger lager.Logger
+	//Settings and catalog of the broker, see config()
+	Config   *Config
+	Store    StateStore
+	Usage    *UsageCollector
+	Metering *MeteringCollector
+	Audit    *audit.Auditor
+	//Shared by all copies of the broker. Required, as requests changing an instance take its lock
+	Locks *InstanceLocks
+	//Shared by all copies of the broker. Required, as provisions are checked against the instance limits with it
+	Counter *InstanceCounter
+	//Shared by all copies of the broker. Required, as rotations and unbinds record the retired credentials in it
+	Retirements *RetirementIndex
+	//Radosgw clients of the backends besides the default one, whose client is Rados. See onBackend
+	Backends BackendClients
+
+	//Audit record of the operation run by a copy of the broker, see StartAudit
+	event *audit.Event
+	//Backend a copy of the broker works on, see onBackend
+	backend *brokerConfig.Backend
 }
 
 func (broker *Broker) Services(ctx context.Context) ([]brokerapi.Service, error) {
-	broker.BrokerCalled = true
 	//All possible service-config can be found here: https://github.com/openservicebrokerapi/servicebroker/blob/master/spec.md#input-parameters-schema-object
-	broker.LastOperationError = nil
-	return broker.ServiceConfig, nil
+	return broker.catalog(), nil
 }
 
-func (broker *Broker) Provision(context context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
-	broker.BrokerCalled = true
+func (broker *Broker) Provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (spec brokerapi.ProvisionedServiceSpec, err error) {
+	ctx = audit.NewPlatformContext(ctx, details.RawContext)
+	broker, ev := broker.StartAudit(ctx, audit.Provision, instanceID, "", details.PlanID)
+	defer func() { ev.Finish(err) }()
+	defer broker.Locks.Lock(instanceID)()
 
-	//Initial error checking
-	if broker.ProvisionError != nil {
-		broker.LastOperationError = broker.ProvisionError
-		return brokerapi.ProvisionedServiceSpec{}, broker.ProvisionError
+	//Repeated requests are checked first, so they are answered even when the instance limit is met
+	if exists, err := broker.instanceExists(ctx, instanceID); err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	} else if exists {
+		return broker.provisionExisting(ctx, instanceID, details)
 	}
 
-	if broker.provisionCount() >= broker.BrokerConfig.InstanceLimit {
-		broker.LastOperationError = brokerapi.ErrInstanceLimitMet
-		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceLimitMet
+	if _, err := broker.getPlanBackends(details.ServiceID, details.PlanID); err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
 	}
 
-	if broker.instanceExists(instanceID) {
-		broker.LastOperationError = brokerapi.ErrInstanceAlreadyExists
-		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceAlreadyExists
+	params, err := broker.parseInstanceParameters(details.PlanID, details.RawParameters, false)
+	if err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
 	}
 
-	//Provision
-	if err := broker.Rados.CreateUser(instanceID, instanceID, createTenantID(instanceID)); err != nil {
-		broker.LastOperationError = err
+	//Instances are created on a backend of their plan, in the requested region if any, and stay there
+	backend, err := broker.selectBackend(details.ServiceID, details.PlanID, params.Region)
+	if err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+	if broker, err = broker.onBackend(backend); err != nil {
 		return brokerapi.ProvisionedServiceSpec{}, err
 	}
 
-	quota, err := broker.getPlanQuota(details.PlanID)
+	inst, err := broker.newInstance(ctx, instanceID, details, params)
 	if err != nil {
-		broker.LastOperationError = err
 		return brokerapi.ProvisionedServiceSpec{}, err
 	}
 
-	if err := broker.Rados.SetUserQuota(instanceID, createTenantID(instanceID), quota); err != nil {
-		broker.LastOperationError = err
+	//The instance is counted before it is created, so concurrent provisions can't exceed the limits
+	if err := broker.Counter.Reserve(inst, broker.instanceLimits(inst)); err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+
+	//Provision
+	rb := broker.newRollback(ctx, "provision", lager.Data{"instance-id": instanceID})
+	rb.add("release-instance", func(ctx context.Context) error {
+		broker.Counter.Release(instanceID)
+		return nil
+	})
+	if asyncAllowed {
+		//The instance is recorded first so repeated or concurrent requests see it while the user is created
+		if err := broker.Store.CreateInstance(ctx, inst); err != nil {
+			rb.run()
+			return brokerapi.ProvisionedServiceSpec{}, err
+		}
+		rb.add("delete-instance-record", func(ctx context.Context) error { return broker.Store.DeleteInstance(ctx, instanceID) })
+
+		op, err := broker.startOperation(ctx, instanceID, ProvisionOperation, "Creating object storage user")
+		if err != nil {
+			rb.run()
+			return brokerapi.ProvisionedServiceSpec{}, err
+		}
+
+		//A failed operation keeps the instance record so the platform can deprovision it, but nothing on the radosgw
+		broker.runOperation(ctx, op, func(ctx context.Context) error {
+			userRb := broker.newRollback(ctx, "provision", lager.Data{"instance-id": instanceID})
+			if err := broker.provisionUser(ctx, inst, userRb); err != nil {
+				userRb.run()
+				return err
+			}
+			return nil
+		})
+
+		return brokerapi.ProvisionedServiceSpec{IsAsync: true, OperationData: op.ID, DashboardURL: broker.getDashboardURL(instanceID)}, nil
+	}
+
+	if err := broker.provisionUser(ctx, inst, rb); err != nil {
+		rb.run()
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+
+	if err := broker.Store.CreateInstance(ctx, inst); err != nil {
+		rb.run()
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+
+	//Drop the record of any earlier asynchronous operation on a previous instance with this ID
+	if err := broker.Store.DeleteOperation(ctx, instanceID); err != nil {
+		broker.Logger.Error("failed-to-delete-stale-operation", err)
+	}
+
+	return brokerapi.ProvisionedServiceSpec{IsAsync: false, DashboardURL: broker.getDashboardURL(instanceID)}, nil
+}
+
+//Answers a provision request for an existing instance. Identical requests get the result of the original one,
+//while an instance still being provisioned is reported as such so the platform keeps polling
+func (broker *Broker) provisionExisting(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails) (brokerapi.ProvisionedServiceSpec, error) {
+	inst, err := broker.getInstance(ctx, instanceID)
+	if err != nil {
 		return brokerapi.ProvisionedServiceSpec{}, err
 	}
 
-	if err := broker.S3.PutObject(broker.BrokerConfig.BucketName, broker.getInstanceObjName(instanceID), ""); err != nil {
+	if !inst.matchesProvision(details) {
+		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceAlreadyExists
+	}
+
+	op, err := broker.getOperation(ctx, instanceID)
+	if err != nil {
 		return brokerapi.ProvisionedServiceSpec{}, err
 	}
+	if op != nil && op.Type == ProvisionOperation {
+		if op.State == brokerapi.InProgress && !op.timedOut() {
+			return brokerapi.ProvisionedServiceSpec{IsAsync: true, OperationData: op.ID, DashboardURL: broker.getDashboardURL(instanceID)}, nil
+		}
+		//A failed instance has to be deprovisioned before it can be provisioned again
+		if op.State != brokerapi.Succeeded {
+			return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceAlreadyExists
+		}
+	}
+
+	markExisting(ctx)
+	return brokerapi.ProvisionedServiceSpec{DashboardURL: broker.getDashboardURL(instanceID)}, nil
+}
+
+//Creates the radosgw user of an instance, applies its limits and creates its buckets.
+//Deleting the user, along with its buckets, is registered with the rollback
+func (broker *Broker) provisionUser(ctx context.Context, inst *Instance, rb *rollback) error {
+	if err := broker.Rados.CreateUser(ctx, inst.User, inst.ID, inst.Tenant, inst.MaxBuckets); err != nil {
+		return err
+	}
+	rb.add("delete-user", func(ctx context.Context) error { return broker.Rados.DeleteUser(ctx, inst.User, inst.Tenant) })
+
+	//The placement has to be set before the buckets are created, which it applies to
+	if placement, storageClass := broker.getInstancePlacement(inst); placement != "" {
+		if err := broker.Rados.SetUserPlacement(ctx, inst.User, inst.Tenant, placement, storageClass); err != nil {
+			return err
+		}
+	}
 
-	broker.ProvisionDetails = details
-	broker.AsyncAllowed = asyncAllowed
-	broker.LastOperationError = nil
+	if err := broker.Rados.SetUserQuota(ctx, inst.User, inst.Tenant, inst.QuotaMB, inst.MaxObjects); err != nil {
+		return err
+	}
 
-	return brokerapi.ProvisionedServiceSpec{IsAsync: false}, nil
+	return broker.createBuckets(ctx, inst)
 }
 
-func (broker *Broker) Update(context context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
-	broker.BrokerCalled = true
+func (broker *Broker) Update(ctx context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (spec brokerapi.UpdateServiceSpec, err error) {
+	ctx = audit.NewPlatformContext(ctx, details.RawContext)
+	broker, ev := broker.StartAudit(ctx, audit.Update, instanceID, "", details.PlanID)
+	defer func() { ev.Finish(err) }()
+	defer broker.Locks.Lock(instanceID)()
 
-	if broker.UpdateError != nil {
-		broker.LastOperationError = broker.UpdateError
-		return brokerapi.UpdateServiceSpec{}, broker.UpdateError
+	//The plan is only sent when it changes
+	if details.PlanID != "" {
+		if _, err := broker.getPlan(details.PlanID); err != nil {
+			return brokerapi.UpdateServiceSpec{}, brokerapi.ErrPlanChangeNotSupported
+		}
 	}
 
-	if _, err := broker.getPlan(details.PlanID); err != nil {
-		broker.LastOperationError = brokerapi.ErrPlanChangeNotSupported
+	if broker.operationInProgress(ctx, instanceID) {
+		return brokerapi.UpdateServiceSpec{}, ErrOperationInProgress
+	}
+
+	inst, err := broker.getInstance(ctx, instanceID)
+	if err == ErrStateNotFound {
+		return brokerapi.UpdateServiceSpec{}, brokerapi.ErrInstanceDoesNotExist
+	} else if err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	//Instances stay on their backend, so the plan can only change to a plan of the service on the same backend
+	if details.PlanID != "" && inst.ServiceID != "" && !broker.planOffersBackend(inst.ServiceID, details.PlanID, inst.Backend) {
 		return brokerapi.UpdateServiceSpec{}, brokerapi.ErrPlanChangeNotSupported
 	}
 
-	if details.PlanID == details.PreviousValues.PlanID {
-		broker.LastOperationError = nil
-		return brokerapi.UpdateServiceSpec{}, nil
+	if broker, err = broker.forInstance(inst); err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	//Existing buckets can't move to another placement, so the plan can only change to a plan with the same placement
+	if details.PlanID != "" {
+		placement, storageClass := broker.getInstancePlacement(inst)
+		newPlacement, newStorageClass := broker.getPlanPlacement(details.PlanID)
+		if placement != newPlacement || storageClass != newStorageClass {
+			return brokerapi.UpdateServiceSpec{}, brokerapi.ErrPlanChangeNotSupported
+		}
 	}
 
 	//Update
-	newPlanQuota, err := broker.getPlanQuota(details.PlanID)
-	if err != nil {
-		broker.LastOperationError = err
-		return brokerapi.UpdateServiceSpec{}, err
+	currentPlanID := inst.PlanID
+	if currentPlanID == "" {
+		currentPlanID = details.PreviousValues.PlanID
 	}
 
-	usage, err := broker.Rados.GetUserUsageMB(instanceID, createTenantID(instanceID))
+	planID := details.PlanID
+	if planID == "" {
+		planID = currentPlanID
+	}
+
+	params, err := broker.parseInstanceParameters(planID, details.RawParameters, true)
 	if err != nil {
-		broker.LastOperationError = err
 		return brokerapi.UpdateServiceSpec{}, err
 	}
 
-	if usage >= newPlanQuota {
-		err = errors.New("Current object store usage exceeds size quota of the new plan")
-		broker.LastOperationError = err
-		return brokerapi.UpdateServiceSpec{}, err
+	//A plan change resets the quota to the size of the new plan, unless a quota is requested as well
+	quota, maxObjects, maxBuckets := inst.QuotaMB, inst.MaxObjects, inst.MaxBuckets
+	if planID != currentPlanID {
+		quota, err = broker.getPlanQuota(planID)
+		if err != nil {
+			return brokerapi.UpdateServiceSpec{}, err
+		}
+	}
+	if params.QuotaMB != nil {
+		quota = *params.QuotaMB
+	}
+	if params.MaxObjects != nil {
+		maxObjects = *params.MaxObjects
+	}
+	if params.MaxBuckets != nil {
+		maxBuckets = *params.MaxBuckets
+	}
+	if params.DeletionPolicy != nil {
+		inst.DeletionPolicy = *params.DeletionPolicy
 	}
 
-	if err := broker.Rados.SetUserQuota(instanceID, createTenantID(instanceID), newPlanQuota); err != nil {
-		broker.LastOperationError = err
-		return brokerapi.UpdateServiceSpec{}, err
+	if quota != inst.QuotaMB {
+		usage, err := broker.Rados.GetUserUsageMB(ctx, inst.User, inst.Tenant)
+		if err != nil {
+			return brokerapi.UpdateServiceSpec{}, err
+		}
+
+		if usage >= quota {
+			err = errors.New("Current object store usage exceeds the new size quota")
+			return brokerapi.UpdateServiceSpec{}, err
+		}
 	}
 
-	broker.UpdateDetails = details
-	broker.AsyncAllowed = asyncAllowed
-	broker.LastOperationError = nil
+	rb := broker.newRollback(ctx, "update", lager.Data{"instance-id": instanceID})
+	if planID != inst.PlanID {
+		if err := broker.Counter.ChangePlan(instanceID, planID, broker.getPlanInstanceLimit(planID)); err != nil {
+			return brokerapi.UpdateServiceSpec{}, err
+		}
 
-	return brokerapi.UpdateServiceSpec{IsAsync: broker.ShouldReturnAsync, OperationData: broker.OperationDataToReturn}, nil
-}
+		oldPlanID := inst.PlanID
+		rb.add("restore-plan-count", func(ctx context.Context) error {
+			return broker.Counter.ChangePlan(instanceID, oldPlanID, 0)
+		})
+	}
 
-func (broker *Broker) Deprovision(context context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error) {
-	broker.BrokerCalled = true
+	if quota != inst.QuotaMB || maxObjects != inst.MaxObjects {
+		if err := broker.Rados.SetUserQuota(ctx, inst.User, inst.Tenant, quota, maxObjects); err != nil {
+			rb.run()
+			return brokerapi.UpdateServiceSpec{}, err
+		}
 
-	//Error checking
-	if broker.DeprovisionError != nil {
-		broker.LastOperationError = broker.DeprovisionError
-		return brokerapi.DeprovisionServiceSpec{}, broker.DeprovisionError
+		oldQuota, oldMaxObjects := inst.QuotaMB, inst.MaxObjects
+		rb.add("restore-quota", func(ctx context.Context) error {
+			return broker.Rados.SetUserQuota(ctx, inst.User, inst.Tenant, oldQuota, oldMaxObjects)
+		})
 	}
 
-	if !broker.instanceExists(instanceID) {
-		broker.LastOperationError = brokerapi.ErrInstanceDoesNotExist
+	if maxBuckets != inst.MaxBuckets {
+		if err := broker.Rados.SetUserMaxBuckets(ctx, inst.User, inst.Tenant, maxBuckets); err != nil {
+			rb.run()
+			return brokerapi.UpdateServiceSpec{}, err
+		}
+
+		//Instances without a bucket limit have the radosgw default
+		oldMaxBuckets := inst.MaxBuckets
+		if oldMaxBuckets == 0 {
+			oldMaxBuckets = maxBucketsLimit
+		}
+		rb.add("restore-max-buckets", func(ctx context.Context) error {
+			return broker.Rados.SetUserMaxBuckets(ctx, inst.User, inst.Tenant, oldMaxBuckets)
+		})
+	}
+
+	inst.PlanID = planID
+	inst.QuotaMB = quota
+	inst.MaxObjects = maxObjects
+	inst.MaxBuckets = maxBuckets
+
+	if len(details.RawParameters) > 0 {
+		inst.RawParameters = details.RawParameters
+	}
+	if len(details.RawContext) > 0 {
+		inst.RawContext = details.RawContext
+		inst.setPlatformContext(audit.ParsePlatformContext(details.RawContext))
+	}
+	inst.UpdatedAt = time.Now().UTC()
+	inst.UpdatedBy = audit.IdentityFromContext(ctx)
+
+	if err := broker.Store.UpdateInstance(ctx, inst); err != nil {
+		rb.run()
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	return brokerapi.UpdateServiceSpec{}, nil
+}
+
+func (broker *Broker) Deprovision(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (spec brokerapi.DeprovisionServiceSpec, err error) {
+	broker, ev := broker.StartAudit(ctx, audit.Deprovision, instanceID, "", details.PlanID)
+	defer func() { ev.Finish(err) }()
+	defer broker.Locks.Lock(instanceID)()
+
+	if exists, err := broker.instanceExists(ctx, instanceID); err != nil {
+		return brokerapi.DeprovisionServiceSpec{}, err
+	} else if !exists {
 		return brokerapi.DeprovisionServiceSpec{IsAsync: false}, brokerapi.ErrInstanceDoesNotExist
 	}
 
-	if broker.hasBinds(instanceID) {
+	//A repeated deprovision of an instance still being deprovisioned gets the running operation, so the platform keeps polling
+	if op, err := broker.getOperation(ctx, instanceID); err != nil {
+		return brokerapi.DeprovisionServiceSpec{}, err
+	} else if op != nil && op.State == brokerapi.InProgress && !op.timedOut() {
+		if op.Type == DeprovisionOperation {
+			return brokerapi.DeprovisionServiceSpec{IsAsync: true, OperationData: op.ID}, nil
+		}
+		return brokerapi.DeprovisionServiceSpec{}, ErrOperationInProgress
+	}
+
+	if binds, err := broker.hasBinds(ctx, instanceID); err != nil {
+		return brokerapi.DeprovisionServiceSpec{}, err
+	} else if binds {
 		err := brokerapi.NewFailureResponse(errors.New("Deprovision failed because the instance has binds. All binds under this instance must be unbound before deprovisioning."),
 			403, "deprovision-with-existing-binds")
-		broker.LastOperationError = err
 		return brokerapi.DeprovisionServiceSpec{}, err
 	}
 
-	//Deprovision
-	if err := broker.Rados.DeleteUser(instanceID, createTenantID(instanceID)); err != nil {
-		broker.LastOperationError = err
+	inst, err := broker.getInstance(ctx, instanceID)
+	if err != nil {
 		return brokerapi.DeprovisionServiceSpec{}, err
 	}
 
-	if err := broker.S3.DeleteObject(broker.BrokerConfig.BucketName, broker.getInstanceObjName(instanceID)); err != nil {
-		broker.LastOperationError = err
+	if broker, err = broker.forInstance(inst); err != nil {
 		return brokerapi.DeprovisionServiceSpec{}, err
 	}
 
-	broker.DeprovisionDetails = details
-	broker.AsyncAllowed = asyncAllowed
-	broker.LastOperationError = nil
+	if err := broker.checkDeletionPolicy(ctx, inst); err != nil {
+		return brokerapi.DeprovisionServiceSpec{}, err
+	}
+
+	//Deprovision
+	if asyncAllowed {
+		op, err := broker.startOperation(ctx, instanceID, DeprovisionOperation, "Deleting object storage user")
+		if err != nil {
+			return brokerapi.DeprovisionServiceSpec{}, err
+		}
+
+		broker.runOperation(ctx, op, func(ctx context.Context) error {
+			return broker.deprovisionUser(ctx, inst)
+		})
+
+		return brokerapi.DeprovisionServiceSpec{IsAsync: true, OperationData: op.ID}, nil
+	}
+
+	if err := broker.deprovisionUser(ctx, inst); err != nil {
+		return brokerapi.DeprovisionServiceSpec{}, err
+	}
+
+	if err := broker.Store.DeleteOperation(ctx, instanceID); err != nil {
+		broker.Logger.Error("failed-to-delete-operation", err)
+	}
 
 	return brokerapi.DeprovisionServiceSpec{}, nil
 }
 
-func (broker *Broker) Bind(context context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
-	broker.BrokerCalled = true
+//Deletes the radosgw user of an instance and then the instance itself.
+//A missing user is not an error, as a failed asynchronous provision may never have created it
+func (broker *Broker) deprovisionUser(ctx context.Context, inst *Instance) error {
+	if err := broker.Rados.DeleteUser(ctx, inst.User, inst.Tenant); err != nil && !radosgw.IsNotFound(err) {
+		return err
+	}
+
+	if err := broker.Store.DeleteInstance(ctx, inst.ID); err != nil {
+		return err
+	}
+
+	broker.Counter.Release(inst.ID)
+	return nil
+}
+
+func (broker *Broker) GetInstance(ctx context.Context, instanceID string) (InstanceDetails, error) {
+	inst, err := broker.getInstance(ctx, instanceID)
+	if err == ErrStateNotFound {
+		return InstanceDetails{}, ErrInstanceNotFound
+	} else if err != nil {
+		return InstanceDetails{}, err
+	}
+
+	//Instances are only retrievable once provisioning completed
+	if op, err := broker.getOperation(ctx, instanceID); err == nil && op != nil && op.Type == ProvisionOperation && op.State != brokerapi.Succeeded {
+		return InstanceDetails{}, ErrInstanceNotFound
+	}
 
-	if broker.BindError != nil {
-		broker.LastOperationError = broker.BindError
-		return brokerapi.Binding{}, broker.BindError
+	params, err := decodeParameters(inst.RawParameters)
+	if err != nil {
+		return InstanceDetails{}, err
 	}
 
-	if !broker.instanceExists(instanceID) {
-		broker.LastOperationError = brokerapi.ErrInstanceDoesNotExist
+	return InstanceDetails{
+		ServiceID:    inst.ServiceID,
+		PlanID:       inst.PlanID,
+		DashboardURL: broker.getDashboardURL(instanceID),
+		Parameters:   params,
+	}, nil
+}
+
+func (broker *Broker) Bind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (binding brokerapi.Binding, err error) {
+	ctx = audit.NewPlatformContext(ctx, details.RawContext)
+	broker, ev := broker.StartAudit(ctx, audit.Bind, instanceID, bindingID, details.PlanID)
+	defer func() { ev.Finish(err) }()
+	defer broker.Locks.Lock(instanceID)()
+
+	if exists, err := broker.instanceExists(ctx, instanceID); err != nil {
+		return brokerapi.Binding{}, err
+	} else if !exists {
 		return brokerapi.Binding{}, brokerapi.ErrInstanceDoesNotExist
 	}
 
-	if broker.bindingExists(instanceID, bindingID) {
-		broker.LastOperationError = brokerapi.ErrBindingAlreadyExists
-		return brokerapi.Binding{}, brokerapi.ErrBindingAlreadyExists
+	if broker.operationInProgress(ctx, instanceID) {
+		return brokerapi.Binding{}, ErrOperationInProgress
 	}
 
-	//S3 info
-	s3Key, err := broker.Rados.CreateS3Key(instanceID, createTenantID(instanceID))
+	inst, err := broker.getInstance(ctx, instanceID)
 	if err != nil {
-		broker.LastOperationError = err
 		return brokerapi.Binding{}, err
 	}
 
-	//Swift info
-	_, err = broker.Rados.CreateSubuser(instanceID, bindingID, createTenantID(instanceID))
+	//The credentials depend on the backend of the service, so the binding has to be for the service of the instance
+	if details.ServiceID != "" && inst.ServiceID != "" && details.ServiceID != inst.ServiceID {
+		return brokerapi.Binding{}, ErrUnknownServicePlan
+	}
+
+	if broker, err = broker.forInstance(inst); err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	if exists, err := broker.bindingExists(ctx, instanceID, bindingID); err != nil {
+		return brokerapi.Binding{}, err
+	} else if exists {
+		return broker.bindExisting(ctx, inst, bindingID, details)
+	}
+
+	params, err := broker.parseBindParameters(details.PlanID, details.RawParameters)
 	if err != nil {
-		broker.LastOperationError = err
 		return brokerapi.Binding{}, err
 	}
 
-	userInfo, err := broker.Rados.GetUser(instanceID, createTenantID(instanceID), false)
+	access := ""
+	if params.Access != nil {
+		access = *params.Access
+	}
+
+	//Create the credentials, either for the whole instance or scoped to some of its buckets
+	rb := broker.newRollback(ctx, "bind", lager.Data{"instance-id": instanceID, "binding-id": bindingID})
+	var b *Bind
+	if len(params.Buckets) > 0 {
+		b, err = broker.createScopedBind(ctx, inst, bindingID, access, params.Buckets, rb)
+	} else {
+		b, err = broker.createBind(ctx, inst, bindingID, access, rb)
+	}
 	if err != nil {
-		broker.LastOperationError = err
+		rb.run()
 		return brokerapi.Binding{}, err
 	}
+	b.ServiceID = details.ServiceID
+	b.PlanID = details.PlanID
+	b.AppGUID = getBindAppGUID(details)
+	b.RawParameters = details.RawParameters
+	b.CreatedBy = audit.IdentityFromContext(ctx)
 
-	//Fill info
-	user := createTenantID(instanceID) + "$" + instanceID
-	creds := BindCreds{
-		S3User:         user,
-		S3AccessKey:    s3Key.AccessKey,
-		S3SecretKey:    s3Key.SecretKey,
-		S3Endpoint:     broker.BrokerConfig.S3Endpoint,
-		SwiftUser:      user + ":" + bindingID,
-		SwiftSecretKey: userInfo.SwiftKeys[len(userInfo.SwiftKeys)-1].SecretKey,
-		SwiftEndpoint:  broker.BrokerConfig.SwiftEndpoint,
+	creds, err := broker.getBindCreds(ctx, inst, b)
+	if err != nil {
+		rb.run()
+		return brokerapi.Binding{}, err
 	}
+	b.SwiftKey = creds.SwiftSecretKey
 
 	//Store bind information
-	b := Bind{
-		User:        instanceID,
-		Subuser:     bindingID,
-		Tenant:      createTenantID(instanceID),
-		S3AccessKey: creds.S3AccessKey,
-		SwiftKey:    creds.SwiftSecretKey,
+	if err := broker.Store.PutBinding(ctx, instanceID, bindingID, b); err != nil {
+		rb.run()
+		return brokerapi.Binding{}, err
 	}
 
-	j, err := json.Marshal(b)
+	return brokerapi.Binding{Credentials: creds}, nil
+}
+
+//Answers a bind request for an existing binding. Identical requests get the credentials of the binding again
+func (broker *Broker) bindExisting(ctx context.Context, inst *Instance, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
+	b, err := broker.Store.GetBinding(ctx, inst.ID, bindingID)
 	if err != nil {
-		broker.LastOperationError = err
 		return brokerapi.Binding{}, err
 	}
 
-	if err := broker.S3.PutObject(broker.BrokerConfig.BucketName, broker.getBindObjName(instanceID, bindingID), string(j)); err != nil {
-		broker.LastOperationError = err
-		return brokerapi.Binding{}, err
+	if !b.matchesBind(details) {
+		return brokerapi.Binding{}, brokerapi.ErrBindingAlreadyExists
 	}
 
-	broker.BoundBindingDetails = details
-	broker.LastOperationError = nil
+	creds, err := broker.getBindCreds(ctx, inst, b)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
 
+	markExisting(ctx)
 	return brokerapi.Binding{Credentials: creds}, nil
 }
 
-func (broker *Broker) Unbind(context context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) error {
-	broker.BrokerCalled = true
+func (broker *Broker) GetBinding(ctx context.Context, instanceID, bindingID string) (BindingDetails, error) {
+	bind, err := broker.Store.GetBinding(ctx, instanceID, bindingID)
+	if err == ErrStateNotFound {
+		return BindingDetails{}, ErrBindingNotFound
+	} else if err != nil {
+		return BindingDetails{}, err
+	}
 
-	//Error checking
-	if broker.UnbindError != nil {
-		broker.LastOperationError = broker.UnbindError
-		return broker.UnbindError
+	inst, err := broker.getInstance(ctx, instanceID)
+	if err == ErrStateNotFound {
+		return BindingDetails{}, ErrBindingNotFound
+	} else if err != nil {
+		return BindingDetails{}, err
 	}
 
-	if !broker.instanceExists(instanceID) {
-		broker.LastOperationError = brokerapi.ErrInstanceDoesNotExist
-		return brokerapi.ErrInstanceDoesNotExist
+	if broker, err = broker.forInstance(inst); err != nil {
+		return BindingDetails{}, err
 	}
 
-	if !broker.bindingExists(instanceID, bindingID) {
-		broker.LastOperationError = brokerapi.ErrBindingDoesNotExist
-		return brokerapi.ErrBindingDoesNotExist
+	creds, err := broker.getBindCreds(ctx, inst, bind)
+	if err != nil {
+		return BindingDetails{}, err
 	}
 
-	//Delete bind resources
-	j, err := broker.S3.GetObjectString(broker.BrokerConfig.BucketName, broker.getBindObjName(instanceID, bindingID))
+	params, err := decodeParameters(bind.RawParameters)
 	if err != nil {
-		broker.LastOperationError = err
+		return BindingDetails{}, err
+	}
+
+	return BindingDetails{Credentials: creds, Parameters: params}, nil
+}
+
+func (broker *Broker) Unbind(ctx context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) (err error) {
+	broker, ev := broker.StartAudit(ctx, audit.Unbind, instanceID, bindingID, details.PlanID)
+	defer func() { ev.Finish(err) }()
+	defer broker.Locks.Lock(instanceID)()
+
+	if exists, err := broker.instanceExists(ctx, instanceID); err != nil {
 		return err
+	} else if !exists {
+		return brokerapi.ErrInstanceDoesNotExist
 	}
 
-	bind := Bind{}
-	err = utils.LoadJson(j, &bind)
+	if exists, err := broker.bindingExists(ctx, instanceID, bindingID); err != nil {
+		return err
+	} else if !exists {
+		return brokerapi.ErrBindingDoesNotExist
+	}
+
+	inst, err := broker.getInstance(ctx, instanceID)
 	if err != nil {
-		broker.LastOperationError = err
 		return err
 	}
 
-	if err := broker.Rados.DeleteS3Key(bind.User, bind.Tenant, bind.S3AccessKey); err != nil {
-		broker.LastOperationError = err
+	if broker, err = broker.forInstance(inst); err != nil {
 		return err
 	}
 
-	if err := broker.Rados.DeleteSubuser(bind.User, bind.Subuser, bind.Tenant); err != nil {
-		broker.LastOperationError = err
+	//Delete bind resources
+	bind, err := broker.Store.GetBinding(ctx, instanceID, bindingID)
+	if err != nil {
 		return err
 	}
 
-	if err := broker.S3.DeleteObject(broker.BrokerConfig.BucketName, broker.getBindObjName(instanceID, bindingID)); err != nil {
-		broker.LastOperationError = err
+	for _, r := range bind.Retired {
+		if err := broker.deleteRetiredCredentials(ctx, bind, r); err != nil {
+			return err
+		}
+	}
+
+	if len(bind.Scopes) > 0 {
+		err = broker.deleteScopedBind(ctx, instanceID, bind)
+	} else {
+		err = broker.deleteBind(ctx, bind)
+	}
+	if err != nil {
 		return err
 	}
 
-	broker.UnbindingDetails = details
-	broker.LastOperationError = nil
+	if err := broker.Store.DeleteBinding(ctx, instanceID, bindingID); err != nil {
+		return err
+	}
+	broker.Retirements.Set(instanceID, bindingID, nil)
 
 	return nil
 }
 
-func (broker *Broker) LastOperation(context context.Context, instanceID, operationData string) (brokerapi.LastOperation, error) {
-	broker.LastOperationInstanceID = instanceID
-	broker.LastOperationData = operationData
+func (broker *Broker) LastOperation(ctx context.Context, instanceID, operationData string) (brokerapi.LastOperation, error) {
+	op, err := broker.getOperation(ctx, instanceID)
+	if err != nil {
+		return brokerapi.LastOperation{}, err
+	}
+
+	//Instances without an operation record were handled synchronously, so there is nothing in progress
+	if op == nil {
+		if exists, err := broker.instanceExists(ctx, instanceID); err != nil {
+			return brokerapi.LastOperation{}, err
+		} else if !exists {
+			return brokerapi.LastOperation{}, brokerapi.ErrInstanceDoesNotExist
+		}
+		return brokerapi.LastOperation{State: brokerapi.Succeeded}, nil
+	}
+
+	if operationData != "" && operationData != op.ID {
+		return brokerapi.LastOperation{}, ErrOperationNotFound
+	}
+
+	if op.timedOut() {
+		return brokerapi.LastOperation{State: brokerapi.Failed, Description: string(op.Type) + " did not complete in time"}, nil
+	}
 
-	if broker.LastOperationError != nil {
-		return brokerapi.LastOperation{}, broker.LastOperationError
+	//The platform expects a 410 once a deprovision has completed
+	if op.Type == DeprovisionOperation && op.State == brokerapi.Succeeded {
+		return brokerapi.LastOperation{}, brokerapi.ErrInstanceDoesNotExist
 	}
 
-	return brokerapi.LastOperation{State: broker.LastOperationState, Description: broker.LastOperationDescription}, nil
+	return brokerapi.LastOperation{State: op.State, Description: op.Description}, nil
 }
@@ -0,0 +1,150 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"github.com/icclab/ceph-objectstore-broker/radosgw"
+	"github.com/icclab/ceph-objectstore-broker/s3"
+	rgw "github.com/myENA/radosgwadmin"
+	"github.com/pivotal-cf/brokerapi"
+	"net/http"
+	"strconv"
+)
+
+//Deletion policies decide what happens to the buckets of an instance on deprovision
+const (
+	//The buckets are deleted along with their contents
+	DeletionPolicyDelete = "delete"
+	//Deprovisioning is refused while any of the buckets still holds objects
+	DeletionPolicyProtect = "protect"
+)
+
+//Returns the names of the buckets to create for a new instance. Explicitly named buckets take precedence over a bucket count,
+//which in turn takes precedence over the count set in the plan
+func (b *Broker) getInstanceBuckets(planID string, params *InstanceParameters) ([]string, error) {
+	if len(params.Buckets) > 0 {
+		return params.Buckets, nil
+	}
+
+	count := 0
+	if params.BucketCount != nil {
+		count = *params.BucketCount
+	} else {
+		c, err := b.getPlanBucketCount(planID)
+		if err != nil {
+			return nil, err
+		}
+		count = c
+	}
+
+	//Buckets are scoped to the tenant of the instance, so generated names only need to be unique within it
+	names := []string{}
+	for i := 1; i <= count; i++ {
+		names = append(names, "bucket-"+strconv.Itoa(i))
+	}
+
+	return names, nil
+}
+
+//Returns the number of buckets the plan creates by default, which is 0 if the plan doesn't set 'bucketCount'
+func (b *Broker) getPlanBucketCount(planID string) (int, error) {
+	s, err := b.getPlanSettings(planID)
+	if err != nil {
+		return -1, err
+	}
+
+	return s.BucketCount, nil
+}
+
+//Returns an S3 client authenticated as the radosgw user of the instance, creating an S3 key for it if it has none
+func (b *Broker) getUserS3(ctx context.Context, inst *Instance) (*s3.S3, error) {
+	userInfo, err := b.Rados.GetUser(ctx, inst.User, inst.Tenant, false)
+	if err != nil {
+		return nil, err
+	}
+
+	accessKey, secretKey := "", ""
+	if k := getOwnS3Key(userInfo.Keys, inst.User, inst.Tenant); k != nil {
+		accessKey, secretKey = k.AccessKey, k.SecretKey
+	} else {
+		k, err := b.Rados.CreateS3Key(ctx, inst.User, inst.Tenant)
+		if err != nil {
+			return nil, err
+		}
+		accessKey, secretKey = k.AccessKey, k.SecretKey
+	}
+
+	s := &s3.S3{}
+	backend := b.getBackend()
+	if err := s.Connect(backend.RadosEndpoint, accessKey, secretKey, backend.UseHttps); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+//Returns the first S3 key owned by the user itself rather than one of its subusers, which may have restricted access.
+//It is the key the broker uses to manage the buckets of an instance
+func getOwnS3Key(keys []rgw.UserKey, user string, tenant string) *rgw.UserKey {
+	for i := range keys {
+		if keys[i].User == radosgw.UserID(user, tenant) {
+			return &keys[i]
+		}
+	}
+
+	return nil
+}
+
+//Creates the buckets of an instance as its own user. Existing buckets are left as they are, so a failed provision can be retried
+func (b *Broker) createBuckets(ctx context.Context, inst *Instance) error {
+	if len(inst.Buckets) == 0 {
+		return nil
+	}
+
+	s, err := b.getUserS3(ctx, inst)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range inst.Buckets {
+		exists, err := s.BucketExists(ctx, name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		if err := s.CreateBucket(ctx, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Returns an error if the deletion policy of the instance forbids deleting its buckets in their current state
+func (b *Broker) checkDeletionPolicy(ctx context.Context, inst *Instance) error {
+	if inst.DeletionPolicy != DeletionPolicyProtect || len(inst.Buckets) == 0 {
+		return nil
+	}
+
+	s, err := b.getUserS3(ctx, inst)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range inst.Buckets {
+		empty, err := s.BucketEmpty(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		if !empty {
+			return brokerapi.NewFailureResponse(errors.New("Deprovision failed because bucket '"+name+"' is not empty and the deletion policy of the instance protects it"),
+				http.StatusUnprocessableEntity, "deprovision-with-protected-buckets")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package broker
+
+import (
+	"code.cloudfoundry.org/lager"
+	"context"
+	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
+	"sync"
+)
+
+//Config holds the configuration and catalog of the broker, which can be reloaded while the broker runs.
+//It's replaced as a whole, so the config returned by Get never changes
+type Config struct {
+	mutex   sync.RWMutex
+	current *brokerConfig.BrokerConfig
+	//Serializes reloads, which keep the current config available while the new one is validated
+	reloadMutex sync.Mutex
+}
+
+func NewConfig(bc *brokerConfig.BrokerConfig) *Config {
+	return &Config{current: bc}
+}
+
+func (c *Config) Get() *brokerConfig.BrokerConfig {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.current
+}
+
+//Reload loads the config file again and applies the settings that can change while the broker runs. Changes to the other
+//settings are logged, as they only take effect after a restart. If the config is invalid, or validate rejects it, the
+//current one is kept. validate may be nil
+func (c *Config) Reload(logger lager.Logger, validate func(bc *brokerConfig.BrokerConfig) error) error {
+	c.reloadMutex.Lock()
+	defer c.reloadMutex.Unlock()
+
+	current := c.Get()
+	next, err := brokerConfig.Load(current.ConfigFile)
+	if err != nil {
+		logger.Error("failed-to-reload-config", err)
+		return err
+	}
+
+	reloaded, restart := current.Reloaded(next)
+	//New backends only take effect after a restart, so services can't be moved to them before
+	if problems := reloaded.ValidateServiceBackends(reloaded.Services); len(problems) > 0 {
+		err := &brokerConfig.ValidationError{Problems: problems}
+		logger.Error("failed-to-reload-config", err)
+		return err
+	}
+	if validate != nil {
+		if err := validate(reloaded); err != nil {
+			logger.Error("failed-to-reload-config", err)
+			return err
+		}
+	}
+	if len(restart) > 0 {
+		logger.Info("config-changes-need-restart", lager.Data{"settings": restart})
+	}
+
+	c.mutex.Lock()
+	c.current = reloaded
+	c.mutex.Unlock()
+	logger.Info("reloaded-config", lager.Data{"services": len(reloaded.Services), "instance-limit": reloaded.InstanceLimit})
+	return nil
+}
+
+//ReloadConfig reloads the config of the broker, rejecting catalogs with placements the radosgws don't have
+func (b *Broker) ReloadConfig(ctx context.Context) error {
+	return b.Config.Reload(b.Logger, func(bc *brokerConfig.BrokerConfig) error {
+		c := *b
+		c.Config = NewConfig(bc)
+		return c.ValidatePlacements(ctx)
+	})
+}
+
+//Returns the current config of the broker
+func (b *Broker) config() *brokerConfig.BrokerConfig {
+	return b.Config.Get()
+}
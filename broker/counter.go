@@ -0,0 +1,227 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"github.com/pivotal-cf/brokerapi"
+	"net/http"
+	"sync"
+)
+
+var ErrInstanceLimitMet = brokerapi.NewFailureResponse(
+	errors.New("The instance limit for this service has been reached"), http.StatusUnprocessableEntity, "instance-limit-reached")
+
+var ErrOrgInstanceLimitMet = brokerapi.NewFailureResponse(
+	errors.New("The instance limit for this organization has been reached"), http.StatusUnprocessableEntity, "org-instance-limit-reached")
+
+var ErrPlanInstanceLimitMet = brokerapi.NewFailureResponse(
+	errors.New("The instance limit for this plan has been reached"), http.StatusUnprocessableEntity, "plan-instance-limit-reached")
+
+//InstanceCounter counts the instances of the broker in total, per organization and per plan, so the instance limits can be
+//checked without listing the state store. Instances are counted from the moment their provision is reserved, so concurrent
+//provisions can't exceed a limit. The counts only cover the instances of one broker process. They are rebuilt from the
+//state store on startup and recounted periodically, so replicas sharing a store only see each other's instances after a
+//recount, and may together exceed a limit in between
+type InstanceCounter struct {
+	mutex     sync.Mutex
+	instances map[string]countedInstance
+	orgs      map[string]int
+	plans     map[string]int
+}
+
+type countedInstance struct {
+	org  string
+	plan string
+}
+
+//InstanceLimits are the limits a provision is checked against. A limit of 0 or less is no limit
+type InstanceLimits struct {
+	Total int
+	Org   int
+	Plan  int
+}
+
+func NewInstanceCounter() *InstanceCounter {
+	return &InstanceCounter{instances: map[string]countedInstance{}, orgs: map[string]int{}, plans: map[string]int{}}
+}
+
+//Rebuild replaces the counts with the instances in the store. Instances whose record can't be read are counted without
+//organization and plan
+func (c *InstanceCounter) Rebuild(ctx context.Context, store StateStore) error {
+	instances, err := countStore(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.instances = map[string]countedInstance{}
+	c.orgs = map[string]int{}
+	c.plans = map[string]int{}
+	for instID, ci := range instances {
+		c.add(instID, ci)
+	}
+	return nil
+}
+
+//RecountInstances corrects the counts of the instance counter from the store, e.g. to catch up with the instances provisioned
+//or deprovisioned by other replicas sharing the store. Instances counted differently than they're stored are checked
+//again holding their lock, so provisions and deprovisions in progress are counted as before. The first error is returned
+func (b *Broker) RecountInstances(ctx context.Context) error {
+	stored, err := countStore(ctx, b.Store)
+	if err != nil {
+		return err
+	}
+
+	counted := b.Counter.counted()
+	recount := []string{}
+	for instID, ci := range stored {
+		if cci, ok := counted[instID]; !ok || cci != ci {
+			recount = append(recount, instID)
+		}
+	}
+	for instID := range counted {
+		if _, ok := stored[instID]; !ok {
+			recount = append(recount, instID)
+		}
+	}
+
+	//Instances whose record can't be read keep their count, without holding up the others
+	for _, instID := range recount {
+		if recountErr := b.recountInstance(ctx, instID); recountErr != nil && err == nil {
+			err = recountErr
+		}
+	}
+	return err
+}
+
+func (b *Broker) recountInstance(ctx context.Context, instID string) error {
+	defer b.Locks.Lock(instID)()
+
+	inst, err := b.Store.GetInstance(ctx, instID)
+	if err == ErrStateNotFound {
+		b.Counter.Release(instID)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	//Stored instances are counted even if they exceed a limit, as they exist already
+	b.Counter.Reserve(inst, InstanceLimits{})
+	return nil
+}
+
+//Returns the instances of the store as they are counted. Instances whose record can't be read are counted without
+//organization and plan
+func countStore(ctx context.Context, store StateStore) (map[string]countedInstance, error) {
+	instIDs, err := store.ListInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := map[string]countedInstance{}
+	for _, instID := range instIDs {
+		inst, err := store.GetInstance(ctx, instID)
+		if err == ErrStateNotFound {
+			continue
+		} else if err != nil {
+			instances[instID] = countedInstance{}
+			continue
+		}
+		instances[instID] = countedInstance{org: inst.OrganizationGUID, plan: inst.PlanID}
+	}
+
+	return instances, nil
+}
+
+//Returns a copy of the counted instances
+func (c *InstanceCounter) counted() map[string]countedInstance {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	counted := map[string]countedInstance{}
+	for instID, ci := range c.instances {
+		counted[instID] = ci
+	}
+	return counted
+}
+
+//Count returns the number of counted instances
+func (c *InstanceCounter) Count() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.instances)
+}
+
+//Reserve counts the instance if none of the limits is met, and otherwise returns the error of the limit that is.
+//The instance stays counted until it is released
+func (c *InstanceCounter) Reserve(inst *Instance, limits InstanceLimits) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	//An instance counted before is replaced, as its record is gone
+	c.remove(inst.ID)
+
+	if limits.Total > 0 && len(c.instances) >= limits.Total {
+		return ErrInstanceLimitMet
+	}
+	if limits.Org > 0 && inst.OrganizationGUID != "" && c.orgs[inst.OrganizationGUID] >= limits.Org {
+		return ErrOrgInstanceLimitMet
+	}
+	if limits.Plan > 0 && c.plans[inst.PlanID] >= limits.Plan {
+		return ErrPlanInstanceLimitMet
+	}
+
+	c.add(inst.ID, countedInstance{org: inst.OrganizationGUID, plan: inst.PlanID})
+	return nil
+}
+
+//Release stops counting the instance. Releasing an instance that isn't counted does nothing
+func (c *InstanceCounter) Release(instID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.remove(instID)
+}
+
+//ChangePlan moves a counted instance to another plan, unless the new plan has reached its limit
+func (c *InstanceCounter) ChangePlan(instID string, planID string, planLimit int) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ci, ok := c.instances[instID]
+	if !ok || ci.plan == planID {
+		return nil
+	}
+	if planLimit > 0 && c.plans[planID] >= planLimit {
+		return ErrPlanInstanceLimitMet
+	}
+
+	c.remove(instID)
+	ci.plan = planID
+	c.add(instID, ci)
+	return nil
+}
+
+func (c *InstanceCounter) add(instID string, ci countedInstance) {
+	c.instances[instID] = ci
+	if ci.org != "" {
+		c.orgs[ci.org]++
+	}
+	c.plans[ci.plan]++
+}
+
+func (c *InstanceCounter) remove(instID string) {
+	ci, ok := c.instances[instID]
+	if !ok {
+		return
+	}
+
+	delete(c.instances, instID)
+	if c.orgs[ci.org]--; c.orgs[ci.org] <= 0 {
+		delete(c.orgs, ci.org)
+	}
+	if c.plans[ci.plan]--; c.plans[ci.plan] <= 0 {
+		delete(c.plans, ci.plan)
+	}
+}
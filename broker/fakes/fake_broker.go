@@ -0,0 +1,224 @@
+package fakes
+
+import (
+	"context"
+	"github.com/pivotal-cf/brokerapi"
+	"sync"
+)
+
+//FakeBroker is a test double wrapping a broker. It records the requests it receives and fails them with the configured
+//errors instead of passing them on. It's safe for concurrent requests
+type FakeBroker struct {
+	broker brokerapi.ServiceBroker
+	mutex  sync.Mutex
+
+	provisionError   error
+	updateError      error
+	deprovisionError error
+	bindError        error
+	unbindError      error
+
+	called             bool
+	asyncAllowed       bool
+	provisionDetails   brokerapi.ProvisionDetails
+	updateDetails      brokerapi.UpdateDetails
+	deprovisionDetails brokerapi.DeprovisionDetails
+	bindDetails        brokerapi.BindDetails
+	unbindDetails      brokerapi.UnbindDetails
+	lastOperationData  string
+	lastError          error
+}
+
+//NewFakeBroker wraps the broker. Without a broker, requests that don't fail with a configured error succeed with empty responses
+func NewFakeBroker(b brokerapi.ServiceBroker) *FakeBroker {
+	return &FakeBroker{broker: b}
+}
+
+//FailProvision makes provision requests fail with err, or pass again if err is nil
+func (fb *FakeBroker) FailProvision(err error) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.provisionError = err
+}
+
+func (fb *FakeBroker) FailUpdate(err error) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.updateError = err
+}
+
+func (fb *FakeBroker) FailDeprovision(err error) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.deprovisionError = err
+}
+
+func (fb *FakeBroker) FailBind(err error) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.bindError = err
+}
+
+func (fb *FakeBroker) FailUnbind(err error) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.unbindError = err
+}
+
+//Called returns true once any request was received
+func (fb *FakeBroker) Called() bool {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	return fb.called
+}
+
+//AsyncAllowed returns whether the last provision, update or deprovision request allowed asynchronous operations
+func (fb *FakeBroker) AsyncAllowed() bool {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	return fb.asyncAllowed
+}
+
+func (fb *FakeBroker) ProvisionDetails() brokerapi.ProvisionDetails {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	return fb.provisionDetails
+}
+
+func (fb *FakeBroker) UpdateDetails() brokerapi.UpdateDetails {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	return fb.updateDetails
+}
+
+func (fb *FakeBroker) DeprovisionDetails() brokerapi.DeprovisionDetails {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	return fb.deprovisionDetails
+}
+
+func (fb *FakeBroker) BindDetails() brokerapi.BindDetails {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	return fb.bindDetails
+}
+
+func (fb *FakeBroker) UnbindDetails() brokerapi.UnbindDetails {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	return fb.unbindDetails
+}
+
+//LastOperationData returns the operation data of the last last operation request
+func (fb *FakeBroker) LastOperationData() string {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	return fb.lastOperationData
+}
+
+//LastError returns the error of the last provision, update, deprovision, bind or unbind request
+func (fb *FakeBroker) LastError() error {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	return fb.lastError
+}
+
+//Marks the fake as called and records the request while holding the mutex
+func (fb *FakeBroker) record(update func()) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.called = true
+	update()
+}
+
+func (fb *FakeBroker) setLastError(err error) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.lastError = err
+}
+
+func (fb *FakeBroker) Services(ctx context.Context) ([]brokerapi.Service, error) {
+	fb.record(func() {})
+	if fb.broker == nil {
+		return []brokerapi.Service{}, nil
+	}
+
+	return fb.broker.Services(ctx)
+}
+
+func (fb *FakeBroker) Provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (spec brokerapi.ProvisionedServiceSpec, err error) {
+	defer func() { fb.setLastError(err) }()
+	fb.record(func() {
+		fb.provisionDetails = details
+		fb.asyncAllowed = asyncAllowed
+		err = fb.provisionError
+	})
+	if err != nil || fb.broker == nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+
+	return fb.broker.Provision(ctx, instanceID, details, asyncAllowed)
+}
+
+func (fb *FakeBroker) Update(ctx context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (spec brokerapi.UpdateServiceSpec, err error) {
+	defer func() { fb.setLastError(err) }()
+	fb.record(func() {
+		fb.updateDetails = details
+		fb.asyncAllowed = asyncAllowed
+		err = fb.updateError
+	})
+	if err != nil || fb.broker == nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	return fb.broker.Update(ctx, instanceID, details, asyncAllowed)
+}
+
+func (fb *FakeBroker) Deprovision(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (spec brokerapi.DeprovisionServiceSpec, err error) {
+	defer func() { fb.setLastError(err) }()
+	fb.record(func() {
+		fb.deprovisionDetails = details
+		fb.asyncAllowed = asyncAllowed
+		err = fb.deprovisionError
+	})
+	if err != nil || fb.broker == nil {
+		return brokerapi.DeprovisionServiceSpec{}, err
+	}
+
+	return fb.broker.Deprovision(ctx, instanceID, details, asyncAllowed)
+}
+
+func (fb *FakeBroker) Bind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (binding brokerapi.Binding, err error) {
+	defer func() { fb.setLastError(err) }()
+	fb.record(func() {
+		fb.bindDetails = details
+		err = fb.bindError
+	})
+	if err != nil || fb.broker == nil {
+		return brokerapi.Binding{}, err
+	}
+
+	return fb.broker.Bind(ctx, instanceID, bindingID, details)
+}
+
+func (fb *FakeBroker) Unbind(ctx context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) (err error) {
+	defer func() { fb.setLastError(err) }()
+	fb.record(func() {
+		fb.unbindDetails = details
+		err = fb.unbindError
+	})
+	if err != nil || fb.broker == nil {
+		return err
+	}
+
+	return fb.broker.Unbind(ctx, instanceID, bindingID, details)
+}
+
+func (fb *FakeBroker) LastOperation(ctx context.Context, instanceID, operationData string) (brokerapi.LastOperation, error) {
+	fb.record(func() { fb.lastOperationData = operationData })
+	if fb.broker == nil {
+		return brokerapi.LastOperation{State: brokerapi.Succeeded}, nil
+	}
+
+	return fb.broker.LastOperation(ctx, instanceID, operationData)
+}
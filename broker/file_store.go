@@ -0,0 +1,77 @@
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+//FileStore keeps the broker state in a single JSON file on local disk, for deployments where
+//the broker metadata should not live on the Ceph cluster it manages.
+//The whole state is held in memory and the file is rewritten atomically after every change,
+//so only a single broker process may use a given file
+type FileStore struct {
+	*MemoryStore
+	path string
+}
+
+//NewFileStore opens the state file at the given path, creating it if it doesn't exist yet
+func NewFileStore(path string) (*FileStore, error) {
+	fs := &FileStore{MemoryStore: NewMemoryStore(), path: path}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		if err := fs.save(&fs.state); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(b, &fs.state); err != nil {
+		return nil, err
+	}
+
+	//Files written by older versions may lack some of the sections
+	if fs.state.Instances == nil {
+		fs.state.Instances = newMemoryState().Instances
+	}
+	if fs.state.Bindings == nil {
+		fs.state.Bindings = newMemoryState().Bindings
+	}
+	if fs.state.Operations == nil {
+		fs.state.Operations = newMemoryState().Operations
+	}
+
+	fs.persist = fs.save
+	return fs, nil
+}
+
+//Writes the state to a temporary file next to the state file and then renames it, so a crash never leaves a partial file behind
+func (fs *FileStore) save(s *memoryState) error {
+	j, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(fs.path), filepath.Base(fs.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(j); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fs.path)
+}
@@ -0,0 +1,66 @@
+package broker
+
+import (
+	"encoding/json"
+	"github.com/pivotal-cf/brokerapi"
+	"reflect"
+)
+
+//Returns true if a provision request asks for the instance as it is recorded, so repeating it is not a conflict
+func (inst *Instance) matchesProvision(details brokerapi.ProvisionDetails) bool {
+	org, space := getProvisionOrgSpace(details)
+	return inst.ServiceID == details.ServiceID &&
+		inst.PlanID == details.PlanID &&
+		inst.OrganizationGUID == org &&
+		inst.SpaceGUID == space &&
+		sameParameters(inst.RawParameters, details.RawParameters)
+}
+
+//Returns true if a bind request asks for the binding as it is recorded.
+//Bindings recorded before the request details were stored never match
+func (bind *Bind) matchesBind(details brokerapi.BindDetails) bool {
+	return bind.ServiceID != "" &&
+		bind.ServiceID == details.ServiceID &&
+		bind.PlanID == details.PlanID &&
+		bind.AppGUID == getBindAppGUID(details) &&
+		sameParameters(bind.RawParameters, details.RawParameters)
+}
+
+//Returns the app of a bind request. The top level app_guid is deprecated in favour of the one in the bind resource
+func getBindAppGUID(details brokerapi.BindDetails) string {
+	if details.AppGUID == "" && details.BindResource != nil {
+		return details.BindResource.AppGuid
+	}
+
+	return details.AppGUID
+}
+
+//Compares request parameters by their JSON value, so formatting and key order don't matter.
+//Missing parameters are the same as an empty object
+func sameParameters(a json.RawMessage, b json.RawMessage) bool {
+	var va, vb interface{}
+	if err := decodeRawParameters(a, &va); err != nil {
+		return false
+	}
+	if err := decodeRawParameters(b, &vb); err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(va, vb)
+}
+
+func decodeRawParameters(raw json.RawMessage, v *interface{}) error {
+	if len(raw) == 0 {
+		*v = map[string]interface{}{}
+		return nil
+	}
+
+	if err := json.Unmarshal(raw, v); err != nil {
+		return err
+	}
+	if *v == nil {
+		*v = map[string]interface{}{}
+	}
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/icclab/ceph-objectstore-broker/audit"
+	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
+	"github.com/pivotal-cf/brokerapi"
+	"time"
+)
+
+//Current version of the instance record. Records with a lower version are upgraded when read
+const instanceRecordVersion = 1
+
+//Instance is the record of a provisioned service instance
+type Instance struct {
+	Version          int             `json:"version"`
+	ID               string          `json:"id"`
+	ServiceID        string          `json:"serviceID"`
+	PlanID           string          `json:"planID"`
+	OrganizationGUID string          `json:"organizationGUID"`
+	SpaceGUID        string          `json:"spaceGUID"`
+	User             string          `json:"user"`
+	Tenant           string          `json:"tenant"`
+	QuotaMB          int             `json:"quotaMB"`
+	MaxObjects       int             `json:"maxObjects,omitempty"`
+	MaxBuckets       int             `json:"maxBuckets,omitempty"`
+	Buckets          []string        `json:"buckets,omitempty"`
+	DeletionPolicy   string          `json:"deletionPolicy,omitempty"`
+	RawContext       json.RawMessage `json:"context,omitempty"`
+	RawParameters    json.RawMessage `json:"parameters,omitempty"`
+	CreatedAt        time.Time       `json:"createdAt"`
+	UpdatedAt        time.Time       `json:"updatedAt"`
+
+	//Taken from the platform context of the requests. Cloud Foundry instances have an organization and space instead
+	Platform  string `json:"platform,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	ClusterID string `json:"clusterID,omitempty"`
+	//Backend of the service the instance was provisioned from, which its users are on. Empty for the default backend
+	Backend string `json:"backend,omitempty"`
+	//Placement target and default storage class of the instance user, from the plan. Instances provisioned before plans
+	//had placements have none, and are in the placement of their backend
+	Placement    string `json:"placement,omitempty"`
+	StorageClass string `json:"storageClass,omitempty"`
+	//Originating identities of the requests that provisioned and last updated the instance
+	CreatedBy *audit.Identity `json:"createdBy,omitempty"`
+	UpdatedBy *audit.Identity `json:"updatedBy,omitempty"`
+}
+
+//Creates the record of a new instance from the provision request and its parsed parameters
+func (b *Broker) newInstance(ctx context.Context, instID string, details brokerapi.ProvisionDetails, params *InstanceParameters) (*Instance, error) {
+	quota, err := b.getPlanQuota(details.PlanID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	org, space := getProvisionOrgSpace(details)
+	inst := &Instance{
+		Version:          instanceRecordVersion,
+		ID:               instID,
+		ServiceID:        details.ServiceID,
+		PlanID:           details.PlanID,
+		OrganizationGUID: org,
+		SpaceGUID:        space,
+		User:             instID,
+		Tenant:           createTenantID(instID),
+		QuotaMB:          quota,
+		RawContext:       details.RawContext,
+		RawParameters:    details.RawParameters,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+		CreatedBy:        audit.IdentityFromContext(ctx),
+		UpdatedBy:        audit.IdentityFromContext(ctx),
+	}
+	if backend := b.getBackend().Name; backend != brokerConfig.DefaultBackend {
+		inst.Backend = backend
+	}
+	inst.Placement, inst.StorageClass = b.getPlanPlacement(details.PlanID)
+	inst.setPlatformContext(audit.ParsePlatformContext(details.RawContext))
+
+	if params.QuotaMB != nil {
+		inst.QuotaMB = *params.QuotaMB
+	}
+	if params.MaxObjects != nil {
+		inst.MaxObjects = *params.MaxObjects
+	}
+	if params.MaxBuckets != nil {
+		inst.MaxBuckets = *params.MaxBuckets
+	}
+	if params.DeletionPolicy != nil {
+		inst.DeletionPolicy = *params.DeletionPolicy
+	}
+
+	inst.Buckets, err = b.getInstanceBuckets(details.PlanID, params)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := inst.MaxBuckets
+	if limit == 0 {
+		limit = maxBucketsLimit
+	}
+	if len(inst.Buckets) > limit {
+		return nil, newInvalidParametersError("more buckets requested than allowed by max_buckets")
+	}
+
+	return inst, nil
+}
+
+//Returns the record of an instance, upgrading and storing it first if it was written by an older broker
+func (b *Broker) getInstance(ctx context.Context, instID string) (*Instance, error) {
+	inst, err := b.Store.GetInstance(ctx, instID)
+	if err != nil {
+		return nil, err
+	}
+
+	if inst.Version >= instanceRecordVersion {
+		return inst, nil
+	}
+
+	if err := b.upgradeInstance(ctx, inst); err != nil {
+		return nil, err
+	}
+
+	if err := b.Store.UpdateInstance(ctx, inst); err != nil {
+		return nil, err
+	}
+
+	return inst, nil
+}
+
+//Records where the instance lives according to the platform context of a request
+func (inst *Instance) setPlatformContext(pc *audit.PlatformContext) {
+	if pc == nil {
+		return
+	}
+
+	inst.Platform = pc.Platform
+	inst.Namespace = pc.Namespace
+	inst.ClusterID = pc.ClusterID
+}
+
+//Returns the organization and space of a provision request. They are deprecated in favour of the platform context,
+//which is used when they're missing
+func getProvisionOrgSpace(details brokerapi.ProvisionDetails) (string, string) {
+	org, space := details.OrganizationGUID, details.SpaceGUID
+	if pc := audit.ParsePlatformContext(details.RawContext); pc != nil {
+		if org == "" {
+			org = pc.OrganizationGUID
+		}
+		if space == "" {
+			space = pc.SpaceGUID
+		}
+	}
+
+	return org, space
+}
+
+//Fills in what can be recovered of a record from before instance records were versioned, which were empty markers.
+//The user and tenant follow from the instance ID, while the plan is found through the quota currently set on the user
+func (b *Broker) upgradeInstance(ctx context.Context, inst *Instance) error {
+	if inst.Version == 0 {
+		inst.User = inst.ID
+		inst.Tenant = createTenantID(inst.ID)
+
+		quota, err := b.Rados.GetUserQuotaMB(ctx, inst.User, inst.Tenant)
+		if err != nil {
+			return err
+		}
+		inst.QuotaMB = quota
+
+		//The plan and service have to belong together. Brokers from before versioned records had a single service,
+		//which is assumed if no plan has the quota
+		if s, p := b.getPlanByQuota(quota); p != nil {
+			inst.ServiceID, inst.PlanID = s.ID, p.ID
+		} else if services := b.config().Services; len(services) > 0 {
+			inst.ServiceID = services[0].ID
+		}
+
+		inst.UpdatedAt = time.Now().UTC()
+	}
+
+	inst.Version = instanceRecordVersion
+	return nil
+}
@@ -0,0 +1,47 @@
+package broker
+
+import (
+	"sync"
+)
+
+//InstanceLocks serializes the requests changing the same instance, so concurrent requests for an instance can't interleave
+//their radosgw calls and record updates. Requests for different instances don't wait for each other.
+//The locks only cover the requests of one broker process
+type InstanceLocks struct {
+	mutex sync.Mutex
+	locks map[string]*instanceLock
+}
+
+type instanceLock struct {
+	mutex sync.Mutex
+	//Number of requests holding or waiting for the lock, which is dropped once there are none
+	refs int
+}
+
+func NewInstanceLocks() *InstanceLocks {
+	return &InstanceLocks{locks: map[string]*instanceLock{}}
+}
+
+//Lock waits until no other request holds the lock of the instance and takes it. The returned function releases it
+func (l *InstanceLocks) Lock(instID string) (unlock func()) {
+	l.mutex.Lock()
+	il := l.locks[instID]
+	if il == nil {
+		il = &instanceLock{}
+		l.locks[instID] = il
+	}
+	il.refs++
+	l.mutex.Unlock()
+
+	il.mutex.Lock()
+	return func() {
+		il.mutex.Unlock()
+
+		l.mutex.Lock()
+		il.refs--
+		if il.refs == 0 {
+			delete(l.locks, instID)
+		}
+		l.mutex.Unlock()
+	}
+}
@@ -0,0 +1,173 @@
+package broker
+
+import (
+	"code.cloudfoundry.org/lager"
+	"context"
+	"encoding/json"
+	"github.com/icclab/ceph-objectstore-broker/audit"
+	"github.com/icclab/ceph-objectstore-broker/radosgw"
+	"github.com/pivotal-cf/brokerapi"
+	"time"
+)
+
+//QuotaSync is the outcome of re-syncing the quota of an instance to its plan
+type QuotaSync struct {
+	InstanceID string `json:"instanceID"`
+	PlanID     string `json:"planID"`
+	//Quota set on the radosgw before the sync
+	OldQuotaMB int  `json:"oldQuotaMB"`
+	QuotaMB    int  `json:"quotaMB"`
+	UsageMB    int  `json:"usageMB"`
+	Changed    bool `json:"changed"`
+	//Set if the quota of the instance couldn't be synced
+	Error string `json:"error,omitempty"`
+}
+
+//ForceDeleteInstance deletes an instance regardless of its bindings, operations and deletion policy.
+//The users of the instance and its scoped bindings are deleted along with their buckets and data, then all records of the instance.
+//Resources that are already gone are not an error, so a failed force delete can be repeated
+func (b *Broker) ForceDeleteInstance(ctx context.Context, instID string) error {
+	defer b.Locks.Lock(instID)()
+
+	inst, err := b.getInstance(ctx, instID)
+	if err == ErrStateNotFound {
+		return brokerapi.ErrInstanceDoesNotExist
+	} else if err != nil {
+		return err
+	}
+
+	if b, err = b.forInstance(inst); err != nil {
+		return err
+	}
+
+	bindIDs, err := b.Store.ListBindings(ctx, instID)
+	if err != nil {
+		return err
+	}
+
+	//Keys and subusers of the other bindings are deleted with the instance user, as are the bucket policies of scoped bindings
+	for _, bindID := range bindIDs {
+		bind, err := b.Store.GetBinding(ctx, instID, bindID)
+		if err != nil {
+			return err
+		}
+
+		if bind.User != inst.User {
+			if err := b.Rados.DeleteUser(ctx, bind.User, bind.Tenant); err != nil && !radosgw.IsNotFound(err) {
+				return err
+			}
+		}
+	}
+
+	if err := b.Rados.DeleteUser(ctx, inst.User, inst.Tenant); err != nil && !radosgw.IsNotFound(err) {
+		return err
+	}
+
+	for _, bindID := range bindIDs {
+		if err := b.Store.DeleteBinding(ctx, instID, bindID); err != nil {
+			return err
+		}
+	}
+
+	if err := b.Store.DeleteOperation(ctx, instID); err != nil {
+		return err
+	}
+
+	if err := b.Store.DeleteInstance(ctx, instID); err != nil {
+		return err
+	}
+	b.Counter.Release(instID)
+
+	b.Logger.Info("force-deleted-instance", lager.Data{"instance-id": instID, "bindings": len(bindIDs)})
+	return nil
+}
+
+//SyncQuota sets the quota of an instance back to what its plan allows: the size of the plan, or the quota_mb it was
+//provisioned or updated with if that is smaller. The quota is only changed on the radosgw and in the record if dryRun isn't set
+func (b *Broker) SyncQuota(ctx context.Context, instID string, dryRun bool) (*QuotaSync, error) {
+	defer b.Locks.Lock(instID)()
+
+	inst, err := b.getInstance(ctx, instID)
+	if err == ErrStateNotFound {
+		return nil, brokerapi.ErrInstanceDoesNotExist
+	} else if err != nil {
+		return nil, err
+	}
+
+	if b, err = b.forInstance(inst); err != nil {
+		return nil, err
+	}
+
+	planQuota, err := b.getPlanQuota(inst.PlanID)
+	if err != nil {
+		return nil, err
+	}
+
+	//The parameters aren't validated again, as they may no longer fit a plan that changed since
+	quota := planQuota
+	params := InstanceParameters{}
+	if len(inst.RawParameters) > 0 {
+		if err := json.Unmarshal(inst.RawParameters, &params); err != nil {
+			return nil, err
+		}
+	}
+	if params.QuotaMB != nil && *params.QuotaMB < quota {
+		quota = *params.QuotaMB
+	}
+
+	old, err := b.Rados.GetUserQuotaMB(ctx, inst.User, inst.Tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	usage, err := b.Rados.GetUserUsageMB(ctx, inst.User, inst.Tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	sync := &QuotaSync{InstanceID: instID, PlanID: inst.PlanID, OldQuotaMB: old, QuotaMB: quota, UsageMB: usage,
+		Changed: old != quota || inst.QuotaMB != quota}
+	if dryRun || !sync.Changed {
+		return sync, nil
+	}
+
+	if err := b.Rados.SetUserQuota(ctx, inst.User, inst.Tenant, quota, inst.MaxObjects); err != nil {
+		return nil, err
+	}
+
+	inst.QuotaMB = quota
+	inst.UpdatedAt = time.Now().UTC()
+	if err := b.Store.UpdateInstance(ctx, inst); err != nil {
+		return nil, err
+	}
+
+	b.Logger.Info("synced-quota", lager.Data{"instance-id": instID, "old-quota-mb": old, "quota-mb": quota})
+	return sync, nil
+}
+
+//SyncQuotas syncs the quotas of the instances, or of all instances if none are given, and returns the outcome for each.
+//An instance failing doesn't stop the others. Changes are audited, dry runs are not
+func (b *Broker) SyncQuotas(ctx context.Context, instIDs []string, dryRun bool) ([]QuotaSync, error) {
+	if len(instIDs) == 0 {
+		var err error
+		if instIDs, err = b.Store.ListInstances(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	syncs := []QuotaSync{}
+	for _, instID := range instIDs {
+		ab, ev := b, (*audit.Event)(nil)
+		if !dryRun {
+			ab, ev = b.StartAudit(ctx, audit.SyncQuota, instID, "", "")
+		}
+		sync, err := ab.SyncQuota(ctx, instID, dryRun)
+		ev.Finish(err)
+		if err != nil {
+			sync = &QuotaSync{InstanceID: instID, Error: err.Error()}
+		}
+		syncs = append(syncs, *sync)
+	}
+
+	return syncs, nil
+}
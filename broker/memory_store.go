@@ -0,0 +1,234 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+//MemoryStore keeps the broker state in memory only, so it is lost when the broker stops. Mainly intended for tests.
+//Records are stored JSON encoded, so callers never share memory with the store
+type MemoryStore struct {
+	mutex sync.RWMutex
+	state memoryState
+	//Called with the new state after every change. If it fails the change is rolled back
+	persist func(s *memoryState) error
+}
+
+type memoryState struct {
+	Instances  map[string]json.RawMessage            `json:"instances"`
+	Bindings   map[string]map[string]json.RawMessage `json:"bindings"`
+	Operations map[string]json.RawMessage            `json:"operations"`
+	AuditHead  string                                `json:"auditHead,omitempty"`
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{state: newMemoryState()}
+}
+
+func newMemoryState() memoryState {
+	return memoryState{
+		Instances:  map[string]json.RawMessage{},
+		Bindings:   map[string]map[string]json.RawMessage{},
+		Operations: map[string]json.RawMessage{},
+	}
+}
+
+func (m *MemoryStore) CreateInstance(ctx context.Context, inst *Instance) error {
+	return m.update(func(s *memoryState) error {
+		return put(s.Instances, inst.ID, inst)
+	})
+}
+
+func (m *MemoryStore) UpdateInstance(ctx context.Context, inst *Instance) error {
+	return m.update(func(s *memoryState) error {
+		if _, ok := s.Instances[inst.ID]; !ok {
+			return ErrStateNotFound
+		}
+		return put(s.Instances, inst.ID, inst)
+	})
+}
+
+func (m *MemoryStore) GetInstance(ctx context.Context, instID string) (*Instance, error) {
+	inst := &Instance{}
+	if err := m.get(func(s *memoryState) json.RawMessage { return s.Instances[instID] }, inst); err != nil {
+		return nil, err
+	}
+
+	return inst, nil
+}
+
+func (m *MemoryStore) InstanceExists(ctx context.Context, instID string) (bool, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	_, ok := m.state.Instances[instID]
+	return ok, nil
+}
+
+func (m *MemoryStore) ListInstances(ctx context.Context) ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return sortedKeys(m.state.Instances), nil
+}
+
+func (m *MemoryStore) DeleteInstance(ctx context.Context, instID string) error {
+	return m.update(func(s *memoryState) error {
+		delete(s.Instances, instID)
+		return nil
+	})
+}
+
+func (m *MemoryStore) PutBinding(ctx context.Context, instID string, bindID string, bind *Bind) error {
+	return m.update(func(s *memoryState) error {
+		if s.Bindings[instID] == nil {
+			s.Bindings[instID] = map[string]json.RawMessage{}
+		}
+		return put(s.Bindings[instID], bindID, bind)
+	})
+}
+
+func (m *MemoryStore) GetBinding(ctx context.Context, instID string, bindID string) (*Bind, error) {
+	bind := &Bind{}
+	if err := m.get(func(s *memoryState) json.RawMessage { return s.Bindings[instID][bindID] }, bind); err != nil {
+		return nil, err
+	}
+
+	return bind, nil
+}
+
+func (m *MemoryStore) BindingExists(ctx context.Context, instID string, bindID string) (bool, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	_, ok := m.state.Bindings[instID][bindID]
+	return ok, nil
+}
+
+func (m *MemoryStore) ListBindings(ctx context.Context, instID string) ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return sortedKeys(m.state.Bindings[instID]), nil
+}
+
+func (m *MemoryStore) DeleteBinding(ctx context.Context, instID string, bindID string) error {
+	return m.update(func(s *memoryState) error {
+		delete(s.Bindings[instID], bindID)
+		if len(s.Bindings[instID]) == 0 {
+			delete(s.Bindings, instID)
+		}
+		return nil
+	})
+}
+
+func (m *MemoryStore) PutOperation(ctx context.Context, op *Operation) error {
+	return m.update(func(s *memoryState) error {
+		return put(s.Operations, op.InstanceID, op)
+	})
+}
+
+func (m *MemoryStore) GetOperation(ctx context.Context, instID string) (*Operation, error) {
+	op := &Operation{}
+	if err := m.get(func(s *memoryState) json.RawMessage { return s.Operations[instID] }, op); err != nil {
+		return nil, err
+	}
+
+	return op, nil
+}
+
+func (m *MemoryStore) DeleteOperation(ctx context.Context, instID string) error {
+	return m.update(func(s *memoryState) error {
+		delete(s.Operations, instID)
+		return nil
+	})
+}
+
+func (m *MemoryStore) GetAuditHead(ctx context.Context) (string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.state.AuditHead, nil
+}
+
+func (m *MemoryStore) PutAuditHead(ctx context.Context, hash string) error {
+	return m.update(func(s *memoryState) error {
+		s.AuditHead = hash
+		return nil
+	})
+}
+
+//Applies a change to the state while holding the write lock
+func (m *MemoryStore) update(change func(s *memoryState) error) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.persist == nil {
+		return change(&m.state)
+	}
+
+	old := m.state.clone()
+	if err := change(&m.state); err != nil {
+		m.state = old
+		return err
+	}
+
+	if err := m.persist(&m.state); err != nil {
+		m.state = old
+		return err
+	}
+
+	return nil
+}
+
+//Decodes the record returned by 'find' into 'i', returning ErrStateNotFound if there is none
+func (m *MemoryStore) get(find func(s *memoryState) json.RawMessage, i interface{}) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	j := find(&m.state)
+	if j == nil {
+		return ErrStateNotFound
+	}
+
+	return json.Unmarshal(j, i)
+}
+
+//Copies the maps of the state. The records themselves are never modified in place, so they can be shared
+func (s *memoryState) clone() memoryState {
+	c := newMemoryState()
+	for k, v := range s.Instances {
+		c.Instances[k] = v
+	}
+	for instID, binds := range s.Bindings {
+		c.Bindings[instID] = map[string]json.RawMessage{}
+		for k, v := range binds {
+			c.Bindings[instID][k] = v
+		}
+	}
+	for k, v := range s.Operations {
+		c.Operations[k] = v
+	}
+	c.AuditHead = s.AuditHead
+	return c
+}
+
+func put(records map[string]json.RawMessage, id string, i interface{}) error {
+	j, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+
+	records[id] = j
+	return nil
+}
+
+func sortedKeys(records map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,318 @@
+package broker
+
+import (
+	"code.cloudfoundry.org/lager"
+	"context"
+	"encoding/csv"
+	"errors"
+	"github.com/icclab/ceph-objectstore-broker/radosgw"
+	rgw "github.com/myENA/radosgwadmin"
+	"github.com/pivotal-cf/brokerapi"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Dimensions a metering report can be aggregated by
+const (
+	GroupByInstance     = "instance"
+	GroupByOrganization = "organization"
+	GroupBySpace        = "space"
+	GroupByPlan         = "plan"
+)
+
+//MeteringRecord is the traffic and storage of an instance, or of a group of instances, over the window of a report.
+//Fields not shared by all instances of a group are left empty
+type MeteringRecord struct {
+	InstanceID       string `json:"instanceID,omitempty"`
+	PlanID           string `json:"planID,omitempty"`
+	PlanName         string `json:"planName,omitempty"`
+	OrganizationGUID string `json:"organizationGUID,omitempty"`
+	SpaceGUID        string `json:"spaceGUID,omitempty"`
+	//Set for usage logged by instances that were deprovisioned since, whose plan, organization and space are unknown
+	Deprovisioned bool `json:"deprovisioned,omitempty"`
+	Instances     int  `json:"instances"`
+
+	BytesSent     int64 `json:"bytesSent"`
+	BytesReceived int64 `json:"bytesReceived"`
+	Ops           int64 `json:"ops"`
+	SuccessfulOps int64 `json:"successfulOps"`
+	//Storage is sampled when the report is created, as the usage log doesn't record it
+	SizeKB  int64 `json:"sizeKB"`
+	Objects int64 `json:"objects"`
+	//Set if the storage of an instance could not be read, in which case it's missing from the totals
+	Error string `json:"error,omitempty"`
+}
+
+//MeteringReport is the usage of the broker's instances between start and end
+type MeteringReport struct {
+	Start     time.Time        `json:"start"`
+	End       time.Time        `json:"end"`
+	CreatedAt time.Time        `json:"createdAt"`
+	GroupBy   string           `json:"groupBy"`
+	Records   []MeteringRecord `json:"records"`
+}
+
+//Columns of the CSV format of a metering report
+var meteringCSVHeader = []string{"start", "end", "instance_id", "plan_id", "plan_name", "organization_guid", "space_guid", "deprovisioned",
+	"instances", "bytes_sent", "bytes_received", "ops", "successful_ops", "size_kb", "objects", "error"}
+
+//Meter creates a report of the usage of all instances between start and end from the usage log of the radosgw.
+//Traffic of the scoped binding users is added to their instance, and usage logged in the tenants of instances
+//that are no longer stored is reported as deprovisioned
+func (b *Broker) Meter(ctx context.Context, start time.Time, end time.Time) (*MeteringReport, error) {
+	if !start.Before(end) {
+		return nil, errors.New("The start of the metering window must be before its end")
+	}
+
+	owned, tenants, _, err := b.getOwnedUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	//Each Ceph cluster logs the usage of the users on it
+	entries := []rgw.UsageEntry{}
+	for _, backends := range b.getClusters() {
+		cb, err := b.onBackend(backends[0])
+		if err != nil {
+			return nil, err
+		}
+
+		usage, err := cb.Rados.GetUsageLog(ctx, start, end)
+		if err != nil {
+			return nil, err
+		}
+		co, _ := clusterUsers(owned, tenants, backends)
+		for _, e := range usage.Entries {
+			if owned[e.User] == nil || co[e.User] != nil {
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	report := &MeteringReport{Start: start.UTC(), End: end.UTC(), CreatedAt: time.Now().UTC(), GroupBy: GroupByInstance}
+	records := map[string]*MeteringRecord{}
+	for _, instID := range tenants {
+		//The user of an instance still being provisioned may not exist yet
+		if op, err := b.getOperation(ctx, instID); err == nil && op != nil && op.Type == ProvisionOperation && op.State != brokerapi.Succeeded {
+			continue
+		}
+
+		inst, err := b.getInstance(ctx, instID)
+		if err != nil {
+			return nil, err
+		}
+
+		records[instID] = b.newMeteringRecord(ctx, inst)
+	}
+
+	//The tenants of deprovisioned instances are recognized by the instance user, which is named after the instance
+	deprovisioned := map[string]string{}
+	for _, e := range entries {
+		if name, tenant := radosgw.SplitUserID(e.User); tenant != "" && tenants[tenant] == "" && tenant == createTenantID(name) {
+			deprovisioned[tenant] = name
+		}
+	}
+
+	for _, e := range entries {
+		_, tenant := radosgw.SplitUserID(e.User)
+		var r *MeteringRecord
+		if ou := owned[e.User]; ou != nil {
+			r = records[ou.instID]
+		} else if instID := deprovisioned[tenant]; instID != "" {
+			if r = records[instID]; r == nil {
+				r = &MeteringRecord{InstanceID: instID, Deprovisioned: true, Instances: 1}
+				records[instID] = r
+			}
+		}
+		if r == nil {
+			continue
+		}
+
+		for _, bucket := range e.Buckets {
+			for _, c := range bucket.Categories {
+				r.BytesSent += int64(c.BytesSent)
+				r.BytesReceived += int64(c.BytesReceived)
+				r.Ops += int64(c.Ops)
+				r.SuccessfulOps += int64(c.SuccessfulOps)
+			}
+		}
+	}
+
+	report.Records = sortedMeteringRecords(records)
+	b.Logger.Debug("metered-usage", lager.Data{"start": report.Start, "end": report.End, "instances": len(report.Records)})
+	return report, nil
+}
+
+//Returns the record of an instance with its storage read from the radosgw
+func (b *Broker) newMeteringRecord(ctx context.Context, inst *Instance) *MeteringRecord {
+	r := &MeteringRecord{
+		InstanceID:       inst.ID,
+		PlanID:           inst.PlanID,
+		PlanName:         inst.PlanID,
+		OrganizationGUID: inst.OrganizationGUID,
+		SpaceGUID:        inst.SpaceGUID,
+		Instances:        1,
+	}
+	if p, err := b.getPlan(inst.PlanID); err == nil {
+		r.PlanName = p.Name
+	}
+
+	ib, err := b.forInstance(inst)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+
+	stats, err := ib.Rados.GetUserStats(ctx, inst.User, inst.Tenant)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	r.SizeKB = int64(stats.SizeKB)
+	r.Objects = int64(stats.NumObjects)
+
+	return r
+}
+
+//Aggregate returns a copy of the report with the records summed up by the given dimension.
+//Records of deprovisioned instances are grouped together, as their organization, space and plan are unknown
+func (r *MeteringReport) Aggregate(groupBy string) (*MeteringReport, error) {
+	key := map[string]func(rec *MeteringRecord) string{
+		GroupByInstance:     func(rec *MeteringRecord) string { return rec.InstanceID },
+		GroupByOrganization: func(rec *MeteringRecord) string { return rec.OrganizationGUID },
+		GroupBySpace:        func(rec *MeteringRecord) string { return rec.OrganizationGUID + "/" + rec.SpaceGUID },
+		GroupByPlan:         func(rec *MeteringRecord) string { return rec.PlanID },
+	}[groupBy]
+	if key == nil {
+		return nil, errors.New("Unknown metering group '" + groupBy + "'")
+	}
+
+	if groupBy == r.GroupBy {
+		return r, nil
+	}
+	if r.GroupBy != GroupByInstance {
+		return nil, errors.New("Only reports by instance can be aggregated")
+	}
+
+	groups := map[string]*MeteringRecord{}
+	for i := range r.Records {
+		rec := &r.Records[i]
+		k := key(rec)
+		if rec.Deprovisioned {
+			k = "deprovisioned"
+		}
+
+		g := groups[k]
+		if g == nil {
+			g = &MeteringRecord{Deprovisioned: rec.Deprovisioned}
+			switch groupBy {
+			case GroupByOrganization:
+				g.OrganizationGUID = rec.OrganizationGUID
+			case GroupBySpace:
+				g.OrganizationGUID, g.SpaceGUID = rec.OrganizationGUID, rec.SpaceGUID
+			case GroupByPlan:
+				g.PlanID, g.PlanName = rec.PlanID, rec.PlanName
+			}
+			groups[k] = g
+		}
+
+		g.Instances += rec.Instances
+		g.BytesSent += rec.BytesSent
+		g.BytesReceived += rec.BytesReceived
+		g.Ops += rec.Ops
+		g.SuccessfulOps += rec.SuccessfulOps
+		g.SizeKB += rec.SizeKB
+		g.Objects += rec.Objects
+		if rec.Error != "" && g.Error == "" {
+			g.Error = "Storage of instance '" + rec.InstanceID + "' unavailable: " + rec.Error
+		}
+	}
+
+	return &MeteringReport{Start: r.Start, End: r.End, CreatedAt: r.CreatedAt, GroupBy: groupBy, Records: sortedMeteringRecords(groups)}, nil
+}
+
+//WriteCSV writes the records of the report as CSV with a header line, repeating the window of the report on every line
+func (r *MeteringReport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(meteringCSVHeader); err != nil {
+		return err
+	}
+
+	start, end := r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339)
+	for _, rec := range r.Records {
+		line := []string{start, end, rec.InstanceID, rec.PlanID, rec.PlanName, rec.OrganizationGUID, rec.SpaceGUID,
+			strconv.FormatBool(rec.Deprovisioned), strconv.Itoa(rec.Instances),
+			strconv.FormatInt(rec.BytesSent, 10), strconv.FormatInt(rec.BytesReceived, 10),
+			strconv.FormatInt(rec.Ops, 10), strconv.FormatInt(rec.SuccessfulOps, 10),
+			strconv.FormatInt(rec.SizeKB, 10), strconv.FormatInt(rec.Objects, 10), rec.Error}
+		if err := cw.Write(line); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+//Orders the records by the key they're stored under, so reports are stable
+func sortedMeteringRecords(records map[string]*MeteringRecord) []MeteringRecord {
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	sorted := make([]MeteringRecord, 0, len(keys))
+	for _, k := range keys {
+		sorted = append(sorted, *records[k])
+	}
+	return sorted
+}
+
+//MeteringCollector periodically meters the usage of the last completed period, aligned to the metering interval,
+//so the admin API can serve it without querying the radosgw. Reports for other windows are created on request
+type MeteringCollector struct {
+	broker   *Broker
+	interval time.Duration
+	mutex    sync.RWMutex
+	report   *MeteringReport
+}
+
+func NewMeteringCollector(b *Broker, interval time.Duration) *MeteringCollector {
+	return &MeteringCollector{broker: b, interval: interval}
+}
+
+//Run meters the last completed period right away and then whenever a period completes. It doesn't return
+func (c *MeteringCollector) Run() {
+	for {
+		if err := c.Update(context.Background()); err != nil {
+			c.broker.Logger.Error("failed-to-meter-usage", err)
+		}
+		time.Sleep(time.Until(time.Now().Truncate(c.interval).Add(c.interval)))
+	}
+}
+
+//Update meters the last completed period and replaces the last report
+func (c *MeteringCollector) Update(ctx context.Context) error {
+	end := time.Now().UTC().Truncate(c.interval)
+	report, err := c.broker.Meter(ctx, end.Add(-c.interval), end)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.report = report
+	c.mutex.Unlock()
+	return nil
+}
+
+//Report returns the last metered period, or nil if none was metered yet
+func (c *MeteringCollector) Report() *MeteringReport {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.report
+}
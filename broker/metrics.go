@@ -0,0 +1,54 @@
+package broker
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	instancesDesc     = prometheus.NewDesc("cosb_instances", "Number of service instances in the state store.", nil, nil)
+	instanceLimitDesc = prometheus.NewDesc("cosb_instance_limit", "Maximum number of service instances the broker provisions.", nil, nil)
+	bindingsDesc      = prometheus.NewDesc("cosb_bindings", "Number of bindings in the state store.", nil, nil)
+)
+
+//StateCollector exposes the number of instances and bindings of a broker to Prometheus. They are counted from the state store on each scrape
+type StateCollector struct {
+	broker *Broker
+}
+
+func NewStateCollector(b *Broker) *StateCollector {
+	return &StateCollector{broker: b}
+}
+
+func (c *StateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- instancesDesc
+	ch <- instanceLimitDesc
+	ch <- bindingsDesc
+}
+
+func (c *StateCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(instanceLimitDesc, prometheus.GaugeValue, float64(c.broker.config().InstanceLimit))
+
+	//Collectors aren't passed the context of the scrape
+	ctx := context.Background()
+	instIDs, err := c.broker.Store.ListInstances(ctx)
+	if err != nil {
+		c.broker.Logger.Error("failed-to-collect-metrics", err)
+		ch <- prometheus.NewInvalidMetric(instancesDesc, err)
+		ch <- prometheus.NewInvalidMetric(bindingsDesc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(instancesDesc, prometheus.GaugeValue, float64(len(instIDs)))
+
+	bindings := 0
+	for _, instID := range instIDs {
+		bindIDs, err := c.broker.Store.ListBindings(ctx, instID)
+		if err != nil {
+			c.broker.Logger.Error("failed-to-collect-metrics", err)
+			ch <- prometheus.NewInvalidMetric(bindingsDesc, err)
+			return
+		}
+		bindings += len(bindIDs)
+	}
+	ch <- prometheus.MustNewConstMetric(bindingsDesc, prometheus.GaugeValue, float64(bindings))
+}
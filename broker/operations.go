@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"code.cloudfoundry.org/lager"
+	"context"
+	"errors"
+	"github.com/pivotal-cf/brokerapi"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type OperationType string
+
+const operationTimeout = 15 * time.Minute
+
+const (
+	ProvisionOperation   OperationType = "provision"
+	DeprovisionOperation OperationType = "deprovision"
+)
+
+//Operation is the record of the last asynchronous operation started on an instance
+type Operation struct {
+	ID          string                       `json:"id"`
+	Type        OperationType                `json:"type"`
+	InstanceID  string                       `json:"instanceID"`
+	State       brokerapi.LastOperationState `json:"state"`
+	Description string                       `json:"description"`
+	StartedAt   time.Time                    `json:"startedAt"`
+	UpdatedAt   time.Time                    `json:"updatedAt"`
+}
+
+var ErrOperationInProgress = brokerapi.NewFailureResponseBuilder(
+	errors.New("Another operation for this service instance is in progress"), http.StatusUnprocessableEntity, "concurrency-error",
+).WithErrorKey("ConcurrencyError").Build()
+
+var ErrOperationNotFound = brokerapi.NewFailureResponse(
+	errors.New("No operation matching the given operation data was found for this service instance"), http.StatusBadRequest, "operation-not-found")
+
+//Creates a new in progress operation record for the instance and stores it
+func (b *Broker) startOperation(ctx context.Context, instID string, opType OperationType, description string) (*Operation, error) {
+	now := time.Now().UTC()
+	op := &Operation{
+		ID:          string(opType) + "-" + strconv.FormatInt(now.UnixNano(), 36),
+		Type:        opType,
+		InstanceID:  instID,
+		State:       brokerapi.InProgress,
+		Description: description,
+		StartedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	if err := b.Store.PutOperation(ctx, op); err != nil {
+		return nil, err
+	}
+
+	return op, nil
+}
+
+//Runs the steps of an operation in the background and records the outcome once they are done.
+//The steps outlive the request, so they get its values but not its cancellation, and are limited by the operation timeout.
+//The audit record of the request is written along with the outcome
+func (b *Broker) runOperation(ctx context.Context, op *Operation, steps func(ctx context.Context) error) {
+	ev := b.event
+	ev.Async(op.ID)
+
+	go func() {
+		logger := b.Logger.Session("operation", lager.Data{"instance-id": op.InstanceID, "operation": op.ID})
+
+		opCtx, cancel := context.WithTimeout(detachContext(ctx), operationTimeout)
+		err := steps(opCtx)
+		cancel()
+		if err != nil {
+			logger.Error("operation-failed", err)
+			op.State = brokerapi.Failed
+			op.Description = string(op.Type) + " failed: " + err.Error()
+		} else {
+			logger.Info("operation-succeeded")
+			op.State = brokerapi.Succeeded
+			op.Description = string(op.Type) + " succeeded"
+		}
+
+		op.UpdatedAt = time.Now().UTC()
+		//The outcome is stored even if the operation ran out of time
+		if err := b.Store.PutOperation(detachContext(ctx), op); err != nil {
+			logger.Error("failed-to-store-operation", err)
+		}
+
+		ev.FinishAsync(err)
+	}()
+}
+
+//Returns the last operation of an instance, or nil if no operation was recorded for it
+func (b *Broker) getOperation(ctx context.Context, instID string) (*Operation, error) {
+	op, err := b.Store.GetOperation(ctx, instID)
+	if err == ErrStateNotFound {
+		return nil, nil
+	}
+
+	return op, err
+}
+
+//Returns true if an asynchronous operation is still running on the instance
+func (b *Broker) operationInProgress(ctx context.Context, instID string) bool {
+	op, err := b.getOperation(ctx, instID)
+	return err == nil && op != nil && op.State == brokerapi.InProgress && !op.timedOut()
+}
+
+//Operations still in progress after this long are considered lost, e.g. because the broker was restarted while running them
+func (op *Operation) timedOut() bool {
+	return op.State == brokerapi.InProgress && time.Since(op.UpdatedAt) > operationTimeout
+}
@@ -0,0 +1,265 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/xeipuuv/gojsonschema"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//Highest bucket limit that can be requested, matching the radosgw default
+const maxBucketsLimit = 1000
+
+//InstanceParameters are the parameters accepted when provisioning or updating an instance.
+//Unset parameters are nil, in which case the plan defaults or current values apply
+type InstanceParameters struct {
+	QuotaMB    *int `json:"quota_mb"`
+	MaxObjects *int `json:"max_objects"`
+	MaxBuckets *int `json:"max_buckets"`
+
+	//Only accepted when provisioning
+	Buckets     []string `json:"buckets"`
+	BucketCount *int     `json:"bucket_count"`
+
+	DeletionPolicy *string `json:"deletion_policy"`
+	//Only accepted when provisioning, as instances can't move between clusters
+	Region *string `json:"region"`
+}
+
+//BindParameters are the parameters accepted when binding
+type BindParameters struct {
+	Access  *string     `json:"access"`
+	Buckets []BindScope `json:"buckets"`
+}
+
+//Access modes of a binding, which map onto the permissions of radosgw subusers
+const (
+	AccessRead      = "read"
+	AccessWrite     = "write"
+	AccessReadWrite = "readwrite"
+	AccessFull      = "full"
+)
+
+//Returns the failure response for parameters that don't match the plan's schema
+func newInvalidParametersError(reason string) error {
+	return brokerapi.NewFailureResponse(errors.New("Invalid parameters: "+reason), http.StatusBadRequest, "invalid-parameters")
+}
+
+//Returns the schema of the instance parameters, with the quota limited to the plan's size.
+//The buckets and region of an instance can only be chosen when it is created, the region only if the plan has any
+func instanceParametersSchema(planQuotaMB int, regions []string, create bool) map[string]interface{} {
+	quota := map[string]interface{}{
+		"type":        "integer",
+		"minimum":     1,
+		"description": "Size quota in MB, at most the size of the plan",
+	}
+	if planQuotaMB > 0 {
+		quota["maximum"] = planQuotaMB
+	}
+
+	properties := map[string]interface{}{
+		"quota_mb": quota,
+		"max_objects": map[string]interface{}{
+			"type":        "integer",
+			"minimum":     1,
+			"description": "Maximum number of objects, unlimited if not set",
+		},
+		"max_buckets": map[string]interface{}{
+			"type":        "integer",
+			"minimum":     1,
+			"maximum":     maxBucketsLimit,
+			"description": "Maximum number of buckets/containers",
+		},
+		"deletion_policy": map[string]interface{}{
+			"type":        "string",
+			"enum":        []string{DeletionPolicyDelete, DeletionPolicyProtect},
+			"description": "Whether deprovisioning deletes the instance's buckets with their contents, or is refused while they hold objects",
+		},
+	}
+
+	if create {
+		properties["buckets"] = map[string]interface{}{
+			"type":        "array",
+			"maxItems":    maxBucketsLimit,
+			"uniqueItems": true,
+			"items": map[string]interface{}{
+				"type":    "string",
+				"pattern": "^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$",
+			},
+			"description": "Names of the buckets to create for the instance",
+		}
+		properties["bucket_count"] = map[string]interface{}{
+			"type":        "integer",
+			"minimum":     0,
+			"maximum":     maxBucketsLimit,
+			"description": "Number of buckets with generated names to create for the instance, if no names are given",
+		}
+		if len(regions) > 0 {
+			properties["region"] = map[string]interface{}{
+				"type":        "string",
+				"enum":        regions,
+				"description": "Region of the Ceph cluster the instance is created on, by default " + regions[0],
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"$schema":              "http://json-schema.org/draft-04/schema#",
+		"type":                 "object",
+		"additionalProperties": false,
+		"properties":           properties,
+	}
+}
+
+//Returns the schema of the bind parameters
+func bindParametersSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"$schema":              "http://json-schema.org/draft-04/schema#",
+		"type":                 "object",
+		"additionalProperties": false,
+		"properties": map[string]interface{}{
+			"access": map[string]interface{}{
+				"type":        "string",
+				"enum":        []string{AccessRead, AccessWrite, AccessReadWrite, AccessFull},
+				"description": "Access of the credentials to the instance's data. If not set, the S3 key has the full access of the instance while Swift is limited to readwrite",
+			},
+			"buckets": map[string]interface{}{
+				"type":     "array",
+				"minItems": 1,
+				"items": map[string]interface{}{
+					"type":                 "object",
+					"additionalProperties": false,
+					"required":             []string{"bucket"},
+					"properties": map[string]interface{}{
+						"bucket": map[string]interface{}{"type": "string", "minLength": 1},
+						"prefix": map[string]interface{}{"type": "string"},
+					},
+				},
+				"description": "Buckets, optionally limited to a key prefix, the credentials are limited to. Scoped credentials are for S3 only",
+			},
+		},
+	}
+}
+
+//Returns the parameter schemas of a plan. Plans without schemas in the service config get the default instance parameter schema
+func (b *Broker) getPlanSchemas(plan brokerapi.ServicePlan) *brokerapi.ServiceSchemas {
+	if plan.Schemas != nil {
+		return plan.Schemas
+	}
+
+	quota, err := b.getPlanQuota(plan.ID)
+	if err != nil {
+		quota = 0
+	}
+	regions := b.getPlanRegions(plan.ID)
+
+	return &brokerapi.ServiceSchemas{
+		Instance: brokerapi.ServiceInstanceSchema{
+			Create: brokerapi.Schema{Parameters: instanceParametersSchema(quota, regions, true)},
+			Update: brokerapi.Schema{Parameters: instanceParametersSchema(quota, regions, false)},
+		},
+		Binding: brokerapi.ServiceBindingSchema{
+			Create: brokerapi.Schema{Parameters: bindParametersSchema()},
+		},
+	}
+}
+
+//Returns the service config with the parameter schemas of each plan filled in
+func (b *Broker) catalog() []brokerapi.Service {
+	config := b.config().Services
+	services := make([]brokerapi.Service, len(config))
+	for i, s := range config {
+		plans := make([]brokerapi.ServicePlan, len(s.Plans))
+		for j, p := range s.Plans {
+			p.Schemas = b.getPlanSchemas(p)
+			plans[j] = p
+		}
+
+		s.Plans = plans
+		services[i] = s
+	}
+
+	return services
+}
+
+//Validates the raw instance parameters against the create or update schema of the plan and parses them
+func (b *Broker) parseInstanceParameters(planID string, raw json.RawMessage, update bool) (*InstanceParameters, error) {
+	params := &InstanceParameters{}
+	if len(raw) == 0 {
+		return params, nil
+	}
+
+	plan, err := b.getPlan(planID)
+	if err != nil {
+		return nil, err
+	}
+
+	schemas := b.getPlanSchemas(*plan)
+	schema := schemas.Instance.Create.Parameters
+	if update {
+		schema = schemas.Instance.Update.Parameters
+	}
+
+	if err := validateParameters(schema, raw); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(raw, params); err != nil {
+		return nil, newInvalidParametersError(err.Error())
+	}
+
+	//Plans with schemas of their own may not limit the quota, so it is checked here as well
+	if planQuota, err := b.getPlanQuota(planID); err == nil && planQuota > 0 && params.QuotaMB != nil && *params.QuotaMB > planQuota {
+		return nil, newInvalidParametersError("quota_mb is larger than the plan's quota of " + strconv.Itoa(planQuota) + " MB")
+	}
+
+	return params, nil
+}
+
+//Validates the raw bind parameters against the binding schema of the plan and parses them
+func (b *Broker) parseBindParameters(planID string, raw json.RawMessage) (*BindParameters, error) {
+	params := &BindParameters{}
+	if len(raw) == 0 {
+		return params, nil
+	}
+
+	plan, err := b.getPlan(planID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateParameters(b.getPlanSchemas(*plan).Binding.Create.Parameters, raw); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(raw, params); err != nil {
+		return nil, newInvalidParametersError(err.Error())
+	}
+
+	return params, nil
+}
+
+//Validates raw parameters against a JSON schema. An empty schema accepts any parameters
+func validateParameters(schema map[string]interface{}, raw json.RawMessage) error {
+	if len(schema) == 0 {
+		return nil
+	}
+
+	result, err := gojsonschema.Validate(gojsonschema.NewGoLoader(schema), gojsonschema.NewBytesLoader(raw))
+	if err != nil {
+		return newInvalidParametersError(err.Error())
+	}
+
+	if !result.Valid() {
+		reasons := []string{}
+		for _, e := range result.Errors() {
+			reasons = append(reasons, e.String())
+		}
+		return newInvalidParametersError(strings.Join(reasons, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package broker
+
+import (
+	"context"
+	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
+	"github.com/icclab/ceph-objectstore-broker/radosgw"
+)
+
+//Returns the placement target and default storage class of new instances of the plan on the backend of the broker. Plans
+//without a placement of their own use the one of the backend
+func (b *Broker) getPlanPlacement(planID string) (string, string) {
+	placement, storageClass := b.getBackend().Placement, ""
+	if s, err := b.getPlanSettings(planID); err == nil {
+		if s.Placement != "" {
+			placement = s.Placement
+		}
+		storageClass = s.StorageClass
+	}
+	return placement, storageClass
+}
+
+//Returns the placement target and default storage class of the instance, which is on the backend of the broker
+func (b *Broker) getInstancePlacement(inst *Instance) (string, string) {
+	if inst.Placement == "" {
+		return b.getBackend().Placement, inst.StorageClass
+	}
+	return inst.Placement, inst.StorageClass
+}
+
+//ValidatePlacements checks that the placement targets and storage classes the plans use on each backend are defined in the
+//zonegroups of its radosgw. Clusters no plan sets a placement on aren't asked. All problems are returned as a
+//*brokerConfig.ValidationError
+func (b *Broker) ValidatePlacements(ctx context.Context) error {
+	type use struct {
+		plan         string
+		placement    string
+		storageClass string
+	}
+
+	problems := []string{}
+	for _, backends := range b.getClusters() {
+		uses := []use{}
+		for _, name := range backends {
+			bb, err := b.onBackend(name)
+			if err != nil {
+				return err
+			}
+
+			for _, s := range b.config().Services {
+				for _, p := range s.Plans {
+					if !bb.planOffersBackend(s.ID, p.ID, name) {
+						continue
+					}
+
+					placement, storageClass := bb.getPlanPlacement(p.ID)
+					if placement == "" {
+						continue
+					}
+					if storageClass == "" {
+						storageClass = radosgw.StandardStorageClass
+					}
+					uses = append(uses, use{"Plan '" + p.Name + "' of service '" + s.Name + "' on backend '" + name + "'", placement, storageClass})
+				}
+			}
+		}
+		if len(uses) == 0 {
+			continue
+		}
+
+		cb, err := b.onBackend(backends[0])
+		if err != nil {
+			return err
+		}
+		targets, err := cb.Rados.GetPlacementTargets(ctx)
+		if err != nil {
+			return &brokerConfig.ValidationError{Problems: []string{"Failed to read the placement targets of backend '" + backends[0] +
+				"', which needs the 'zone=read' capability. " + err.Error()}}
+		}
+
+		for _, u := range uses {
+			classes, ok := targets[u.placement]
+			if !ok {
+				problems = append(problems, u.plan+" uses the placement target '"+u.placement+"', which is not in the zonegroups of its radosgw")
+				continue
+			}
+
+			found := false
+			for _, c := range classes {
+				found = found || c == u.storageClass
+			}
+			if !found {
+				problems = append(problems, u.plan+" uses the storage class '"+u.storageClass+"', which the placement target '"+
+					u.placement+"' doesn't have")
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return &brokerConfig.ValidationError{Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package broker
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/icclab/ceph-objectstore-broker/s3"
+	"strconv"
+	"strings"
+)
+
+//BindScope is a bucket, and optionally a key prefix within it, that a scoped binding may access
+type BindScope struct {
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+//PolicyStatement is a statement of an S3 bucket policy
+type PolicyStatement struct {
+	Sid       string                            `json:"Sid"`
+	Effect    string                            `json:"Effect"`
+	Principal map[string][]string               `json:"Principal"`
+	Action    []string                          `json:"Action"`
+	Resource  []string                          `json:"Resource"`
+	Condition map[string]map[string]interface{} `json:"Condition,omitempty"`
+}
+
+//Bucket policy document. Statements are kept raw so those not added by the broker are written back unchanged
+type bucketPolicy struct {
+	Version   string            `json:"Version"`
+	Statement []json.RawMessage `json:"Statement"`
+}
+
+//Policies may hold a single statement instead of a list of them
+func (p *bucketPolicy) UnmarshalJSON(data []byte) error {
+	doc := struct {
+		Version   string          `json:"Version"`
+		Statement json.RawMessage `json:"Statement"`
+	}{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	if doc.Version != "" {
+		p.Version = doc.Version
+	}
+	p.Statement = nil
+	st := strings.TrimSpace(string(doc.Statement))
+	if st == "" || st == "null" {
+		return nil
+	}
+	if strings.HasPrefix(st, "{") {
+		p.Statement = []json.RawMessage{doc.Statement}
+		return nil
+	}
+
+	return json.Unmarshal(doc.Statement, &p.Statement)
+}
+
+//Returns the object actions granted for an access mode
+func getObjectActions(access string) []string {
+	read := []string{"s3:GetObject"}
+	write := []string{"s3:PutObject", "s3:DeleteObject", "s3:AbortMultipartUpload", "s3:ListMultipartUploadParts"}
+
+	switch access {
+	case AccessRead:
+		return read
+	case AccessWrite:
+		return write
+	case AccessFull:
+		return []string{"s3:*"}
+	}
+
+	return append(read, write...)
+}
+
+//Creates the statements granting a radosgw user the access to the scopes, grouped by bucket.
+//The statement IDs are derived from the binding ID so they can be found again when unbinding
+func newScopeStatements(bindingID string, tenant string, user string, access string, scopes []BindScope) map[string][]PolicyStatement {
+	principal := map[string][]string{"AWS": {"arn:aws:iam::" + tenant + ":user/" + user}}
+	//Statement IDs may only be alphanumeric, so the binding ID is hex encoded
+	sidPrefix := "cosb" + hex.EncodeToString([]byte(bindingID))
+
+	statements := map[string][]PolicyStatement{}
+	for i, sc := range scopes {
+		sid := sidPrefix + "s" + strconv.Itoa(i)
+		bucketArn := "arn:aws:s3:::" + sc.Bucket
+
+		//Listing is granted on the bucket, limited to the prefix through a condition
+		if access != AccessWrite {
+			list := PolicyStatement{
+				Sid:       sid + "list",
+				Effect:    "Allow",
+				Principal: principal,
+				Action:    []string{"s3:ListBucket"},
+				Resource:  []string{bucketArn},
+			}
+			if sc.Prefix != "" {
+				list.Condition = map[string]map[string]interface{}{"StringLike": {"s3:prefix": sc.Prefix + "*"}}
+			}
+			statements[sc.Bucket] = append(statements[sc.Bucket], list)
+		}
+
+		statements[sc.Bucket] = append(statements[sc.Bucket], PolicyStatement{
+			Sid:       sid + "objects",
+			Effect:    "Allow",
+			Principal: principal,
+			Action:    getObjectActions(access),
+			Resource:  []string{bucketArn + "/" + sc.Prefix + "*"},
+		})
+	}
+
+	return statements
+}
+
+//Adds the statements to the policy of the bucket, keeping any statements already in it
+func addPolicyStatements(ctx context.Context, s *s3.S3, bucket string, statements []PolicyStatement) error {
+	policy, err := getBucketPolicy(ctx, s, bucket)
+	if err != nil {
+		return err
+	}
+
+	for _, st := range statements {
+		raw, err := json.Marshal(st)
+		if err != nil {
+			return err
+		}
+		policy.Statement = append(policy.Statement, raw)
+	}
+
+	return setBucketPolicy(ctx, s, bucket, policy)
+}
+
+//Removes the statements with the given IDs from the policy of the bucket, removing the policy entirely if nothing is left in it
+func removePolicyStatements(ctx context.Context, s *s3.S3, bucket string, statements []PolicyStatement) error {
+	policy, err := getBucketPolicy(ctx, s, bucket)
+	if err != nil {
+		return err
+	}
+
+	remove := map[string]bool{}
+	for _, st := range statements {
+		remove[st.Sid] = true
+	}
+
+	kept := []json.RawMessage{}
+	for _, raw := range policy.Statement {
+		st := struct {
+			Sid string `json:"Sid"`
+		}{}
+		if err := json.Unmarshal(raw, &st); err == nil && remove[st.Sid] {
+			continue
+		}
+		kept = append(kept, raw)
+	}
+	policy.Statement = kept
+
+	return setBucketPolicy(ctx, s, bucket, policy)
+}
+
+func getBucketPolicy(ctx context.Context, s *s3.S3, bucket string) (*bucketPolicy, error) {
+	j, err := s.GetBucketPolicy(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &bucketPolicy{Version: "2012-10-17"}
+	if j == "" {
+		return policy, nil
+	}
+
+	if err := json.Unmarshal([]byte(j), policy); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+func setBucketPolicy(ctx context.Context, s *s3.S3, bucket string, policy *bucketPolicy) error {
+	if len(policy.Statement) == 0 {
+		return s.SetBucketPolicy(ctx, bucket, "")
+	}
+
+	j, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+
+	return s.SetBucketPolicy(ctx, bucket, string(j))
+}
@@ -0,0 +1,373 @@
+package broker
+
+import (
+	"code.cloudfoundry.org/lager"
+	"context"
+	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
+	"github.com/icclab/ceph-objectstore-broker/radosgw"
+	rgw "github.com/myENA/radosgwadmin"
+	"sort"
+	"strings"
+	"time"
+)
+
+//Kinds of discrepancies between the radosgw and the state of the broker
+const (
+	//A user created by the broker for an instance or scoped binding that no longer exists
+	OrphanedUser = "orphaned-user"
+	//A subuser of a broker user not referenced by any binding
+	OrphanedSubuser = "orphaned-subuser"
+	//An S3 key of a broker user not referenced by any binding
+	OrphanedS3Key = "orphaned-s3-key"
+	//The user of a stored instance or scoped binding does not exist. Only reported
+	MissingUser = "missing-user"
+	//The S3 key of a stored binding does not exist. Only reported
+	MissingCredentials = "missing-credentials"
+)
+
+//Users modified more recently than this are left alone by default, as they may belong to a provision or bind that is still running
+const DefaultOrphanMinAge = time.Hour
+
+//Discrepancy is something found on the radosgw that doesn't match the state of the broker
+type Discrepancy struct {
+	Kind string `json:"kind"`
+	//Backend of the Ceph cluster the user is on, if it's not the cluster of the default backend
+	Backend    string `json:"backend,omitempty"`
+	User       string `json:"user"`
+	Tenant     string `json:"tenant"`
+	Subuser    string `json:"subuser,omitempty"`
+	AccessKey  string `json:"accessKey,omitempty"`
+	InstanceID string `json:"instanceID,omitempty"`
+	BindingID  string `json:"bindingID,omitempty"`
+	Removed    bool   `json:"removed,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+//ReconcileReport lists the discrepancies found by a reconciliation, and whether the orphans were removed
+type ReconcileReport struct {
+	DryRun        bool          `json:"dryRun"`
+	StartedAt     time.Time     `json:"startedAt"`
+	UsersChecked  int           `json:"usersChecked"`
+	Skipped       []string      `json:"skipped,omitempty"`
+	Discrepancies []Discrepancy `json:"discrepancies"`
+}
+
+//The keys and subusers a broker user should have according to the stored instances and bindings
+type ownedUser struct {
+	instID string
+	//Backend of the instance, which is where the user is
+	backend string
+	//Empty for instance users
+	bindID   string
+	keys     map[string]string
+	subusers map[string]string
+}
+
+//Reconcile compares the users on the radosgw of each Ceph cluster, along with their keys and subusers, against the stored instances
+//and bindings on the cluster. Users, keys and subusers the broker created but no longer references are orphans, which are removed
+//unless dryRun is set. Users modified less than minAge ago are skipped. Only users in a tenant are considered, so the broker's own
+//user is never touched
+func (b *Broker) Reconcile(ctx context.Context, dryRun bool, minAge time.Duration) (*ReconcileReport, error) {
+	report := &ReconcileReport{DryRun: dryRun, StartedAt: time.Now().UTC(), Discrepancies: []Discrepancy{}}
+	logger := b.Logger.Session("reconcile", lager.Data{"dry-run": dryRun})
+
+	owned, tenants, pending, err := b.getOwnedUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, backends := range b.getClusters() {
+		cb, err := b.onBackend(backends[0])
+		if err != nil {
+			return nil, err
+		}
+
+		co, ct := clusterUsers(owned, tenants, backends)
+		found, err := cb.reconcileCluster(ctx, report, co, ct, pending, minAge)
+		if err != nil {
+			return nil, err
+		}
+		if backends[0] != brokerConfig.DefaultBackend {
+			for i := range found {
+				found[i].Backend = backends[0]
+			}
+		}
+
+		if !dryRun {
+			for i := range found {
+				cb.removeOrphan(ctx, &found[i])
+			}
+		}
+		report.Discrepancies = append(report.Discrepancies, found...)
+	}
+
+	logger.Info("finished", lager.Data{"users-checked": report.UsersChecked, "discrepancies": len(report.Discrepancies)})
+	return report, nil
+}
+
+//Returns the names of the backends of each Ceph cluster, which are the backends sharing a radosgw endpoint. The cluster of the
+//default backend comes first, and the default backend first within it
+func (b *Broker) getClusters() [][]string {
+	clusters := [][]string{}
+	byEndpoint := map[string]int{}
+	for _, name := range b.config().BackendNames() {
+		backend, _ := b.config().Backend(name)
+		i, ok := byEndpoint[backend.RadosEndpoint]
+		if !ok {
+			i = len(clusters)
+			byEndpoint[backend.RadosEndpoint] = i
+			clusters = append(clusters, []string{})
+		}
+		clusters[i] = append(clusters[i], name)
+	}
+	return clusters
+}
+
+//Returns the owned users and instance tenants of the instances on the backends
+func clusterUsers(owned map[string]*ownedUser, tenants map[string]string, backends []string) (map[string]*ownedUser, map[string]string) {
+	onCluster := map[string]bool{}
+	for _, name := range backends {
+		onCluster[name] = true
+	}
+
+	co := map[string]*ownedUser{}
+	instances := map[string]bool{}
+	for id, ou := range owned {
+		if onCluster[ou.backend] {
+			co[id] = ou
+			instances[ou.instID] = true
+		}
+	}
+
+	ct := map[string]string{}
+	for tenant, instID := range tenants {
+		if instances[instID] {
+			ct[tenant] = instID
+		}
+	}
+	return co, ct
+}
+
+//Returns the discrepancies between the users on the radosgw of the broker and the owned users, counting the users checked in the report
+func (b *Broker) reconcileCluster(ctx context.Context, report *ReconcileReport, owned map[string]*ownedUser, tenants map[string]string,
+	pending map[string]bool, minAge time.Duration) ([]Discrepancy, error) {
+	found := []Discrepancy{}
+	ids, err := b.Rados.ListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+
+	//Instance users of deleted instances are recognised by their tenant, which is derived from their name.
+	//Any other user in their tenant belonged to a scoped binding of the instance
+	orphanTenants := map[string]bool{}
+	for _, id := range ids {
+		name, tenant := radosgw.SplitUserID(id)
+		if tenant != "" && owned[id] == nil && tenants[tenant] == "" && tenant == createTenantID(name) {
+			orphanTenants[tenant] = true
+		}
+	}
+
+	existing := map[string]bool{}
+	for _, id := range ids {
+		existing[id] = true
+		name, tenant := radosgw.SplitUserID(id)
+		if tenant == "" {
+			continue
+		}
+		ou := owned[id]
+		if ou == nil && tenants[tenant] == "" && !orphanTenants[tenant] {
+			continue
+		}
+		report.UsersChecked++
+
+		meta, err := b.Rados.GetUserMetadata(ctx, name, tenant)
+		if radosgw.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if ou == nil {
+			if time.Since(time.Time(meta.Mtime)) < minAge {
+				report.Skipped = append(report.Skipped, id)
+				continue
+			}
+			found = append(found, Discrepancy{Kind: OrphanedUser, User: name, Tenant: tenant, InstanceID: tenants[tenant]})
+			continue
+		}
+
+		missing := findMissingCredentials(ou, meta, name, tenant)
+		found = append(found, missing...)
+
+		if pending[ou.instID] || time.Since(time.Time(meta.Mtime)) < minAge {
+			report.Skipped = append(report.Skipped, id)
+			continue
+		}
+		found = append(found, findOrphanedCredentials(ou, meta, name, tenant)...)
+	}
+
+	//Users of instances still being provisioned may not exist yet
+	ownedIDs := []string{}
+	for id := range owned {
+		ownedIDs = append(ownedIDs, id)
+	}
+	sort.Strings(ownedIDs)
+	for _, id := range ownedIDs {
+		if ou := owned[id]; !existing[id] && !pending[ou.instID] {
+			name, tenant := radosgw.SplitUserID(id)
+			found = append(found, Discrepancy{Kind: MissingUser, User: name, Tenant: tenant,
+				InstanceID: ou.instID, BindingID: ou.bindID})
+		}
+	}
+
+	return found, nil
+}
+
+//Returns the users the stored instances and bindings reference by their radosgw user ID, the instance ID of each instance tenant,
+//and the instances with an operation in progress
+func (b *Broker) getOwnedUsers(ctx context.Context) (map[string]*ownedUser, map[string]string, map[string]bool, error) {
+	owned := map[string]*ownedUser{}
+	tenants := map[string]string{}
+	pending := map[string]bool{}
+
+	instIDs, err := b.Store.ListInstances(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for _, instID := range instIDs {
+		inst, err := b.getInstance(ctx, instID)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		backend := inst.Backend
+		if backend == "" {
+			backend = brokerConfig.DefaultBackend
+		}
+		owned[radosgw.UserID(inst.User, inst.Tenant)] = &ownedUser{instID: instID, backend: backend, keys: map[string]string{},
+			subusers: map[string]string{}}
+		tenants[inst.Tenant] = instID
+		pending[instID] = b.operationInProgress(ctx, instID)
+
+		bindIDs, err := b.Store.ListBindings(ctx, instID)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		for _, bindID := range bindIDs {
+			bind, err := b.Store.GetBinding(ctx, instID, bindID)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+
+			id := radosgw.UserID(bind.User, bind.Tenant)
+			ou := owned[id]
+			if ou == nil {
+				ou = &ownedUser{instID: instID, bindID: bindID, backend: backend, keys: map[string]string{}, subusers: map[string]string{}}
+				owned[id] = ou
+			}
+
+			ou.keys[bind.S3AccessKey] = bindID
+			if bind.Subuser != "" {
+				ou.subusers[bind.Subuser] = bindID
+			}
+			for _, r := range bind.Retired {
+				ou.keys[r.S3AccessKey] = bindID
+				if r.Subuser != "" {
+					ou.subusers[r.Subuser] = bindID
+				}
+			}
+		}
+	}
+
+	return owned, tenants, pending, nil
+}
+
+//Returns the S3 keys referenced by bindings that the user doesn't have
+func findMissingCredentials(ou *ownedUser, meta *rgw.MUserResponse, name string, tenant string) []Discrepancy {
+	keys := map[string]bool{}
+	for _, k := range meta.Data.Keys {
+		keys[k.AccessKey] = true
+	}
+
+	referenced := []string{}
+	for key := range ou.keys {
+		referenced = append(referenced, key)
+	}
+	sort.Strings(referenced)
+
+	found := []Discrepancy{}
+	for _, key := range referenced {
+		if !keys[key] {
+			found = append(found, Discrepancy{Kind: MissingCredentials, User: name, Tenant: tenant, AccessKey: key,
+				InstanceID: ou.instID, BindingID: ou.keys[key]})
+		}
+	}
+
+	return found
+}
+
+//Returns the subusers and S3 keys of the user that no binding references.
+//The S3 key the broker uses to manage the buckets of an instance is kept
+func findOrphanedCredentials(ou *ownedUser, meta *rgw.MUserResponse, name string, tenant string) []Discrepancy {
+	id := radosgw.UserID(name, tenant)
+	found := []Discrepancy{}
+
+	orphanSubusers := map[string]bool{}
+	for _, su := range meta.Data.SubUsers {
+		subuser := strings.TrimPrefix(su.ID, id+":")
+		if ou.subusers[subuser] == "" {
+			orphanSubusers[subuser] = true
+			found = append(found, Discrepancy{Kind: OrphanedSubuser, User: name, Tenant: tenant, Subuser: subuser, InstanceID: ou.instID})
+		}
+	}
+
+	var ownKey *rgw.UserKey
+	if ou.bindID == "" {
+		ownKey = getOwnS3Key(meta.Data.Keys, name, tenant)
+	}
+	for _, k := range meta.Data.Keys {
+		if ou.keys[k.AccessKey] != "" || (ownKey != nil && k.AccessKey == ownKey.AccessKey) {
+			continue
+		}
+
+		//Keys of orphaned subusers are removed along with them
+		subuser := strings.TrimPrefix(k.User, id+":")
+		if k.User != id && orphanSubusers[subuser] {
+			continue
+		}
+
+		d := Discrepancy{Kind: OrphanedS3Key, User: name, Tenant: tenant, AccessKey: k.AccessKey, InstanceID: ou.instID, BindingID: ou.bindID}
+		if k.User != id {
+			d.Subuser = subuser
+		}
+		found = append(found, d)
+	}
+
+	return found
+}
+
+//Removes an orphan, recording the outcome in the discrepancy. Missing resources are left as they are
+func (b *Broker) removeOrphan(ctx context.Context, d *Discrepancy) {
+	var err error
+	switch d.Kind {
+	case OrphanedUser:
+		err = b.Rados.DeleteUser(ctx, d.User, d.Tenant)
+	case OrphanedSubuser:
+		err = b.Rados.DeleteSubuser(ctx, d.User, d.Subuser, d.Tenant)
+	case OrphanedS3Key:
+		err = b.Rados.DeleteS3Key(ctx, d.User, d.Tenant, d.AccessKey)
+	default:
+		return
+	}
+
+	if err != nil && !radosgw.IsNotFound(err) {
+		b.Logger.Error("failed-to-remove-orphan", err, lager.Data{"kind": d.Kind, "user": d.User, "tenant": d.Tenant})
+		d.Error = err.Error()
+		return
+	}
+
+	b.Logger.Info("removed-orphan", lager.Data{"kind": d.Kind, "user": d.User, "tenant": d.Tenant, "subuser": d.Subuser})
+	d.Removed = true
+}
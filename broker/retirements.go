@@ -0,0 +1,114 @@
+package broker
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+//RetirementIndex holds when the earliest retired credentials of each binding with any are due for deletion, so they can
+//be deleted without listing the state store. Like the InstanceCounter it only covers the rotations of one broker process,
+//and is rebuilt from the state store on startup
+type RetirementIndex struct {
+	mutex   sync.Mutex
+	pending map[retiringBinding]time.Time
+}
+
+type retiringBinding struct {
+	instID string
+	bindID string
+}
+
+func NewRetirementIndex() *RetirementIndex {
+	return &RetirementIndex{pending: map[retiringBinding]time.Time{}}
+}
+
+//Rebuild replaces the index with the retired credentials of the bindings in the store
+func (r *RetirementIndex) Rebuild(ctx context.Context, store StateStore) error {
+	instIDs, err := store.ListInstances(ctx)
+	if err != nil {
+		return err
+	}
+
+	pending := map[retiringBinding]time.Time{}
+	for _, instID := range instIDs {
+		bindIDs, err := store.ListBindings(ctx, instID)
+		if err != nil {
+			return err
+		}
+
+		for _, bindID := range bindIDs {
+			bind, err := store.GetBinding(ctx, instID, bindID)
+			if err == ErrStateNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			if deleteAt, ok := nextDeletion(bind.Retired); ok {
+				pending[retiringBinding{instID, bindID}] = deleteAt
+			}
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.pending = pending
+	return nil
+}
+
+//Len returns the number of bindings with retired credentials
+func (r *RetirementIndex) Len() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.pending)
+}
+
+//Set records the retired credentials the binding has left. A binding without any is removed from the index
+func (r *RetirementIndex) Set(instID string, bindID string, retired []RetiredCredentials) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if deleteAt, ok := nextDeletion(retired); ok {
+		r.pending[retiringBinding{instID, bindID}] = deleteAt
+	} else {
+		delete(r.pending, retiringBinding{instID, bindID})
+	}
+}
+
+//Returns the bindings with retired credentials due for deletion at the time by instance, in the order of the instance IDs
+func (r *RetirementIndex) due(now time.Time) ([]string, map[string][]string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	bindIDs := map[string][]string{}
+	for rb, deleteAt := range r.pending {
+		if !now.Before(deleteAt) {
+			bindIDs[rb.instID] = append(bindIDs[rb.instID], rb.bindID)
+		}
+	}
+
+	instIDs := []string{}
+	for instID := range bindIDs {
+		instIDs = append(instIDs, instID)
+		sort.Strings(bindIDs[instID])
+	}
+	sort.Strings(instIDs)
+	return instIDs, bindIDs
+}
+
+//Returns when the earliest of the retired credentials are due for deletion, if there are any
+func nextDeletion(retired []RetiredCredentials) (time.Time, bool) {
+	if len(retired) == 0 {
+		return time.Time{}, false
+	}
+
+	next := retired[0].DeleteAt
+	for _, r := range retired[1:] {
+		if r.DeleteAt.Before(next) {
+			next = r.DeleteAt
+		}
+	}
+	return next, true
+}
@@ -0,0 +1,44 @@
+package broker
+
+import (
+	"code.cloudfoundry.org/lager"
+	"context"
+)
+
+//rollback collects the compensating actions of a multi-step operation, so the completed steps can be undone if a later one fails
+type rollback struct {
+	ctx    context.Context
+	logger lager.Logger
+	steps  []rollbackStep
+}
+
+type rollbackStep struct {
+	name string
+	undo func(ctx context.Context) error
+}
+
+//The compensating actions get a context with the values of the operation's context that is never cancelled,
+//as a cancelled request is exactly when its completed steps have to be undone
+func (b *Broker) newRollback(ctx context.Context, action string, data lager.Data) *rollback {
+	return &rollback{ctx: detachContext(ctx), logger: b.Logger.Session(action+"-rollback", data)}
+}
+
+//Registers the compensating action of a step that just completed
+func (r *rollback) add(name string, undo func(ctx context.Context) error) {
+	r.steps = append(r.steps, rollbackStep{name: name, undo: undo})
+}
+
+//Undoes the completed steps in reverse order. All compensating actions are attempted, and those that fail are logged
+//so what was left behind on the radosgw can be cleaned up later
+func (r *rollback) run() {
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+		if err := step.undo(r.ctx); err != nil {
+			r.logger.Error("cleanup-failed", err, lager.Data{"step": step.name})
+			continue
+		}
+		r.logger.Info("cleaned-up", lager.Data{"step": step.name})
+	}
+
+	r.steps = nil
+}
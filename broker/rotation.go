@@ -0,0 +1,185 @@
+package broker
+
+import (
+	"code.cloudfoundry.org/lager"
+	"context"
+	"errors"
+	"github.com/icclab/ceph-objectstore-broker/audit"
+	"github.com/icclab/ceph-objectstore-broker/radosgw"
+	"github.com/pivotal-cf/brokerapi"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//RetiredCredentials are credentials of a binding replaced by a rotation, which stay valid until DeleteAt
+type RetiredCredentials struct {
+	S3AccessKey string    `json:"s3AccessKey"`
+	Subuser     string    `json:"subuser,omitempty"`
+	DeleteAt    time.Time `json:"deleteAt"`
+}
+
+//RotateBindingCredentials replaces the S3 and Swift keys of a binding. The old keys keep working for the grace period,
+//so apps can be restaged with the new credentials without downtime.
+//Swift only allows one key per subuser, so bindings with Swift credentials get a new subuser
+func (b *Broker) RotateBindingCredentials(ctx context.Context, instID string, bindID string, grace time.Duration) (*BindCreds, error) {
+	defer b.Locks.Lock(instID)()
+
+	if exists, err := b.instanceExists(ctx, instID); err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	if b.operationInProgress(ctx, instID) {
+		return nil, ErrOperationInProgress
+	}
+
+	inst, err := b.getInstance(ctx, instID)
+	if err != nil {
+		return nil, err
+	}
+
+	if b, err = b.forInstance(inst); err != nil {
+		return nil, err
+	}
+
+	bind, err := b.Store.GetBinding(ctx, instID, bindID)
+	if err == ErrStateNotFound {
+		return nil, brokerapi.ErrBindingDoesNotExist
+	} else if err != nil {
+		return nil, err
+	}
+
+	rb := b.newRollback(ctx, "rotate-credentials", lager.Data{"instance-id": instID, "binding-id": bindID})
+	retired := RetiredCredentials{S3AccessKey: bind.S3AccessKey, DeleteAt: time.Now().UTC().Add(grace)}
+	if len(bind.Scopes) > 0 {
+		k, err := b.Rados.CreateS3Key(ctx, bind.User, bind.Tenant)
+		if err != nil {
+			return nil, err
+		}
+		rb.add("delete-s3-key", func(ctx context.Context) error { return b.Rados.DeleteS3Key(ctx, bind.User, bind.Tenant, k.AccessKey) })
+		bind.S3AccessKey = k.AccessKey
+	} else {
+		bind.Rotations++
+		newBind, err := b.createBind(ctx, inst, bindID+"-r"+strconv.Itoa(bind.Rotations), bind.Access, rb)
+		if err != nil {
+			rb.run()
+			return nil, err
+		}
+
+		retired.Subuser = bind.Subuser
+		bind.Subuser = newBind.Subuser
+		bind.S3AccessKey = newBind.S3AccessKey
+	}
+	bind.Retired = append(bind.Retired, retired)
+
+	creds, err := b.getBindCreds(ctx, inst, bind)
+	if err != nil {
+		rb.run()
+		return nil, err
+	}
+	bind.SwiftKey = creds.SwiftSecretKey
+
+	if err := b.Store.PutBinding(ctx, instID, bindID, bind); err != nil {
+		rb.run()
+		return nil, err
+	}
+	b.Retirements.Set(instID, bindID, bind.Retired)
+
+	b.Logger.Info("rotated-binding-credentials", lager.Data{"instance-id": instID, "binding-id": bindID, "delete-old-at": retired.DeleteAt})
+	return creds, nil
+}
+
+//DeleteRetiredCredentials deletes the rotated out credentials of all bindings whose grace period is over. Only the
+//bindings the retirement index has due are read, so nothing is read from the store while no credentials are due.
+//An instance failing doesn't stop the others. Its bindings stay in the index, so the next sweep retries them
+func (b *Broker) DeleteRetiredCredentials(ctx context.Context) error {
+	now := time.Now().UTC()
+	instIDs, bindIDs := b.Retirements.due(now)
+	failed := []string{}
+	for _, instID := range instIDs {
+		ab, ev := b.StartAudit(ctx, audit.DeleteRetiredCredentials, instID, "", "")
+		err := ab.deleteExpiredCredentials(ctx, instID, bindIDs[instID], now)
+		ev.Finish(err)
+		if err != nil {
+			b.Logger.Error("delete-retired-credentials-failed", err, lager.Data{"instance-id": instID, "binding-ids": bindIDs[instID]})
+			failed = append(failed, instID+": "+err.Error())
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.New("Failed to delete the retired credentials of " + strconv.Itoa(len(failed)) + " of " + strconv.Itoa(len(instIDs)) +
+			" instances. " + strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+//Deletes the credentials of the instance's bindings whose grace period is over, holding the instance lock
+//so bindings aren't rotated or unbound at the same time. Bindings and instances that are gone are removed from the index
+func (b *Broker) deleteExpiredCredentials(ctx context.Context, instID string, bindIDs []string, now time.Time) error {
+	defer b.Locks.Lock(instID)()
+
+	inst, err := b.getInstance(ctx, instID)
+	if err == ErrStateNotFound {
+		for _, bindID := range bindIDs {
+			b.Retirements.Set(instID, bindID, nil)
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if b, err = b.forInstance(inst); err != nil {
+		return err
+	}
+
+	for _, bindID := range bindIDs {
+		bind, err := b.Store.GetBinding(ctx, instID, bindID)
+		if err == ErrStateNotFound {
+			b.Retirements.Set(instID, bindID, nil)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		kept := []RetiredCredentials{}
+		for _, r := range bind.Retired {
+			if now.Before(r.DeleteAt) {
+				kept = append(kept, r)
+				continue
+			}
+
+			if err := b.deleteRetiredCredentials(ctx, bind, r); err != nil {
+				return err
+			}
+		}
+
+		if len(kept) != len(bind.Retired) {
+			bind.Retired = kept
+			if err := b.Store.PutBinding(ctx, instID, bindID, bind); err != nil {
+				return err
+			}
+		}
+		b.Retirements.Set(instID, bindID, kept)
+	}
+
+	return nil
+}
+
+//Deletes rotated out credentials. Credentials that are already gone are not an error
+func (b *Broker) deleteRetiredCredentials(ctx context.Context, bind *Bind, r RetiredCredentials) error {
+	if err := b.Rados.DeleteS3Key(ctx, bind.User, bind.Tenant, r.S3AccessKey); err != nil && !radosgw.IsNotFound(err) {
+		return err
+	}
+
+	if r.Subuser == "" {
+		return nil
+	}
+
+	if err := b.Rados.DeleteSubuser(ctx, bind.User, r.Subuser, bind.Tenant); err != nil && !radosgw.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
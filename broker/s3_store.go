@@ -0,0 +1,210 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/icclab/ceph-objectstore-broker/s3"
+	"github.com/icclab/ceph-objectstore-broker/utils"
+	"strings"
+)
+
+//Object holding the hash of the last audit record, next to the instance and operation prefixes
+const auditHeadObjName = "audit-head"
+
+//S3Store keeps the broker state as objects in a bucket on the object store.
+//Instances are JSON objects under the instance prefix, with their bindings stored as JSON objects 'below' them
+type S3Store struct {
+	s3              *s3.S3
+	bucketName      string
+	instancePrefix  string
+	operationPrefix string
+}
+
+func NewS3Store(s *s3.S3, bucketName string, instancePrefix string, operationPrefix string) *S3Store {
+	return &S3Store{s3: s, bucketName: bucketName, instancePrefix: instancePrefix, operationPrefix: operationPrefix}
+}
+
+func (s *S3Store) CreateInstance(ctx context.Context, inst *Instance) error {
+	return s.putJson(ctx, s.getInstanceObjName(inst.ID), inst)
+}
+
+func (s *S3Store) UpdateInstance(ctx context.Context, inst *Instance) error {
+	if exists, err := s.exists(ctx, s.getInstanceObjName(inst.ID)); err != nil {
+		return err
+	} else if !exists {
+		return ErrStateNotFound
+	}
+
+	return s.putJson(ctx, s.getInstanceObjName(inst.ID), inst)
+}
+
+func (s *S3Store) GetInstance(ctx context.Context, instID string) (*Instance, error) {
+	j, err := s.getString(ctx, s.getInstanceObjName(instID))
+	if err != nil {
+		return nil, err
+	}
+
+	//Older brokers stored empty marker objects, which are returned as unversioned records to be upgraded
+	inst := &Instance{}
+	if j == "" {
+		inst.ID = instID
+		return inst, nil
+	}
+
+	if err := utils.LoadJson(j, inst); err != nil {
+		return nil, err
+	}
+
+	return inst, nil
+}
+
+func (s *S3Store) InstanceExists(ctx context.Context, instID string) (bool, error) {
+	return s.exists(ctx, s.getInstanceObjName(instID))
+}
+
+func (s *S3Store) ListInstances(ctx context.Context) ([]string, error) {
+	objs, done := s.s3.GetObjects(ctx, s.bucketName, s.instancePrefix, false)
+	defer close(done)
+
+	ids := []string{}
+	for o := range objs {
+		if o.Err != nil {
+			return nil, o.Err
+		}
+
+		//Non-recursive listings also return the 'directories' holding the bindings of an instance
+		if strings.HasSuffix(o.Key, "/") {
+			continue
+		}
+		ids = append(ids, strings.TrimPrefix(o.Key, s.instancePrefix))
+	}
+
+	return ids, nil
+}
+
+func (s *S3Store) DeleteInstance(ctx context.Context, instID string) error {
+	return s.s3.DeleteObject(ctx, s.bucketName, s.getInstanceObjName(instID))
+}
+
+func (s *S3Store) PutBinding(ctx context.Context, instID string, bindID string, bind *Bind) error {
+	return s.putJson(ctx, s.getBindObjName(instID, bindID), bind)
+}
+
+func (s *S3Store) GetBinding(ctx context.Context, instID string, bindID string) (*Bind, error) {
+	bind := &Bind{}
+	if err := s.getJson(ctx, s.getBindObjName(instID, bindID), bind); err != nil {
+		return nil, err
+	}
+
+	return bind, nil
+}
+
+func (s *S3Store) BindingExists(ctx context.Context, instID string, bindID string) (bool, error) {
+	return s.exists(ctx, s.getBindObjName(instID, bindID))
+}
+
+func (s *S3Store) ListBindings(ctx context.Context, instID string) ([]string, error) {
+	prefix := s.getInstanceObjName(instID) + "/"
+	objs, done := s.s3.GetObjects(ctx, s.bucketName, prefix, false)
+	defer close(done)
+
+	ids := []string{}
+	for o := range objs {
+		if o.Err != nil {
+			return nil, o.Err
+		}
+		ids = append(ids, strings.TrimPrefix(o.Key, prefix))
+	}
+
+	return ids, nil
+}
+
+func (s *S3Store) DeleteBinding(ctx context.Context, instID string, bindID string) error {
+	return s.s3.DeleteObject(ctx, s.bucketName, s.getBindObjName(instID, bindID))
+}
+
+func (s *S3Store) PutOperation(ctx context.Context, op *Operation) error {
+	return s.putJson(ctx, s.getOperationObjName(op.InstanceID), op)
+}
+
+func (s *S3Store) GetOperation(ctx context.Context, instID string) (*Operation, error) {
+	op := &Operation{}
+	if err := s.getJson(ctx, s.getOperationObjName(instID), op); err != nil {
+		return nil, err
+	}
+
+	return op, nil
+}
+
+func (s *S3Store) DeleteOperation(ctx context.Context, instID string) error {
+	if exists, err := s.exists(ctx, s.getOperationObjName(instID)); err != nil || !exists {
+		return err
+	}
+
+	return s.s3.DeleteObject(ctx, s.bucketName, s.getOperationObjName(instID))
+}
+
+func (s *S3Store) GetAuditHead(ctx context.Context) (string, error) {
+	hash, err := s.getString(ctx, auditHeadObjName)
+	if err == ErrStateNotFound {
+		return "", nil
+	}
+	return hash, err
+}
+
+func (s *S3Store) PutAuditHead(ctx context.Context, hash string) error {
+	return s.s3.PutObject(ctx, s.bucketName, auditHeadObjName, hash)
+}
+
+//Returns false if the object doesn't exist. Any other error, e.g. a denied request, is returned rather than taken for a
+//missing object
+func (s *S3Store) exists(ctx context.Context, objName string) (bool, error) {
+	_, err := s.s3.GetObjectInfo(ctx, s.bucketName, objName)
+	if s3.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *S3Store) putJson(ctx context.Context, objName string, i interface{}) error {
+	j, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+
+	return s.s3.PutObject(ctx, s.bucketName, objName, string(j))
+}
+
+//Loads the JSON object into the passed struct, returning ErrStateNotFound if it doesn't exist
+func (s *S3Store) getJson(ctx context.Context, objName string, i interface{}) error {
+	j, err := s.getString(ctx, objName)
+	if err != nil {
+		return err
+	}
+
+	return utils.LoadJson(j, i)
+}
+
+//Returns the content of the object, or ErrStateNotFound if it doesn't exist
+func (s *S3Store) getString(ctx context.Context, objName string) (string, error) {
+	j, err := s.s3.GetObjectString(ctx, s.bucketName, objName)
+	if s3.IsNotFound(err) {
+		return "", ErrStateNotFound
+	}
+	return j, err
+}
+
+//Converts the instance ID into the object name format
+func (s *S3Store) getInstanceObjName(instID string) string {
+	return s.instancePrefix + instID
+}
+
+//Converts the instance and binding IDs into the object name format
+func (s *S3Store) getBindObjName(instID string, bindID string) string {
+	return s.instancePrefix + instID + "/" + bindID
+}
+
+//Converts the instance ID into the operation object name format
+func (s *S3Store) getOperationObjName(instID string) string {
+	return s.operationPrefix + instID
+}
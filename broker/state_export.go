@@ -0,0 +1,147 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+//Current version of the state export format
+const stateExportVersion = 1
+
+//StateExport holds all records of a state store, e.g. to move the broker to another store or to back it up
+type StateExport struct {
+	Version    int             `json:"version"`
+	ExportedAt time.Time       `json:"exportedAt"`
+	Instances  []InstanceState `json:"instances"`
+}
+
+//InstanceState holds the record of an instance along with those of its bindings and last operation
+type InstanceState struct {
+	Instance  *Instance        `json:"instance"`
+	Bindings  map[string]*Bind `json:"bindings,omitempty"`
+	Operation *Operation       `json:"operation,omitempty"`
+}
+
+//ExportState reads all records of the store. Records are exported as stored, without upgrading them
+func ExportState(ctx context.Context, store StateStore) (*StateExport, error) {
+	exp := &StateExport{Version: stateExportVersion, ExportedAt: time.Now().UTC(), Instances: []InstanceState{}}
+
+	instIDs, err := store.ListInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, instID := range instIDs {
+		inst, err := store.GetInstance(ctx, instID)
+		if err != nil {
+			return nil, err
+		}
+		state := InstanceState{Instance: inst, Bindings: map[string]*Bind{}}
+
+		bindIDs, err := store.ListBindings(ctx, instID)
+		if err != nil {
+			return nil, err
+		}
+		for _, bindID := range bindIDs {
+			if state.Bindings[bindID], err = store.GetBinding(ctx, instID, bindID); err != nil {
+				return nil, err
+			}
+		}
+
+		op, err := store.GetOperation(ctx, instID)
+		if err == nil {
+			state.Operation = op
+		} else if err != ErrStateNotFound {
+			return nil, err
+		}
+
+		exp.Instances = append(exp.Instances, state)
+	}
+
+	return exp, nil
+}
+
+//ImportState writes the records of an export to the store and returns the number of instances imported.
+//Instances already in the store are skipped, along with their bindings and operation, unless overwrite is set
+func ImportState(ctx context.Context, store StateStore, exp *StateExport, overwrite bool) (int, error) {
+	if exp.Version > stateExportVersion {
+		return 0, errors.New("State export version is newer than supported by this broker")
+	}
+
+	imported := 0
+	for _, state := range exp.Instances {
+		inst := state.Instance
+		if inst == nil || inst.ID == "" {
+			return imported, errors.New("State export holds an instance without ID")
+		}
+
+		exists, err := store.InstanceExists(ctx, inst.ID)
+		if err != nil {
+			return imported, err
+		}
+
+		if !exists {
+			err = store.CreateInstance(ctx, inst)
+		} else if overwrite {
+			err = store.UpdateInstance(ctx, inst)
+		} else {
+			continue
+		}
+		if err != nil {
+			return imported, err
+		}
+
+		for bindID, bind := range state.Bindings {
+			if err := store.PutBinding(ctx, inst.ID, bindID, bind); err != nil {
+				return imported, err
+			}
+		}
+
+		if state.Operation != nil {
+			if err := store.PutOperation(ctx, state.Operation); err != nil {
+				return imported, err
+			}
+		}
+
+		imported++
+	}
+
+	return imported, nil
+}
+
+//ImportState imports the records of an export into the store of the running broker, holding the lock of each instance
+//while its records are written. The imported instances are counted and their retired credentials indexed right away,
+//so the limits and the sweep cover them without a restart
+func (b *Broker) ImportState(ctx context.Context, exp *StateExport, overwrite bool) (int, error) {
+	imported := 0
+	for _, state := range exp.Instances {
+		if state.Instance == nil || state.Instance.ID == "" {
+			return imported, errors.New("State export holds an instance without ID")
+		}
+
+		n, err := b.importInstance(ctx, exp.Version, state, overwrite)
+		imported += n
+		if err != nil {
+			return imported, err
+		}
+	}
+
+	return imported, nil
+}
+
+func (b *Broker) importInstance(ctx context.Context, version int, state InstanceState, overwrite bool) (int, error) {
+	defer b.Locks.Lock(state.Instance.ID)()
+
+	n, err := ImportState(ctx, b.Store, &StateExport{Version: version, Instances: []InstanceState{state}}, overwrite)
+	if err != nil || n == 0 {
+		return n, err
+	}
+
+	//Imported instances are counted even if they exceed a limit, as they exist already
+	b.Counter.Reserve(state.Instance, InstanceLimits{})
+	for bindID, bind := range state.Bindings {
+		b.Retirements.Set(state.Instance.ID, bindID, bind.Retired)
+	}
+	return n, nil
+}
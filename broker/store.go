@@ -0,0 +1,59 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
+	"github.com/icclab/ceph-objectstore-broker/s3"
+)
+
+//StateStore persists the instances, bindings and operations managed by the broker
+type StateStore interface {
+	CreateInstance(ctx context.Context, inst *Instance) error
+	//Overwrites the record of an existing instance
+	UpdateInstance(ctx context.Context, inst *Instance) error
+	GetInstance(ctx context.Context, instID string) (*Instance, error)
+	InstanceExists(ctx context.Context, instID string) (bool, error)
+	//Returns the IDs of all stored instances
+	ListInstances(ctx context.Context) ([]string, error)
+	DeleteInstance(ctx context.Context, instID string) error
+
+	PutBinding(ctx context.Context, instID string, bindID string, bind *Bind) error
+	GetBinding(ctx context.Context, instID string, bindID string) (*Bind, error)
+	BindingExists(ctx context.Context, instID string, bindID string) (bool, error)
+	//Returns the IDs of all bindings stored under the instance
+	ListBindings(ctx context.Context, instID string) ([]string, error)
+	DeleteBinding(ctx context.Context, instID string, bindID string) error
+
+	PutOperation(ctx context.Context, op *Operation) error
+	GetOperation(ctx context.Context, instID string) (*Operation, error)
+	DeleteOperation(ctx context.Context, instID string) error
+
+	//Hash of the last audit record written by the broker or cosb-admin, see audit.HeadStore
+	GetAuditHead(ctx context.Context) (string, error)
+	PutAuditHead(ctx context.Context, hash string) error
+}
+
+//Returned by the getters of a StateStore when the requested record does not exist
+var ErrStateNotFound = errors.New("Record not found in the broker state store")
+
+const (
+	S3StateStore     = "s3"
+	FileStateStore   = "file"
+	MemoryStateStore = "memory"
+)
+
+//NewStateStore creates the state store selected in the broker config.
+//The S3 client is only used by the S3 backed store
+func NewStateStore(bc *brokerConfig.BrokerConfig, s *s3.S3) (StateStore, error) {
+	switch bc.StateStore {
+	case S3StateStore:
+		return NewS3Store(s, bc.BucketName, bc.InstancePrefix, bc.OperationPrefix), nil
+	case FileStateStore:
+		return NewFileStore(bc.StateStorePath)
+	case MemoryStateStore:
+		return NewMemoryStore(), nil
+	}
+
+	return nil, errors.New("Unknown state store '" + bc.StateStore + "'")
+}
@@ -0,0 +1,179 @@
+package broker
+
+import (
+	"code.cloudfoundry.org/lager"
+	"context"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"time"
+)
+
+var (
+	//The metrics endpoint isn't authenticated, so the organizations and spaces of the instances are left out
+	usageLabels          = []string{"instance_id", "plan"}
+	instanceSizeDesc     = prometheus.NewDesc("cosb_instance_size_bytes", "Size of all objects of a service instance.", usageLabels, nil)
+	instanceObjectsDesc  = prometheus.NewDesc("cosb_instance_objects", "Number of objects of a service instance.", usageLabels, nil)
+	instanceQuotaDesc    = prometheus.NewDesc("cosb_instance_quota_bytes", "Size quota of a service instance. Missing if unlimited.", usageLabels, nil)
+	instanceMaxObjDesc   = prometheus.NewDesc("cosb_instance_max_objects", "Object limit of a service instance. Missing if unlimited.", usageLabels, nil)
+	usageCollectedAtDesc = prometheus.NewDesc("cosb_usage_collected_timestamp_seconds", "Time the usage of the instances was last collected.", nil, nil)
+)
+
+//InstanceUsage is the storage used by an instance along with its limits
+type InstanceUsage struct {
+	InstanceID       string `json:"instanceID"`
+	PlanID           string `json:"planID"`
+	PlanName         string `json:"planName"`
+	OrganizationGUID string `json:"organizationGUID"`
+	SpaceGUID        string `json:"spaceGUID"`
+	SizeKB           int    `json:"sizeKB"`
+	Objects          int    `json:"objects"`
+	//The limits are -1 if unlimited
+	QuotaKB    int64 `json:"quotaKB"`
+	MaxObjects int64 `json:"maxObjects"`
+	//Set if the usage of the instance could not be collected, in which case the other values are unknown
+	Error string `json:"error,omitempty"`
+}
+
+//UsageReport is the usage of all instances as of the time it was collected
+type UsageReport struct {
+	CollectedAt time.Time       `json:"collectedAt"`
+	Instances   []InstanceUsage `json:"instances"`
+}
+
+//UsageCollector periodically collects the storage usage of all instances from the radosgw.
+//The last report is served by the admin API and exposed to Prometheus, so neither queries the radosgw on each request
+type UsageCollector struct {
+	broker *Broker
+	mutex  sync.RWMutex
+	report *UsageReport
+}
+
+func NewUsageCollector(b *Broker) *UsageCollector {
+	return &UsageCollector{broker: b}
+}
+
+//Run collects the usage right away and then at every interval. It doesn't return
+func (c *UsageCollector) Run(interval time.Duration) {
+	for {
+		if err := c.Update(context.Background()); err != nil {
+			c.broker.Logger.Error("failed-to-collect-usage", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+//Update collects the usage of all instances and replaces the last report. Instances whose usage can't be collected are
+//included with the error, while failing to list the instances fails the whole update
+func (c *UsageCollector) Update(ctx context.Context) error {
+	b := c.broker
+	instIDs, err := b.Store.ListInstances(ctx)
+	if err != nil {
+		return err
+	}
+
+	report := &UsageReport{CollectedAt: time.Now().UTC(), Instances: []InstanceUsage{}}
+	for _, instID := range instIDs {
+		//The user of an instance still being provisioned may not exist yet
+		if op, err := b.getOperation(ctx, instID); err == nil && op != nil && op.Type == ProvisionOperation && op.State != brokerapi.Succeeded {
+			continue
+		}
+
+		inst, err := b.getInstance(ctx, instID)
+		if err != nil {
+			report.Instances = append(report.Instances, InstanceUsage{InstanceID: instID, Error: err.Error()})
+			continue
+		}
+
+		report.Instances = append(report.Instances, b.getInstanceUsage(ctx, inst))
+	}
+
+	c.mutex.Lock()
+	c.report = report
+	c.mutex.Unlock()
+
+	b.Logger.Debug("collected-usage", lager.Data{"instances": len(report.Instances)})
+	return nil
+}
+
+//Report returns the last collected usage, or nil if it wasn't collected yet
+func (c *UsageCollector) Report() *UsageReport {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.report
+}
+
+func (c *UsageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- instanceSizeDesc
+	ch <- instanceObjectsDesc
+	ch <- instanceQuotaDesc
+	ch <- instanceMaxObjDesc
+	ch <- usageCollectedAtDesc
+}
+
+func (c *UsageCollector) Collect(ch chan<- prometheus.Metric) {
+	report := c.Report()
+	if report == nil {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(usageCollectedAtDesc, prometheus.GaugeValue, float64(report.CollectedAt.Unix()))
+	for _, u := range report.Instances {
+		if u.Error != "" {
+			continue
+		}
+
+		labels := []string{u.InstanceID, u.PlanName}
+		ch <- prometheus.MustNewConstMetric(instanceSizeDesc, prometheus.GaugeValue, float64(u.SizeKB)*1024, labels...)
+		ch <- prometheus.MustNewConstMetric(instanceObjectsDesc, prometheus.GaugeValue, float64(u.Objects), labels...)
+		if u.QuotaKB >= 0 {
+			ch <- prometheus.MustNewConstMetric(instanceQuotaDesc, prometheus.GaugeValue, float64(u.QuotaKB)*1024, labels...)
+		}
+		if u.MaxObjects >= 0 {
+			ch <- prometheus.MustNewConstMetric(instanceMaxObjDesc, prometheus.GaugeValue, float64(u.MaxObjects), labels...)
+		}
+	}
+}
+
+//Reads the usage and quota of an instance from the radosgw
+func (b *Broker) getInstanceUsage(ctx context.Context, inst *Instance) InstanceUsage {
+	u := InstanceUsage{
+		InstanceID:       inst.ID,
+		PlanID:           inst.PlanID,
+		PlanName:         inst.PlanID,
+		OrganizationGUID: inst.OrganizationGUID,
+		SpaceGUID:        inst.SpaceGUID,
+	}
+	if p, err := b.getPlan(inst.PlanID); err == nil {
+		u.PlanName = p.Name
+	}
+
+	ib, err := b.forInstance(inst)
+	if err != nil {
+		u.Error = err.Error()
+		return u
+	}
+
+	stats, err := ib.Rados.GetUserStats(ctx, inst.User, inst.Tenant)
+	if err != nil {
+		u.Error = err.Error()
+		return u
+	}
+	u.SizeKB = stats.SizeKB
+	u.Objects = stats.NumObjects
+
+	quota, err := ib.Rados.GetUserQuota(ctx, inst.User, inst.Tenant)
+	if err != nil {
+		u.Error = err.Error()
+		return u
+	}
+	u.QuotaKB = -1
+	u.MaxObjects = -1
+	if quota.Enabled {
+		u.QuotaKB = quota.MaxSizeKb
+		u.MaxObjects = quota.MaxObjects
+	}
+
+	return u
+}
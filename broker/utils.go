@@ -1,77 +1,123 @@
 package broker
 
 import (
+	"context"
 	"errors"
+	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
 	"github.com/pivotal-cf/brokerapi"
-	"strconv"
 	"strings"
+	"time"
 )
 
-func (b *Broker) instanceExists(instID string) bool {
-	_, err := b.S3.GetObjectInfo(b.BrokerConfig.BucketName, b.getInstanceObjName(instID))
-	return err == nil
+//Errors of the store are returned rather than taken for a missing instance, so requests fail instead of acting on a
+//wrong answer
+func (b *Broker) instanceExists(ctx context.Context, instID string) (bool, error) {
+	return b.Store.InstanceExists(ctx, instID)
 }
 
-func (b *Broker) bindingExists(instID string, bindID string) bool {
-	_, err := b.S3.GetObjectInfo(b.BrokerConfig.BucketName, b.getBindObjName(instID, bindID))
-	return err == nil
-}
-
-//Returns the number of provisioned instances
-func (b *Broker) provisionCount() int {
-	objs, done := b.S3.GetObjects(b.BrokerConfig.BucketName, b.BrokerConfig.InstancePrefix, false)
-	defer close(done)
-	count := 0
-	for range objs {
-		count++
-	}
-	return count
+func (b *Broker) bindingExists(ctx context.Context, instID string, bindID string) (bool, error) {
+	return b.Store.BindingExists(ctx, instID, bindID)
 }
 
 //Returns true if the provisioned instance has any binds
-func (b *Broker) hasBinds(instID string) bool {
-	objs, done := b.S3.GetObjects(b.BrokerConfig.BucketName, b.getInstanceObjName(instID)+"/", false)
-	defer close(done)
-	for range objs {
-		return true
-	}
-	return false
+func (b *Broker) hasBinds(ctx context.Context, instID string) (bool, error) {
+	ids, err := b.Store.ListBindings(ctx, instID)
+	return len(ids) > 0, err
 }
 
+//Returns the plan with the ID from any service of the catalog
 func (b *Broker) getPlan(planID string) (*brokerapi.ServicePlan, error) {
-	for _, p := range b.ServiceConfig[0].Plans {
-		if p.ID == planID {
-			return &p, nil
+	for _, s := range b.config().Services {
+		for _, p := range s.Plans {
+			if p.ID == planID {
+				return &p, nil
+			}
 		}
 	}
 
 	return nil, errors.New("Plan with ID '" + planID + "' not found")
 }
 
-func (b *Broker) getPlanQuota(planID string) (int, error) {
+//Returns the settings of the plan from its metadata. The catalog is validated when it's loaded, so only plans missing
+//from it return an error
+func (b *Broker) getPlanSettings(planID string) (*brokerConfig.PlanSettings, error) {
 	p, err := b.getPlan(planID)
 	if err != nil {
-		return -1, err
+		return nil, err
 	}
 
-	i, err := strconv.Atoi(p.Metadata.AdditionalMetadata["quotaMB"].(string))
+	return brokerConfig.ParsePlanSettings(*p)
+}
+
+//Returns the number of instances of the plan the broker provisions, set by 'instanceLimit' in the plan metadata. 0 is no limit
+func (b *Broker) getPlanInstanceLimit(planID string) int {
+	s, err := b.getPlanSettings(planID)
+	if err != nil {
+		return 0
+	}
+	return s.InstanceLimit
+}
+
+//Returns the limits a new instance is checked against
+func (b *Broker) instanceLimits(inst *Instance) InstanceLimits {
+	config := b.config()
+	return InstanceLimits{
+		Total: config.InstanceLimit,
+		Org:   config.OrgInstanceLimit,
+		Plan:  b.getPlanInstanceLimit(inst.PlanID),
+	}
+}
+
+func (b *Broker) getPlanQuota(planID string) (int, error) {
+	s, err := b.getPlanSettings(planID)
 	if err != nil {
 		return -1, err
 	}
 
-	return i, nil
+	return s.QuotaMB, nil
+}
+
+//Returns the plan with the given quota along with its service, or nil if there is no such plan or the quota doesn't
+//identify a single plan
+func (b *Broker) getPlanByQuota(quotaMB int) (*brokerapi.Service, *brokerapi.ServicePlan) {
+	var service *brokerapi.Service
+	var found *brokerapi.ServicePlan
+	for _, s := range b.config().Services {
+		for _, p := range s.Plans {
+			if q, err := b.getPlanQuota(p.ID); err != nil || q != quotaMB {
+				continue
+			}
+
+			if found != nil {
+				return nil, nil
+			}
+			s, plan := s, p
+			service, found = &s, &plan
+		}
+	}
+
+	return service, found
 }
 
 func createTenantID(instanceID string) string {
 	return strings.Replace(instanceID, "-", "", -1)
 }
 
-//Converts the instance ID into the object name format
-func (b *Broker) getInstanceObjName(instID string) string {
-	return b.BrokerConfig.InstancePrefix + instID
+//detachedContext keeps the values of its parent, such as the originating identity, but is never done
+type detachedContext struct {
+	parent context.Context
 }
 
-//Converts the instance and binding IDs into the object name format
-func (b *Broker) getBindObjName(instID string, bindID string) string {
-	return b.BrokerConfig.InstancePrefix + instID + "/" + bindID
+//Returns a context with the values of ctx that is never cancelled, for work that has to outlive the request
+//it was started by, like asynchronous operations and rollbacks
+func detachContext(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
 }
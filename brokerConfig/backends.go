@@ -0,0 +1,274 @@
+package brokerConfig
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pivotal-cf/brokerapi"
+	"sort"
+	"strings"
+)
+
+//Name of the backend made of the 'radosgw' settings, which services without a backend use
+const DefaultBackend = "default"
+
+//Keys of the service and plan metadata naming the backends of their instances
+const (
+	backendMetadataKey  = "backend"
+	backendsMetadataKey = "backends"
+)
+
+//Types of credentials a backend can hand out in bindings
+const (
+	S3Credentials    = "s3"
+	SwiftCredentials = "swift"
+)
+
+//BackendConfig is a backend as given in the 'backends' section of the config file. Settings left out are taken from the
+//default backend, so a backend on the same radosgw only sets what differs, e.g. its credential types
+type BackendConfig struct {
+	Endpoint    string   `json:"endpoint"`
+	AccessKey   string   `json:"access_key"`
+	SecretKey   string   `json:"secret_key"`
+	AdminPath   string   `json:"admin_path"`
+	S3Path      string   `json:"s3_path"`
+	SwiftPath   string   `json:"swift_path"`
+	UseHttps    *bool    `json:"use_https"`
+	Region      string   `json:"region"`
+	Placement   string   `json:"placement"`
+	Credentials []string `json:"credentials"`
+}
+
+//Backend is a radosgw the instances of a service are created on, with the placement of their users and the types of
+//credentials their bindings get. Backends with the same endpoint are on the same Ceph cluster
+type Backend struct {
+	Name string
+	//Region of the cluster, which instances can be provisioned in with the 'region' parameter
+	Region         string
+	RadosEndpoint  string
+	RadosAccessKey string
+	RadosSecretKey string
+	RadosAdminPath string
+	S3Endpoint     string
+	SwiftEndpoint  string
+	UseHttps       bool
+	//Placement target of the buckets of the instance users. Empty for the default placement of the radosgw
+	Placement   string
+	Credentials []string
+}
+
+//Offers returns true if bindings on the backend get credentials of the type
+func (b *Backend) Offers(credentials string) bool {
+	for _, c := range b.Credentials {
+		if c == credentials {
+			return true
+		}
+	}
+	return false
+}
+
+//Backend returns the settings of the backend with the name. The default backend is made of the radosgw settings
+func (b *BrokerConfig) Backend(name string) (*Backend, bool) {
+	if name == "" || name == DefaultBackend {
+		return &Backend{
+			Name:           DefaultBackend,
+			RadosEndpoint:  b.RadosEndpoint,
+			RadosAccessKey: b.RadosAccessKey,
+			RadosSecretKey: b.RadosSecretKey,
+			RadosAdminPath: b.RadosAdminPath,
+			S3Endpoint:     b.S3Endpoint,
+			SwiftEndpoint:  b.SwiftEndpoint,
+			UseHttps:       b.UseHttps,
+			Region:         b.RadosRegion,
+			Credentials:    []string{S3Credentials, SwiftCredentials},
+		}, true
+	}
+
+	backend, ok := b.Backends[name]
+	return backend, ok
+}
+
+//BackendNames returns the names of all backends, starting with the default one
+func (b *BrokerConfig) BackendNames() []string {
+	names := []string{}
+	for name := range b.Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{DefaultBackend}, names...)
+}
+
+//PlanBackends returns the names of the backends the instances of the plan can be created on, of which the first is the one
+//used if no region is requested. They are named by 'backend', or a list of 'backends', in the metadata of the plan, or else in
+//that of the service
+func PlanBackends(service brokerapi.Service, plan brokerapi.ServicePlan) ([]string, error) {
+	if plan.Metadata != nil {
+		if names, err := metadataBackends(plan.Metadata.AdditionalMetadata); err != nil || names != nil {
+			return names, err
+		}
+	}
+	if service.Metadata != nil {
+		if names, err := metadataBackends(service.Metadata.AdditionalMetadata); err != nil || names != nil {
+			return names, err
+		}
+	}
+
+	return []string{DefaultBackend}, nil
+}
+
+//Returns the backends named in the metadata, or nil if it names none
+func metadataBackends(metadata map[string]interface{}) ([]string, error) {
+	if v, ok := metadata[backendMetadataKey]; ok {
+		name, isString := v.(string)
+		if !isString {
+			return nil, errors.New("'backend' must be the name of a backend")
+		}
+		if name == "" {
+			name = DefaultBackend
+		}
+		return []string{name}, nil
+	}
+
+	v, ok := metadata[backendsMetadataKey]
+	if !ok {
+		return nil, nil
+	}
+	list, isList := v.([]interface{})
+	if !isList || len(list) == 0 {
+		return nil, errors.New("'backends' must be a list of backend names")
+	}
+
+	names := []string{}
+	for _, e := range list {
+		name, isString := e.(string)
+		if !isString || name == "" {
+			return nil, errors.New("'backends' must be a list of backend names")
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+//Resolves the backends of the config file against the default backend. Returns the problems found
+func (b *BrokerConfig) loadBackends(file *configFile) []string {
+	problems := []string{}
+	b.Backends = map[string]*Backend{}
+
+	def, _ := b.Backend(DefaultBackend)
+	for _, name := range sortedBackendNames(file.backends) {
+		c := file.backends[name]
+		label := "Backend '" + name + "'"
+		if name == DefaultBackend {
+			problems = append(problems, label+" is made of the 'radosgw' settings and can't be given in 'backends'")
+			continue
+		}
+
+		backend := *def
+		backend.Name = name
+		if c.Endpoint != "" {
+			backend.RadosEndpoint = strings.TrimSuffix(c.Endpoint, "/")
+			//A backend on another radosgw has its own keys
+			if c.AccessKey == "" || c.SecretKey == "" {
+				problems = append(problems, label+" has its own endpoint but no 'access_key' or 'secret_key'")
+			}
+		}
+		if c.AccessKey != "" {
+			backend.RadosAccessKey = c.AccessKey
+		}
+		if c.SecretKey != "" {
+			backend.RadosSecretKey = c.SecretKey
+		}
+		if c.AdminPath != "" {
+			backend.RadosAdminPath = c.AdminPath
+		}
+		if c.UseHttps != nil {
+			backend.UseHttps = *c.UseHttps
+		}
+		//Backends on the radosgw of the default backend are in its region
+		if c.Endpoint != "" || c.Region != "" {
+			backend.Region = c.Region
+		}
+
+		//The paths are kept when only the endpoint changes
+		backend.S3Endpoint = backend.RadosEndpoint + strings.TrimPrefix(def.S3Endpoint, def.RadosEndpoint)
+		if c.S3Path != "" {
+			backend.S3Endpoint = backend.RadosEndpoint + c.S3Path
+		}
+		backend.SwiftEndpoint = backend.RadosEndpoint + strings.TrimPrefix(def.SwiftEndpoint, def.RadosEndpoint)
+		if c.SwiftPath != "" {
+			backend.SwiftEndpoint = backend.RadosEndpoint + c.SwiftPath
+		}
+
+		backend.Placement = c.Placement
+		if c.Credentials != nil {
+			backend.Credentials = nil
+			for _, cred := range c.Credentials {
+				if cred != S3Credentials && cred != SwiftCredentials {
+					problems = append(problems, fmt.Sprintf("%s has an unknown credential type '%s'. Use 's3' or 'swift'", label, cred))
+					continue
+				}
+				backend.Credentials = append(backend.Credentials, cred)
+			}
+			if len(c.Credentials) == 0 {
+				problems = append(problems, label+" offers no credentials")
+			}
+		}
+
+		if backend.UseHttps && strings.HasPrefix(backend.RadosEndpoint, "http://") {
+			problems = append(problems, label+" has 'use_https' set but its endpoint is using 'HTTP'")
+		}
+		if !backend.UseHttps && strings.HasPrefix(backend.RadosEndpoint, "https://") {
+			problems = append(problems, label+" has 'use_https' unset but its endpoint is using 'HTTPS'")
+		}
+
+		b.Backends[name] = &backend
+	}
+
+	return problems
+}
+
+//ValidateServiceBackends returns the problems of the backends of the plans of the services: backends that are not in the
+//config, several backends of a plan in the same region, which couldn't be told apart by the 'region' parameter, and storage
+//classes without a placement target on a backend
+func (b *BrokerConfig) ValidateServiceBackends(services []brokerapi.Service) []string {
+	problems := []string{}
+	for _, s := range services {
+		for _, p := range s.Plans {
+			plan := "Plan '" + p.Name + "' of service '" + s.Name + "'"
+			names, err := PlanBackends(s, p)
+			if err != nil {
+				problems = append(problems, plan+" has invalid metadata: "+err.Error())
+				continue
+			}
+
+			regions := map[string]bool{}
+			for _, name := range names {
+				backend, ok := b.Backend(name)
+				if !ok {
+					problems = append(problems, plan+" uses the unknown backend '"+name+"'")
+					continue
+				}
+
+				if len(names) > 1 && regions[backend.Region] {
+					problems = append(problems, plan+" has several backends in the region '"+backend.Region+"'")
+				}
+				regions[backend.Region] = true
+
+				//Storage classes are defined per placement target, which the admin API needs to set one
+				if settings, err := ParsePlanSettings(p); err == nil && settings.StorageClass != "" && settings.Placement == "" &&
+					backend.Placement == "" {
+					problems = append(problems, plan+" has a 'storageClass' but no 'placement', and neither has the backend '"+name+"'")
+				}
+			}
+		}
+	}
+	return problems
+}
+
+func sortedBackendNames(backends map[string]BackendConfig) []string {
+	names := []string{}
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
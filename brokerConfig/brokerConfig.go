@@ -1,10 +1,12 @@
 package brokerConfig
 
 import (
-	"errors"
+	"github.com/pivotal-cf/brokerapi"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type BrokerConfig struct {
@@ -12,18 +14,98 @@ type BrokerConfig struct {
 	RadosSecretKey string
 	RadosAdminPath string
 	RadosEndpoint  string
+	//Region of the default backend
+	RadosRegion string
 
-	S3Endpoint     string
-	SwiftEndpoint  string
-	BucketName     string
-	BrokerUsername string
-	BrokerPassword string
-	InstanceLimit  int
-	InstancePrefix string
-	UseHttps       bool
+	S3Endpoint      string
+	SwiftEndpoint   string
+	BucketName      string
+	BrokerUsername  string
+	BrokerPassword  string
+	InstanceLimit   int
+	InstancePrefix  string
+	OperationPrefix string
+	UseHttps        bool
+	StateStore      string
+	StateStorePath  string
+	DashboardURL    string
+
+	//Maximum number of instances per organization, 0 for no limit
+	OrgInstanceLimit int
+
+	//How long credentials replaced by a rotation keep working
+	RotationGracePeriod time.Duration
+	//How often credentials whose grace period is over are deleted
+	RotationSweepInterval time.Duration
+	//How often the instance counts are corrected from the state store
+	InstanceRecountInterval time.Duration
+	//How often the storage usage of all instances is collected
+	UsageInterval time.Duration
+	//Length of the periods the traffic and storage of all instances is metered for
+	MeteringInterval time.Duration
+
+	//Sinks the audit records are written to. Auditing is disabled if there are none
+	AuditSinks []string
+	//File of the 'file' audit sink
+	AuditFile string
+	//Prefix of the objects the 's3' audit sink writes to the broker bucket, and how often it writes them
+	AuditPrefix        string
+	AuditFlushInterval time.Duration
+
+	//Config file the settings were loaded from, if any
+	ConfigFile string
+	//Catalog of the broker, from the config file or the services file. Only set by Load
+	Services     []brokerapi.Service
+	ServicesFile string
+	//Backends of the config file by name, besides the default one made of the radosgw settings. See Backend
+	Backends map[string]*Backend
+}
+
+//ValidationError lists all the problems found in a configuration
+type ValidationError struct {
+	Problems []string
 }
 
+func (e *ValidationError) Error() string {
+	return "Invalid broker config: " + strings.Join(e.Problems, "; ")
+}
+
+//Load reads the settings and catalog from the config file at path and the environment, whose variables override the file.
+//Without a path, only the environment is read. All problems found are returned together as a *ValidationError
+func Load(path string) (*BrokerConfig, error) {
+	b := &BrokerConfig{ConfigFile: path}
+	file := &configFile{}
+	problems := []string{}
+
+	if path != "" {
+		var err error
+		if file, err = readConfigFile(path); err != nil {
+			return nil, &ValidationError{Problems: []string{err.Error()}}
+		}
+		problems = append(problems, file.problems...)
+	}
+
+	problems = append(problems, b.update(file.lookup)...)
+	problems = append(problems, b.loadBackends(file)...)
+	problems = append(problems, b.loadServices(file)...)
+
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	return b, nil
+}
+
+//Update reads the settings from the environment only, without the catalog
 func (b *BrokerConfig) Update() error {
+	if problems := b.update(os.Getenv); len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+//Reads the settings from lookup, which returns the value of a setting by the name of its environment variable.
+//Returns the problems found
+func (b *BrokerConfig) update(lookup func(key string) string) []string {
 
 	const s3Path = "/"
 	const swiftPath = "/auth/v1.0"
@@ -31,82 +113,279 @@ func (b *BrokerConfig) Update() error {
 	const instanceLimit = 2000
 	const bucketName = "ceph-objectstore-broker"
 	const instancePrefix = "instances/"
+	const operationPrefix = "operations/"
 	const useHttps = true
+	const stateStore = "s3"
+	const stateStorePath = "cosb-state.json"
+	const rotationGracePeriod = 24 * time.Hour
+	const rotationSweepInterval = time.Minute
+	const instanceRecountInterval = 5 * time.Minute
+	const usageInterval = 5 * time.Minute
+	const meteringInterval = time.Hour
+	const auditFile = "cosb-audit.log"
+	const auditPrefix = "audit/"
+	const auditFlushInterval = time.Minute
+
+	problems := []string{}
 
 	//Required params
-	if b.RadosAccessKey = os.Getenv("RADOS_ACCESS_KEY"); b.RadosAccessKey == "" {
-		return errors.New("RADOS_ACCESS_KEY missing")
+	if b.RadosAccessKey = lookup("RADOS_ACCESS_KEY"); b.RadosAccessKey == "" {
+		problems = append(problems, missing("RADOS_ACCESS_KEY"))
 	}
-	if b.RadosSecretKey = os.Getenv("RADOS_SECRET_KEY"); b.RadosSecretKey == "" {
-		return errors.New("RADOS_SECRET_KEY missing")
+	if b.RadosSecretKey = lookup("RADOS_SECRET_KEY"); b.RadosSecretKey == "" {
+		problems = append(problems, missing("RADOS_SECRET_KEY"))
 	}
 
-	if b.RadosEndpoint = strings.TrimSuffix(os.Getenv("RADOS_ENDPOINT"), "/"); b.RadosEndpoint == "" {
-		return errors.New("RADOS_ENDPOINT missing")
+	if b.RadosEndpoint = strings.TrimSuffix(lookup("RADOS_ENDPOINT"), "/"); b.RadosEndpoint == "" {
+		problems = append(problems, missing("RADOS_ENDPOINT"))
 	}
 
-	if b.BrokerUsername = os.Getenv("BROKER_USERNAME"); b.BrokerUsername == "" {
-		return errors.New("BROKER_USERNAME missing")
+	if b.BrokerUsername = lookup("BROKER_USERNAME"); b.BrokerUsername == "" {
+		problems = append(problems, missing("BROKER_USERNAME"))
 	}
 
-	if b.BrokerPassword = os.Getenv("BROKER_PASSWORD"); b.BrokerPassword == "" {
-		return errors.New("BROKER_PASSWORD missing")
+	if b.BrokerPassword = lookup("BROKER_PASSWORD"); b.BrokerPassword == "" {
+		problems = append(problems, missing("BROKER_PASSWORD"))
 	}
 
 	//Optional params
+	b.RadosRegion = lookup("RADOS_REGION")
+
 	b.S3Endpoint = b.RadosEndpoint + s3Path
-	if v := os.Getenv("S3_PATH"); v != "" {
+	if v := lookup("S3_PATH"); v != "" {
 		b.S3Endpoint = b.RadosEndpoint + v
 	}
 
 	b.SwiftEndpoint = b.RadosEndpoint + swiftPath
-	if v := os.Getenv("SWIFT_PATH"); v != "" {
+	if v := lookup("SWIFT_PATH"); v != "" {
 		b.SwiftEndpoint = b.RadosEndpoint + v
 	}
 
 	b.BucketName = bucketName
-	if v := os.Getenv("BUCKET_NAME"); v != "" {
+	if v := lookup("BUCKET_NAME"); v != "" {
 		b.BucketName = v
 	}
 
 	b.RadosAdminPath = radosAdmin
-	if v := os.Getenv("RADOS_ADMIN"); v != "" {
+	if v := lookup("RADOS_ADMIN"); v != "" {
 		b.RadosAdminPath = v
 	}
 
 	b.InstanceLimit = instanceLimit
-	if v := os.Getenv("INSTANCE_LIMIT"); v != "" {
+	if v := lookup("INSTANCE_LIMIT"); v != "" {
 		l, err := strconv.Atoi(v)
 		if err != nil {
-			b.InstanceLimit = instanceLimit
-			return errors.New("Error reading 'INSTANCE_LIMIT'. Using default value: " + strconv.Itoa(instanceLimit))
+			problems = append(problems, "Error reading 'INSTANCE_LIMIT'. Default value: "+strconv.Itoa(instanceLimit))
 		}
 
 		b.InstanceLimit = l
 	}
 
+	b.OrgInstanceLimit = 0
+	if v := lookup("ORG_INSTANCE_LIMIT"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 0 {
+			problems = append(problems, "Error reading 'ORG_INSTANCE_LIMIT'. Default value: no limit")
+		}
+		b.OrgInstanceLimit = l
+	}
+
 	b.InstancePrefix = instancePrefix
-	if v := os.Getenv("INSTANCE_PREFIX"); v != "" {
+	if v := lookup("INSTANCE_PREFIX"); v != "" {
 		b.InstancePrefix = v
 	}
 
+	b.OperationPrefix = operationPrefix
+	if v := lookup("OPERATION_PREFIX"); v != "" {
+		b.OperationPrefix = v
+	}
+
 	b.UseHttps = useHttps
-	if v := os.Getenv("USE_HTTPS"); v != "" {
+	if v := lookup("USE_HTTPS"); v != "" {
 		parsedBool, err := strconv.ParseBool(v)
 		if err != nil {
-			return errors.New("Error parsing 'USE_HTTPS'. Using default value: " + strconv.FormatBool(useHttps))
+			problems = append(problems, "Error parsing 'USE_HTTPS'. Default value: "+strconv.FormatBool(useHttps))
 		}
 		b.UseHttps = parsedBool
 	}
 
+	b.StateStore = stateStore
+	if v := lookup("STATE_STORE"); v != "" {
+		b.StateStore = v
+	}
+
+	if b.StateStore != "s3" && b.StateStore != "file" && b.StateStore != "memory" {
+		problems = append(problems, "'STATE_STORE' must be one of 's3', 'file' or 'memory'")
+	}
+
+	b.StateStorePath = stateStorePath
+	if v := lookup("STATE_STORE_PATH"); v != "" {
+		b.StateStorePath = v
+	}
+
+	b.DashboardURL = lookup("DASHBOARD_URL")
+
+	b.RotationGracePeriod = rotationGracePeriod
+	if v := lookup("ROTATION_GRACE_PERIOD"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			problems = append(problems, "Error parsing 'ROTATION_GRACE_PERIOD'. Default value: "+rotationGracePeriod.String())
+		}
+		b.RotationGracePeriod = d
+	}
+
+	b.RotationSweepInterval = rotationSweepInterval
+	if v := lookup("ROTATION_SWEEP_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			problems = append(problems, "Error parsing 'ROTATION_SWEEP_INTERVAL'. Default value: "+rotationSweepInterval.String())
+		}
+		b.RotationSweepInterval = d
+	}
+
+	b.InstanceRecountInterval = instanceRecountInterval
+	if v := lookup("INSTANCE_RECOUNT_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			problems = append(problems, "Error parsing 'INSTANCE_RECOUNT_INTERVAL'. Default value: "+instanceRecountInterval.String())
+		}
+		b.InstanceRecountInterval = d
+	}
+
+	b.UsageInterval = usageInterval
+	if v := lookup("USAGE_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			problems = append(problems, "Error parsing 'USAGE_INTERVAL'. Default value: "+usageInterval.String())
+		}
+		b.UsageInterval = d
+	}
+
+	b.MeteringInterval = meteringInterval
+	if v := lookup("METERING_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			problems = append(problems, "Error parsing 'METERING_INTERVAL'. Default value: "+meteringInterval.String())
+		}
+		b.MeteringInterval = d
+	}
+
+	b.AuditSinks = nil
+	for _, v := range strings.Split(lookup("AUDIT_SINKS"), ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if v != "file" && v != "syslog" && v != "s3" {
+			problems = append(problems, "'AUDIT_SINKS' must be a comma separated list of 'file', 'syslog' and 's3'")
+			continue
+		}
+		b.AuditSinks = append(b.AuditSinks, v)
+	}
+
+	b.AuditFile = auditFile
+	if v := lookup("AUDIT_FILE"); v != "" {
+		b.AuditFile = v
+	}
+
+	b.AuditPrefix = auditPrefix
+	if v := lookup("AUDIT_PREFIX"); v != "" {
+		b.AuditPrefix = v
+	}
+
+	b.AuditFlushInterval = auditFlushInterval
+	if v := lookup("AUDIT_FLUSH_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			problems = append(problems, "Error parsing 'AUDIT_FLUSH_INTERVAL'. Default value: "+auditFlushInterval.String())
+		}
+		b.AuditFlushInterval = d
+	}
+
 	//Ensure https flag and provided endpoint match in protocol
 	if b.UseHttps && strings.Contains(b.RadosEndpoint, "http://") {
-		return errors.New("'USE_HTTPS' is 'true' but 'RADOS_ENDPOINT' is using 'HTTP'")
+		problems = append(problems, "'USE_HTTPS' is 'true' but 'RADOS_ENDPOINT' is using 'HTTP'")
 	}
 
 	if !b.UseHttps && strings.Contains(b.RadosEndpoint, "https://") {
-		return errors.New("'USE_HTTPS' is 'false' but 'RADOS_ENDPOINT' is using 'HTTPS'")
+		problems = append(problems, "'USE_HTTPS' is 'false' but 'RADOS_ENDPOINT' is using 'HTTPS'")
 	}
 
-	return nil
+	return problems
+}
+
+//Returns the problem of a missing required setting
+func missing(env string) string {
+	return env + " missing, or '" + fileSettings[env] + "' in the config file"
+}
+
+//Reloaded returns a copy of the config with the settings of next that can change while the broker runs: the catalog,
+//instance limits, dashboard URL and rotation grace period. The names of the other settings that differ in next are returned,
+//as they only take effect after a restart. As the backends are among them, services of next may use backends unknown until
+//the restart, see ValidateServiceBackends
+func (b *BrokerConfig) Reloaded(next *BrokerConfig) (*BrokerConfig, []string) {
+	reloaded := *b
+	reloaded.Services = next.Services
+	reloaded.ServicesFile = next.ServicesFile
+	reloaded.InstanceLimit = next.InstanceLimit
+	reloaded.OrgInstanceLimit = next.OrgInstanceLimit
+	reloaded.DashboardURL = next.DashboardURL
+	reloaded.RotationGracePeriod = next.RotationGracePeriod
+
+	restart := []string{}
+	changed := func(name string, from interface{}, to interface{}) {
+		if from != to {
+			restart = append(restart, name)
+		}
+	}
+	changed("RADOS_ACCESS_KEY", b.RadosAccessKey, next.RadosAccessKey)
+	changed("RADOS_SECRET_KEY", b.RadosSecretKey, next.RadosSecretKey)
+	changed("RADOS_ENDPOINT", b.RadosEndpoint, next.RadosEndpoint)
+	changed("RADOS_ADMIN", b.RadosAdminPath, next.RadosAdminPath)
+	changed("S3_PATH", b.S3Endpoint, next.S3Endpoint)
+	changed("SWIFT_PATH", b.SwiftEndpoint, next.SwiftEndpoint)
+	changed("USE_HTTPS", b.UseHttps, next.UseHttps)
+	changed("RADOS_REGION", b.RadosRegion, next.RadosRegion)
+	changed("BROKER_USERNAME", b.BrokerUsername, next.BrokerUsername)
+	changed("BROKER_PASSWORD", b.BrokerPassword, next.BrokerPassword)
+	changed("BUCKET_NAME", b.BucketName, next.BucketName)
+	changed("INSTANCE_PREFIX", b.InstancePrefix, next.InstancePrefix)
+	changed("OPERATION_PREFIX", b.OperationPrefix, next.OperationPrefix)
+	changed("STATE_STORE", b.StateStore, next.StateStore)
+	changed("STATE_STORE_PATH", b.StateStorePath, next.StateStorePath)
+	changed("ROTATION_SWEEP_INTERVAL", b.RotationSweepInterval, next.RotationSweepInterval)
+	changed("INSTANCE_RECOUNT_INTERVAL", b.InstanceRecountInterval, next.InstanceRecountInterval)
+	changed("USAGE_INTERVAL", b.UsageInterval, next.UsageInterval)
+	changed("METERING_INTERVAL", b.MeteringInterval, next.MeteringInterval)
+	changed("AUDIT_SINKS", strings.Join(b.AuditSinks, ","), strings.Join(next.AuditSinks, ","))
+	changed("AUDIT_FILE", b.AuditFile, next.AuditFile)
+	changed("AUDIT_PREFIX", b.AuditPrefix, next.AuditPrefix)
+	changed("AUDIT_FLUSH_INTERVAL", b.AuditFlushInterval, next.AuditFlushInterval)
+	if !reflect.DeepEqual(b.Backends, next.Backends) {
+		restart = append(restart, "backends")
+	}
+
+	return &reloaded, restart
+}
+
+//Loads the catalog from the config file, or else from the services file, and validates it. Returns the problems found
+func (b *BrokerConfig) loadServices(file *configFile) []string {
+	const servicesFile = "brokerConfig/service-config.json"
+
+	if file.services != nil {
+		b.Services = file.services
+	} else {
+		b.ServicesFile = servicesFile
+		if v := file.lookup("SERVICES_FILE"); v != "" {
+			b.ServicesFile = v
+		}
+
+		services, err := readServicesFile(b.ServicesFile)
+		if err != nil {
+			return []string{"Error reading the services file '" + b.ServicesFile + "'. " + err.Error()}
+		}
+		b.Services = services
+	}
+
+	return append(ValidateCatalog(b.Services), b.ValidateServiceBackends(b.Services)...)
 }
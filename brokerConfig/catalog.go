@@ -0,0 +1,230 @@
+package brokerConfig
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pivotal-cf/brokerapi"
+	"math"
+	"strconv"
+	"strings"
+)
+
+//PlanSettings are the settings of a plan, read from the metadata of the plan in the catalog
+type PlanSettings struct {
+	//Size quota of the instances, from 'quotaMB'. Required
+	QuotaMB int
+	//Maximum number of instances of the plan, from 'instanceLimit'. 0 is no limit
+	InstanceLimit int
+	//Number of buckets created with an instance if none are requested, from 'bucketCount'
+	BucketCount int
+	//Placement target of the buckets of the instances, from 'placement'. Empty for the placement of the backend
+	Placement string
+	//Storage class of the objects written to the buckets of the instances, from 'storageClass'. Empty for the default
+	//storage class of the placement target
+	StorageClass string
+}
+
+//Sizes in MB of the units accepted for sizes, which follow the plans of the default catalog in taking a GB as 1000 MB.
+//Sizes without a unit are in MB
+var sizeUnits = map[string]float64{
+	"MB":  1,
+	"GB":  1000,
+	"TB":  1000 * 1000,
+	"MIB": 1,
+	"GIB": 1024,
+	"TIB": 1024 * 1024,
+}
+
+//ParsePlanSettings reads the settings of the plan from its metadata. Sizes are numbers of MB or strings with a unit,
+//e.g. 500, "500" or "5GB", and counts are numbers or strings holding one
+func ParsePlanSettings(plan brokerapi.ServicePlan) (*PlanSettings, error) {
+	metadata := map[string]interface{}{}
+	if plan.Metadata != nil && plan.Metadata.AdditionalMetadata != nil {
+		metadata = plan.Metadata.AdditionalMetadata
+	}
+
+	s := &PlanSettings{}
+	problems := []string{}
+
+	v, ok := metadata["quotaMB"]
+	if !ok {
+		problems = append(problems, "'quotaMB' missing")
+	} else if quota, err := ParseSizeMB(v); err != nil {
+		problems = append(problems, "'quotaMB' "+err.Error())
+	} else if quota <= 0 {
+		problems = append(problems, "'quotaMB' must be positive")
+	} else {
+		s.QuotaMB = quota
+	}
+
+	for _, count := range []struct {
+		key string
+		out *int
+	}{{"instanceLimit", &s.InstanceLimit}, {"bucketCount", &s.BucketCount}} {
+		v, ok := metadata[count.key]
+		if !ok {
+			continue
+		}
+
+		c, err := parseCount(v)
+		if err != nil {
+			problems = append(problems, "'"+count.key+"' "+err.Error())
+			continue
+		}
+		*count.out = c
+	}
+
+	for _, name := range []struct {
+		key string
+		out *string
+	}{{"placement", &s.Placement}, {"storageClass", &s.StorageClass}} {
+		v, ok := metadata[name.key]
+		if !ok {
+			continue
+		}
+
+		value, isString := v.(string)
+		if !isString || strings.TrimSpace(value) == "" {
+			problems = append(problems, "'"+name.key+"' must be a name")
+			continue
+		}
+		*name.out = value
+	}
+
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, ", "))
+	}
+	return s, nil
+}
+
+//ParseSizeMB returns the size in MB of a number of MB or a string with an optional unit, e.g. "5GB" or "512 MiB"
+func ParseSizeMB(v interface{}) (int, error) {
+	var mb float64
+	switch v := v.(type) {
+	case float64:
+		mb = v
+	case int:
+		mb = float64(v)
+	case string:
+		s := strings.ToUpper(strings.TrimSpace(v))
+		number := strings.TrimRight(s, "MGTIB ")
+		unit := strings.TrimSpace(s[len(number):])
+		if unit == "" {
+			unit = "MB"
+		}
+
+		factor, ok := sizeUnits[unit]
+		if !ok {
+			return 0, fmt.Errorf("has an unknown unit '%s'", unit)
+		}
+		n, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return 0, fmt.Errorf("is not a size: '%s'", v)
+		}
+		mb = n * factor
+	default:
+		return 0, fmt.Errorf("must be a number or a string, not %v", v)
+	}
+
+	if mb != math.Trunc(mb) {
+		return 0, fmt.Errorf("must be a whole number of MB, not %v", mb)
+	}
+	return int(mb), nil
+}
+
+//Returns the non-negative count held by a number or string
+func parseCount(v interface{}) (int, error) {
+	var c float64
+	switch v := v.(type) {
+	case float64:
+		c = v
+	case int:
+		c = float64(v)
+	case string:
+		i, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return 0, fmt.Errorf("is not a number: '%s'", v)
+		}
+		c = float64(i)
+	default:
+		return 0, fmt.Errorf("must be a number or a string, not %v", v)
+	}
+
+	if c < 0 || c != math.Trunc(c) {
+		return 0, fmt.Errorf("must be a whole number of at least 0, not %v", c)
+	}
+	return int(c), nil
+}
+
+//ValidateCatalog returns the problems of the catalog: missing services, plans or required fields, IDs and names that
+//aren't unique, and plan metadata that can't be read
+func ValidateCatalog(services []brokerapi.Service) []string {
+	if len(services) == 0 {
+		return []string{"The catalog has no services"}
+	}
+
+	problems := []string{}
+	ids := map[string]string{}
+	serviceNames := map[string]bool{}
+	unique := func(id string, what string) {
+		if id == "" {
+			return
+		}
+		if other, ok := ids[id]; ok {
+			problems = append(problems, what+" has the same ID as "+other)
+			return
+		}
+		ids[id] = what
+	}
+
+	for i, s := range services {
+		label := fmt.Sprintf("number %d", i+1)
+		if s.Name != "" {
+			label = "'" + s.Name + "'"
+		}
+		service := "Service " + label
+
+		problems = append(problems, requiredFields(service, map[string]string{"id": s.ID, "name": s.Name, "description": s.Description})...)
+		unique(s.ID, service)
+		if s.Name != "" && serviceNames[s.Name] {
+			problems = append(problems, service+" is not the only service with that name")
+		}
+		serviceNames[s.Name] = true
+
+		if len(s.Plans) == 0 {
+			problems = append(problems, service+" has no plans")
+		}
+
+		planNames := map[string]bool{}
+		for j, p := range s.Plans {
+			plan := fmt.Sprintf("Plan number %d of service %s", j+1, label)
+			if p.Name != "" {
+				plan = "Plan '" + p.Name + "' of service " + label
+			}
+
+			problems = append(problems, requiredFields(plan, map[string]string{"id": p.ID, "name": p.Name, "description": p.Description})...)
+			unique(p.ID, plan)
+			if p.Name != "" && planNames[p.Name] {
+				problems = append(problems, plan+" is not the only plan of the service with that name")
+			}
+			planNames[p.Name] = true
+
+			if _, err := ParsePlanSettings(p); err != nil {
+				problems = append(problems, plan+" has invalid metadata: "+err.Error())
+			}
+		}
+	}
+
+	return problems
+}
+
+//Returns the problems of the fields that are empty
+func requiredFields(what string, fields map[string]string) []string {
+	problems := []string{}
+	for _, name := range []string{"id", "name", "description"} {
+		if fields[name] == "" {
+			problems = append(problems, what+" has no "+name)
+		}
+	}
+	return problems
+}
@@ -0,0 +1,194 @@
+package brokerConfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pivotal-cf/brokerapi"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+//Settings of the config file, by the environment variable they are overridden by
+var fileSettings = map[string]string{
+	"RADOS_ENDPOINT":            "radosgw.endpoint",
+	"RADOS_ACCESS_KEY":          "radosgw.access_key",
+	"RADOS_SECRET_KEY":          "radosgw.secret_key",
+	"RADOS_ADMIN":               "radosgw.admin_path",
+	"S3_PATH":                   "radosgw.s3_path",
+	"SWIFT_PATH":                "radosgw.swift_path",
+	"USE_HTTPS":                 "radosgw.use_https",
+	"RADOS_REGION":              "radosgw.region",
+	"BROKER_USERNAME":           "broker.username",
+	"BROKER_PASSWORD":           "broker.password",
+	"INSTANCE_LIMIT":            "broker.instance_limit",
+	"ORG_INSTANCE_LIMIT":        "broker.org_instance_limit",
+	"DASHBOARD_URL":             "broker.dashboard_url",
+	"ROTATION_GRACE_PERIOD":     "broker.rotation_grace_period",
+	"ROTATION_SWEEP_INTERVAL":   "broker.rotation_sweep_interval",
+	"INSTANCE_RECOUNT_INTERVAL": "broker.instance_recount_interval",
+	"USAGE_INTERVAL":            "broker.usage_interval",
+	"METERING_INTERVAL":         "broker.metering_interval",
+	"STATE_STORE":               "state_store.type",
+	"STATE_STORE_PATH":          "state_store.path",
+	"BUCKET_NAME":               "state_store.bucket_name",
+	"INSTANCE_PREFIX":           "state_store.instance_prefix",
+	"OPERATION_PREFIX":          "state_store.operation_prefix",
+	"AUDIT_SINKS":               "audit.sinks",
+	"AUDIT_FILE":                "audit.file",
+	"AUDIT_PREFIX":              "audit.prefix",
+	"AUDIT_FLUSH_INTERVAL":      "audit.flush_interval",
+	"SERVICES_FILE":             "services_file",
+}
+
+//Keys of the catalog and the backends in the config file
+const (
+	servicesKey = "services"
+	backendsKey = "backends"
+)
+
+//configFile holds the settings of a config file by their key, e.g. 'radosgw.endpoint'
+type configFile struct {
+	settings map[string]string
+	services []brokerapi.Service
+	backends map[string]BackendConfig
+	//Unknown or malformed settings
+	problems []string
+}
+
+//Returns the value of the setting by the name of its environment variable. The environment variable takes precedence
+func (f *configFile) lookup(env string) string {
+	if v := os.Getenv(env); v != "" {
+		return v
+	}
+	return f.settings[fileSettings[env]]
+}
+
+//Reads a YAML or JSON config file. The settings are grouped in sections, e.g. 'endpoint' in 'radosgw', and lists are
+//joined with commas. The catalog is read like the services file, and the backends by their name
+func readConfigFile(path string) (*configFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the config file '%s'. %v", path, err)
+	}
+
+	raw := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("Error parsing the config file '%s'. %v", path, err)
+	}
+
+	known := map[string]bool{}
+	for _, key := range fileSettings {
+		known[key] = true
+	}
+
+	f := &configFile{settings: map[string]string{}}
+	for _, section := range sortedKeys(raw) {
+		if section == servicesKey {
+			if err := convertYAML(raw[section], &f.services); err != nil {
+				f.problems = append(f.problems, "Error reading 'services'. "+err.Error())
+			}
+			continue
+		}
+		if section == backendsKey {
+			if err := convertYAML(raw[section], &f.backends); err != nil {
+				f.problems = append(f.problems, "Error reading 'backends'. "+err.Error())
+			}
+			continue
+		}
+
+		values, ok := raw[section].(map[interface{}]interface{})
+		if !ok {
+			values = map[interface{}]interface{}{"": raw[section]}
+		}
+		for k, v := range values {
+			key := section
+			if k != "" {
+				key += "." + fmt.Sprint(k)
+			}
+			if !known[key] {
+				f.problems = append(f.problems, "Unknown setting '"+key+"' in the config file")
+				continue
+			}
+
+			value, err := settingValue(v)
+			if err != nil {
+				f.problems = append(f.problems, "Error reading '"+key+"'. "+err.Error())
+				continue
+			}
+			f.settings[key] = value
+		}
+	}
+
+	sort.Strings(f.problems)
+	return f, nil
+}
+
+//Returns the value of a setting as the environment variable would hold it
+func settingValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		values := []string{}
+		for _, e := range v {
+			values = append(values, fmt.Sprint(e))
+		}
+		return strings.Join(values, ","), nil
+	case map[interface{}]interface{}:
+		return "", fmt.Errorf("Expected a value, not a section")
+	}
+	return fmt.Sprint(v), nil
+}
+
+//Decodes a value parsed from YAML into out by way of JSON, so the JSON field names of out apply
+func convertYAML(v interface{}, out interface{}) error {
+	data, err := json.Marshal(jsonCompatible(v))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+//Converts the maps parsed from YAML, which have interface keys, to maps that can be encoded as JSON
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonCompatible(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = jsonCompatible(e)
+		}
+		return l
+	}
+	return v
+}
+
+func readServicesFile(path string) ([]brokerapi.Service, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	services := []brokerapi.Service{}
+	if err := json.Unmarshal(data, &services); err != nil {
+		return nil, err
+	}
+	return services, nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
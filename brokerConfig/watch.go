@@ -0,0 +1,60 @@
+package brokerConfig
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+//Watch calls reload when the process receives SIGHUP, and when the content of one of the files returned by paths changes,
+//which is checked every interval. Paths are asked for again after each reload, so a services file the reloaded config points
+//to is watched from then on. Files replaced rather than written to, like mounted Kubernetes config maps, are noticed as well.
+//Runs until the process stops
+func Watch(paths func() []string, interval time.Duration, reload func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	last := readFiles(paths(), nil)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			reload()
+			last = readFiles(paths(), nil)
+		case <-ticker.C:
+			current := readFiles(paths(), last)
+			changed := false
+			for path, data := range current {
+				if prev, ok := last[path]; ok && !bytes.Equal(data, prev) {
+					changed = true
+				}
+			}
+			last = current
+			if changed {
+				reload()
+				last = readFiles(paths(), last)
+			}
+		}
+	}
+}
+
+//Returns the content of the files by their path. Files that can't be read keep their content in previous, or are left out
+func readFiles(paths []string, previous map[string][]byte) map[string][]byte {
+	files := map[string][]byte{}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if data, err := ioutil.ReadFile(path); err == nil {
+			files[path] = data
+		} else if data, ok := previous[path]; ok {
+			files[path] = data
+		}
+	}
+	return files
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"bytes"
+	"code.cloudfoundry.org/lager"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/icclab/ceph-objectstore-broker/audit"
+	"github.com/icclab/ceph-objectstore-broker/broker"
+	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
+	rg "github.com/icclab/ceph-objectstore-broker/radosgw"
+	"github.com/icclab/ceph-objectstore-broker/s3"
+	"github.com/pivotal-cf/brokerapi"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: cosb-admin [-config FILE] [-services FILE] [-url BROKER_URL] COMMAND [ARGS]
+
+Inspects and manages the state of the broker, using the same config file and environment variables as the broker.
+force-delete, sync-quotas and import are made through the admin API of the running broker at BROKER_URL, so its
+locks and instance counts cover them. The other commands read the state store and the radosgw directly.
+
+Commands:
+  instances                          List all instances
+  bindings INSTANCE_ID               List the bindings of an instance
+  show INSTANCE_ID                   Show an instance with its user, quota and usage
+  force-delete -yes INSTANCE_ID      Delete an instance with its bindings, buckets and data, ignoring its deletion policy
+  sync-quotas [-dry-run] [ID...]     Set the quotas of the instances, or all of them, back to their plans
+  export [-o FILE]                   Write the broker state as JSON to the file or stdout
+  import [-overwrite] [-i FILE]      Read broker state as JSON from the file or stdin
+  audit-verify [-i FILE | -s3] [-no-head]
+                                     Check that the records of an audit log file, or of the s3 audit sink, were neither modified
+                                     nor removed, and that the log reaches the head kept in the state store
+  metering [-start TIME] [-end TIME] [-group-by instance|organization|space|plan] [-format csv|json] [-o FILE]
+                                     Write a report of the traffic and storage of the instances, by default for the current month
+`
+
+func main() {
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "Config file of the broker")
+	services := flag.String("services", "", "Path of the service config of the broker, overriding the config file")
+	brokerUrl := flag.String("url", defaultBrokerUrl(), "URL of the running broker, for the commands made through its admin API")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+
+	if *services != "" {
+		os.Setenv("SERVICES_FILE", *services)
+	}
+
+	//Checking audit logs needs no broker. Without the head check it works without the broker's environment
+	if cmd == "audit-verify" {
+		if err := verifyAudit(*configFile, args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	//Changes to instances are made by the running broker, which holds the instance locks and counts
+	if cmd == "force-delete" || cmd == "sync-quotas" || cmd == "import" {
+		c, err := newAdminClient(*configFile, *brokerUrl)
+		if err == nil {
+			switch cmd {
+			case "force-delete":
+				err = forceDelete(c, args)
+			case "sync-quotas":
+				err = syncQuotas(c, args)
+			case "import":
+				err = importState(c, args)
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	b, err := setupBroker(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	switch cmd {
+	case "instances":
+		err = listInstances(b)
+	case "bindings":
+		err = listBindings(b, args)
+	case "show":
+		err = showInstance(b, args)
+	case "export":
+		err = exportState(b, args)
+	case "metering":
+		err = meteringReport(b, args)
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown command '"+cmd+"'")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	//Flushes the records of the audit sinks
+	if closeErr := b.Audit.Close(); closeErr != nil {
+		fmt.Fprintln(os.Stderr, "Failed to close the audit log.", closeErr)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+//Sets up a broker like the server does, without starting it. Log output goes to stderr to keep stdout for the command output
+func setupBroker(configFile string) (*broker.Broker, error) {
+	logger := lager.NewLogger("cosb-admin")
+	logger.RegisterSink(lager.NewWriterSink(os.Stderr, lager.INFO))
+
+	bc, err := brokerConfig.Load(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load broker config. %v", err)
+	}
+
+	rados := &rg.Radosgw{}
+	if err := rados.Setup(bc.RadosEndpoint, bc.RadosAdminPath, bc.RadosAccessKey, bc.RadosSecretKey); err != nil {
+		return nil, fmt.Errorf("Failed to setup radosgw client. %v", err)
+	}
+
+	s := &s3.S3{}
+	if err := s.Connect(bc.RadosEndpoint, bc.RadosAccessKey, bc.RadosSecretKey, bc.UseHttps); err != nil {
+		return nil, fmt.Errorf("Failed to setup S3 client. %v", err)
+	}
+
+	store, err := broker.NewStateStore(bc, s)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to setup the broker state store. %v", err)
+	}
+
+	auditor, err := broker.NewAuditor(bc, s, store, logger)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to setup the audit log. %v", err)
+	}
+
+	backends, err := broker.NewBackendClients(bc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &broker.Broker{
+		Logger:   logger,
+		Rados:    rados,
+		Backends: backends,
+		Config:   broker.NewConfig(bc),
+		Store:    store,
+		Audit:    auditor,
+		Locks:    broker.NewInstanceLocks(),
+		//The tool doesn't provision, so the instances are left uncounted
+		Counter:     broker.NewInstanceCounter(),
+		Retirements: broker.NewRetirementIndex(),
+	}, nil
+}
+
+//Returns a context identifying the operator running the command in the audit records
+func adminContext() context.Context {
+	return audit.NewContext(context.Background(), &audit.Identity{Platform: "cosb-admin", Value: adminUser()})
+}
+
+func adminUser() []byte {
+	user, _ := json.Marshal(map[string]string{"user": os.Getenv("USER")})
+	return user
+}
+
+func defaultBrokerUrl() string {
+	if url := os.Getenv("BROKER_URL"); url != "" {
+		return url
+	}
+	return "http://127.0.0.1:8080"
+}
+
+//Client of the admin API of the running broker, using the broker credentials of the config
+type adminClient struct {
+	url      string
+	username string
+	password string
+}
+
+func newAdminClient(configFile string, url string) (*adminClient, error) {
+	bc, err := brokerConfig.Load(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load broker config. %v", err)
+	}
+
+	return &adminClient{url: strings.TrimSuffix(url, "/"), username: bc.BrokerUsername, password: bc.BrokerPassword}, nil
+}
+
+//Sends the body as JSON and decodes the response into result. The operator is sent as the originating identity, so the
+//broker audits the change on their behalf
+func (c *adminClient) call(path string, body interface{}, result interface{}) error {
+	j, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", c.url+path, bytes.NewReader(j))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(audit.OriginatingIdentityHeader, "cosb-admin "+base64.StdEncoding.EncodeToString(adminUser()))
+	req.SetBasicAuth(c.username, c.password)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to reach the broker at %s. %v", c.url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		e := brokerapi.ErrorResponse{}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("The broker responded with %s. %s", resp.Status, e.Description)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func listInstances(b *broker.Broker) error {
+	ids, err := b.Store.ListInstances(adminContext())
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPLAN\tUSER\tQUOTA MB\tCREATED")
+	for _, id := range ids {
+		inst, err := b.Store.GetInstance(adminContext(), id)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", inst.ID, inst.PlanID, rg.UserID(inst.User, inst.Tenant), inst.QuotaMB, inst.CreatedAt.Format("2006-01-02 15:04"))
+	}
+
+	return w.Flush()
+}
+
+func listBindings(b *broker.Broker, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("bindings takes the ID of an instance")
+	}
+
+	ids, err := b.Store.ListBindings(adminContext(), args[0])
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSER\tSUBUSER\tACCESS\tS3 KEY\tSCOPES\tRETIRED")
+	for _, id := range ids {
+		bind, err := b.Store.GetBinding(adminContext(), args[0], id)
+		if err != nil {
+			return err
+		}
+
+		scopes := []string{}
+		for _, sc := range bind.Scopes {
+			scopes = append(scopes, sc.Bucket+"/"+sc.Prefix)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\n", id, rg.UserID(bind.User, bind.Tenant), bind.Subuser, bind.Access, bind.S3AccessKey,
+			strings.Join(scopes, ","), len(bind.Retired))
+	}
+
+	return w.Flush()
+}
+
+func showInstance(b *broker.Broker, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("show takes the ID of an instance")
+	}
+
+	inst, err := b.Store.GetInstance(adminContext(), args[0])
+	if err != nil {
+		return err
+	}
+
+	bindIDs, err := b.Store.ListBindings(adminContext(), inst.ID)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", inst.ID)
+	fmt.Fprintf(w, "Service:\t%s\n", inst.ServiceID)
+	fmt.Fprintf(w, "Plan:\t%s\n", inst.PlanID)
+	fmt.Fprintf(w, "Organization:\t%s\n", inst.OrganizationGUID)
+	fmt.Fprintf(w, "Space:\t%s\n", inst.SpaceGUID)
+	if inst.Platform != "" {
+		fmt.Fprintf(w, "Platform:\t%s\n", inst.Platform)
+	}
+	if inst.Namespace != "" {
+		fmt.Fprintf(w, "Namespace:\t%s (cluster %s)\n", inst.Namespace, inst.ClusterID)
+	}
+	if inst.CreatedBy != nil {
+		fmt.Fprintf(w, "Created by:\t%s %s\n", inst.CreatedBy.Platform, inst.CreatedBy.Value)
+	}
+	if inst.Backend != "" {
+		fmt.Fprintf(w, "Backend:\t%s\n", inst.Backend)
+	}
+	if inst.Placement != "" {
+		fmt.Fprintf(w, "Placement:\t%s %s\n", inst.Placement, inst.StorageClass)
+	}
+	fmt.Fprintf(w, "User:\t%s\n", rg.UserID(inst.User, inst.Tenant))
+	fmt.Fprintf(w, "Buckets:\t%s\n", strings.Join(inst.Buckets, ", "))
+	fmt.Fprintf(w, "Deletion policy:\t%s\n", inst.DeletionPolicy)
+	fmt.Fprintf(w, "Bindings:\t%d\n", len(bindIDs))
+	fmt.Fprintf(w, "Recorded quota:\t%d MB\n", inst.QuotaMB)
+
+	rados, err := b.InstanceRadosgw(inst)
+	if err != nil {
+		return err
+	}
+
+	//The user may be missing on the radosgw, which is worth showing rather than failing on
+	if quota, err := rados.GetUserQuotaMB(adminContext(), inst.User, inst.Tenant); err != nil {
+		fmt.Fprintf(w, "Quota:\tunavailable (%v)\n", err)
+	} else {
+		fmt.Fprintf(w, "Quota:\t%d MB\n", quota)
+	}
+	if usage, err := rados.GetUserUsageMB(adminContext(), inst.User, inst.Tenant); err != nil {
+		fmt.Fprintf(w, "Usage:\tunavailable (%v)\n", err)
+	} else {
+		fmt.Fprintf(w, "Usage:\t%d MB\n", usage)
+	}
+
+	return w.Flush()
+}
+
+func forceDelete(c *adminClient, args []string) error {
+	fs := flag.NewFlagSet("force-delete", flag.ExitOnError)
+	yes := fs.Bool("yes", false, "Confirm deleting the instance along with all of its data")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("force-delete takes the ID of an instance")
+	}
+	if !*yes {
+		return fmt.Errorf("force-delete deletes all data of the instance and must be confirmed with -yes")
+	}
+
+	path := strings.Replace(broker.ForceDeletePath, "{instance_id}", fs.Arg(0), 1)
+	if err := c.call(path, nil, &brokerapi.EmptyResponse{}); err != nil {
+		return err
+	}
+
+	fmt.Println("Deleted instance", fs.Arg(0))
+	return nil
+}
+
+func syncQuotas(c *adminClient, args []string) error {
+	fs := flag.NewFlagSet("sync-quotas", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Only show the quotas that would change")
+	fs.Parse(args)
+
+	syncs := []broker.QuotaSync{}
+	if err := c.call(broker.SyncQuotasPath, broker.SyncQuotasRequest{InstanceIDs: fs.Args(), DryRun: *dryRun}, &syncs); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPLAN\tOLD QUOTA MB\tQUOTA MB\tUSAGE MB\tCHANGED")
+	failed := 0
+	for _, sync := range syncs {
+		if sync.Error != "" {
+			fmt.Fprintf(w, "%s\t\t\t\t\tfailed: %s\n", sync.InstanceID, sync.Error)
+			failed++
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%t\n", sync.InstanceID, sync.PlanID, sync.OldQuotaMB, sync.QuotaMB, sync.UsageMB, sync.Changed)
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("Failed to sync the quota of %d instances", failed)
+	}
+
+	return nil
+}
+
+func exportState(b *broker.Broker, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("o", "", "File to write the state to. Defaults to stdout")
+	fs.Parse(args)
+
+	exp, err := broker.ExportState(adminContext(), b.Store)
+	if err != nil {
+		return err
+	}
+
+	j, err := json.MarshalIndent(exp, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		_, err = fmt.Println(string(j))
+		return err
+	}
+
+	return ioutil.WriteFile(*out, j, 0600)
+}
+
+func importState(c *adminClient, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	in := fs.String("i", "", "File to read the state from. Defaults to stdin")
+	overwrite := fs.Bool("overwrite", false, "Replace instances that are already in the state store")
+	fs.Parse(args)
+
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	exp := &broker.StateExport{}
+	if err := json.NewDecoder(r).Decode(exp); err != nil {
+		return fmt.Errorf("Failed to parse state. %v", err)
+	}
+
+	path := broker.ImportStatePath
+	if *overwrite {
+		path += "?overwrite=true"
+	}
+	resp := broker.ImportStateResponse{}
+	if err := c.call(path, exp, &resp); err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %d of %d instances\n", resp.Imported, resp.Instances)
+	return nil
+}
+
+func meteringReport(b *broker.Broker, args []string) error {
+	now := time.Now().UTC()
+	fs := flag.NewFlagSet("metering", flag.ExitOnError)
+	startArg := fs.String("start", time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).Format(time.RFC3339), "Start of the report as RFC 3339 time")
+	endArg := fs.String("end", now.Format(time.RFC3339), "End of the report as RFC 3339 time")
+	groupBy := fs.String("group-by", broker.GroupByInstance, "Sum up the usage by instance, organization, space or plan")
+	format := fs.String("format", "csv", "Format of the report, csv or json")
+	out := fs.String("o", "", "File to write the report to. Defaults to stdout")
+	fs.Parse(args)
+
+	if *format != "csv" && *format != "json" {
+		return fmt.Errorf("The format must be 'csv' or 'json'")
+	}
+
+	start, err := time.Parse(time.RFC3339, *startArg)
+	if err != nil {
+		return fmt.Errorf("Invalid start. %v", err)
+	}
+	end, err := time.Parse(time.RFC3339, *endArg)
+	if err != nil {
+		return fmt.Errorf("Invalid end. %v", err)
+	}
+
+	report, err := b.Meter(adminContext(), start, end)
+	if err != nil {
+		return err
+	}
+	if report, err = report.Aggregate(*groupBy); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if *format == "csv" {
+		return report.WriteCSV(w)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+//Checks the chains of an audit log, and that it reaches the head kept in the state store unless -no-head is set
+func verifyAudit(configFile string, args []string) error {
+	fs := flag.NewFlagSet("audit-verify", flag.ExitOnError)
+	in := fs.String("i", "", "Audit log file to check. Defaults to stdin")
+	fromS3 := fs.Bool("s3", false, "Check the records the s3 audit sink wrote to the broker bucket")
+	noHead := fs.Bool("no-head", false, "Don't check that the log reaches the head kept in the state store, e.g. for logs of other hosts")
+	fs.Parse(args)
+
+	var r io.Reader = os.Stdin
+	head := ""
+	if *fromS3 || !*noHead {
+		bc, err := brokerConfig.Load(configFile)
+		if err != nil {
+			return fmt.Errorf("Failed to load broker config. %v", err)
+		}
+
+		s := &s3.S3{}
+		if err := s.Connect(bc.RadosEndpoint, bc.RadosAccessKey, bc.RadosSecretKey, bc.UseHttps); err != nil {
+			return fmt.Errorf("Failed to setup S3 client. %v", err)
+		}
+
+		if !*noHead {
+			store, err := broker.NewStateStore(bc, s)
+			if err != nil {
+				return fmt.Errorf("Failed to setup the broker state store. %v", err)
+			}
+			if head, err = store.GetAuditHead(context.Background()); err != nil {
+				return fmt.Errorf("Failed to read the hash of the last audit record. %v", err)
+			}
+		}
+
+		if *fromS3 {
+			if r, err = audit.NewS3Reader(context.Background(), s, bc.BucketName, bc.AuditPrefix); err != nil {
+				return err
+			}
+		}
+	}
+	if !*fromS3 && *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	n, err := audit.VerifyHead(r, head)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Verified %d records\n", n)
+	return nil
+}
@@ -2,17 +2,30 @@ package main
 
 import (
 	"code.cloudfoundry.org/lager"
+	"context"
+	"flag"
+	"github.com/icclab/ceph-objectstore-broker/audit"
 	"github.com/icclab/ceph-objectstore-broker/broker"
 	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
+	"github.com/icclab/ceph-objectstore-broker/metrics"
 	rg "github.com/icclab/ceph-objectstore-broker/radosgw"
 	"github.com/icclab/ceph-objectstore-broker/s3"
-	"github.com/icclab/ceph-objectstore-broker/utils"
 	"github.com/pivotal-cf/brokerapi"
+	"github.com/prometheus/client_golang/prometheus"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
+//How often the config file is checked for changes
+const configCheckInterval = 10 * time.Second
+
 func main() {
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "YAML or JSON config file of the broker. Environment variables override its settings")
+	flag.Parse()
+
 	//Init logger
 	logger := lager.NewLogger("broker")
 	logger.RegisterSink(lager.NewWriterSink(os.Stdout, lager.INFO))
@@ -20,22 +33,13 @@ func main() {
 	logger.Info("Broker starting")
 
 	//Load configs
-	bc := &brokerConfig.BrokerConfig{}
-	err := bc.Update()
+	bc, err := brokerConfig.Load(*configFile)
 	if err != nil {
 		logger.Error("Failed to load broker config", err)
 		return
 	}
 	logger.Info("Loaded broker config")
 
-	services := []brokerapi.Service{}
-	err = utils.LoadJsonFromFile("brokerConfig/service-config.json", &services)
-	if err != nil {
-		logger.Error("Failed to load service config", err)
-		return
-	}
-	logger.Info("Loaded service config")
-
 	//Connect to rgw
 	rados := &rg.Radosgw{}
 	if err := rados.Setup(bc.RadosEndpoint, bc.RadosAdminPath, bc.RadosAccessKey, bc.RadosSecretKey); err != nil {
@@ -43,6 +47,16 @@ func main() {
 		return
 	}
 
+	//Connect to the radosgws of the other backends
+	backends, err := broker.NewBackendClients(bc)
+	if err != nil {
+		logger.Error("Failed to setup the backends", err)
+		return
+	}
+	if len(backends) > 0 {
+		logger.Info("Using backends " + strings.Join(bc.BackendNames(), ", "))
+	}
+
 	//Create s3 client
 	s := &s3.S3{}
 	err = s.Connect(bc.RadosEndpoint, bc.RadosAccessKey, bc.RadosSecretKey, bc.UseHttps)
@@ -51,30 +65,116 @@ func main() {
 		return
 	}
 
-	brok := &broker.Broker{
-		Logger:            logger,
-		Rados:             rados,
-		ServiceConfig:     services,
-		BrokerConfig:      bc,
-		S3:                s,
-		ShouldReturnAsync: false,
+	//Setup the state store
+	store, err := broker.NewStateStore(bc, s)
+	if err != nil {
+		logger.Error("Failed to setup the broker state store", err)
+		return
 	}
 
-	if b, bucketExistErr := s.BucketExists(bc.BucketName); !b && bucketExistErr == nil {
-		if err = s.CreateBucket(bc.BucketName); err != nil {
-			logger.Error("Failed to create base bucket of the broker", err)
+	//The broker bucket holds the state of the S3 state store and the records of the S3 audit sink
+	useBucket := bc.StateStore == broker.S3StateStore
+	for _, sink := range bc.AuditSinks {
+		useBucket = useBucket || sink == audit.S3SinkName
+	}
+	if useBucket {
+		if b, bucketExistErr := s.BucketExists(context.Background(), bc.BucketName); !b && bucketExistErr == nil {
+			if err = s.CreateBucket(context.Background(), bc.BucketName); err != nil {
+				logger.Error("Failed to create base bucket of the broker", err)
+				return
+			}
+		} else if bucketExistErr != nil {
+			logger.Error("Failed to check if base bucket of the broker exists", bucketExistErr)
 			return
 		}
-	} else if bucketExistErr != nil {
-		logger.Error("Failed to check if base bucket of the broker exists", bucketExistErr)
+		logger.Info("Ensured broker bucket exists on Ceph")
+	}
+	logger.Info("Using '" + bc.StateStore + "' state store")
+
+	//Setup the audit log, which is kept apart from the logs of the broker
+	auditor, err := broker.NewAuditor(bc, s, store, logger)
+	if err != nil {
+		logger.Error("Failed to setup the audit log", err)
+		return
+	}
+	defer auditor.Close()
+	if auditor != nil {
+		logger.Info("Writing audit records to " + strings.Join(bc.AuditSinks, ", "))
+	}
+
+	//Count the existing instances for the instance limits
+	counter := broker.NewInstanceCounter()
+	if err := counter.Rebuild(context.Background(), store); err != nil {
+		logger.Error("Failed to count the instances in the state store", err)
+		return
+	}
+	logger.Info("Counted " + strconv.Itoa(counter.Count()) + " instances")
+
+	//Find the credentials replaced by rotations that are yet to be deleted
+	retirements := broker.NewRetirementIndex()
+	if err := retirements.Rebuild(context.Background(), store); err != nil {
+		logger.Error("Failed to read the retired credentials in the state store", err)
+		return
+	}
+
+	brok := &broker.Broker{
+		Logger:      logger,
+		Rados:       rados,
+		Backends:    backends,
+		Config:      broker.NewConfig(bc),
+		Store:       store,
+		Audit:       auditor,
+		Locks:       broker.NewInstanceLocks(),
+		Counter:     counter,
+		Retirements: retirements,
+	}
+
+	//Plans can only be provisioned in placement targets and storage classes the radosgws have
+	if err := brok.ValidatePlacements(context.Background()); err != nil {
+		logger.Error("Invalid placements", err)
 		return
 	}
-	logger.Info("Ensured broker bucket exists on Ceph")
 
 	//Start the broker
 	creds := brokerapi.BrokerCredentials{Username: bc.BrokerUsername, Password: bc.BrokerPassword}
-	handler := brokerapi.New(brok, logger, creds)
-	http.Handle("/", handler)
+	handler := broker.NewAPIHandler(metrics.InstrumentBroker(brok), brok, logger, creds)
+	http.Handle("/", audit.IdentityHandler(handler))
+	http.Handle("/admin/", broker.NewAdminHandler(brok, logger, bc.BrokerUsername, bc.BrokerPassword))
+
+	//Collect the storage usage of the instances for the metrics and the admin API
+	brok.Usage = broker.NewUsageCollector(brok)
+	go brok.Usage.Run(bc.UsageInterval)
+
+	//Meter the traffic and storage of the instances from the usage log of the radosgw
+	brok.Metering = broker.NewMeteringCollector(brok, bc.MeteringInterval)
+	go brok.Metering.Run()
+
+	//Expose metrics for Prometheus
+	prometheus.MustRegister(broker.NewStateCollector(brok), brok.Usage)
+	http.Handle("/metrics", metrics.Handler())
+
+	//Delete credentials replaced by rotations once their grace period is over
+	go func() {
+		for range time.Tick(bc.RotationSweepInterval) {
+			if err := brok.DeleteRetiredCredentials(context.Background()); err != nil {
+				logger.Error("Failed to delete retired credentials", err)
+			}
+		}
+	}()
+
+	//Catch up with the instances provisioned and deprovisioned by other replicas sharing the state store
+	go func() {
+		for range time.Tick(bc.InstanceRecountInterval) {
+			if err := brok.RecountInstances(context.Background()); err != nil {
+				logger.Error("Failed to recount the instances", err)
+			}
+		}
+	}()
+
+	//Apply changes of the catalog and the settings that don't need a restart, on SIGHUP or when the config or services file changes
+	watched := func() []string { return []string{*configFile, brok.Config.Get().ServicesFile} }
+	go brokerConfig.Watch(watched, configCheckInterval, func() { brok.ReloadConfig(context.Background()) })
+
 	logger.Info("Starting server on port: 8080")
 	err = http.ListenAndServe(":8080", nil)
 	if err != nil {
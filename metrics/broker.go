@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"context"
+	"github.com/pivotal-cf/brokerapi"
+	"time"
+)
+
+//instrumentedBroker records the OSB requests handled by the wrapped broker
+type instrumentedBroker struct {
+	broker brokerapi.ServiceBroker
+}
+
+//InstrumentBroker wraps a broker so the duration and result of every OSB operation is recorded
+func InstrumentBroker(b brokerapi.ServiceBroker) brokerapi.ServiceBroker {
+	return &instrumentedBroker{broker: b}
+}
+
+func (ib *instrumentedBroker) Services(ctx context.Context) (services []brokerapi.Service, err error) {
+	defer observeOSB("catalog", time.Now(), &err)
+	return ib.broker.Services(ctx)
+}
+
+func (ib *instrumentedBroker) Provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (spec brokerapi.ProvisionedServiceSpec, err error) {
+	defer observeOSB("provision", time.Now(), &err)
+	return ib.broker.Provision(ctx, instanceID, details, asyncAllowed)
+}
+
+func (ib *instrumentedBroker) Deprovision(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (spec brokerapi.DeprovisionServiceSpec, err error) {
+	defer observeOSB("deprovision", time.Now(), &err)
+	return ib.broker.Deprovision(ctx, instanceID, details, asyncAllowed)
+}
+
+func (ib *instrumentedBroker) Bind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (binding brokerapi.Binding, err error) {
+	defer observeOSB("bind", time.Now(), &err)
+	return ib.broker.Bind(ctx, instanceID, bindingID, details)
+}
+
+func (ib *instrumentedBroker) Unbind(ctx context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) (err error) {
+	defer observeOSB("unbind", time.Now(), &err)
+	return ib.broker.Unbind(ctx, instanceID, bindingID, details)
+}
+
+func (ib *instrumentedBroker) Update(ctx context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (spec brokerapi.UpdateServiceSpec, err error) {
+	defer observeOSB("update", time.Now(), &err)
+	return ib.broker.Update(ctx, instanceID, details, asyncAllowed)
+}
+
+func (ib *instrumentedBroker) LastOperation(ctx context.Context, instanceID, operationData string) (op brokerapi.LastOperation, err error) {
+	defer observeOSB("last_operation", time.Now(), &err)
+	return ib.broker.LastOperation(ctx, instanceID, operationData)
+}
+
+func observeOSB(operation string, start time.Time, err *error) {
+	ObserveOSBRequest(operation, start, *err)
+}
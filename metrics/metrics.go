@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+const namespace = "cosb"
+
+//Results of requests and calls, as used in the result label
+const (
+	ResultSuccess = "success"
+	ResultError   = "error"
+)
+
+var (
+	osbRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "osb_requests_total",
+		Help:      "Number of OSB API requests handled, by operation and result.",
+	}, []string{"operation", "result"})
+
+	osbDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "osb_request_duration_seconds",
+		Help:      "Time taken to handle OSB API requests, by operation and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "result"})
+
+	radosgwDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "radosgw_call_duration_seconds",
+		Help:      "Time taken by radosgw admin API calls, by call and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"call", "result"})
+
+	radosgwErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "radosgw_call_errors_total",
+		Help:      "Number of failed radosgw admin API calls, by call.",
+	}, []string{"call"})
+
+	s3Duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "s3_call_duration_seconds",
+		Help:      "Time taken by S3 calls, including those of the S3 state store, by call and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"call", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(osbRequests, osbDuration, radosgwDuration, radosgwErrors, s3Duration)
+}
+
+//Handler returns the handler of the metrics endpoint, which exposes all registered metrics in the Prometheus format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+//ObserveOSBRequest records the duration and result of an OSB API request
+func ObserveOSBRequest(operation string, start time.Time, err error) {
+	r := result(err)
+	osbRequests.WithLabelValues(operation, r).Inc()
+	osbDuration.WithLabelValues(operation, r).Observe(time.Since(start).Seconds())
+}
+
+//ObserveRadosgwCall records the duration and result of a radosgw admin API call.
+//It is meant to be deferred with the named error result of the call
+func ObserveRadosgwCall(call string, start time.Time, err *error) {
+	r := result(*err)
+	radosgwDuration.WithLabelValues(call, r).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		radosgwErrors.WithLabelValues(call).Inc()
+	}
+}
+
+//ObserveS3Call records the duration and result of an S3 call.
+//It is meant to be deferred with the named error result of the call
+func ObserveS3Call(call string, start time.Time, err *error) {
+	s3Duration.WithLabelValues(call, result(*err)).Observe(time.Since(start).Seconds())
+}
+
+func result(err error) string {
+	if err != nil {
+		return ResultError
+	}
+
+	return ResultSuccess
+}
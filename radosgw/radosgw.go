@@ -2,8 +2,13 @@ package radosgw
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"github.com/icclab/ceph-objectstore-broker/metrics"
 	rgw "github.com/myENA/radosgwadmin"
 	rcl "github.com/myENA/restclient"
+	"net/http"
+	"strings"
 	"time"
 )
 
@@ -11,6 +16,8 @@ type Radosgw struct {
 	conn      *rgw.AdminAPI
 	keyID     string
 	secretKey string
+	//Called with the outcome of every call to the admin API, if set
+	observer func(call string, err error)
 }
 
 func (rg *Radosgw) Setup(radosUrl string, radosAdminPath string, keyID string, secretKey string) error {
@@ -36,8 +43,26 @@ func (rg *Radosgw) Setup(radosUrl string, radosAdminPath string, keyID string, s
 	return nil
 }
 
-func (rg *Radosgw) CreateUser(name string, dispName string, tenant string) error {
-	_, err := rg.conn.UserCreate(context.Background(), &rgw.UserCreateRequest{UID: name, DisplayName: dispName, Tenant: tenant})
+//WithObserver returns a copy of the client sharing its connection, which reports every call to the admin API to the observer
+func (rg *Radosgw) WithObserver(observer func(call string, err error)) *Radosgw {
+	c := *rg
+	c.observer = observer
+	return &c
+}
+
+//Records a call in the metrics and reports it to the observer. Deferred with a pointer to the named error result of the call
+func (rg *Radosgw) observe(call string, start time.Time, err *error) {
+	metrics.ObserveRadosgwCall(call, start, err)
+	if rg.observer != nil {
+		rg.observer(call, *err)
+	}
+}
+
+//A maxBuckets of 0 leaves the radosgw default in place
+func (rg *Radosgw) CreateUser(ctx context.Context, name string, dispName string, tenant string, maxBuckets int) (err error) {
+	defer rg.observe("create-user", time.Now(), &err)
+
+	_, err = rg.conn.UserCreate(ctx, &rgw.UserCreateRequest{UID: name, DisplayName: dispName, Tenant: tenant, MaxBuckets: maxBuckets})
 	if err != nil {
 		return err
 	}
@@ -45,8 +70,10 @@ func (rg *Radosgw) CreateUser(name string, dispName string, tenant string) error
 	return nil
 }
 
-func (rg *Radosgw) GetUser(name string, tenant string, getStats bool) (*rgw.UserInfoResponse, error) {
-	userInfo, err := rg.conn.UserInfo(context.Background(), tenant+"$"+name, getStats)
+func (rg *Radosgw) GetUser(ctx context.Context, name string, tenant string, getStats bool) (userInfo *rgw.UserInfoResponse, err error) {
+	defer rg.observe("get-user", time.Now(), &err)
+
+	userInfo, err = rg.conn.UserInfo(ctx, tenant+"$"+name, getStats)
 	if err != nil {
 		return nil, err
 	}
@@ -54,8 +81,58 @@ func (rg *Radosgw) GetUser(name string, tenant string, getStats bool) (*rgw.User
 	return userInfo, nil
 }
 
-func (rg *Radosgw) SetUserQuota(name string, tenant string, sizeMB int) error {
-	err := rg.conn.QuotaSet(context.Background(), &rgw.QuotaSetRequest{UID: tenant + "$" + name, QuotaType: "user", MaximumSizeKb: sizeMB * 1024, Enabled: true})
+//Returns the IDs of all users on the radosgw, with the tenant prefixed as 'tenant$user' for users in a tenant
+func (rg *Radosgw) ListUsers(ctx context.Context) (users []string, err error) {
+	defer rg.observe("list-users", time.Now(), &err)
+
+	users, err = rg.conn.MListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+//Returns the metadata of a user, which holds its keys and subusers along with the time it was last modified
+func (rg *Radosgw) GetUserMetadata(ctx context.Context, name string, tenant string) (meta *rgw.MUserResponse, err error) {
+	defer rg.observe("get-user-metadata", time.Now(), &err)
+
+	meta, err = rg.conn.MGetUser(ctx, UserID(name, tenant))
+	if err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+//UserID returns the ID the radosgw uses for a user, which is prefixed by its tenant if it has one
+func UserID(name string, tenant string) string {
+	if tenant == "" {
+		return name
+	}
+
+	return tenant + "$" + name
+}
+
+//SplitUserID splits a user ID as returned by ListUsers into the user's name and tenant
+func SplitUserID(id string) (name string, tenant string) {
+	if i := strings.Index(id, "$"); i >= 0 {
+		return id[i+1:], id[:i]
+	}
+
+	return id, ""
+}
+
+//A maxObjects of 0 or less removes the limit on the number of objects
+func (rg *Radosgw) SetUserQuota(ctx context.Context, name string, tenant string, sizeMB int, maxObjects int) (err error) {
+	defer rg.observe("set-user-quota", time.Now(), &err)
+
+	if maxObjects <= 0 {
+		maxObjects = -1
+	}
+
+	err = rg.conn.QuotaSet(ctx, &rgw.QuotaSetRequest{UID: tenant + "$" + name, QuotaType: "user", MaximumSizeKb: sizeMB * 1024,
+		MaximumObjects: maxObjects, Enabled: true})
 	if err != nil {
 		return err
 	}
@@ -63,8 +140,115 @@ func (rg *Radosgw) SetUserQuota(name string, tenant string, sizeMB int) error {
 	return nil
 }
 
-func (rg *Radosgw) GetUserQuotaMB(name string, tenant string) (int, error) {
-	q, err := rg.conn.QuotaUser(context.Background(), tenant+"$"+name)
+func (rg *Radosgw) SetUserMaxBuckets(ctx context.Context, name string, tenant string, maxBuckets int) (err error) {
+	defer rg.observe("set-user-max-buckets", time.Now(), &err)
+
+	_, err = rg.conn.UserModify(ctx, &rgw.UserModifyRequest{UID: tenant + "$" + name, MaxBuckets: maxBuckets})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+//SetUserPlacement sets the placement target the buckets of the user are created in by default, and the storage class objects
+//are written with unless requested otherwise. An empty storage class is the default of the placement target. The admin API
+//can't change them through the user, so the user's metadata is read and written back with the new placement
+func (rg *Radosgw) SetUserPlacement(ctx context.Context, name string, tenant string, placement string, storageClass string) (err error) {
+	defer rg.observe("set-user-placement", time.Now(), &err)
+
+	key := &metadataKey{Key: UserID(name, tenant)}
+	meta := &userMetadata{}
+	if err = rg.conn.Get(ctx, "metadata/user", key, meta); err != nil {
+		return err
+	}
+
+	data, ok := meta.fields["data"].(map[string]interface{})
+	if !ok {
+		return errors.New("Metadata of user '" + key.Key + "' not returned by the radosgw")
+	}
+	data["default_placement"] = placement
+	data["default_storage_class"] = storageClass
+
+	return rg.conn.Put(ctx, "metadata/user", key, meta, nil)
+}
+
+//GetPlacementTargets returns the storage classes of the placement targets of the zonegroups of the radosgw by the name of the
+//target. Releases before Nautilus don't list storage classes, so their targets only have the STANDARD class
+func (rg *Radosgw) GetPlacementTargets(ctx context.Context) (targets map[string][]string, err error) {
+	defer rg.observe("get-placement-targets", time.Now(), &err)
+
+	zonegroups := &zonegroupMap{}
+	if err = rg.conn.Get(ctx, "config", &configType{Type: "zonegroup-map"}, zonegroups); err != nil {
+		return nil, err
+	}
+
+	targets = map[string][]string{}
+	for _, zg := range zonegroups.Zonegroups {
+		for _, t := range zg.Val.PlacementTargets {
+			classes := t.StorageClasses
+			if len(classes) == 0 {
+				classes = []string{StandardStorageClass}
+			}
+			targets[t.Name] = append(targets[t.Name], classes...)
+		}
+	}
+
+	return targets, nil
+}
+
+//Storage class every placement target has
+const StandardStorageClass = "STANDARD"
+
+//Query of the metadata calls of the admin API
+type metadataKey struct {
+	Key string `url:"key"`
+}
+
+//Query of the config call of the admin API
+type configType struct {
+	Type string `url:"type"`
+}
+
+//Query of the usage call of the admin API. rgw.UsageRequest can't be used, as the radosgw doesn't understand the format its
+//times are encoded in
+type usageQuery struct {
+	Start       string `url:"start"`
+	End         string `url:"end"`
+	ShowEntries bool   `url:"show-entries"`
+}
+
+//Format of the times in usage queries, which the radosgw takes as UTC
+const usageTimeFormat = "2006-01-02 15:04:05"
+
+//zonegroupMap is the part of the zonegroup map of the radosgw the broker reads
+type zonegroupMap struct {
+	Zonegroups []struct {
+		Val struct {
+			Name             string `json:"name"`
+			PlacementTargets []struct {
+				Name           string   `json:"name"`
+				StorageClasses []string `json:"storage_classes"`
+			} `json:"placement_targets"`
+		} `json:"val"`
+	} `json:"zonegroups"`
+}
+
+//userMetadata is the metadata of a user as a whole, so writing it back leaves the fields the broker doesn't know untouched
+type userMetadata struct {
+	fields map[string]interface{}
+}
+
+func (m *userMetadata) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &m.fields)
+}
+
+func (m *userMetadata) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.fields)
+}
+
+func (rg *Radosgw) GetUserQuotaMB(ctx context.Context, name string, tenant string) (int, error) {
+	q, err := rg.GetUserQuota(ctx, name, tenant)
 	if err != nil {
 		return -1, err
 	}
@@ -72,8 +256,48 @@ func (rg *Radosgw) GetUserQuotaMB(name string, tenant string) (int, error) {
 	return (int)(q.MaxSizeKb / 1024), nil
 }
 
-func (rg *Radosgw) GetUserUsageMB(name string, tenant string) (int, error) {
-	userInfo, err := rg.GetUser(name, tenant, true)
+//Returns the user quota, whose size and object limits are -1 if unlimited
+func (rg *Radosgw) GetUserQuota(ctx context.Context, name string, tenant string) (quota *rgw.QuotaMeta, err error) {
+	defer rg.observe("get-user-quota", time.Now(), &err)
+
+	quota, err = rg.conn.QuotaUser(ctx, tenant+"$"+name)
+	if err != nil {
+		return nil, err
+	}
+
+	return quota, nil
+}
+
+//Returns the size and number of objects of all buckets of the user
+func (rg *Radosgw) GetUserStats(ctx context.Context, name string, tenant string) (*rgw.UserStats, error) {
+	userInfo, err := rg.GetUser(ctx, name, tenant, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if userInfo.Stats == nil {
+		return nil, errors.New("Stats of user '" + UserID(name, tenant) + "' not returned by the radosgw")
+	}
+
+	return userInfo.Stats, nil
+}
+
+//Returns the usage log entries of all users between start and end, which the radosgw records per user, bucket and hour.
+//The radosgw only keeps a usage log if 'rgw enable usage log' is set
+func (rg *Radosgw) GetUsageLog(ctx context.Context, start time.Time, end time.Time) (usage *rgw.UsageResponse, err error) {
+	defer rg.observe("get-usage", time.Now(), &err)
+
+	usage = &rgw.UsageResponse{}
+	query := &usageQuery{Start: start.UTC().Format(usageTimeFormat), End: end.UTC().Format(usageTimeFormat), ShowEntries: true}
+	if err = rg.conn.Get(ctx, "usage", query, usage); err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+func (rg *Radosgw) GetUserUsageMB(ctx context.Context, name string, tenant string) (int, error) {
+	userInfo, err := rg.GetUser(ctx, name, tenant, true)
 	if err != nil {
 		return -1, err
 	}
@@ -81,8 +305,10 @@ func (rg *Radosgw) GetUserUsageMB(name string, tenant string) (int, error) {
 	return userInfo.Stats.SizeKB / 1024, nil
 }
 
-func (rg *Radosgw) DeleteUser(name string, tenant string) error {
-	err := rg.conn.UserRm(context.Background(), tenant+"$"+name, true)
+func (rg *Radosgw) DeleteUser(ctx context.Context, name string, tenant string) (err error) {
+	defer rg.observe("delete-user", time.Now(), &err)
+
+	err = rg.conn.UserRm(ctx, tenant+"$"+name, true)
 	if err != nil {
 		return err
 	}
@@ -90,9 +316,11 @@ func (rg *Radosgw) DeleteUser(name string, tenant string) error {
 	return nil
 }
 
-//Creating a subuser creates a swift key
-func (rg *Radosgw) CreateSubuser(user string, subuser string, tenant string) (*rgw.SubUser, error) {
-	subusers, err := rg.conn.SubUserCreate(context.Background(), &rgw.SubUserCreateModifyRequest{UID: tenant + "$" + user, SubUser: subuser, Access: "readwrite"})
+//Creating a subuser creates a swift key. Access is one of read, write, readwrite or full
+func (rg *Radosgw) CreateSubuser(ctx context.Context, user string, subuser string, tenant string, access string) (su *rgw.SubUser, err error) {
+	defer rg.observe("create-subuser", time.Now(), &err)
+
+	subusers, err := rg.conn.SubUserCreate(ctx, &rgw.SubUserCreateModifyRequest{UID: tenant + "$" + user, SubUser: subuser, Access: access})
 	if err != nil {
 		return nil, err
 	}
@@ -100,9 +328,11 @@ func (rg *Radosgw) CreateSubuser(user string, subuser string, tenant string) (*r
 	return &subusers[len(subusers)-1], nil
 }
 
-func (rg *Radosgw) DeleteSubuser(user string, subuser string, tenant string) error {
+func (rg *Radosgw) DeleteSubuser(ctx context.Context, user string, subuser string, tenant string) (err error) {
+	defer rg.observe("delete-subuser", time.Now(), &err)
+
 	purge := true
-	err := rg.conn.SubUserRm(context.Background(), &rgw.SubUserRmRequest{UID: tenant + "$" + user, SubUser: subuser, PurgeKeys: &purge})
+	err = rg.conn.SubUserRm(ctx, &rgw.SubUserRmRequest{UID: tenant + "$" + user, SubUser: subuser, PurgeKeys: &purge})
 	if err != nil {
 		return err
 	}
@@ -110,10 +340,12 @@ func (rg *Radosgw) DeleteSubuser(user string, subuser string, tenant string) err
 	return nil
 }
 
-func (rg *Radosgw) CreateS3Key(user string, tenant string) (*rgw.UserKey, error) {
+func (rg *Radosgw) CreateS3Key(ctx context.Context, user string, tenant string) (key *rgw.UserKey, err error) {
+	defer rg.observe("create-key", time.Now(), &err)
+
 	genKey := true
 
-	keys, err := rg.conn.KeyCreate(context.Background(), &rgw.KeyCreateRequest{UID: tenant + "$" + user, GenerateKey: &genKey})
+	keys, err := rg.conn.KeyCreate(ctx, &rgw.KeyCreateRequest{UID: tenant + "$" + user, GenerateKey: &genKey})
 	if err != nil {
 		return nil, err
 	}
@@ -121,11 +353,41 @@ func (rg *Radosgw) CreateS3Key(user string, tenant string) (*rgw.UserKey, error)
 	return &keys[len(keys)-1], nil
 }
 
-func (rg *Radosgw) DeleteS3Key(user string, tenant string, s3AccessKey string) error {
-	err := rg.conn.KeyRm(context.Background(), &rgw.KeyRmRequest{UID: tenant + "$" + user, AccessKey: s3AccessKey})
+//Creates an S3 key owned by the subuser, which is limited to the access of the subuser
+func (rg *Radosgw) CreateSubuserS3Key(ctx context.Context, user string, subuser string, tenant string) (key *rgw.UserKey, err error) {
+	defer rg.observe("create-key", time.Now(), &err)
+
+	genKey := true
+
+	keys, err := rg.conn.KeyCreate(ctx, &rgw.KeyCreateRequest{UID: tenant + "$" + user, SubUser: subuser, KeyType: "s3", GenerateKey: &genKey})
+	if err != nil {
+		return nil, err
+	}
+
+	//The keys of the user and all its subusers are returned
+	subuserID := tenant + "$" + user + ":" + subuser
+	for i := len(keys) - 1; i >= 0; i-- {
+		if keys[i].User == subuserID {
+			return &keys[i], nil
+		}
+	}
+
+	return nil, errors.New("Created S3 key of subuser '" + subuserID + "' not returned by the radosgw")
+}
+
+func (rg *Radosgw) DeleteS3Key(ctx context.Context, user string, tenant string, s3AccessKey string) (err error) {
+	defer rg.observe("delete-key", time.Now(), &err)
+
+	err = rg.conn.KeyRm(ctx, &rgw.KeyRmRequest{UID: tenant + "$" + user, AccessKey: s3AccessKey})
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+//IsNotFound returns true if the error is the radosgw reporting that the requested resource does not exist
+func IsNotFound(err error) bool {
+	respErr, ok := err.(*rcl.ResponseError)
+	return ok && respErr.StatusCode == http.StatusNotFound
+}
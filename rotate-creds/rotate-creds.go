@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/icclab/ceph-objectstore-broker/broker"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+//Rotates the credentials of a binding through the admin API of a running broker.
+//The broker credentials are read from BROKER_USERNAME and BROKER_PASSWORD, as in the broker's own environment
+func main() {
+	brokerUrl := flag.String("url", "http://127.0.0.1:8080", "URL of the broker")
+	instID := flag.String("instance", "", "ID of the service instance")
+	bindID := flag.String("binding", "", "ID of the binding")
+	grace := flag.String("grace", "", "How long the old credentials keep working, e.g. '1h'. Defaults to the broker's configured grace period")
+	flag.Parse()
+
+	if *instID == "" || *bindID == "" {
+		fmt.Println("Both -instance and -binding are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	body, err := json.Marshal(map[string]string{"grace_period": *grace})
+	if err != nil {
+		fmt.Println("Failed to create request.", err)
+		os.Exit(1)
+	}
+
+	path := strings.NewReplacer("{instance_id}", *instID, "{binding_id}", *bindID).
+		Replace(broker.RotateCredentialsPath)
+	req, err := http.NewRequest("POST", strings.TrimSuffix(*brokerUrl, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		fmt.Println("Failed to create request.", err)
+		os.Exit(1)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(os.Getenv("BROKER_USERNAME"), os.Getenv("BROKER_PASSWORD"))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Println("Failed to reach the broker.", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	out, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Println("Failed to read the response.", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(string(out))
+	if resp.StatusCode != http.StatusOK {
+		fmt.Println("Rotation failed with status", resp.Status)
+		os.Exit(1)
+	}
+}
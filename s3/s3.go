@@ -1,11 +1,16 @@
 package s3
 
 import (
+	"context"
+	"github.com/icclab/ceph-objectstore-broker/metrics"
 	"github.com/minio/minio-go"
 	"io"
 	"strings"
+	"time"
 )
 
+//S3 wraps the S3 client. The context passed to each call cancels it, though calls the client has no context
+//support for can only be cancelled before they start
 type S3 struct {
 	conn *minio.Client
 }
@@ -23,34 +28,82 @@ func (s3 *S3) Connect(endpoint string, accessKey string, secretKey string, secur
 	return err
 }
 
-func (s3 *S3) CreateBucket(name string) error {
+func (s3 *S3) CreateBucket(ctx context.Context, name string) (err error) {
+	defer metrics.ObserveS3Call("create-bucket", time.Now(), &err)
+	if err = ctx.Err(); err != nil {
+		return err
+	}
 	return s3.conn.MakeBucket(name, "")
 }
 
-func (s3 *S3) BucketExists(bucketName string) (bool, error) {
-	e, err := s3.conn.BucketExists(bucketName)
-	return e, err
+func (s3 *S3) BucketExists(ctx context.Context, bucketName string) (exists bool, err error) {
+	defer metrics.ObserveS3Call("bucket-exists", time.Now(), &err)
+	if err = ctx.Err(); err != nil {
+		return false, err
+	}
+	return s3.conn.BucketExists(bucketName)
 }
 
-func (s3 *S3) DeleteBucket(name string) error {
+func (s3 *S3) DeleteBucket(ctx context.Context, name string) (err error) {
+	defer metrics.ObserveS3Call("delete-bucket", time.Now(), &err)
+	if err = ctx.Err(); err != nil {
+		return err
+	}
 	return s3.conn.RemoveBucket(name)
 }
 
-func (s3 *S3) PutObject(bucketName string, objName string, data string) error {
+//Returns true if the bucket holds no objects
+func (s3 *S3) BucketEmpty(ctx context.Context, name string) (empty bool, err error) {
+	defer metrics.ObserveS3Call("list-objects", time.Now(), &err)
+	objs, doneCh := s3.GetObjects(ctx, name, "", true)
+	defer close(doneCh)
+
+	for o := range objs {
+		if o.Err != nil {
+			return false, o.Err
+		}
+		return false, nil
+	}
+
+	return true, nil
+}
+
+//Returns the policy of the bucket as JSON, or an empty string if it has none
+func (s3 *S3) GetBucketPolicy(ctx context.Context, bucketName string) (policy string, err error) {
+	defer metrics.ObserveS3Call("get-bucket-policy", time.Now(), &err)
+	if err = ctx.Err(); err != nil {
+		return "", err
+	}
+	return s3.conn.GetBucketPolicy(bucketName)
+}
+
+//Sets the JSON policy of the bucket. An empty policy removes it
+func (s3 *S3) SetBucketPolicy(ctx context.Context, bucketName string, policy string) (err error) {
+	defer metrics.ObserveS3Call("set-bucket-policy", time.Now(), &err)
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return s3.conn.SetBucketPolicy(bucketName, policy)
+}
+
+func (s3 *S3) PutObject(ctx context.Context, bucketName string, objName string, data string) (err error) {
+	defer metrics.ObserveS3Call("put-object", time.Now(), &err)
 	r := strings.NewReader(data)
-	_, err := s3.conn.PutObject(bucketName, objName, r, r.Size(), minio.PutObjectOptions{})
+	_, err = s3.conn.PutObjectWithContext(ctx, bucketName, objName, r, r.Size(), minio.PutObjectOptions{})
 	return err
 }
 
-func (s3 *S3) PutObjectWithMetadata(bucketName string, objName string, data string, metadata map[string]string) error {
+func (s3 *S3) PutObjectWithMetadata(ctx context.Context, bucketName string, objName string, data string, metadata map[string]string) (err error) {
+	defer metrics.ObserveS3Call("put-object", time.Now(), &err)
 	r := strings.NewReader(data)
-	_, err := s3.conn.PutObject(bucketName, objName, r, r.Size(), minio.PutObjectOptions{UserMetadata: metadata})
+	_, err = s3.conn.PutObjectWithContext(ctx, bucketName, objName, r, r.Size(), minio.PutObjectOptions{UserMetadata: metadata})
 	return err
 }
 
 //Gets the specified object and returns the contained data as a string
-func (s3 *S3) GetObjectString(bucketName string, objName string) (string, error) {
-	o, err := s3.conn.GetObject(bucketName, objName, minio.GetObjectOptions{})
+func (s3 *S3) GetObjectString(ctx context.Context, bucketName string, objName string) (data string, err error) {
+	defer metrics.ObserveS3Call("get-object", time.Now(), &err)
+	o, err := s3.conn.GetObjectWithContext(ctx, bucketName, objName, minio.GetObjectOptions{})
 	if err != nil {
 		return "", err
 	}
@@ -69,7 +122,16 @@ func (s3 *S3) GetObjectString(bucketName string, objName string) (string, error)
 	return string(b), nil
 }
 
-func (s3 *S3) GetObjectInfo(bucketName string, objName string) (*minio.ObjectInfo, error) {
+//IsNotFound returns true if the error is S3 reporting that the requested object does not exist
+func IsNotFound(err error) bool {
+	return minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
+
+func (s3 *S3) GetObjectInfo(ctx context.Context, bucketName string, objName string) (info *minio.ObjectInfo, err error) {
+	defer metrics.ObserveS3Call("stat-object", time.Now(), &err)
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
 	oi, err := s3.conn.StatObject(bucketName, objName, minio.StatObjectOptions{})
 	return &oi, err
 }
@@ -78,12 +140,40 @@ func (s3 *S3) GetObjectInfo(bucketName string, objName string) (*minio.ObjectInf
 //
 //'recursive' is whether all 'directories' under the given prefix are given, or only the directory directly under it
 //
-//The second returned channel should be closed by the user when done using the object information channel
-func (s3 *S3) GetObjects(bucketName string, objectPrefix string, recursive bool) (<-chan minio.ObjectInfo, chan struct{}) {
+//The second returned channel should be closed by the user when done using the object information channel.
+//If the context is done before the listing completed, the last object information holds the error of the context
+func (s3 *S3) GetObjects(ctx context.Context, bucketName string, objectPrefix string, recursive bool) (<-chan minio.ObjectInfo, chan struct{}) {
 	doneCh := make(chan struct{})
-	return s3.conn.ListObjectsV2(bucketName, objectPrefix, recursive, doneCh), doneCh
+	listDoneCh := make(chan struct{})
+	objs := s3.conn.ListObjectsV2(bucketName, objectPrefix, recursive, listDoneCh)
+
+	out := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(listDoneCh)
+		defer close(out)
+
+		for o := range objs {
+			select {
+			case out <- o:
+			case <-doneCh:
+				return
+			case <-ctx.Done():
+				select {
+				case out <- minio.ObjectInfo{Err: ctx.Err()}:
+				case <-doneCh:
+				}
+				return
+			}
+		}
+	}()
+
+	return out, doneCh
 }
 
-func (s3 *S3) DeleteObject(bucketName string, objName string) error {
+func (s3 *S3) DeleteObject(ctx context.Context, bucketName string, objName string) (err error) {
+	defer metrics.ObserveS3Call("delete-object", time.Now(), &err)
+	if err = ctx.Err(); err != nil {
+		return err
+	}
 	return s3.conn.RemoveObject(bucketName, objName)
 }
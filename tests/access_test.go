@@ -0,0 +1,67 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	. "github.com/icclab/ceph-objectstore-broker/tests/testutils"
+	"testing"
+)
+
+//Restricted bindings get a subuser with the permissions of their access mode and an S3 key of that subuser, while
+//unrestricted ones get a read-write subuser and a key of the instance user
+func TestAccessModes(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+	b, _, baseUrl, closeServer := newLoggedBroker(t, fake)
+	defer closeServer()
+
+	if _, err := provisionRequest(baseUrl, "inst", "plan", "org")(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name        string
+		access      string
+		permissions string
+		keyOwner    string
+	}{
+		{"Unrestricted", "", "readwrite", "inst$inst"},
+		{"Read", "read", "read", "inst$inst:read"},
+		{"Write", "write", "write", "inst$inst:write"},
+		{"Read Write", "readwrite", "readwrite", "inst$inst:readwrite"},
+		{"Full", "full", "full", "inst$inst:full"},
+	}
+	for _, c := range cases {
+		bindID := c.access
+		var params map[string]interface{}
+		if c.access == "" {
+			bindID = "unrestricted"
+		} else {
+			params = map[string]interface{}{"access": c.access}
+		}
+
+		resp, err := bindWithParameters(baseUrl, "inst", bindID, params)
+		creds := receivedBindCreds{}
+		json.Unmarshal(resp.Body(), &creds)
+		user, userErr := b.Rados.GetUser(context.Background(), "inst", "inst", false)
+		permissions, keyOwner := "", ""
+		if userErr == nil {
+			for _, su := range user.SubUsers {
+				if su.ID == "inst$inst:"+bindID {
+					permissions = su.Permissions
+				}
+			}
+			for _, k := range user.Keys {
+				if k.AccessKey == creds.C.S3AccessKey {
+					keyOwner = k.User
+				}
+			}
+		}
+		t.Run(c.name, CheckErrs(t, nil, err, userErr, Equals(201, resp.StatusCode(), "Unexpected status"),
+			Equals(c.access, creds.C.Access, "Wrong access in the credentials"), Equals(c.permissions, permissions, "Wrong subuser permissions"),
+			Equals(c.keyOwner, keyOwner, "Wrong owner of the S3 key"), Equals(c.keyOwner, creds.C.S3User, "Wrong S3 user in the credentials")))
+	}
+
+	resp, err := bindWithParameters(baseUrl, "inst", "invalid", map[string]interface{}{"access": "admin"})
+	t.Run("Invalid", CheckErrs(t, nil, err, Equals(400, resp.StatusCode(), "Unexpected status")))
+}
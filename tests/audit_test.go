@@ -0,0 +1,235 @@
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"code.cloudfoundry.org/lager"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/icclab/ceph-objectstore-broker/audit"
+	"github.com/icclab/ceph-objectstore-broker/broker"
+	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
+	. "github.com/icclab/ceph-objectstore-broker/tests/testutils"
+	"github.com/pivotal-cf/brokerapi"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cosb-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	sink, err := audit.NewFileSink(path)
+	if !t.Run("Open File Sink", CheckErrs(t, nil, err)) {
+		t.FailNow()
+	}
+	auditor, err := audit.New(lager.NewLogger("test"), nil, sink)
+	if !t.Run("Start Auditor", CheckErrs(t, nil, err)) {
+		t.FailNow()
+	}
+
+	//cloudfoundry {"user_id":"683ea748-3092-4ff4-b656-39cacc4d5360"}
+	id := audit.ParseIdentity("cloudfoundry eyJ1c2VyX2lkIjoiNjgzZWE3NDgtMzA5Mi00ZmY0LWI2NTYtMzljYWNjNGQ1MzYwIn0=")
+	t.Run("Parse Identity", CheckErrs(t, nil, Equals("cloudfoundry", id.Platform, "Wrong platform"),
+		Equals(`{"user_id":"683ea748-3092-4ff4-b656-39cacc4d5360"}`, string(id.Value), "Wrong identity value")))
+
+	cf := audit.ParsePlatformContext([]byte(`{"platform":"cloudfoundry","organization_guid":"org","space_guid":"space","instance_name":"db"}`))
+	k8s := audit.ParsePlatformContext([]byte(`{"platform":"kubernetes","namespace":"apps","clusterid":"cluster"}`))
+	t.Run("Parse Platform Context", CheckErrs(t, nil, Equals(audit.PlatformContext{Platform: "cloudfoundry", OrganizationGUID: "org", SpaceGUID: "space", InstanceName: "db"}, *cf, "Wrong Cloud Foundry context"),
+		Equals(audit.PlatformContext{Platform: "kubernetes", Namespace: "apps", ClusterID: "cluster"}, *k8s, "Wrong Kubernetes context"),
+		Equals((*audit.PlatformContext)(nil), audit.ParsePlatformContext([]byte(`{"namespace":"apps"}`)), "Context without platform accepted")))
+	ctx := audit.NewContext(audit.NewPlatformContext(context.Background(), []byte(`{"platform":"cloudfoundry","organization_guid":"org"}`)), id)
+
+	ev := auditor.Start(ctx, audit.Bind, "inst", "bind", "plan")
+	ev.RadosgwCall("create-subuser", nil)
+	ev.RadosgwCall("create-s3-key", errors.New("failed"))
+	ev.Finish(errors.New("failed"))
+
+	//Asynchronous operations are only recorded once they complete
+	ev = auditor.Start(ctx, audit.Provision, "inst", "", "plan")
+	ev.Async("provision-1")
+	ev.Finish(nil)
+	ev.FinishAsync(nil)
+
+	//Operations of the broker are recorded with the identity of the request
+	b := &broker.Broker{Logger: lager.NewLogger("test"), Config: broker.NewConfig(&brokerConfig.BrokerConfig{}), Store: broker.NewMemoryStore(), Audit: auditor,
+		Locks: broker.NewInstanceLocks(), Counter: broker.NewInstanceCounter(), Retirements: broker.NewRetirementIndex()}
+	_, err = b.Deprovision(ctx, "missing", brokerapi.DeprovisionDetails{}, false)
+	t.Run("Deprovision Missing", CheckErrs(t, nil, Equals(brokerapi.ErrInstanceDoesNotExist, err, "Expected instance not found")))
+	t.Run("Close Auditor", CheckErrs(t, nil, auditor.Close()))
+
+	content, err := ioutil.ReadFile(path)
+	t.Run("Read Audit Log", CheckErrs(t, nil, err))
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	records := []audit.Record{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		rec := audit.Record{}
+		t.Run("Parse Record", CheckErrs(t, nil, json.Unmarshal(scanner.Bytes(), &rec)))
+		records = append(records, rec)
+	}
+	if !t.Run("Number Of Records", CheckErrs(t, nil, Equals(4, len(records), "Wrong number of records"))) {
+		t.FailNow()
+	}
+
+	t.Run("Started Record", CheckErrs(t, nil, Equals(audit.Started, records[0].Operation, "Chain not started")))
+	t.Run("Bind Record", CheckErrs(t, nil, Equals(audit.ResultFailure, records[1].Result, "Wrong result"),
+		Equals("bind", records[1].BindingID, "Wrong binding"), Equals(2, len(records[1].RadosgwCalls), "Wrong number of radosgw calls"),
+		Equals("failed", records[1].RadosgwCalls[1].Error, "Radosgw call error missing"),
+		Equals("cloudfoundry", records[1].Identity.Platform, "Identity missing"),
+		Equals("org", records[1].Context.OrganizationGUID, "Platform context missing")))
+	t.Run("Async Record", CheckErrs(t, nil, Equals(audit.ResultSuccess, records[2].Result, "Wrong result"),
+		Equals("provision-1", records[2].OperationID, "Operation ID missing")))
+	t.Run("Broker Record", CheckErrs(t, nil, Equals(audit.Deprovision, records[3].Operation, "Wrong operation"),
+		Equals("missing", records[3].InstanceID, "Wrong instance"), Equals(audit.ResultFailure, records[3].Result, "Wrong result"),
+		Equals("cloudfoundry", records[3].Identity.Platform, "Identity missing")))
+
+	n, err := audit.Verify(bytes.NewReader(content))
+	t.Run("Verify", CheckErrs(t, nil, err, Equals(4, n, "Wrong number of verified records")))
+
+	modified := strings.Replace(string(content), `"result":"failure"`, `"result":"success"`, 1)
+	_, err = audit.Verify(strings.NewReader(modified))
+	t.Run("Verify Modified", CheckErrs(t, nil, Equals(true, err != nil, "Modified record not detected")))
+
+	removed := strings.Join(append([]string{lines[0]}, lines[2:]...), "\n")
+	_, err = audit.Verify(strings.NewReader(removed))
+	t.Run("Verify Removed", CheckErrs(t, nil, Equals(true, err != nil, "Removed record not detected")))
+}
+
+//The chains of auditors sharing a head store are linked, so removing a whole chain is detected
+func TestAuditChains(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cosb-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	store := broker.NewMemoryStore()
+	chains := []string{}
+	for i := 0; i < 3; i++ {
+		sink, err := audit.NewFileSink(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auditor, err := audit.New(lager.NewLogger("test"), store, sink)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auditor.Start(context.Background(), audit.Bind, "inst", "bind-"+strconv.Itoa(i), "plan").Finish(nil)
+		if err := auditor.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	records := make([]audit.Record, len(lines))
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &records[i]); err != nil {
+			t.Fatal(err)
+		}
+		if records[i].Seq == 1 {
+			chains = append(chains, records[i].Chain)
+		}
+	}
+	head, headErr := store.GetAuditHead(context.Background())
+	t.Run("Linked", CheckErrs(t, nil, headErr, Equals(6, len(records), "Wrong number of records"), Equals(3, len(chains), "Wrong number of chains"),
+		Equals("", records[0].PrevHash, "First chain linked"), Equals(records[1].Hash, records[2].PrevHash, "Second chain not linked"),
+		Equals(records[3].Hash, records[4].PrevHash, "Third chain not linked"), Equals(records[5].Hash, head, "Wrong head")))
+
+	n, err := audit.Verify(bytes.NewReader(content))
+	t.Run("Verify", CheckErrs(t, nil, err, Equals(6, n, "Wrong number of verified records")))
+
+	//The first chain of a log may follow records of a rotated log
+	_, err = audit.Verify(strings.NewReader(strings.Join(lines[2:], "\n")))
+	t.Run("Verify Rotated", CheckErrs(t, nil, err))
+
+	_, err = audit.Verify(strings.NewReader(strings.Join(append(lines[:2:2], lines[4:]...), "\n")))
+	t.Run("Verify Removed Chain", CheckErrs(t, nil, Equals(true, err != nil, "Removed chain not detected")))
+
+	_, err = audit.VerifyHead(bytes.NewReader(content), head)
+	t.Run("Verify Head", CheckErrs(t, nil, err))
+
+	_, err = audit.VerifyHead(strings.NewReader(strings.Join(lines[:4], "\n")), head)
+	t.Run("Verify Removed End", CheckErrs(t, nil, Equals(true, err != nil, "Records removed from the end not detected")))
+}
+
+//Sink buffering the records until it's flushed, like the s3 sink
+type flushingSink struct {
+	recordSink
+	buffered []audit.Record
+	onFlush  func(seq uint64, hash string)
+}
+
+func (s *flushingSink) Write(rec *audit.Record) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.buffered = append(s.buffered, *rec)
+	return nil
+}
+
+func (s *flushingSink) OnFlush(f func(seq uint64, hash string)) {
+	s.onFlush = f
+}
+
+func (s *flushingSink) flush() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.buffered) == 0 {
+		return
+	}
+	s.records = append(s.records, s.buffered...)
+	last := s.buffered[len(s.buffered)-1]
+	s.buffered = nil
+	s.onFlush(last.Seq, last.Hash)
+}
+
+func (s *flushingSink) Close() error {
+	s.flush()
+	return nil
+}
+
+//With a flushing sink the head only moves once the records were flushed, so the sink always reaches it
+func TestAuditHeadFlush(t *testing.T) {
+	store := broker.NewMemoryStore()
+	sink := &flushingSink{}
+	auditor, err := audit.New(lager.NewLogger("test"), store, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditor.Start(context.Background(), audit.Bind, "inst", "bind", "plan").Finish(nil)
+
+	//The head is saved in the background
+	time.Sleep(10 * time.Millisecond)
+	head, err := store.GetAuditHead(context.Background())
+	t.Run("Not Flushed", CheckErrs(t, nil, err, Equals("", head, "Head moved past the flushed records")))
+
+	sink.flush()
+	flushed := sink.records[len(sink.records)-1].Hash
+	auditor.Start(context.Background(), audit.Unbind, "inst", "bind", "plan").Finish(nil)
+	deadline := time.Now().Add(time.Second)
+	for head != flushed && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		head, err = store.GetAuditHead(context.Background())
+	}
+	t.Run("Flushed", CheckErrs(t, nil, err, Equals(flushed, head, "Head not moved to the flushed records")))
+
+	err = auditor.Close()
+	head, headErr := store.GetAuditHead(context.Background())
+	t.Run("Closed", CheckErrs(t, nil, err, headErr, Equals(3, len(sink.records), "Records not flushed"),
+		Equals(sink.records[2].Hash, head, "Head not saved on close")))
+}
@@ -0,0 +1,300 @@
+package tests
+
+import (
+	"code.cloudfoundry.org/lager"
+	"context"
+	"encoding/json"
+	"github.com/go-resty/resty"
+	"github.com/icclab/ceph-objectstore-broker/broker"
+	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
+	rgw "github.com/icclab/ceph-objectstore-broker/radosgw"
+	. "github.com/icclab/ceph-objectstore-broker/tests/testutils"
+	"github.com/pivotal-cf/brokerapi"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//Returns a service with a single plan, whose instances are created on the backend
+func backendService(id string, backend string) brokerapi.Service {
+	return brokerapi.Service{ID: id, Name: id, Bindable: true, PlanUpdatable: true,
+		Metadata: &brokerapi.ServiceMetadata{AdditionalMetadata: map[string]interface{}{"backend": backend}},
+		Plans: []brokerapi.ServicePlan{{ID: id + "-plan", Name: "small", Metadata: &brokerapi.ServicePlanMetadata{
+			AdditionalMetadata: map[string]interface{}{"quotaMB": "100"}}}}}
+}
+
+//Services are dispatched to their backends: the default one with both credentials, a Swift only backend on the same
+//radosgw, and a premium backend on another radosgw with its own placement and only S3 credentials
+func TestServiceBackends(t *testing.T) {
+	fake, premiumFake := NewFakeRadosgw(), NewFakeRadosgw()
+	defer fake.Close()
+	defer premiumFake.Close()
+
+	bc := &brokerConfig.BrokerConfig{InstanceLimit: 100, RadosEndpoint: fake.Server.URL, RadosAdminPath: "admin", RadosAccessKey: "key",
+		RadosSecretKey: "secret", S3Endpoint: fake.Server.URL + "/", SwiftEndpoint: fake.Server.URL + "/auth/v1.0"}
+	bc.Backends = map[string]*brokerConfig.Backend{
+		"swift-only": {Name: "swift-only", RadosEndpoint: fake.Server.URL, RadosAdminPath: "admin", RadosAccessKey: "key", RadosSecretKey: "secret",
+			S3Endpoint: bc.S3Endpoint, SwiftEndpoint: bc.SwiftEndpoint, Credentials: []string{brokerConfig.SwiftCredentials}},
+		"premium": {Name: "premium", RadosEndpoint: premiumFake.Server.URL, RadosAdminPath: "admin", RadosAccessKey: "key", RadosSecretKey: "secret",
+			S3Endpoint: premiumFake.Server.URL + "/", SwiftEndpoint: premiumFake.Server.URL + "/auth/v1.0", Placement: "ssd-placement",
+			Credentials: []string{brokerConfig.S3Credentials}},
+	}
+	bc.Services = []brokerapi.Service{backendService("standard", ""), backendService("swift", "swift-only"), backendService("premium", "premium")}
+	t.Run("Valid Backends", CheckErrs(t, nil, Equals(0, len(bc.ValidateServiceBackends(bc.Services)), "Backends of the services not found")))
+
+	rados := &rgw.Radosgw{}
+	if err := rados.Setup(fake.Server.URL, "admin", "key", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	backends, err := broker.NewBackendClients(bc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := broker.NewMemoryStore()
+	b := &broker.Broker{Logger: lager.NewLogger("test"), Rados: rados, Backends: backends, Config: broker.NewConfig(bc), Store: store,
+		Locks: broker.NewInstanceLocks(), Counter: broker.NewInstanceCounter(), Retirements: broker.NewRetirementIndex()}
+	server := httptest.NewServer(broker.NewAPIHandler(b, b, lager.NewLogger("test"), brokerapi.BrokerCredentials{Username: "user", Password: "pass"}))
+	defer server.Close()
+	baseUrl := "http://user:pass@" + strings.TrimPrefix(server.URL, "http://") + "/v2/service_instances/"
+
+	request := func() *resty.Request {
+		return resty.R().SetHeader("X-Broker-API-Version", "2.14")
+	}
+	bind := func(service string, instID string) (*broker.BindCreds, int) {
+		resp, err := request().SetBody(map[string]string{"service_id": service, "plan_id": service + "-plan", "app_guid": "app"}).
+			Put(baseUrl + instID + "/service_bindings/bind")
+		if err != nil {
+			t.Fatal(err)
+		}
+		creds := &receivedBindCreds{}
+		json.Unmarshal(resp.Body(), creds)
+		return &creds.C, resp.StatusCode()
+	}
+
+	for _, service := range []string{"standard", "swift", "premium"} {
+		resp, err := request().SetBody(provisionBody{ServiceID: service, PlanID: service + "-plan", OrgGUID: "org", Space_guid: "space"}).
+			Put(baseUrl + service)
+		t.Run("Provision "+service, CheckErrs(t, nil, err, Equals(201, resp.StatusCode(), "Provision failed")))
+	}
+	t.Run("Users Per Backend", CheckErrs(t, []interface{}{fake.Users(), premiumFake.Users()},
+		Equals(2, len(fake.Users()), "Wrong number of users on the default radosgw"),
+		Equals(1, len(premiumFake.Users()), "Wrong number of users on the premium radosgw")))
+
+	inst, err := store.GetInstance(context.Background(), "premium")
+	t.Run("Instance Backend", CheckErrs(t, nil, err, Equals("premium", inst.Backend, "Backend not recorded"),
+		Equals("ssd-placement", premiumFake.Placement(rgw.UserID(inst.User, inst.Tenant)), "Placement not applied")))
+
+	creds, code := bind("standard", "standard")
+	t.Run("Bind Both", CheckErrs(t, nil, Equals(201, code, "Bind failed"), Equals(true, creds.S3SecretKey != "", "S3 credentials missing"),
+		Equals(true, creds.SwiftSecretKey != "", "Swift credentials missing")))
+
+	creds, code = bind("swift", "swift")
+	t.Run("Bind Swift Only", CheckErrs(t, nil, Equals(201, code, "Bind failed"), Equals("", creds.S3SecretKey, "S3 credentials returned"),
+		Equals(true, creds.SwiftSecretKey != "", "Swift credentials missing")))
+
+	creds, code = bind("premium", "premium")
+	t.Run("Bind Premium", CheckErrs(t, nil, Equals(201, code, "Bind failed"), Equals(true, creds.S3SecretKey != "", "S3 credentials missing"),
+		Equals("", creds.SwiftSecretKey, "Swift credentials returned"), Equals(premiumFake.Server.URL+"/", creds.S3Endpoint, "Wrong S3 endpoint")))
+
+	//Plans are only provisioned through their own service, and instances only bound through theirs
+	resp, err := request().SetBody(provisionBody{ServiceID: "standard", PlanID: "premium-plan", OrgGUID: "org", Space_guid: "space"}).
+		Put(baseUrl + "mismatch")
+	t.Run("Plan Of Other Service", CheckErrs(t, nil, err, Equals(400, resp.StatusCode(), "Provision with a plan of another service accepted")))
+	_, code = bind("standard", "premium")
+	t.Run("Bind Other Service", CheckErrs(t, nil, Equals(400, code, "Bind through another service accepted")))
+
+	resp, err = request().SetQueryParam("service_id", "premium").SetQueryParam("plan_id", "premium-plan").
+		Delete(baseUrl + "premium/service_bindings/bind")
+	t.Run("Unbind Premium", CheckErrs(t, nil, err, Equals(200, resp.StatusCode(), "Unbind failed")))
+	resp, err = request().SetQueryParam("service_id", "premium").SetQueryParam("plan_id", "premium-plan").Delete(baseUrl + "premium")
+	t.Run("Deprovision Premium", CheckErrs(t, nil, err, Equals(200, resp.StatusCode(), "Deprovision failed"),
+		Equals(0, len(premiumFake.Users()), "User not deleted from the premium radosgw"),
+		Equals(2, len(fake.Users()), "Users of the default radosgw changed")))
+}
+
+//Plans offered on several Ceph clusters are provisioned in the region requested by the 'region' parameter, and instances stay on
+//their cluster, which reconciliation checks separately
+func TestRegionBackends(t *testing.T) {
+	zurich, geneva := NewFakeRadosgw(), NewFakeRadosgw()
+	defer zurich.Close()
+	defer geneva.Close()
+
+	bc := &brokerConfig.BrokerConfig{InstanceLimit: 100, RadosEndpoint: zurich.Server.URL, RadosAdminPath: "admin", RadosAccessKey: "key",
+		RadosSecretKey: "secret", RadosRegion: "zurich", S3Endpoint: zurich.Server.URL + "/", SwiftEndpoint: zurich.Server.URL + "/auth/v1.0"}
+	bc.Backends = map[string]*brokerConfig.Backend{
+		"geneva": {Name: "geneva", Region: "geneva", RadosEndpoint: geneva.Server.URL, RadosAdminPath: "admin", RadosAccessKey: "key",
+			RadosSecretKey: "secret", S3Endpoint: geneva.Server.URL + "/", SwiftEndpoint: geneva.Server.URL + "/auth/v1.0",
+			Credentials: []string{brokerConfig.S3Credentials, brokerConfig.SwiftCredentials}},
+	}
+	regional := backendService("regional", "")
+	regional.Plans[0].Metadata.AdditionalMetadata["backends"] = []interface{}{"default", "geneva"}
+	regional.Plans = append(regional.Plans, brokerapi.ServicePlan{ID: "regional-local", Name: "local", Metadata: &brokerapi.ServicePlanMetadata{
+		AdditionalMetadata: map[string]interface{}{"quotaMB": "100"}}})
+	bc.Services = []brokerapi.Service{regional}
+	t.Run("Valid Backends", CheckErrs(t, nil, Equals(0, len(bc.ValidateServiceBackends(bc.Services)), "Backends of the plans not found")))
+
+	rados := &rgw.Radosgw{}
+	if err := rados.Setup(zurich.Server.URL, "admin", "key", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	backends, err := broker.NewBackendClients(bc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := broker.NewMemoryStore()
+	b := &broker.Broker{Logger: lager.NewLogger("test"), Rados: rados, Backends: backends, Config: broker.NewConfig(bc), Store: store,
+		Locks: broker.NewInstanceLocks(), Counter: broker.NewInstanceCounter(), Retirements: broker.NewRetirementIndex()}
+	server := httptest.NewServer(broker.NewAPIHandler(b, b, lager.NewLogger("test"), brokerapi.BrokerCredentials{Username: "user", Password: "pass"}))
+	defer server.Close()
+	baseUrl := "http://user:pass@" + strings.TrimPrefix(server.URL, "http://") + "/v2/service_instances/"
+
+	provision := func(instID string, params map[string]interface{}) int {
+		resp, err := resty.R().SetHeader("X-Broker-API-Version", "2.14").SetBody(provisionBody{ServiceID: "regional", PlanID: "regional-plan",
+			OrgGUID: "org", Space_guid: "space", Parameters: params}).Put(baseUrl + instID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode()
+	}
+
+	t.Run("Provision Default Region", CheckErrs(t, nil, Equals(201, provision("zurich-inst", nil), "Provision failed")))
+	t.Run("Provision Geneva", CheckErrs(t, nil, Equals(201, provision("geneva-inst", map[string]interface{}{"region": "geneva"}), "Provision failed")))
+	t.Run("Provision Unknown Region", CheckErrs(t, nil, Equals(400, provision("bern-inst", map[string]interface{}{"region": "bern"}),
+		"Provision in an unknown region accepted")))
+	t.Run("Users Per Cluster", CheckErrs(t, []interface{}{zurich.Users(), geneva.Users()},
+		Equals(1, len(zurich.Users()), "Wrong number of users in zurich"), Equals(1, len(geneva.Users()), "Wrong number of users in geneva")))
+
+	inst, err := store.GetInstance(context.Background(), "geneva-inst")
+	t.Run("Instance Backend", CheckErrs(t, nil, err, Equals("geneva", inst.Backend, "Backend not recorded")))
+
+	//The local plan is only on the default backend, which the instance in geneva can't move to
+	resp, err := resty.R().SetHeader("X-Broker-API-Version", "2.14").
+		SetBody(map[string]interface{}{"service_id": "regional", "plan_id": "regional-local"}).Patch(baseUrl + "geneva-inst")
+	t.Run("Update To Other Cluster", CheckErrs(t, nil, err, Equals(422, resp.StatusCode(), "Plan change to another cluster accepted")))
+
+	//The user of an instance that is no longer stored is an orphan on its own cluster only
+	if err := store.DeleteInstance(context.Background(), "geneva-inst"); err != nil {
+		t.Fatal(err)
+	}
+	report, err := b.Reconcile(context.Background(), false, 0)
+	if !t.Run("Reconcile", CheckErrs(t, nil, err)) {
+		t.FailNow()
+	}
+	t.Run("Reconcile Clusters", CheckErrs(t, []interface{}{report.Discrepancies}, Equals(1, len(report.Discrepancies), "Wrong number of discrepancies"),
+		Equals(0, len(geneva.Users()), "Orphan not removed in geneva"), Equals(1, len(zurich.Users()), "Users in zurich changed")))
+	if len(report.Discrepancies) == 1 {
+		d := report.Discrepancies[0]
+		t.Run("Orphan", CheckErrs(t, nil, Equals(broker.OrphanedUser, d.Kind, "Wrong kind"), Equals("geneva", d.Backend, "Wrong backend"),
+			Equals(true, d.Removed, "Not removed")))
+	}
+}
+
+//Plans with a placement target and storage class apply them to the instance users and return them in the credentials. They are
+//checked against the zonegroup of the radosgw, and plans can't change to another placement
+func TestPlanPlacements(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+	fake.PlacementTargets["ssd-placement"] = []string{"STANDARD", "COLD"}
+
+	bc := &brokerConfig.BrokerConfig{InstanceLimit: 100, RadosEndpoint: fake.Server.URL, RadosAdminPath: "admin", RadosAccessKey: "key",
+		RadosSecretKey: "secret", S3Endpoint: fake.Server.URL + "/", SwiftEndpoint: fake.Server.URL + "/auth/v1.0"}
+	service := backendService("storage", "")
+	service.Plans = append(service.Plans,
+		brokerapi.ServicePlan{ID: "storage-ssd", Name: "ssd", Metadata: &brokerapi.ServicePlanMetadata{
+			AdditionalMetadata: map[string]interface{}{"quotaMB": "100", "placement": "ssd-placement"}}},
+		brokerapi.ServicePlan{ID: "storage-cold", Name: "cold", Metadata: &brokerapi.ServicePlanMetadata{
+			AdditionalMetadata: map[string]interface{}{"quotaMB": "100", "placement": "ssd-placement", "storageClass": "COLD"}}})
+	bc.Services = []brokerapi.Service{service}
+	t.Run("Valid Backends", CheckErrs(t, nil, Equals(0, len(bc.ValidateServiceBackends(bc.Services)), "Valid plans rejected")))
+
+	rados := &rgw.Radosgw{}
+	if err := rados.Setup(fake.Server.URL, "admin", "key", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	store := broker.NewMemoryStore()
+	config := broker.NewConfig(bc)
+	b := &broker.Broker{Logger: lager.NewLogger("test"), Rados: rados, Backends: broker.BackendClients{}, Config: config, Store: store,
+		Locks: broker.NewInstanceLocks(), Counter: broker.NewInstanceCounter(), Retirements: broker.NewRetirementIndex()}
+	t.Run("Valid Placements", CheckErrs(t, nil, b.ValidatePlacements(context.Background())))
+
+	server := httptest.NewServer(broker.NewAPIHandler(b, b, lager.NewLogger("test"), brokerapi.BrokerCredentials{Username: "user", Password: "pass"}))
+	defer server.Close()
+	baseUrl := "http://user:pass@" + strings.TrimPrefix(server.URL, "http://") + "/v2/service_instances/"
+	request := func() *resty.Request {
+		return resty.R().SetHeader("X-Broker-API-Version", "2.14")
+	}
+
+	for _, planID := range []string{"storage-plan", "storage-cold"} {
+		resp, err := request().SetBody(provisionBody{ServiceID: "storage", PlanID: planID, OrgGUID: "org", Space_guid: "space"}).
+			Put(baseUrl + planID)
+		t.Run("Provision "+planID, CheckErrs(t, nil, err, Equals(201, resp.StatusCode(), "Provision failed")))
+	}
+
+	inst, err := store.GetInstance(context.Background(), "storage-cold")
+	uid := rgw.UserID(inst.User, inst.Tenant)
+	t.Run("User Placement", CheckErrs(t, nil, err, Equals("ssd-placement", fake.Placement(uid), "Placement not applied"),
+		Equals("COLD", fake.StorageClass(uid), "Storage class not applied"), Equals("ssd-placement", inst.Placement, "Placement not recorded")))
+	inst, err = store.GetInstance(context.Background(), "storage-plan")
+	t.Run("Default Placement", CheckErrs(t, nil, err, Equals("", fake.Placement(rgw.UserID(inst.User, inst.Tenant)), "Placement applied")))
+
+	resp, err := request().SetBody(map[string]string{"service_id": "storage", "plan_id": "storage-cold", "app_guid": "app"}).
+		Put(baseUrl + "storage-cold/service_bindings/bind")
+	creds := &receivedBindCreds{}
+	unmarshalErr := json.Unmarshal(resp.Body(), creds)
+	t.Run("Bind Placement", CheckErrs(t, nil, err, unmarshalErr, Equals(201, resp.StatusCode(), "Bind failed"),
+		Equals("ssd-placement", creds.C.Placement, "Wrong placement"), Equals("COLD", creds.C.StorageClass, "Wrong storage class")))
+
+	//Existing buckets stay in their placement, so only plans with the same placement can be changed to
+	resp, err = request().SetBody(map[string]interface{}{"service_id": "storage", "plan_id": "storage-ssd"}).Patch(baseUrl + "storage-cold")
+	t.Run("Change Placement", CheckErrs(t, nil, err, Equals(422, resp.StatusCode(), "Plan change to another placement accepted")))
+
+	//Placements the zonegroup doesn't have are found on startup
+	invalid := *bc
+	invalid.Services = []brokerapi.Service{backendService("invalid", "")}
+	invalid.Services[0].Plans = append(invalid.Services[0].Plans,
+		brokerapi.ServicePlan{ID: "invalid-nvme", Name: "nvme", Metadata: &brokerapi.ServicePlanMetadata{
+			AdditionalMetadata: map[string]interface{}{"quotaMB": "100", "placement": "nvme-placement"}}},
+		brokerapi.ServicePlan{ID: "invalid-glacier", Name: "glacier", Metadata: &brokerapi.ServicePlanMetadata{
+			AdditionalMetadata: map[string]interface{}{"quotaMB": "100", "placement": "ssd-placement", "storageClass": "GLACIER"}}})
+	b.Config = broker.NewConfig(&invalid)
+	err = b.ValidatePlacements(context.Background())
+	validationErr, ok := err.(*brokerConfig.ValidationError)
+	t.Run("Invalid Placements", CheckErrs(t, []interface{}{err}, Equals(true, ok, "Invalid placements accepted")))
+	if ok {
+		t.Run("Placement Problems", CheckErrs(t, []interface{}{validationErr.Problems}, Equals(2, len(validationErr.Problems), "Wrong number of problems")))
+	}
+}
+
+//Quotas larger than the plan's are refused even if the plan's own schemas don't limit them
+func TestPlanQuotaParameter(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+
+	bc := &brokerConfig.BrokerConfig{InstanceLimit: 100, RadosEndpoint: fake.Server.URL, RadosAdminPath: "admin", RadosAccessKey: "key",
+		RadosSecretKey: "secret", S3Endpoint: fake.Server.URL + "/", SwiftEndpoint: fake.Server.URL + "/auth/v1.0"}
+	bc.Services = []brokerapi.Service{backendService("custom", "")}
+	bc.Services[0].Plans[0].Schemas = &brokerapi.ServiceSchemas{}
+
+	rados := &rgw.Radosgw{}
+	if err := rados.Setup(fake.Server.URL, "admin", "key", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	b := &broker.Broker{Logger: lager.NewLogger("test"), Rados: rados, Backends: broker.BackendClients{}, Config: broker.NewConfig(bc),
+		Store: broker.NewMemoryStore(), Locks: broker.NewInstanceLocks(), Counter: broker.NewInstanceCounter(), Retirements: broker.NewRetirementIndex()}
+	ctx := context.Background()
+
+	details := brokerapi.ProvisionDetails{ServiceID: "custom", PlanID: "custom-plan", OrganizationGUID: "org", SpaceGUID: "space",
+		RawParameters: json.RawMessage(`{"quota_mb": 101}`)}
+	_, err := b.Provision(ctx, "too-large", details, false)
+	t.Run("Provision Above Plan", CheckErrs(t, nil, Equals(true, err != nil, "Quota above the plan accepted")))
+
+	details.RawParameters = json.RawMessage(`{"quota_mb": 100}`)
+	_, err = b.Provision(ctx, "custom-inst", details, false)
+	t.Run("Provision Plan Quota", CheckErrs(t, nil, err))
+
+	_, err = b.Update(ctx, "custom-inst", brokerapi.UpdateDetails{ServiceID: "custom", PlanID: "custom-plan",
+		RawParameters: json.RawMessage(`{"quota_mb": 101}`)}, false)
+	t.Run("Update Above Plan", CheckErrs(t, nil, Equals(true, err != nil, "Quota above the plan accepted")))
+}
@@ -1,6 +1,7 @@
 package tests
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/go-resty/resty"
 	"github.com/icclab/ceph-objectstore-broker/broker"
@@ -14,6 +15,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 type catalog struct {
@@ -21,16 +23,55 @@ type catalog struct {
 }
 
 type provisionBody struct {
-	ServiceID  string `json:"service_id"`
-	PlanID     string `json:"plan_id"`
-	OrgGUID    string `json:"organization_guid"`
-	Space_guid string `json:"space_guid"`
+	ServiceID  string                 `json:"service_id"`
+	PlanID     string                 `json:"plan_id"`
+	OrgGUID    string                 `json:"organization_guid"`
+	Space_guid string                 `json:"space_guid"`
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
 }
 
 type receivedBindCreds struct {
 	C broker.BindCreds `json:"credentials"`
 }
 
+type fetchedInstance struct {
+	ServiceID string `json:"service_id"`
+	PlanID    string `json:"plan_id"`
+}
+
+type asyncResponse struct {
+	Operation string `json:"operation"`
+}
+
+type lastOperationResponse struct {
+	State       string `json:"state"`
+	Description string `json:"description"`
+}
+
+// Polls the last operation endpoint until the operation leaves the 'in progress' state, returning the final status code and state
+func waitForOperation(t *testing.T, url string, operation string) (int, string) {
+	for i := 0; i < 30; i++ {
+		resp, err := resty.R().
+			SetHeader("X-Broker-API-Version", "2.14").
+			SetQueryParam("operation", operation).
+			Get(url)
+		if err != nil {
+			t.Fatal("Failed to poll last operation", err)
+		}
+
+		lastOp := lastOperationResponse{}
+		json.Unmarshal(resp.Body(), &lastOp)
+		if resp.StatusCode() != 200 || lastOp.State != string(brokerapi.InProgress) {
+			return resp.StatusCode(), lastOp.State
+		}
+
+		time.Sleep(time.Second)
+	}
+
+	t.Fatal("Operation did not finish in time")
+	return 0, ""
+}
+
 func TestBroker(t *testing.T) {
 	//Load config
 	bc := brokerConfig.BrokerConfig{}
@@ -56,24 +97,54 @@ func TestBroker(t *testing.T) {
 		t.FailNow()
 	}
 
+	t.Run("Test Plan Schemas", CheckErrs(t, nil, Equals(true, cat.Services[0].Plans[0].Schemas != nil, "Plan schemas missing")))
+
 	//Provision
 	instID := "789"
-	provBody := provisionBody{ServiceID: s[0].ID, PlanID: s[0].Plans[0].ID, OrgGUID: "123", Space_guid: "456"}
+	planQ, _ := strconv.Atoi(cat.Services[0].Plans[0].Metadata.AdditionalMetadata["quotaMB"].(string))
+	provBody := provisionBody{ServiceID: s[0].ID, PlanID: s[0].Plans[0].ID, OrgGUID: "123", Space_guid: "456",
+		Parameters: map[string]interface{}{"quota_mb": planQ + 1}}
 	req := resty.R().
 		SetHeader("X-Broker-API-Version", "2.14").
 		SetBody(provBody)
 
+	resp, err = req.Put(baseUrl + "/service_instances/" + instID)
+	t.Run("Test Provision Quota Above Plan", CheckErrs(t, nil, err, Equals(400, resp.StatusCode(), "Unexpected status code")))
+
+	provBody.Parameters = map[string]interface{}{"max_objects": 1000, "max_buckets": 10, "buckets": []string{"data"}}
+	req.SetBody(provBody)
 	resp, err = req.Put(baseUrl + "/service_instances/" + instID)
 	if !t.Run("Test Provision", CheckErrs(t, nil, err, Equals(201, resp.StatusCode(), "Unexpected status code"))) {
 		t.FailNow()
 	}
 
 	resp, err = req.Put(baseUrl + "/service_instances/" + instID)
+	t.Run("Test Provision Repeat", CheckErrs(t, nil, err, Equals(200, resp.StatusCode(), "Unexpected status code")))
+
+	conflictBody := provBody
+	conflictBody.OrgGUID += "x"
+	resp, err = resty.R().
+		SetHeader("X-Broker-API-Version", "2.14").
+		SetBody(conflictBody).
+		Put(baseUrl + "/service_instances/" + instID)
 	t.Run("Test Provision Conflict", CheckErrs(t, nil, err, Equals(409, resp.StatusCode(), "Unexpected status code")))
 
+	//Fetch instance
+	resp, err = req.Get(baseUrl + "/service_instances/" + instID)
+	fetched := fetchedInstance{}
+	unmarshalErr = json.Unmarshal(resp.Body(), &fetched)
+	t.Run("Test Get Instance", CheckErrs(t, nil, err, unmarshalErr, Equals(200, resp.StatusCode(), "Unexpected status code"),
+		Equals(provBody.PlanID, fetched.PlanID, "Unexpected plan")))
+
+	resp, err = req.Get(baseUrl + "/service_instances/" + instID + "x")
+	t.Run("Test Get Missing Instance", CheckErrs(t, nil, err, Equals(404, resp.StatusCode(), "Unexpected status code")))
+
 	//Bind
 	bindID := "abc"
-	resp, err = req.Put(baseUrl + "/service_instances/" + instID + "/service_bindings/" + bindID)
+	bindReq := resty.R().
+		SetHeader("X-Broker-API-Version", "2.14").
+		SetBody(map[string]interface{}{"service_id": s[0].ID, "plan_id": s[0].Plans[0].ID, "app_guid": "app"})
+	resp, err = bindReq.Put(baseUrl + "/service_instances/" + instID + "/service_bindings/" + bindID)
 	if !t.Run("Test Bind", CheckErrs(t, nil, err, Equals(201, resp.StatusCode(), "Unexpected status code"))) {
 		t.FailNow()
 	}
@@ -83,17 +154,43 @@ func TestBroker(t *testing.T) {
 	if unmarshalErr != nil {
 		t.Fatal("Failed to parse bind credentials", unmarshalErr)
 	}
+	noProtocolEndpoint := strings.Replace(strings.Replace(creds.C.S3Endpoint, "http://", "", 1), "https://", "", 1)
+
+	//Fetch binding
+	resp, err = req.Get(baseUrl + "/service_instances/" + instID + "/service_bindings/" + bindID)
+	fetchedCreds := receivedBindCreds{}
+	unmarshalErr = json.Unmarshal(resp.Body(), &fetchedCreds)
+	t.Run("Test Get Binding", CheckErrs(t, nil, err, unmarshalErr, Equals(200, resp.StatusCode(), "Unexpected status code"),
+		Equals(creds.C, fetchedCreds.C, "Fetched credentials differ")))
+
+	resp, err = req.Get(baseUrl + "/service_instances/" + instID + "/service_bindings/" + bindID + "x")
+	t.Run("Test Get Missing Binding", CheckErrs(t, nil, err, Equals(404, resp.StatusCode(), "Unexpected status code")))
+
+	resp, err = bindReq.Put(baseUrl + "/service_instances/" + instID + "/service_bindings/" + bindID)
+	repeatCreds := receivedBindCreds{}
+	json.Unmarshal(resp.Body(), &repeatCreds)
+	t.Run("Test Bind Repeat", CheckErrs(t, nil, err, Equals(200, resp.StatusCode(), "Unexpected status code"),
+		Equals(creds.C, repeatCreds.C, "Repeated bind returned different credentials")))
 
-	resp, err = req.Put(baseUrl + "/service_instances/" + instID + "/service_bindings/" + bindID)
+	resp, err = resty.R().
+		SetHeader("X-Broker-API-Version", "2.14").
+		SetBody(map[string]interface{}{"service_id": s[0].ID, "plan_id": s[0].Plans[0].ID, "app_guid": "other-app"}).
+		Put(baseUrl + "/service_instances/" + instID + "/service_bindings/" + bindID)
 	t.Run("Test Bind Conflict", CheckErrs(t, nil, err, Equals(409, resp.StatusCode(), "Unexpected status code")))
 
-	resp, err = req.Put(baseUrl + "/service_instances/" + instID + "x" + "/service_bindings/" + bindID)
+	resp, err = bindReq.Put(baseUrl + "/service_instances/" + instID + "x" + "/service_bindings/" + bindID)
 	t.Run("Test Invalid Bind", CheckErrs(t, nil, err, Equals(404, resp.StatusCode(), "Unexpected status code")))
 
-	noProtocolEndpoint := strings.Replace(strings.Replace(creds.C.S3Endpoint, "http://", "", 1), "https://", "", 1)
-	_, err = s3.New(noProtocolEndpoint, creds.C.S3AccessKey, creds.C.S3SecretKey, bc.UseHttps)
+	s3Client, err := s3.New(noProtocolEndpoint, creds.C.S3AccessKey, creds.C.S3SecretKey, bc.UseHttps)
 	t.Run("Test S3 Creds", CheckErrs(t, nil, err))
 
+	bucketExists := false
+	if s3Client != nil {
+		bucketExists, err = s3Client.BucketExists(creds.C.Bucket)
+	}
+	t.Run("Test Precreated Bucket", CheckErrs(t, nil, err, Equals("data", creds.C.Bucket, "Unexpected bucket in credentials"),
+		Equals(true, bucketExists, "Bucket was not created")))
+
 	sc := swift.Connection{
 		UserName: creds.C.SwiftUser,
 		ApiKey:   creds.C.SwiftSecretKey,
@@ -101,20 +198,83 @@ func TestBroker(t *testing.T) {
 	}
 	t.Run("Test Swift Creds", CheckErrs(t, nil, sc.Authenticate()))
 
+	//Rotate credentials
+	resp, err = resty.R().
+		SetBody(broker.RotateCredentialsRequest{GracePeriod: "1h"}).
+		Post(strings.Replace(baseUrl, "/v2", "", 1) + "/admin/service_instances/" + instID + "/service_bindings/" + bindID + "/rotate_credentials")
+	rotated := broker.RotateCredentialsResponse{}
+	unmarshalErr = json.Unmarshal(resp.Body(), &rotated)
+	if !t.Run("Test Rotate Credentials", CheckErrs(t, nil, err, unmarshalErr, Equals(200, resp.StatusCode(), "Unexpected status code"))) {
+		t.FailNow()
+	}
+	t.Run("Test Rotated Keys Differ", CheckErrs(t, nil, Equals(true, rotated.Credentials.S3AccessKey != creds.C.S3AccessKey, "S3 key not rotated"),
+		Equals(true, rotated.Credentials.SwiftUser != creds.C.SwiftUser, "Swift subuser not rotated")))
+
+	t.Run("Test Old Swift Creds Within Grace Period", CheckErrs(t, nil, sc.Authenticate()))
+
+	rsc := swift.Connection{
+		UserName: rotated.Credentials.SwiftUser,
+		ApiKey:   rotated.Credentials.SwiftSecretKey,
+		AuthUrl:  rotated.Credentials.SwiftEndpoint,
+	}
+	t.Run("Test Rotated Swift Creds", CheckErrs(t, nil, rsc.Authenticate()))
+
 	r := rgw.Radosgw{}
 	if r.Setup(bc.RadosEndpoint, bc.RadosAdminPath, bc.RadosAccessKey, bc.RadosSecretKey) != nil {
 		t.Error("Failed to setup radosgw")
 	}
+	ctx := context.Background()
 
 	ut := strings.Split(creds.C.S3User, "$")
-	q, err := r.GetUserQuotaMB(ut[1], ut[0])
+	q, err := r.GetUserQuotaMB(ctx, ut[1], ut[0])
 	if err != nil {
 		t.Error("Couldn't get user qota from the radosgw", err)
 	}
 	expectedQ, _ := strconv.Atoi(cat.Services[0].Plans[0].Metadata.AdditionalMetadata["quotaMB"].(string))
 	t.Run("Test Initial Plan Size", CheckErrs(t, nil, Equals(expectedQ, q, "Incorrect plan quota")))
 
+	quota, err := r.GetUserQuota(ctx, ut[1], ut[0])
+	if err != nil {
+		t.Error("Couldn't get user quota from the radosgw", err)
+	} else {
+		t.Run("Test Max Objects Parameter", CheckErrs(t, nil, Equals(int64(1000), quota.MaxObjects, "Incorrect object limit")))
+	}
+
+	//Reconcile
+	orphanKey, err := r.CreateS3Key(ctx, ut[1], ut[0])
+	if err != nil {
+		t.Fatal("Failed to create orphaned key", err)
+	}
+	reconcileUrl := strings.Replace(baseUrl, "/v2", "", 1) + broker.ReconcilePath
+	resp, err = resty.R().SetBody(broker.ReconcileRequest{MinAge: "0s"}).Post(reconcileUrl)
+	report := broker.ReconcileReport{}
+	unmarshalErr = json.Unmarshal(resp.Body(), &report)
+	found := false
+	for _, d := range report.Discrepancies {
+		found = found || (d.Kind == broker.OrphanedS3Key && d.AccessKey == orphanKey.AccessKey && !d.Removed)
+	}
+	t.Run("Test Reconcile Dry Run", CheckErrs(t, nil, err, unmarshalErr, Equals(200, resp.StatusCode(), "Unexpected status code"),
+		Equals(true, report.DryRun, "Not a dry run by default"), Equals(true, found, "Orphaned key not reported")))
+
+	dryRun := false
+	resp, err = resty.R().SetBody(broker.ReconcileRequest{DryRun: &dryRun, MinAge: "0s"}).Post(reconcileUrl)
+	t.Run("Test Reconcile", CheckErrs(t, nil, err, Equals(200, resp.StatusCode(), "Unexpected status code")))
+
+	userInfo, err := r.GetUser(ctx, ut[1], ut[0], false)
+	found = false
+	if err == nil {
+		for _, k := range userInfo.Keys {
+			found = found || k.AccessKey == orphanKey.AccessKey
+		}
+	}
+	t.Run("Test Reconcile Removed Orphan", CheckErrs(t, nil, err, Equals(false, found, "Orphaned key not removed")))
+
+	//The bound credentials are untouched
+	resp, err = req.Get(baseUrl + "/service_instances/" + instID + "/service_bindings/" + bindID)
+	t.Run("Test Reconcile Kept Binding", CheckErrs(t, nil, err, Equals(200, resp.StatusCode(), "Unexpected status code")))
+
 	//Update
+	provBody.Parameters = nil
 	provBody.PlanID = s[0].Plans[1].ID
 	resp, err = req.SetBody(provBody).Patch(baseUrl + "/service_instances/" + instID)
 	t.Run("Test Update", CheckErrs(t, nil, err, Equals(200, resp.StatusCode(), "Unexpected status code")))
@@ -126,7 +286,7 @@ func TestBroker(t *testing.T) {
 	resp, err = req.SetBody(provBody).Patch(baseUrl + "/service_instances/" + instID)
 	t.Run("Test Update Invalid Plan", CheckErrs(t, nil, err, Equals(422, resp.StatusCode(), "Unexpected status code")))
 
-	q, _ = r.GetUserQuotaMB(ut[1], ut[0])
+	q, _ = r.GetUserQuotaMB(ctx, ut[1], ut[0])
 	expectedQ, _ = strconv.Atoi(cat.Services[0].Plans[1].Metadata.AdditionalMetadata["quotaMB"].(string))
 	t.Run("Test New Plan Size", CheckErrs(t, nil, Equals(expectedQ, q, "Incorrect plan quota")))
 
@@ -146,3 +306,66 @@ func TestBroker(t *testing.T) {
 	resp, err = req.Delete(baseUrl + "/service_instances/" + instID)
 	t.Run("Test Deprovision Repeat", CheckErrs(t, nil, err, Equals(410, resp.StatusCode(), "Unexpected status code")))
 }
+
+func TestBrokerAsync(t *testing.T) {
+	bc := brokerConfig.BrokerConfig{}
+	if err := bc.Update(); err != nil {
+		t.Fatal("Failed to load broker config")
+	}
+
+	s := []brokerapi.Service{}
+	if err := utils.LoadJsonFromFile("../brokerConfig/service-config.json", &s); err != nil {
+		t.Fatal("Failed to load service config")
+	}
+
+	baseUrl := "http://" + bc.BrokerUsername + ":" + bc.BrokerPassword + "@127.0.0.1:8080/v2"
+	instUrl := baseUrl + "/service_instances/" + "async-789"
+
+	//Provision
+	provBody := provisionBody{ServiceID: s[0].ID, PlanID: s[0].Plans[0].ID, OrgGUID: "123", Space_guid: "456"}
+	resp, err := resty.R().
+		SetHeader("X-Broker-API-Version", "2.14").
+		SetQueryParam("accepts_incomplete", "true").
+		SetBody(provBody).
+		Put(instUrl)
+	if !t.Run("Test Async Provision", CheckErrs(t, nil, err, Equals(202, resp.StatusCode(), "Unexpected status code"))) {
+		t.FailNow()
+	}
+
+	op := asyncResponse{}
+	json.Unmarshal(resp.Body(), &op)
+
+	//Repeating the request while provisioning reports the same operation, or success if it already finished
+	resp, err = resty.R().
+		SetHeader("X-Broker-API-Version", "2.14").
+		SetQueryParam("accepts_incomplete", "true").
+		SetBody(provBody).
+		Put(instUrl)
+	repeatOp := asyncResponse{}
+	json.Unmarshal(resp.Body(), &repeatOp)
+	t.Run("Test Async Provision Repeat", CheckErrs(t, nil, err, Equals(true,
+		(resp.StatusCode() == 202 && repeatOp.Operation == op.Operation) || resp.StatusCode() == 200, "Unexpected response to repeated provision")))
+
+	code, state := waitForOperation(t, instUrl+"/last_operation", op.Operation)
+	if !t.Run("Test Async Provision Succeeded", CheckErrs(t, nil, Equals(200, code, "Unexpected status code"),
+		Equals(string(brokerapi.Succeeded), state, "Unexpected operation state"))) {
+		t.FailNow()
+	}
+
+	resp, err = resty.R().
+		SetHeader("X-Broker-API-Version", "2.14").
+		SetQueryParam("operation", op.Operation+"x").
+		Get(instUrl + "/last_operation")
+	t.Run("Test Unknown Operation", CheckErrs(t, nil, err, Equals(400, resp.StatusCode(), "Unexpected status code")))
+
+	//Deprovision
+	resp, err = resty.R().
+		SetHeader("X-Broker-API-Version", "2.14").
+		SetQueryParams(map[string]string{"service_id": s[0].ID, "plan_id": s[0].Plans[0].ID, "accepts_incomplete": "true"}).
+		Delete(instUrl)
+	t.Run("Test Async Deprovision", CheckErrs(t, nil, err, Equals(202, resp.StatusCode(), "Unexpected status code")))
+
+	json.Unmarshal(resp.Body(), &op)
+	code, _ = waitForOperation(t, instUrl+"/last_operation", op.Operation)
+	t.Run("Test Async Deprovision Gone", CheckErrs(t, nil, Equals(410, code, "Unexpected status code")))
+}
@@ -0,0 +1,152 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-resty/resty"
+	"github.com/icclab/ceph-objectstore-broker/broker"
+	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
+	. "github.com/icclab/ceph-objectstore-broker/tests/testutils"
+	"github.com/pivotal-cf/brokerapi"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//Returns a broker from newFakeRadosgwBroker whose S3 requests go to the fake as well, and the URL of its instances
+func newBucketBroker(t *testing.T, fake *FakeRadosgw) (*broker.Broker, string, func()) {
+	b := newFakeRadosgwBroker(t, fake, broker.NewMemoryStore(), &brokerConfig.BrokerConfig{InstanceLimit: 100, RadosEndpoint: fake.Server.URL})
+	server := httptest.NewServer(broker.NewAPIHandler(b, b, b.Logger, brokerapi.BrokerCredentials{Username: "user", Password: "pass"}))
+	return b, "http://user:pass@" + strings.TrimPrefix(server.URL, "http://") + "/v2/service_instances/", server.Close
+}
+
+func provisionWithParameters(baseUrl string, instID string, params map[string]interface{}) (*resty.Response, error) {
+	return resty.R().SetHeader("X-Broker-API-Version", "2.14").
+		SetBody(provisionBody{ServiceID: "service", PlanID: "plan", OrgGUID: "org", Space_guid: "space", Parameters: params}).Put(baseUrl + instID)
+}
+
+func bindWithParameters(baseUrl string, instID string, bindID string, params map[string]interface{}) (*resty.Response, error) {
+	body := map[string]interface{}{"service_id": "service", "plan_id": "plan", "app_guid": "app"}
+	if params != nil {
+		body["parameters"] = params
+	}
+	return resty.R().SetHeader("X-Broker-API-Version", "2.14").SetBody(body).Put(baseUrl + instID + "/service_bindings/" + bindID)
+}
+
+//The buckets of an instance are created as its user, returned in the credentials of its bindings and handled on
+//deprovision according to its deletion policy
+func TestDeletionPolicies(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+	_, baseUrl, closeServer := newBucketBroker(t, fake)
+	defer closeServer()
+
+	resp, err := provisionWithParameters(baseUrl, "created", map[string]interface{}{"bucket_count": 2})
+	creds := receivedBindCreds{}
+	bindResp, bindErr := resty.R().SetHeader("X-Broker-API-Version", "2.14").SetResult(&creds).
+		SetBody(map[string]string{"service_id": "service", "plan_id": "plan", "app_guid": "app"}).Put(baseUrl + "created/service_bindings/bind")
+	t.Run("Created", CheckErrs(t, nil, err, bindErr, Equals(201, resp.StatusCode(), "Unexpected status"), Equals(201, bindResp.StatusCode(), "Unexpected status"),
+		Equals(fmt.Sprint([]string{"created:bucket-1", "created:bucket-2"}), fmt.Sprint(fake.Buckets()), "Wrong buckets"),
+		Equals("bucket-1", creds.C.Bucket, "Wrong bucket in the credentials"),
+		Equals(fmt.Sprint([]string{"bucket-1", "bucket-2"}), fmt.Sprint(creds.C.Buckets), "Wrong buckets in the credentials")))
+
+	cases := []struct {
+		name   string
+		policy string
+		object bool
+		status int
+		left   []string
+	}{
+		{"Default", "", true, 200, []string{}},
+		{"Delete", broker.DeletionPolicyDelete, true, 200, []string{}},
+		{"Protect Empty", broker.DeletionPolicyProtect, false, 200, []string{}},
+		{"Protect Not Empty", broker.DeletionPolicyProtect, true, 422, []string{"protected:data"}},
+	}
+	for _, c := range cases {
+		instID := "deleted"
+		if c.status != 200 {
+			instID = "protected"
+		}
+		params := map[string]interface{}{"buckets": []string{"data"}}
+		if c.policy != "" {
+			params["deletion_policy"] = c.policy
+		}
+		if _, err := provisionWithParameters(baseUrl, instID, params); err != nil {
+			t.Fatal(err)
+		}
+		if c.object {
+			fake.PutObject(instID, "data", "object", "data")
+		}
+
+		resp, err := resty.R().SetHeader("X-Broker-API-Version", "2.14").Delete(baseUrl + instID + "?service_id=service&plan_id=plan")
+		users := map[string]bool{}
+		for _, id := range fake.Users() {
+			users[id] = true
+		}
+		buckets := []string{}
+		for _, id := range fake.Buckets() {
+			if !strings.HasPrefix(id, "created:") {
+				buckets = append(buckets, id)
+			}
+		}
+		t.Run(c.name, CheckErrs(t, nil, err, Equals(c.status, resp.StatusCode(), "Unexpected status"),
+			Equals(fmt.Sprint(c.left), fmt.Sprint(buckets), "Wrong buckets left"),
+			Equals(c.status != 200, users[instID+"$"+instID], "Wrong user left")))
+	}
+}
+
+//The broker manages the buckets of an instance with the first S3 key of its user, even once bindings added keys of
+//their own to the user, and reconciliation keeps exactly that key
+func TestManagementKey(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+	b, baseUrl, closeServer := newBucketBroker(t, fake)
+	defer closeServer()
+	ctx := context.Background()
+
+	if _, err := provisionWithParameters(baseUrl, "inst", map[string]interface{}{"buckets": []string{"data"}}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := b.Rados.GetUser(ctx, "inst", "inst", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	managementKey := user.Keys[0].AccessKey
+
+	//Unrestricted bindings get a key of the instance user itself
+	for _, bindID := range []string{"first", "second"} {
+		if _, err := bindWithParameters(baseUrl, "inst", bindID, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	user, err = b.Rados.GetUser(ctx, "inst", "inst", false)
+	ownKeys := 0
+	if err == nil {
+		for _, k := range user.Keys {
+			if k.User == "inst$inst" {
+				ownKeys++
+			}
+		}
+	}
+	t.Run("Keys Added", CheckErrs(t, nil, err, Equals(3, ownKeys, "Wrong number of keys of the instance user")))
+
+	resp, err := bindWithParameters(baseUrl, "inst", "scoped", map[string]interface{}{"buckets": []map[string]string{{"bucket": "data"}}})
+	t.Run("Scoped Bind", CheckErrs(t, nil, err, Equals(201, resp.StatusCode(), "Unexpected status"),
+		Equals(true, fake.BucketPolicy("inst", "data") != "", "Policy not set"),
+		Equals(fmt.Sprint([]string{managementKey}), fmt.Sprint(fake.S3AccessKeys()), "Buckets not managed with the first key")))
+
+	report, err := b.Reconcile(ctx, false, 0)
+	user, userErr := b.Rados.GetUser(ctx, "inst", "inst", false)
+	kept := false
+	if userErr == nil {
+		for _, k := range user.Keys {
+			kept = kept || k.AccessKey == managementKey
+		}
+	}
+	t.Run("Reconciled", CheckErrs(t, nil, err, userErr, Equals("", discrepancies(report), "Unexpected discrepancies"),
+		Equals(true, kept, "Management key removed")))
+
+	resp, err = resty.R().SetHeader("X-Broker-API-Version", "2.14").Delete(baseUrl + "inst/service_bindings/scoped?service_id=service&plan_id=plan")
+	t.Run("Scoped Unbind", CheckErrs(t, nil, err, Equals(200, resp.StatusCode(), "Unexpected status"),
+		Equals(fmt.Sprint([]string{managementKey}), fmt.Sprint(fake.S3AccessKeys()), "Buckets not managed with the first key")))
+}
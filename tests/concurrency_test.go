@@ -0,0 +1,394 @@
+package tests
+
+import (
+	"code.cloudfoundry.org/lager"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-resty/resty"
+	"github.com/icclab/ceph-objectstore-broker/broker"
+	"github.com/icclab/ceph-objectstore-broker/broker/fakes"
+	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
+	rgw "github.com/icclab/ceph-objectstore-broker/radosgw"
+	. "github.com/icclab/ceph-objectstore-broker/tests/testutils"
+	"github.com/pivotal-cf/brokerapi"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//Runs the requests concurrently and returns their status codes, sorted
+func concurrently(t *testing.T, requests ...func() (*resty.Response, error)) []int {
+	codes := make([]int, len(requests))
+	wg := sync.WaitGroup{}
+	for i, r := range requests {
+		wg.Add(1)
+		go func(i int, r func() (*resty.Response, error)) {
+			defer wg.Done()
+			resp, err := r()
+			if err != nil {
+				t.Error("Request failed", err)
+				return
+			}
+			codes[i] = resp.StatusCode()
+		}(i, r)
+	}
+	wg.Wait()
+
+	sort.Ints(codes)
+	return codes
+}
+
+func sameCodes(expected []int, actual []int) error {
+	return Equals(fmt.Sprint(expected), fmt.Sprint(actual), "Unexpected status codes")
+}
+
+//Returns a broker using the fake radosgw and the store. The broker has a single service with the plans 'plan' and 'limited',
+//of which at most 2 instances are provisioned
+func newFakeRadosgwBroker(t *testing.T, fake *FakeRadosgw, store broker.StateStore, bc *brokerConfig.BrokerConfig) *broker.Broker {
+	rados := &rgw.Radosgw{}
+	if err := rados.Setup(fake.Server.URL, "admin", "key", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	bc.Services = []brokerapi.Service{{ID: "service", Name: "object-storage", Bindable: true, PlanUpdatable: true, Plans: []brokerapi.ServicePlan{
+		{ID: "plan", Name: "small", Metadata: &brokerapi.ServicePlanMetadata{AdditionalMetadata: map[string]interface{}{"quotaMB": "100"}}},
+		{ID: "limited", Name: "limited", Metadata: &brokerapi.ServicePlanMetadata{AdditionalMetadata: map[string]interface{}{"quotaMB": "100", "instanceLimit": 2.0}}},
+	}}}
+	return &broker.Broker{
+		Logger:      lager.NewLogger("test"),
+		Rados:       rados,
+		Config:      broker.NewConfig(bc),
+		Store:       store,
+		Locks:       broker.NewInstanceLocks(),
+		Counter:     broker.NewInstanceCounter(),
+		Retirements: broker.NewRetirementIndex(),
+	}
+}
+
+//Returns the OSB API of a broker from newFakeRadosgwBroker
+func newFakeBackedBroker(t *testing.T, fake *FakeRadosgw, store broker.StateStore, bc *brokerConfig.BrokerConfig) http.Handler {
+	b := newFakeRadosgwBroker(t, fake, store, bc)
+	return broker.NewAPIHandler(b, b, lager.NewLogger("test"), brokerapi.BrokerCredentials{Username: "user", Password: "pass"})
+}
+
+func provisionRequest(baseUrl string, instID string, planID string, org string) func() (*resty.Response, error) {
+	return func() (*resty.Response, error) {
+		return resty.R().SetHeader("X-Broker-API-Version", "2.14").
+			SetBody(provisionBody{ServiceID: "service", PlanID: planID, OrgGUID: org, Space_guid: "space"}).Put(baseUrl + instID)
+	}
+}
+
+//Runs concurrent requests against a broker backed by a fake radosgw, which is meant to be run with the race detector.
+//Repeated requests for the same instance or binding are serialized by the instance locks, so exactly one of them creates
+//or deletes the instance or binding
+func TestConcurrentRequests(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+
+	store := broker.NewMemoryStore()
+	server := httptest.NewServer(newFakeBackedBroker(t, fake, store, &brokerConfig.BrokerConfig{InstanceLimit: 100}))
+	defer server.Close()
+	baseUrl := "http://user:pass@" + strings.TrimPrefix(server.URL, "http://") + "/v2/service_instances/"
+
+	request := func() *resty.Request {
+		return resty.R().SetHeader("X-Broker-API-Version", "2.14")
+	}
+	provision := func(instID string) func() (*resty.Response, error) {
+		return provisionRequest(baseUrl, instID, "plan", "org")
+	}
+	bind := func(instID string, bindID string) func() (*resty.Response, error) {
+		return func() (*resty.Response, error) {
+			return request().SetBody(map[string]string{"service_id": "service", "plan_id": "plan", "app_guid": "app"}).
+				Put(baseUrl + instID + "/service_bindings/" + bindID)
+		}
+	}
+	unbind := func(instID string, bindID string) func() (*resty.Response, error) {
+		return func() (*resty.Response, error) {
+			return request().SetQueryParam("service_id", "service").SetQueryParam("plan_id", "plan").
+				Delete(baseUrl + instID + "/service_bindings/" + bindID)
+		}
+	}
+	deprovision := func(instID string) func() (*resty.Response, error) {
+		return func() (*resty.Response, error) {
+			return request().SetQueryParam("service_id", "service").SetQueryParam("plan_id", "plan").Delete(baseUrl + instID)
+		}
+	}
+	lastOperation := func(instID string) func() (*resty.Response, error) {
+		return func() (*resty.Response, error) {
+			return request().Get(baseUrl + instID + "/last_operation")
+		}
+	}
+
+	instIDs := []string{"inst-1", "inst-2", "inst-3", "inst-4"}
+	bindIDs := []string{"bind-1", "bind-2", "bind-3"}
+
+	//Each instance is provisioned twice at once, which creates it once and reports the repeated request as identical
+	wg := sync.WaitGroup{}
+	for _, instID := range instIDs {
+		wg.Add(1)
+		go func(instID string) {
+			defer wg.Done()
+			codes := concurrently(t, provision(instID), provision(instID), lastOperation("missing"))
+			t.Run("Concurrent Provision", CheckErrs(t, nil, sameCodes([]int{200, 201, 410}, codes)))
+		}(instID)
+	}
+	wg.Wait()
+	t.Run("Users Created", CheckErrs(t, nil, Equals(len(instIDs), len(fake.Users()), "Wrong number of radosgw users")))
+
+	//Bindings of the same instance are created one after the other, the repeated ones returning the same credentials
+	for _, instID := range instIDs {
+		wg.Add(1)
+		go func(instID string) {
+			defer wg.Done()
+			requests := []func() (*resty.Response, error){lastOperation(instID)}
+			for _, bindID := range bindIDs {
+				requests = append(requests, bind(instID, bindID), bind(instID, bindID))
+			}
+			codes := concurrently(t, requests...)
+			t.Run("Concurrent Bind", CheckErrs(t, nil, sameCodes([]int{200, 200, 200, 200, 201, 201, 201}, codes)))
+		}(instID)
+	}
+	wg.Wait()
+
+	for _, instID := range instIDs {
+		bindings, err := store.ListBindings(context.Background(), instID)
+		t.Run("Bindings Stored", CheckErrs(t, nil, err, Equals(len(bindIDs), len(bindings), "Wrong number of bindings")))
+	}
+
+	//Only one of the repeated unbinds and deprovisions finds what it deletes
+	for _, instID := range instIDs {
+		wg.Add(1)
+		go func(instID string) {
+			defer wg.Done()
+			requests := []func() (*resty.Response, error){}
+			for _, bindID := range bindIDs {
+				requests = append(requests, unbind(instID, bindID), unbind(instID, bindID))
+			}
+			codes := concurrently(t, requests...)
+			t.Run("Concurrent Unbind", CheckErrs(t, nil, sameCodes([]int{200, 200, 200, 410, 410, 410}, codes)))
+
+			codes = concurrently(t, deprovision(instID), deprovision(instID))
+			t.Run("Concurrent Deprovision", CheckErrs(t, nil, sameCodes([]int{200, 410}, codes)))
+		}(instID)
+	}
+	wg.Wait()
+
+	ids, err := store.ListInstances(context.Background())
+	t.Run("Instances Deleted", CheckErrs(t, nil, err, Equals(0, len(ids), "Instances left in the store"),
+		Equals(0, len(fake.Users()), "Users left on the radosgw")))
+}
+
+func TestFakeBroker(t *testing.T) {
+	b := &broker.Broker{Logger: lager.NewLogger("test"), Config: broker.NewConfig(&brokerConfig.BrokerConfig{}), Store: broker.NewMemoryStore(),
+		Locks: broker.NewInstanceLocks(), Counter: broker.NewInstanceCounter(), Retirements: broker.NewRetirementIndex()}
+	fb := fakes.NewFakeBroker(b)
+
+	bindErr := errors.New("bind failed")
+	fb.FailBind(bindErr)
+	details := brokerapi.BindDetails{ServiceID: "service", PlanID: "plan", AppGUID: "app"}
+	_, err := fb.Bind(context.Background(), "inst", "bind", details)
+	t.Run("Injected Error", CheckErrs(t, nil, Equals(bindErr, err, "Configured error not returned"),
+		Equals("app", fb.BindDetails().AppGUID, "Bind details not recorded"), Equals(bindErr, fb.LastError(), "Last error not recorded")))
+
+	//Requests without a configured error are passed to the wrapped broker
+	_, err = fb.Deprovision(context.Background(), "inst", brokerapi.DeprovisionDetails{}, true)
+	t.Run("Passed On", CheckErrs(t, nil, Equals(brokerapi.ErrInstanceDoesNotExist, err, "Request not passed to the broker"),
+		Equals(true, fb.AsyncAllowed(), "Async not recorded"), Equals(true, fb.Called(), "Call not recorded")))
+}
+
+//Concurrent provisions are checked against the limits one at a time, so none of them is exceeded
+func TestConcurrentInstanceLimits(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+
+	store := broker.NewMemoryStore()
+	server := httptest.NewServer(newFakeBackedBroker(t, fake, store, &brokerConfig.BrokerConfig{InstanceLimit: 6, OrgInstanceLimit: 3}))
+	defer server.Close()
+	baseUrl := "http://user:pass@" + strings.TrimPrefix(server.URL, "http://") + "/v2/service_instances/"
+
+	requests := []func() (*resty.Response, error){}
+	for i := 0; i < 5; i++ {
+		requests = append(requests, provisionRequest(baseUrl, "org-"+strconv.Itoa(i), "plan", "org-1"))
+	}
+	codes := concurrently(t, requests...)
+	t.Run("Org Limit", CheckErrs(t, nil, sameCodes([]int{201, 201, 201, 422, 422}, codes)))
+	provisioned, err := store.ListInstances(context.Background())
+	if err != nil || len(provisioned) == 0 {
+		t.Fatal("No instance provisioned", err)
+	}
+
+	requests = []func() (*resty.Response, error){}
+	for i := 0; i < 4; i++ {
+		requests = append(requests, provisionRequest(baseUrl, "plan-"+strconv.Itoa(i), "limited", "org-"+strconv.Itoa(i+2)))
+	}
+	codes = concurrently(t, requests...)
+	t.Run("Plan Limit", CheckErrs(t, nil, sameCodes([]int{201, 201, 422, 422}, codes)))
+
+	requests = []func() (*resty.Response, error){}
+	for i := 0; i < 4; i++ {
+		requests = append(requests, provisionRequest(baseUrl, "total-"+strconv.Itoa(i), "plan", "org-"+strconv.Itoa(i+10)))
+	}
+	codes = concurrently(t, requests...)
+	t.Run("Total Limit", CheckErrs(t, nil, sameCodes([]int{201, 422, 422, 422}, codes)))
+
+	ids, err := store.ListInstances(context.Background())
+	t.Run("Instances Stored", CheckErrs(t, nil, err, Equals(6, len(ids), "Wrong number of instances"),
+		Equals(6, len(fake.Users()), "Wrong number of users")))
+
+	resp, err := resty.R().SetHeader("X-Broker-API-Version", "2.14").SetBody(map[string]string{"service_id": "service", "plan_id": "limited"}).
+		Patch(baseUrl + provisioned[0])
+	t.Run("Plan Change Limit", CheckErrs(t, nil, err, Equals(422, resp.StatusCode(), "Plan change beyond the limit accepted")))
+
+	//A failed provision doesn't keep its reservation, and a deprovision frees its place
+	resp, err = resty.R().SetHeader("X-Broker-API-Version", "2.14").SetQueryParam("service_id", "service").SetQueryParam("plan_id", "plan").
+		Delete(baseUrl + provisioned[0])
+	t.Run("Deprovision", CheckErrs(t, nil, err, Equals(200, resp.StatusCode(), "Deprovision failed")))
+	codes = concurrently(t, provisionRequest(baseUrl, "total-4", "plan", "org-1"), provisionRequest(baseUrl, "total-5", "plan", "org-1"))
+	t.Run("Freed Place", CheckErrs(t, nil, sameCodes([]int{201, 422}, codes)))
+}
+
+//A deprovision repeated while the first one is still running gets the running operation instead of an error
+func TestRepeatedAsyncDeprovision(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+
+	store := broker.NewMemoryStore()
+	server := httptest.NewServer(newFakeBackedBroker(t, fake, store, &brokerConfig.BrokerConfig{InstanceLimit: 100}))
+	defer server.Close()
+	baseUrl := "http://user:pass@" + strings.TrimPrefix(server.URL, "http://") + "/v2/service_instances/"
+
+	resp, err := provisionRequest(baseUrl, "inst", "plan", "org")()
+	if !t.Run("Provision", CheckErrs(t, nil, err, Equals(201, resp.StatusCode(), "Provision failed"))) {
+		t.FailNow()
+	}
+
+	release := fake.HoldRequests(func(req *http.Request) bool { return req.Method == http.MethodDelete })
+	deprovision := func() (*resty.Response, asyncResponse) {
+		resp, err := resty.R().SetHeader("X-Broker-API-Version", "2.14").SetQueryParam("service_id", "service").
+			SetQueryParam("plan_id", "plan").SetQueryParam("accepts_incomplete", "true").Delete(baseUrl + "inst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		op := asyncResponse{}
+		json.Unmarshal(resp.Body(), &op)
+		return resp, op
+	}
+
+	first, firstOp := deprovision()
+	repeated, repeatedOp := deprovision()
+	release()
+	t.Run("Repeated Deprovision", CheckErrs(t, nil, Equals(202, first.StatusCode(), "Deprovision not started"),
+		Equals(202, repeated.StatusCode(), "Repeated deprovision not accepted"),
+		Equals(firstOp.Operation, repeatedOp.Operation, "Repeated deprovision got another operation")))
+
+	code, _ := waitForOperation(t, baseUrl+"inst/last_operation", firstOp.Operation)
+	t.Run("Deprovisioned", CheckErrs(t, nil, Equals(410, code, "Deprovision not finished"), Equals(0, len(fake.Users()), "User not deleted")))
+}
+
+//Repeated provisions and binds with identical details are answered with 200 and those with other details with 409,
+//which brokerapi doesn't do on its own
+func TestRepeatedRequests(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+
+	server := httptest.NewServer(newFakeBackedBroker(t, fake, broker.NewMemoryStore(), &brokerConfig.BrokerConfig{InstanceLimit: 100}))
+	defer server.Close()
+	baseUrl := "http://user:pass@" + strings.TrimPrefix(server.URL, "http://") + "/v2/service_instances/"
+
+	codes := []int{}
+	for _, planID := range []string{"plan", "plan", "limited"} {
+		resp, err := provisionRequest(baseUrl, "inst", planID, "org")()
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes = append(codes, resp.StatusCode())
+	}
+	t.Run("Repeated Provision", CheckErrs(t, nil, sameCodes([]int{201, 200, 409}, codes)))
+
+	codes = []int{}
+	creds := []string{}
+	for _, appGUID := range []string{"app", "app", "other-app"} {
+		resp, err := resty.R().SetHeader("X-Broker-API-Version", "2.14").
+			SetBody(map[string]string{"service_id": "service", "plan_id": "plan", "app_guid": appGUID}).Put(baseUrl + "inst/service_bindings/bind")
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes = append(codes, resp.StatusCode())
+		creds = append(creds, string(resp.Body()))
+	}
+	t.Run("Repeated Bind", CheckErrs(t, nil, sameCodes([]int{201, 200, 409}, codes),
+		Equals(creds[0], creds[1], "Repeated bind got other credentials")))
+}
+
+//The fetch endpoints and the catalog fields advertising them are served by the broker rather than brokerapi
+func TestFetchEndpoints(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+
+	server := httptest.NewServer(newFakeBackedBroker(t, fake, broker.NewMemoryStore(), &brokerConfig.BrokerConfig{InstanceLimit: 100}))
+	defer server.Close()
+	baseUrl := "http://user:pass@" + strings.TrimPrefix(server.URL, "http://") + "/v2/"
+
+	resp, err := resty.R().SetHeader("X-Broker-API-Version", "2.13").Get(baseUrl + "catalog")
+	catalog := struct {
+		Services []struct {
+			InstancesRetrievable bool `json:"instances_retrievable"`
+			BindingsRetrievable  bool `json:"bindings_retrievable"`
+		} `json:"services"`
+	}{}
+	if err == nil {
+		err = json.Unmarshal(resp.Body(), &catalog)
+	}
+	t.Run("Catalog", CheckErrs(t, nil, err, Equals(200, resp.StatusCode(), "Unexpected status"), Equals(1, len(catalog.Services), "Wrong services"),
+		Equals(true, len(catalog.Services) == 1 && catalog.Services[0].InstancesRetrievable && catalog.Services[0].BindingsRetrievable, "Not retrievable")))
+
+	codes := []int{}
+	for _, path := range []string{"service_instances/inst", "service_instances/inst/service_bindings/bind"} {
+		resp, err := resty.R().SetHeader("X-Broker-API-Version", "2.14").Get(baseUrl + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes = append(codes, resp.StatusCode())
+	}
+	t.Run("Missing", CheckErrs(t, nil, sameCodes([]int{404, 404}, codes)))
+
+	if _, err := provisionRequest(baseUrl+"service_instances/", "inst", "plan", "org")(); err != nil {
+		t.Fatal(err)
+	}
+	bindResp, err := resty.R().SetHeader("X-Broker-API-Version", "2.14").
+		SetBody(map[string]string{"service_id": "service", "plan_id": "plan", "app_guid": "app"}).Put(baseUrl + "service_instances/inst/service_bindings/bind")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inst := broker.InstanceDetails{}
+	resp, err = resty.R().SetHeader("X-Broker-API-Version", "2.14").Get(baseUrl + "service_instances/inst")
+	if err == nil {
+		err = json.Unmarshal(resp.Body(), &inst)
+	}
+	t.Run("Instance", CheckErrs(t, nil, err, Equals(200, resp.StatusCode(), "Unexpected status"), Equals("plan", inst.PlanID, "Wrong plan"),
+		Equals("service", inst.ServiceID, "Wrong service")))
+
+	created, fetched := struct{ Credentials interface{} }{}, struct{ Credentials interface{} }{}
+	resp, err = resty.R().SetHeader("X-Broker-API-Version", "2.14").Get(baseUrl + "service_instances/inst/service_bindings/bind")
+	if err == nil {
+		err = json.Unmarshal(bindResp.Body(), &created)
+	}
+	if err == nil {
+		err = json.Unmarshal(resp.Body(), &fetched)
+	}
+	t.Run("Binding", CheckErrs(t, nil, err, Equals(200, resp.StatusCode(), "Unexpected status"), Equals(true, fetched.Credentials != nil, "No credentials"),
+		Equals(fmt.Sprint(created.Credentials), fmt.Sprint(fetched.Credentials), "Fetched credentials differ")))
+
+	resp, err = resty.R().SetHeader("X-Broker-API-Version", "2.13").Get(baseUrl + "service_instances/inst")
+	t.Run("Old API Version", CheckErrs(t, nil, err, Equals(412, resp.StatusCode(), "Unexpected status")))
+
+	resp, err = resty.R().SetHeader("X-Broker-API-Version", "2.14").Get("http://" + strings.TrimPrefix(server.URL, "http://") + "/v2/service_instances/inst")
+	t.Run("Unauthorized", CheckErrs(t, nil, err, Equals(401, resp.StatusCode(), "Unexpected status")))
+}
@@ -0,0 +1,351 @@
+package tests
+
+import (
+	"code.cloudfoundry.org/lager"
+	"context"
+	"github.com/icclab/ceph-objectstore-broker/broker"
+	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
+	rgw "github.com/icclab/ceph-objectstore-broker/radosgw"
+	. "github.com/icclab/ceph-objectstore-broker/tests/testutils"
+	"github.com/pivotal-cf/brokerapi"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+broker:
+  username: user
+  password: pass
+  instance_limit: 10
+radosgw:
+  endpoint: http://radosgw:7480
+  access_key: key
+  secret_key: secret
+  use_https: false
+state_store:
+  type: memory
+audit:
+  sinks: [file, syslog]
+services:
+- id: service
+  name: object-storage
+  description: Object storage
+  plans:
+  - id: plan
+    name: small
+    description: Small plan
+    metadata:
+      quotaMB: "100"
+`
+
+//Unsets the environment variables of the tests' settings, which would override the config file. Returns a function restoring them
+func clearConfigEnv() func() {
+	saved := map[string]string{}
+	for _, key := range []string{"BROKER_USERNAME", "BROKER_PASSWORD", "INSTANCE_LIMIT", "RADOS_ENDPOINT", "RADOS_ACCESS_KEY",
+		"RADOS_SECRET_KEY", "USE_HTTPS", "STATE_STORE", "AUDIT_SINKS", "SERVICES_FILE"} {
+		if v, ok := os.LookupEnv(key); ok {
+			saved[key] = v
+		}
+		os.Unsetenv(key)
+	}
+
+	return func() {
+		for key, v := range saved {
+			os.Setenv(key, v)
+		}
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	defer clearConfigEnv()()
+
+	dir, err := ioutil.TempDir("", "cosb-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+
+	if err := ioutil.WriteFile(path, []byte(testConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bc, err := brokerConfig.Load(path)
+	if !t.Run("Load", CheckErrs(t, nil, err)) {
+		t.FailNow()
+	}
+	t.Run("Settings", CheckErrs(t, nil, Equals("http://radosgw:7480", bc.RadosEndpoint, "Wrong endpoint"),
+		Equals(10, bc.InstanceLimit, "Wrong instance limit"), Equals("memory", bc.StateStore, "Wrong state store"),
+		Equals("file,syslog", strings.Join(bc.AuditSinks, ","), "Wrong audit sinks"),
+		Equals("plan", bc.Services[0].Plans[0].ID, "Wrong catalog")))
+
+	//Environment variables take precedence over the file
+	os.Setenv("INSTANCE_LIMIT", "20")
+	bc, err = brokerConfig.Load(path)
+	os.Unsetenv("INSTANCE_LIMIT")
+	t.Run("Environment Override", CheckErrs(t, nil, err, Equals(20, bc.InstanceLimit, "Environment not applied")))
+
+	//All problems are reported at once
+	invalid := "broker:\n  username: user\n  instance_limit: many\n  unknown: 1\nradosgw:\n  endpoint: https://radosgw\n  use_https: maybe\nservices: []\n"
+	if err := ioutil.WriteFile(path, []byte(invalid), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = brokerConfig.Load(path)
+	verr, ok := err.(*brokerConfig.ValidationError)
+	if !t.Run("Validation", CheckErrs(t, nil, Equals(true, ok, "Expected a validation error"))) {
+		t.FailNow()
+	}
+	//Unknown setting, password, access key, secret key, instance limit, use_https, https mismatch and the empty catalog
+	t.Run("All Problems", CheckErrs(t, []interface{}{verr.Problems}, Equals(8, len(verr.Problems), "Wrong number of problems")))
+}
+
+func TestConfigReload(t *testing.T) {
+	defer clearConfigEnv()()
+
+	dir, err := ioutil.TempDir("", "cosb-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+
+	if err := ioutil.WriteFile(path, []byte(testConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bc, err := brokerConfig.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := broker.NewConfig(bc)
+
+	reloaded := make(chan bool, 1)
+	go brokerConfig.Watch(func() []string { return []string{path} }, 10*time.Millisecond, func() {
+		config.Reload(lager.NewLogger("test"), nil)
+		reloaded <- true
+	})
+
+	//Gives the watcher time to read the file before it changes
+	time.Sleep(100 * time.Millisecond)
+
+	//The limit and catalog change, while the new endpoint needs a restart
+	changed := strings.Replace(testConfig, "instance_limit: 10", "instance_limit: 5", 1)
+	changed = strings.Replace(changed, "http://radosgw:7480", "http://other:7480", 1)
+	changed = strings.Replace(changed, "name: small", "name: tiny", 1)
+	if err := ioutil.WriteFile(path, []byte(changed), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Config not reloaded")
+	}
+	current := config.Get()
+	t.Run("Reloaded", CheckErrs(t, nil, Equals(5, current.InstanceLimit, "Limit not reloaded"),
+		Equals("tiny", current.Services[0].Plans[0].Name, "Catalog not reloaded"),
+		Equals("http://radosgw:7480", current.RadosEndpoint, "Endpoint changed without a restart"),
+		Equals(10, bc.InstanceLimit, "Previous config modified")))
+
+	//An invalid config is rejected and the current one kept
+	if err := ioutil.WriteFile(path, []byte("broker: [\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	<-reloaded
+	t.Run("Invalid Kept", CheckErrs(t, nil, Equals(current, config.Get(), "Invalid config applied")))
+}
+
+//A catalog read from a services file is reloaded when that file changes, as well as when the config file does
+func TestServicesFileReload(t *testing.T) {
+	defer clearConfigEnv()()
+
+	dir, err := ioutil.TempDir("", "cosb-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+	servicesPath := filepath.Join(dir, "services.json")
+
+	services := `[{"id": "service", "name": "object-storage", "description": "Object storage", "plans": [` +
+		`{"id": "plan", "name": "small", "description": "Small plan", "metadata": {"quotaMB": "100"}}]}]`
+	config := testConfig[:strings.Index(testConfig, "services:")] + "services_file: " + servicesPath + "\n"
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(servicesPath, []byte(services), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bc, err := brokerConfig.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := broker.NewConfig(bc)
+
+	reloaded := make(chan bool, 1)
+	go brokerConfig.Watch(func() []string { return []string{path, current.Get().ServicesFile} }, 10*time.Millisecond, func() {
+		current.Reload(lager.NewLogger("test"), nil)
+		reloaded <- true
+	})
+
+	//Gives the watcher time to read the files before they change
+	time.Sleep(100 * time.Millisecond)
+
+	if err := ioutil.WriteFile(servicesPath, []byte(strings.Replace(services, `"small"`, `"tiny"`, 1)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Catalog not reloaded")
+	}
+	t.Run("Reloaded", CheckErrs(t, nil, Equals(servicesPath, current.Get().ServicesFile, "Wrong services file"),
+		Equals("tiny", current.Get().Services[0].Plans[0].Name, "Catalog not reloaded")))
+}
+
+//Reloaded catalogs are rejected if their plans use placement targets the radosgw doesn't have
+func TestPlacementReload(t *testing.T) {
+	defer clearConfigEnv()()
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+
+	dir, err := ioutil.TempDir("", "cosb-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+
+	config := strings.Replace(testConfig, "http://radosgw:7480", fake.Server.URL, 1)
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bc, err := brokerConfig.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rados := &rgw.Radosgw{}
+	if err := rados.Setup(fake.Server.URL, "admin", "key", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	b := &broker.Broker{Logger: lager.NewLogger("test"), Rados: rados, Backends: broker.BackendClients{}, Config: broker.NewConfig(bc),
+		Locks: broker.NewInstanceLocks(), Counter: broker.NewInstanceCounter(), Retirements: broker.NewRetirementIndex()}
+
+	for _, c := range []struct {
+		placement string
+		valid     bool
+	}{{"nvme-placement", false}, {"default-placement", true}} {
+		changed := strings.Replace(config, `quotaMB: "100"`, `quotaMB: "100"`+"\n      placement: "+c.placement, 1)
+		if err := ioutil.WriteFile(path, []byte(changed), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		err := b.ReloadConfig(context.Background())
+		settings, settingsErr := brokerConfig.ParsePlanSettings(b.Config.Get().Services[0].Plans[0])
+		t.Run("Reload "+c.placement, CheckErrs(t, nil, settingsErr, Equals(c.valid, err == nil, "Wrong reload result"),
+			Equals(c.valid, settings.Placement == c.placement, "Wrong placement applied")))
+	}
+}
+
+func TestCatalogValidation(t *testing.T) {
+	for _, c := range []struct {
+		size interface{}
+		mb   int
+	}{{500.0, 500}, {"500", 500}, {"5GB", 5000}, {"2 GiB", 2048}, {"1.5gb", 1500}, {"100MB", 100}} {
+		mb, err := brokerConfig.ParseSizeMB(c.size)
+		t.Run("Size", CheckErrs(t, []interface{}{c.size}, err, Equals(c.mb, mb, "Wrong size")))
+	}
+	for _, size := range []interface{}{"5PB", "many", "0.5MB", true, nil} {
+		_, err := brokerConfig.ParseSizeMB(size)
+		t.Run("Invalid Size", CheckErrs(t, []interface{}{size}, Equals(true, err != nil, "Invalid size accepted")))
+	}
+
+	plan := func(id string, name string, metadata map[string]interface{}) brokerapi.ServicePlan {
+		return brokerapi.ServicePlan{ID: id, Name: name, Description: name,
+			Metadata: &brokerapi.ServicePlanMetadata{AdditionalMetadata: metadata}}
+	}
+	services := []brokerapi.Service{
+		{ID: "service", Name: "object-storage", Description: "Object storage", Plans: []brokerapi.ServicePlan{
+			plan("small", "small", map[string]interface{}{"quotaMB": "1GB", "instanceLimit": 10.0, "bucketCount": "2", "placement": "ssd",
+				"storageClass": "COLD"}),
+		}},
+	}
+	t.Run("Valid Catalog", CheckErrs(t, nil, Equals(0, len(brokerConfig.ValidateCatalog(services)), "Valid catalog rejected")))
+
+	settings, err := brokerConfig.ParsePlanSettings(services[0].Plans[0])
+	t.Run("Plan Settings", CheckErrs(t, nil, err, Equals(1000, settings.QuotaMB, "Wrong quota"),
+		Equals(10, settings.InstanceLimit, "Wrong instance limit"), Equals(2, settings.BucketCount, "Wrong bucket count"),
+		Equals("ssd", settings.Placement, "Wrong placement"), Equals("COLD", settings.StorageClass, "Wrong storage class")))
+
+	services = append(services, brokerapi.Service{ID: "service", Name: "object-storage", Plans: []brokerapi.ServicePlan{
+		plan("small", "small", map[string]interface{}{"quotaMB": "small"}),
+		plan("", "large", map[string]interface{}{"instanceLimit": -1.0}),
+		plan("other", "large", nil),
+		plan("cold", "cold", map[string]interface{}{"quotaMB": "1GB", "storageClass": ""}),
+	}})
+	//Duplicate service ID and name, missing description, duplicate plan ID, invalid quota, missing plan ID,
+	//missing quota and invalid instance limit, duplicate plan name and missing quota, empty storage class
+	problems := brokerConfig.ValidateCatalog(services)
+	t.Run("Invalid Catalog", CheckErrs(t, []interface{}{problems}, Equals(10, len(problems), "Wrong number of problems")))
+}
+
+func TestConfigBackends(t *testing.T) {
+	defer clearConfigEnv()()
+
+	dir, err := ioutil.TempDir("", "cosb-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+
+	backends := `
+backends:
+  swift-only:
+    credentials: [swift]
+  premium:
+    endpoint: http://premium:7480
+    access_key: premium-key
+    secret_key: premium-secret
+    placement: ssd
+`
+	config := strings.Replace(testConfig, "  plans:\n", "  metadata:\n    backend: premium\n  plans:\n", 1) + backends
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bc, err := brokerConfig.Load(path)
+	if !t.Run("Load", CheckErrs(t, nil, err)) {
+		t.FailNow()
+	}
+
+	names, err := brokerConfig.PlanBackends(bc.Services[0], bc.Services[0].Plans[0])
+	if !t.Run("Plan Backends", CheckErrs(t, nil, err, Equals(1, len(names), "Wrong number of backends"))) {
+		t.FailNow()
+	}
+	premium, ok := bc.Backend(names[0])
+	t.Run("Premium", CheckErrs(t, nil, Equals(true, ok, "Backend of the service not found"),
+		Equals("http://premium:7480", premium.RadosEndpoint, "Wrong endpoint"), Equals("http://premium:7480/", premium.S3Endpoint, "Wrong S3 endpoint"),
+		Equals("premium-key", premium.RadosAccessKey, "Wrong access key"), Equals("ssd", premium.Placement, "Wrong placement"),
+		Equals(true, premium.Offers(brokerConfig.S3Credentials) && premium.Offers(brokerConfig.SwiftCredentials), "Wrong credentials")))
+
+	//Settings left out are those of the default backend
+	swift := bc.Backends["swift-only"]
+	t.Run("Defaults", CheckErrs(t, nil, Equals("http://radosgw:7480", swift.RadosEndpoint, "Endpoint not inherited"),
+		Equals("key", swift.RadosAccessKey, "Access key not inherited"), Equals(false, swift.Offers(brokerConfig.S3Credentials), "S3 offered")))
+
+	invalid := config + "  broken:\n    endpoint: https://broken\n    credentials: [ftp]\n  default:\n    placement: ssd\n"
+	invalid = strings.Replace(invalid, "backend: premium", "backend: missing", 1)
+	if err := ioutil.WriteFile(path, []byte(invalid), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = brokerConfig.Load(path)
+	verr, ok := err.(*brokerConfig.ValidationError)
+	if !t.Run("Validation", CheckErrs(t, nil, Equals(true, ok, "Expected a validation error"))) {
+		t.FailNow()
+	}
+	//Missing keys, unknown credential type and HTTPS mismatch of the broken backend, the default backend and the unknown backend
+	t.Run("All Problems", CheckErrs(t, []interface{}{verr.Problems}, Equals(5, len(verr.Problems), "Wrong number of problems")))
+}
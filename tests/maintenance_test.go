@@ -0,0 +1,126 @@
+package tests
+
+import (
+	"context"
+	"github.com/go-resty/resty"
+	"github.com/icclab/ceph-objectstore-broker/broker"
+	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
+	. "github.com/icclab/ceph-objectstore-broker/tests/testutils"
+	"github.com/pivotal-cf/brokerapi"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//The maintenance operations of the admin API are made by the running broker, so its instance counts follow them
+func TestAdminMaintenance(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+
+	b := newFakeRadosgwBroker(t, fake, broker.NewMemoryStore(), &brokerConfig.BrokerConfig{InstanceLimit: 100})
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", broker.NewAdminHandler(b, b.Logger, "user", "pass"))
+	mux.Handle("/", broker.NewAPIHandler(b, b, b.Logger, brokerapi.BrokerCredentials{Username: "user", Password: "pass"}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	url := "http://user:pass@" + strings.TrimPrefix(server.URL, "http://")
+	baseUrl := url + "/v2/service_instances/"
+
+	for _, instID := range []string{"inst-1", "inst-2"} {
+		if _, err := provisionRequest(baseUrl, instID, "limited", "org")(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp, err := provisionRequest(baseUrl, "inst-3", "limited", "org")()
+	t.Run("Limit Reached", CheckErrs(t, nil, err, Equals(422, resp.StatusCode(), "Unexpected status")))
+
+	resp, err = resty.R().Post(url + strings.Replace(broker.ForceDeletePath, "{instance_id}", "inst-1", 1))
+	exists, existsErr := b.Store.InstanceExists(context.Background(), "inst-1")
+	t.Run("Force Delete", CheckErrs(t, nil, err, existsErr, Equals(200, resp.StatusCode(), "Unexpected status"),
+		Equals(false, exists, "Instance left"), Equals(1, len(fake.Users()), "User left"), Equals(1, b.Counter.Count(), "Instance still counted")))
+
+	resp, err = resty.R().Post(url + strings.Replace(broker.ForceDeletePath, "{instance_id}", "missing", 1))
+	t.Run("Force Delete Missing", CheckErrs(t, nil, err, Equals(410, resp.StatusCode(), "Unexpected status")))
+
+	now := time.Now().UTC()
+	exp := broker.StateExport{Version: 1, Instances: []broker.InstanceState{{
+		Instance: &broker.Instance{ID: "imported", ServiceID: "service", PlanID: "limited", OrganizationGUID: "org", User: "imported", Tenant: "imported"},
+		Bindings: map[string]*broker.Bind{"bind": {User: "imported", Tenant: "imported", Retired: []broker.RetiredCredentials{{S3AccessKey: "old", DeleteAt: now}}}},
+	}}}
+	imported := broker.ImportStateResponse{}
+	resp, err = resty.R().SetBody(exp).SetResult(&imported).Post(url + broker.ImportStatePath)
+	t.Run("Import", CheckErrs(t, nil, err, Equals(200, resp.StatusCode(), "Unexpected status"), Equals(1, imported.Imported, "Wrong number of imported instances"),
+		Equals(2, b.Counter.Count(), "Imported instance not counted"), Equals(1, b.Retirements.Len(), "Retired credentials not indexed")))
+
+	resp, err = provisionRequest(baseUrl, "inst-3", "limited", "org")()
+	t.Run("Imported Instance Counted", CheckErrs(t, nil, err, Equals(422, resp.StatusCode(), "Unexpected status")))
+
+	syncs := []broker.QuotaSync{}
+	resp, err = resty.R().SetBody(broker.SyncQuotasRequest{DryRun: true}).SetResult(&syncs).Post(url + broker.SyncQuotasPath)
+	t.Run("Sync Quotas", CheckErrs(t, nil, err, Equals(200, resp.StatusCode(), "Unexpected status"), Equals(2, len(syncs), "Wrong number of instances")))
+	if len(syncs) == 2 {
+		//The user of the imported instance doesn't exist on the radosgw
+		t.Run("Sync Quota Results", CheckErrs(t, nil, Equals("imported", syncs[0].InstanceID, "Wrong instance"),
+			Equals(true, syncs[0].Error != "", "Missing user not reported"), Equals("", syncs[1].Error, "Unexpected error"),
+			Equals(100, syncs[1].QuotaMB, "Wrong quota")))
+	}
+}
+
+//Brokers sharing a state store catch up with each other's instances when they recount them, while provisions in progress
+//stay counted
+func TestRecountInstances(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+
+	store := broker.NewMemoryStore()
+	replicas := []*broker.Broker{}
+	urls := []string{}
+	for i := 0; i < 2; i++ {
+		b := newFakeRadosgwBroker(t, fake, store, &brokerConfig.BrokerConfig{InstanceLimit: 100})
+		server := httptest.NewServer(broker.NewAPIHandler(b, b, b.Logger, brokerapi.BrokerCredentials{Username: "user", Password: "pass"}))
+		defer server.Close()
+		replicas = append(replicas, b)
+		urls = append(urls, "http://user:pass@"+strings.TrimPrefix(server.URL, "http://")+"/v2/service_instances/")
+	}
+
+	for _, instID := range []string{"inst-1", "inst-2"} {
+		if _, err := provisionRequest(urls[0], instID, "limited", "org")(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp, err := provisionRequest(urls[1], "inst-3", "limited", "org")()
+	t.Run("Not Counted", CheckErrs(t, nil, err, Equals(201, resp.StatusCode(), "Unexpected status"),
+		Equals(1, replicas[1].Counter.Count(), "Wrong number of counted instances")))
+
+	err = replicas[1].RecountInstances(context.Background())
+	t.Run("Recounted", CheckErrs(t, nil, err, Equals(3, replicas[1].Counter.Count(), "Wrong number of counted instances")))
+
+	resp, err = provisionRequest(urls[1], "inst-4", "limited", "org")()
+	t.Run("Limit Reached", CheckErrs(t, nil, err, Equals(422, resp.StatusCode(), "Unexpected status")))
+
+	if _, err := resty.R().SetHeader("X-Broker-API-Version", "2.14").
+		Delete(urls[0] + "inst-1?service_id=service&plan_id=limited"); err != nil {
+		t.Fatal(err)
+	}
+
+	//The instance of a provision is counted but not stored while its user is created. The provision holds the lock of the
+	//instance until its record is stored, which the recount waits for
+	release := fake.HoldRequests(adminRequest(http.MethodPut, ""))
+	provisioned := make(chan *resty.Response)
+	go func() {
+		resp, _ := provisionRequest(urls[0], "inst-5", "limited", "org")()
+		provisioned <- resp
+	}()
+	for replicas[0].Counter.Count() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	recounted := make(chan error)
+	go func() { recounted <- replicas[0].RecountInstances(context.Background()) }()
+	time.Sleep(10 * time.Millisecond)
+	release()
+	resp, err = <-provisioned, <-recounted
+	t.Run("Provision In Progress", CheckErrs(t, nil, err, Equals(201, resp.StatusCode(), "Unexpected status"),
+		Equals(3, replicas[0].Counter.Count(), "Wrong number of counted instances")))
+}
@@ -0,0 +1,198 @@
+package tests
+
+import (
+	"bytes"
+	"code.cloudfoundry.org/lager"
+	"context"
+	"github.com/go-resty/resty"
+	"github.com/icclab/ceph-objectstore-broker/broker"
+	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
+	rgwclient "github.com/icclab/ceph-objectstore-broker/radosgw"
+	. "github.com/icclab/ceph-objectstore-broker/tests/testutils"
+	rgw "github.com/myENA/radosgwadmin"
+	"github.com/pivotal-cf/brokerapi"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Returns a usage log entry of the user with the traffic in a single bucket
+func usageEntry(user string, sent int, received int, ops int) rgw.UsageEntry {
+	return rgw.UsageEntry{User: user, Buckets: []rgw.UsageBucket{{Bucket: "data", Owner: user, Categories: []rgw.UsageCategory{
+		{Category: "get_obj", BytesSent: sent, Ops: ops, SuccessfulOps: ops},
+		{Category: "put_obj", BytesReceived: received},
+	}}}}
+}
+
+//The metering endpoint serves the last metered period once there is one, or meters the requested window, aggregated
+//and formatted as requested
+func TestMeteringEndpoint(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+	fake.UsageEntries = []rgw.UsageEntry{usageEntry("inst$inst", 100, 10, 2)}
+
+	b := newFakeRadosgwBroker(t, fake, broker.NewMemoryStore(), &brokerConfig.BrokerConfig{InstanceLimit: 100})
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", broker.NewAdminHandler(b, b.Logger, "user", "pass"))
+	mux.Handle("/", broker.NewAPIHandler(b, b, b.Logger, brokerapi.BrokerCredentials{Username: "user", Password: "pass"}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	url := "http://user:pass@" + strings.TrimPrefix(server.URL, "http://")
+
+	if _, err := provisionRequest(url+"/v2/service_instances/", "inst", "plan", "org")(); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := resty.R().Get(url + broker.MeteringPath)
+	t.Run("Not Metered", CheckErrs(t, nil, err, Equals(503, resp.StatusCode(), "Unexpected status")))
+
+	b.Metering = broker.NewMeteringCollector(b, time.Hour)
+	if err := b.Metering.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	report := broker.MeteringReport{}
+	resp, err = resty.R().SetResult(&report).Get(url + broker.MeteringPath)
+	end := time.Now().UTC().Truncate(time.Hour)
+	t.Run("Last Period", CheckErrs(t, nil, err, Equals(200, resp.StatusCode(), "Unexpected status"),
+		Equals(end, report.End, "Wrong end"), Equals(end.Add(-time.Hour), report.Start, "Wrong start"),
+		Equals(broker.GroupByInstance, report.GroupBy, "Wrong grouping"), Equals(1, len(report.Records), "Wrong number of records")))
+	if len(report.Records) == 1 {
+		t.Run("Instance Record", CheckErrs(t, nil, Equals("inst", report.Records[0].InstanceID, "Wrong instance"),
+			Equals("small", report.Records[0].PlanName, "Wrong plan"), Equals(int64(100), report.Records[0].BytesSent, "Wrong bytes sent"),
+			Equals(int64(10), report.Records[0].BytesReceived, "Wrong bytes received"), Equals(int64(2), report.Records[0].Ops, "Wrong ops")))
+	}
+
+	window := map[string]string{"start": "2026-01-01T00:00:00Z", "end": "2026-02-01T00:00:00Z"}
+	resp, err = resty.R().SetQueryParams(window).SetQueryParams(map[string]string{"group_by": broker.GroupByOrganization, "format": "csv"}).
+		Get(url + broker.MeteringPath)
+	lines := strings.Split(strings.TrimSpace(resp.String()), "\n")
+	t.Run("Window As CSV", CheckErrs(t, nil, err, Equals(200, resp.StatusCode(), "Unexpected status"),
+		Equals("text/csv", resp.Header().Get("Content-Type"), "Wrong content type"), Equals(2, len(lines), "Wrong number of lines"),
+		Equals("2026-01-01T00:00:00Z,2026-02-01T00:00:00Z,,,,org,,false,1,100,10,2,2,0,0,", lines[len(lines)-1], "Wrong record")))
+
+	for name, params := range map[string]map[string]string{
+		"Unknown Group":  {"group_by": "region"},
+		"Unknown Format": {"format": "xml"},
+		"Inverted":       {"start": window["end"], "end": window["start"]},
+		"Invalid Start":  {"start": "yesterday", "end": window["end"]},
+	} {
+		resp, err := resty.R().SetQueryParams(params).Get(url + broker.MeteringPath)
+		t.Run(name, CheckErrs(t, nil, err, Equals(400, resp.StatusCode(), "Unexpected status")))
+	}
+}
+
+//Returns the report as CSV
+func meteringCSV(t *testing.T, report *broker.MeteringReport) string {
+	buf := &bytes.Buffer{}
+	if err := report.WriteCSV(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+//Instances are metered from the usage log of the cluster they're on, along with their scoped binding users, while the
+//tenants of deprovisioned instances are reported on their own and users the broker doesn't own are left out
+func TestMeter(t *testing.T) {
+	fake, eastFake := NewFakeRadosgw(), NewFakeRadosgw()
+	defer fake.Close()
+	defer eastFake.Close()
+
+	bc := &brokerConfig.BrokerConfig{InstanceLimit: 100, RadosEndpoint: fake.Server.URL, RadosAdminPath: "admin", RadosAccessKey: "key", RadosSecretKey: "secret"}
+	bc.Backends = map[string]*brokerConfig.Backend{"east": {Name: "east", RadosEndpoint: eastFake.Server.URL, RadosAdminPath: "admin",
+		RadosAccessKey: "key", RadosSecretKey: "secret", Credentials: []string{brokerConfig.S3Credentials}}}
+	bc.Services = []brokerapi.Service{backendService("standard", ""), backendService("east", "east")}
+	rados := &rgwclient.Radosgw{}
+	if err := rados.Setup(fake.Server.URL, "admin", "key", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	backends, err := broker.NewBackendClients(bc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &broker.Broker{Logger: lager.NewLogger("test"), Rados: rados, Backends: backends, Config: broker.NewConfig(bc), Store: broker.NewMemoryStore(),
+		Locks: broker.NewInstanceLocks(), Counter: broker.NewInstanceCounter(), Retirements: broker.NewRetirementIndex()}
+	server := httptest.NewServer(broker.NewAPIHandler(b, b, b.Logger, brokerapi.BrokerCredentials{Username: "user", Password: "pass"}))
+	defer server.Close()
+	baseUrl := "http://user:pass@" + strings.TrimPrefix(server.URL, "http://") + "/v2/service_instances/"
+
+	for _, inst := range []struct{ id, service, org, space string }{
+		{"inst-a", "standard", "org-1", "space-1"}, {"inst-b", "east", "org-1", "space-2"}, {"inst-c", "standard", "org-2", "space-3"},
+	} {
+		resp, err := resty.R().SetHeader("X-Broker-API-Version", "2.14").SetBody(provisionBody{ServiceID: inst.service, PlanID: inst.service + "-plan",
+			OrgGUID: inst.org, Space_guid: inst.space, Parameters: map[string]interface{}{"buckets": []string{"data"}}}).Put(baseUrl + inst.id)
+		if err != nil || resp.StatusCode() != 201 {
+			t.Fatal(err, resp)
+		}
+	}
+	resp, err := resty.R().SetHeader("X-Broker-API-Version", "2.14").SetBody(map[string]interface{}{"service_id": "standard", "plan_id": "standard-plan",
+		"parameters": map[string]interface{}{"buckets": []map[string]string{{"bucket": "data"}}}}).Put(baseUrl + "inst-a/service_bindings/reader")
+	if err != nil || resp.StatusCode() != 201 {
+		t.Fatal(err, resp)
+	}
+
+	//Each cluster also logs a user with the ID of an instance on the other one, which isn't the user of the instance
+	fake.UsageEntries = []rgw.UsageEntry{usageEntry("insta$inst-a", 100, 10, 2), usageEntry("insta$reader", 50, 0, 1),
+		usageEntry("instc$inst-c", 1, 1, 1), usageEntry("instb$inst-b", 1000, 1000, 1000), usageEntry("gone$gone", 7, 0, 1),
+		usageEntry("operator", 5, 5, 5)}
+	eastFake.UsageEntries = []rgw.UsageEntry{usageEntry("instb$inst-b", 200, 20, 4), usageEntry("insta$inst-a", 1000, 1000, 1000)}
+
+	start, end := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+	window := "2026-01-01T00:00:00Z,2026-02-01T00:00:00Z,"
+	header := "start,end,instance_id,plan_id,plan_name,organization_guid,space_guid,deprovisioned,instances,bytes_sent,bytes_received,ops,successful_ops,size_kb,objects,error\n"
+	report, err := b.Meter(context.Background(), start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("By Instance", CheckErrs(t, nil, Equals(header+
+		window+"gone,,,,,true,1,7,0,1,1,0,0,\n"+
+		window+"inst-a,standard-plan,small,org-1,space-1,false,1,150,10,3,3,0,0,\n"+
+		window+"inst-b,east-plan,small,org-1,space-2,false,1,200,20,4,4,0,0,\n"+
+		window+"inst-c,standard-plan,small,org-2,space-3,false,1,1,1,1,1,0,0,\n", meteringCSV(t, report), "Wrong report")))
+
+	aggregated := map[string]string{
+		broker.GroupByOrganization: window + ",,,,,true,1,7,0,1,1,0,0,\n" +
+			window + ",,,org-1,,false,2,350,30,7,7,0,0,\n" +
+			window + ",,,org-2,,false,1,1,1,1,1,0,0,\n",
+		broker.GroupBySpace: window + ",,,,,true,1,7,0,1,1,0,0,\n" +
+			window + ",,,org-1,space-1,false,1,150,10,3,3,0,0,\n" +
+			window + ",,,org-1,space-2,false,1,200,20,4,4,0,0,\n" +
+			window + ",,,org-2,space-3,false,1,1,1,1,1,0,0,\n",
+		broker.GroupByPlan: window + ",,,,,true,1,7,0,1,1,0,0,\n" +
+			window + ",east-plan,small,,,false,1,200,20,4,4,0,0,\n" +
+			window + ",standard-plan,small,,,false,2,151,11,4,4,0,0,\n",
+	}
+	for groupBy, expected := range aggregated {
+		r, err := report.Aggregate(groupBy)
+		csv := ""
+		if err == nil {
+			csv = meteringCSV(t, r)
+		}
+		t.Run("By "+groupBy, CheckErrs(t, nil, err, Equals(header+expected, csv, "Wrong report")))
+	}
+
+	byOrg, err := report.Aggregate(broker.GroupByOrganization)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, unknownErr := report.Aggregate("region")
+	_, regroupErr := byOrg.Aggregate(broker.GroupByPlan)
+	t.Run("Invalid Groups", CheckErrs(t, nil, Equals(true, unknownErr != nil, "Unknown group accepted"),
+		Equals(true, regroupErr != nil, "Aggregated report regrouped")))
+
+	//Storage that can't be read is reported, while the traffic is still metered
+	restore := eastFake.FailRequests(func(req *http.Request) bool { return req.URL.Query().Get("stats") == "true" })
+	report, err = b.Meter(context.Background(), start, end)
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byOrg, err = report.Aggregate(broker.GroupByOrganization)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("Storage Unavailable", CheckErrs(t, nil, Equals(true, report.Records[2].Error != "", "Error not reported"),
+		Equals(int64(200), report.Records[2].BytesSent, "Traffic not metered"),
+		Equals(true, strings.HasPrefix(byOrg.Records[1].Error, "Storage of instance 'inst-b' unavailable"), "Error not aggregated")))
+}
@@ -0,0 +1,127 @@
+package tests
+
+import (
+	"context"
+	"github.com/go-resty/resty"
+	"github.com/icclab/ceph-objectstore-broker/broker"
+	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
+	"github.com/icclab/ceph-objectstore-broker/metrics"
+	. "github.com/icclab/ceph-objectstore-broker/tests/testutils"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//Returns the values of the samples of the metrics endpoint by their name and labels
+func scrapeMetrics(t *testing.T, url string) map[string]float64 {
+	resp, err := resty.R().Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := map[string]float64{}
+	for _, line := range strings.Split(resp.String(), "\n") {
+		i := strings.LastIndex(line, " ")
+		if line == "" || strings.HasPrefix(line, "#") || i < 0 {
+			continue
+		}
+		if v, err := strconv.ParseFloat(line[i+1:], 64); err == nil {
+			samples[line[:i]] = v
+		}
+	}
+	return samples
+}
+
+//OSB requests are counted by operation and result, along with the radosgw and S3 calls made for them, while the state
+//of the broker is read from the state store on each scrape. The counters are global, so only their increase is checked
+func TestMetrics(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+
+	b := newFakeRadosgwBroker(t, fake, broker.NewMemoryStore(), &brokerConfig.BrokerConfig{InstanceLimit: 100, RadosEndpoint: fake.Server.URL})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(broker.NewStateCollector(b))
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, registry}, promhttp.HandlerOpts{}))
+	mux.Handle("/", broker.NewAPIHandler(metrics.InstrumentBroker(b), b, b.Logger, brokerapi.BrokerCredentials{Username: "user", Password: "pass"}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	metricsUrl := server.URL + "/metrics"
+	baseUrl := "http://user:pass@" + strings.TrimPrefix(server.URL, "http://") + "/v2/service_instances/"
+
+	before := scrapeMetrics(t, metricsUrl)
+	if _, err := provisionWithParameters(baseUrl, "inst", map[string]interface{}{"buckets": []string{"data"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bindWithParameters(baseUrl, "inst", "bind", nil); err != nil {
+		t.Fatal(err)
+	}
+	restore := fake.FailRequests(adminRequest(http.MethodPut, "quota"))
+	if _, err := provisionRequest(baseUrl, "failed", "plan", "org")(); err != nil {
+		t.Fatal(err)
+	}
+	restore()
+	after := scrapeMetrics(t, metricsUrl)
+	increase := func(sample string) float64 {
+		return after[sample] - before[sample]
+	}
+
+	t.Run("OSB Requests", CheckErrs(t, nil, Equals(1.0, increase(`cosb_osb_requests_total{operation="provision",result="success"}`), "Provision not counted"),
+		Equals(1.0, increase(`cosb_osb_requests_total{operation="provision",result="error"}`), "Failed provision not counted"),
+		Equals(1.0, increase(`cosb_osb_requests_total{operation="bind",result="success"}`), "Bind not counted"),
+		Equals(1.0, increase(`cosb_osb_request_duration_seconds_count{operation="provision",result="success"}`), "Provision duration not observed")))
+
+	t.Run("Calls", CheckErrs(t, nil, Equals(2.0, increase(`cosb_radosgw_call_duration_seconds_count{call="create-user",result="success"}`), "User creations not observed"),
+		Equals(1.0, increase(`cosb_radosgw_call_duration_seconds_count{call="set-user-quota",result="error"}`), "Failed call not observed"),
+		Equals(1.0, increase(`cosb_radosgw_call_errors_total{call="set-user-quota"}`), "Failed call not counted"),
+		Equals(1.0, increase(`cosb_s3_call_duration_seconds_count{call="create-bucket",result="success"}`), "Bucket creation not observed")))
+
+	t.Run("State", CheckErrs(t, nil, Equals(1.0, after["cosb_instances"], "Wrong number of instances"),
+		Equals(1.0, after["cosb_bindings"], "Wrong number of bindings"), Equals(100.0, after["cosb_instance_limit"], "Wrong instance limit")))
+}
+
+//The storage of the instances is exposed by instance and plan on the unauthenticated metrics endpoint, while their
+//organizations and spaces are only served by the admin API
+func TestUsageMetrics(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+
+	b := newFakeRadosgwBroker(t, fake, broker.NewMemoryStore(), &brokerConfig.BrokerConfig{InstanceLimit: 100})
+	b.Usage = broker.NewUsageCollector(b)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(b.Usage)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.Handle("/admin/", broker.NewAdminHandler(b, b.Logger, "user", "pass"))
+	mux.Handle("/", broker.NewAPIHandler(b, b, b.Logger, brokerapi.BrokerCredentials{Username: "user", Password: "pass"}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	url := "http://user:pass@" + strings.TrimPrefix(server.URL, "http://")
+
+	if _, err := provisionRequest(url+"/v2/service_instances/", "inst", "plan", "org")(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Usage.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := resty.R().Get(server.URL + "/metrics")
+	samples := scrapeMetrics(t, server.URL+"/metrics")
+	_, size := samples[`cosb_instance_size_bytes{instance_id="inst",plan="small"}`]
+	t.Run("Metrics", CheckErrs(t, nil, err, Equals(true, size, "Size of the instance missing"),
+		Equals(100.0*1024*1024, samples[`cosb_instance_quota_bytes{instance_id="inst",plan="small"}`], "Wrong quota"),
+		Equals(false, strings.Contains(resp.String(), "organization_guid") || strings.Contains(resp.String(), "space_guid"), "Organization or space exposed")))
+
+	report := broker.UsageReport{}
+	resp, err = resty.R().SetResult(&report).Get(url + broker.UsagePath)
+	t.Run("Admin API", CheckErrs(t, nil, err, Equals(200, resp.StatusCode(), "Unexpected status"), Equals(1, len(report.Instances), "Wrong number of instances")))
+	if len(report.Instances) == 1 {
+		t.Run("Admin API Instance", CheckErrs(t, nil, Equals("org", report.Instances[0].OrganizationGUID, "Wrong organization"),
+			Equals("space", report.Instances[0].SpaceGUID, "Wrong space")))
+	}
+}
@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/go-resty/resty"
+	"github.com/icclab/ceph-objectstore-broker/broker"
+	. "github.com/icclab/ceph-objectstore-broker/tests/testutils"
+	"sort"
+	"testing"
+)
+
+//Returns the statements of the policy of a bucket by their ID
+func policyStatements(t *testing.T, fake *FakeRadosgw, tenant string, bucket string) map[string]broker.PolicyStatement {
+	statements := map[string]broker.PolicyStatement{}
+	policy := fake.BucketPolicy(tenant, bucket)
+	if policy == "" {
+		return statements
+	}
+
+	doc := struct {
+		Statement []broker.PolicyStatement
+	}{}
+	if err := json.Unmarshal([]byte(policy), &doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range doc.Statement {
+		statements[st.Sid] = st
+	}
+	return statements
+}
+
+func sids(statements map[string]broker.PolicyStatement) string {
+	ids := []string{}
+	for id := range statements {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return fmt.Sprint(ids)
+}
+
+//Scoped bindings get a user of their own, which the policies of their buckets grant access to. Unbinding removes exactly
+//the statements of the binding, leaving those of other bindings and of anyone else in place
+func TestScopedBindings(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+	_, baseUrl, closeServer := newBucketBroker(t, fake)
+	defer closeServer()
+
+	if _, err := provisionWithParameters(baseUrl, "inst", map[string]interface{}{"buckets": []string{"data", "logs"}}); err != nil {
+		t.Fatal(err)
+	}
+	fake.SetBucketPolicy("inst", "data", `{"Version":"2012-10-17","Statement":{"Sid":"operator","Effect":"Allow",`+
+		`"Principal":{"AWS":["arn:aws:iam::inst:user/operator"]},"Action":["s3:GetObject"],"Resource":["arn:aws:s3:::data/*"]}}`)
+	reader := "cosb" + hex.EncodeToString([]byte("reader")) + "s0"
+	writer := "cosb" + hex.EncodeToString([]byte("writer")) + "s"
+
+	resp, err := bindWithParameters(baseUrl, "inst", "reader", map[string]interface{}{"access": "read",
+		"buckets": []map[string]string{{"bucket": "data", "prefix": "reports/"}}})
+	creds := receivedBindCreds{}
+	json.Unmarshal(resp.Body(), &creds)
+	statements := policyStatements(t, fake, "inst", "data")
+	t.Run("Bind", CheckErrs(t, nil, err, Equals(201, resp.StatusCode(), "Unexpected status"),
+		Equals("inst$reader", creds.C.S3User, "Wrong S3 user"), Equals("", creds.C.SwiftUser, "Swift credentials returned"),
+		Equals("data", creds.C.Bucket, "Wrong bucket"), Equals(fmt.Sprint([]string{"data"}), fmt.Sprint(creds.C.Buckets), "Wrong buckets"),
+		Equals(sids(map[string]broker.PolicyStatement{reader + "list": {}, reader + "objects": {}, "operator": {}}), sids(statements), "Wrong statements"),
+		Equals("arn:aws:iam::inst:user/reader", fmt.Sprint(statements[reader+"objects"].Principal["AWS"][0]), "Wrong principal"),
+		Equals(fmt.Sprint([]string{"s3:GetObject"}), fmt.Sprint(statements[reader+"objects"].Action), "Wrong actions"),
+		Equals(fmt.Sprint([]string{"arn:aws:s3:::data/reports/*"}), fmt.Sprint(statements[reader+"objects"].Resource), "Wrong resources"),
+		Equals("reports/*", fmt.Sprint(statements[reader+"list"].Condition["StringLike"]["s3:prefix"]), "Listing not limited to the prefix")))
+
+	//Write only bindings can't list the buckets
+	resp, err = bindWithParameters(baseUrl, "inst", "writer", map[string]interface{}{"access": "write",
+		"buckets": []map[string]string{{"bucket": "data"}, {"bucket": "logs"}}})
+	t.Run("Bind Several Buckets", CheckErrs(t, nil, err, Equals(201, resp.StatusCode(), "Unexpected status"),
+		Equals(sids(map[string]broker.PolicyStatement{reader + "list": {}, reader + "objects": {}, writer + "0objects": {}, "operator": {}}),
+			sids(policyStatements(t, fake, "inst", "data")), "Wrong statements of the first bucket"),
+		Equals(sids(map[string]broker.PolicyStatement{writer + "1objects": {}}), sids(policyStatements(t, fake, "inst", "logs")), "Wrong statements of the second bucket")))
+
+	users := len(fake.Users())
+	resp, err = bindWithParameters(baseUrl, "inst", "missing", map[string]interface{}{"buckets": []map[string]string{{"bucket": "missing"}}})
+	t.Run("Missing Bucket", CheckErrs(t, nil, err, Equals(400, resp.StatusCode(), "Unexpected status"), Equals(users, len(fake.Users()), "User created")))
+
+	resp, err = resty.R().SetHeader("X-Broker-API-Version", "2.14").Delete(baseUrl + "inst/service_bindings/reader?service_id=service&plan_id=plan")
+	t.Run("Unbind", CheckErrs(t, nil, err, Equals(200, resp.StatusCode(), "Unexpected status"), Equals(users-1, len(fake.Users()), "User left"),
+		Equals(sids(map[string]broker.PolicyStatement{writer + "0objects": {}, "operator": {}}), sids(policyStatements(t, fake, "inst", "data")), "Wrong statements left")))
+
+	resp, err = resty.R().SetHeader("X-Broker-API-Version", "2.14").Delete(baseUrl + "inst/service_bindings/writer?service_id=service&plan_id=plan")
+	t.Run("Unbind Last", CheckErrs(t, nil, err, Equals(200, resp.StatusCode(), "Unexpected status"),
+		Equals(sids(map[string]broker.PolicyStatement{"operator": {}}), sids(policyStatements(t, fake, "inst", "data")), "Foreign statement removed"),
+		Equals("", fake.BucketPolicy("inst", "logs"), "Empty policy left")))
+}
@@ -1,10 +1,13 @@
 package tests
 
 import (
+	"context"
 	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
 	rgw "github.com/icclab/ceph-objectstore-broker/radosgw"
 	. "github.com/icclab/ceph-objectstore-broker/tests/testutils"
+	"github.com/myENA/radosgwadmin"
 	"testing"
+	"time"
 )
 
 func TestRadosgw(t *testing.T) {
@@ -18,43 +21,92 @@ func TestRadosgw(t *testing.T) {
 	if !t.Run("Connect", CheckErrs(t, nil, err)) {
 		t.FailNow()
 	}
+	ctx := context.Background()
 
 	//Vars to use
 	user := "test-user"
 	subuser := "subuser"
 	tenant := "asnfiwejf9w8349t8u023"
 	quotaSize := 100
-	if !t.Run("Create User", CheckErrs(t, nil, rados.CreateUser(user, user, tenant))) {
+	maxObjects := 50
+	maxBuckets := 10
+	if !t.Run("Create User", CheckErrs(t, nil, rados.CreateUser(ctx, user, user, tenant, 0))) {
 		t.FailNow()
 	}
 
-	userInfo, err := rados.GetUser(user, tenant, false)
+	userInfo, err := rados.GetUser(ctx, user, tenant, false)
 	t.Run("Get User", CheckErrs(t, nil, err, Equals(user, userInfo.UserID, "Returned uid incorrect"), Equals(tenant, userInfo.Tenant, "Returned tenant incorrect")))
 
-	usage, err := rados.GetUserUsageMB(user, tenant)
+	usage, err := rados.GetUserUsageMB(ctx, user, tenant)
 	t.Run("Get User UsageMB", CheckErrs(t, nil, err, Equals(0, usage, "User usage is incorrect")))
 
-	t.Run("Set User Quota", CheckErrs(t, nil, rados.SetUserQuota(user, tenant, quotaSize)))
+	t.Run("Set User Quota", CheckErrs(t, nil, rados.SetUserQuota(ctx, user, tenant, quotaSize, maxObjects)))
 
-	q, err := rados.GetUserQuotaMB(user, tenant)
+	q, err := rados.GetUserQuotaMB(ctx, user, tenant)
 	t.Run("Get User QuotaMB", CheckErrs(t, nil, err, Equals(quotaSize, q, "Returned quota size is incorrect")))
 
-	subuserInfo, err := rados.CreateSubuser(user, subuser, tenant)
-	userInfo, _ = rados.GetUser(user, tenant, false)
+	stats, err := rados.GetUserStats(ctx, user, tenant)
+	t.Run("Get User Stats", CheckErrs(t, nil, err))
+	if stats != nil {
+		t.Run("Get User Stats Objects", CheckErrs(t, nil, Equals(0, stats.NumObjects, "User object count is incorrect")))
+	}
+
+	quota, err := rados.GetUserQuota(ctx, user, tenant)
+	t.Run("Get User Quota", CheckErrs(t, nil, err))
+	if quota != nil {
+		t.Run("Get User Quota Limits", CheckErrs(t, nil, Equals(int64(quotaSize*1024), quota.MaxSizeKb, "Returned quota size is incorrect"),
+			Equals(int64(maxObjects), quota.MaxObjects, "Returned object limit is incorrect")))
+	}
+
+	_, err = rados.GetUsageLog(ctx, time.Now().Add(-time.Hour), time.Now())
+	t.Run("Get Usage Log", CheckErrs(t, nil, err))
+
+	t.Run("Set User Max Buckets", CheckErrs(t, nil, rados.SetUserMaxBuckets(ctx, user, tenant, maxBuckets)))
+	userInfo, err = rados.GetUser(ctx, user, tenant, false)
+	t.Run("Get User Max Buckets", CheckErrs(t, nil, err, Equals(maxBuckets, userInfo.MaxBuckets, "Returned bucket limit is incorrect")))
+
+	subuserInfo, err := rados.CreateSubuser(ctx, user, subuser, tenant, "read")
+	userInfo, _ = rados.GetUser(ctx, user, tenant, false)
 	t.Run("Create Subuser", CheckErrs(t, nil, err, Equals(tenant+"$"+user+":"+subuser, subuserInfo.ID, "Returned subuser is incorrect"),
 		Equals(1, len(userInfo.SubUsers), "Wrong number of subusers")))
 
-	s3Key, err := rados.CreateS3Key(user, tenant)
-	userInfo, _ = rados.GetUser(user, tenant, false)
+	subuserKey, err := rados.CreateSubuserS3Key(ctx, user, subuser, tenant)
+	t.Run("Create Subuser S3 Key", CheckErrs(t, nil, err))
+	if subuserKey != nil {
+		t.Run("Subuser S3 Key Owner", CheckErrs(t, nil, Equals(tenant+"$"+user+":"+subuser, subuserKey.User, "Key not owned by subuser")))
+		t.Run("Delete Subuser S3 Key", CheckErrs(t, nil, rados.DeleteS3Key(ctx, user, tenant, subuserKey.AccessKey)))
+	}
+
+	s3Key, err := rados.CreateS3Key(ctx, user, tenant)
+	userInfo, _ = rados.GetUser(ctx, user, tenant, false)
 	t.Run("Create S3 Key", CheckErrs(t, nil, err, Equals(2, len(userInfo.Keys), "Wrong number of keys")))
 
-	err = rados.DeleteS3Key(user, tenant, s3Key.AccessKey)
-	userInfo, _ = rados.GetUser(user, tenant, false)
+	err = rados.DeleteS3Key(ctx, user, tenant, s3Key.AccessKey)
+	userInfo, _ = rados.GetUser(ctx, user, tenant, false)
 	t.Run("Delete S3 Key", CheckErrs(t, nil, err, Equals(1, len(userInfo.Keys), "Wrong number of keys")))
 
-	err = rados.DeleteSubuser(user, subuser, tenant)
-	userInfo, _ = rados.GetUser(user, tenant, false)
+	err = rados.DeleteSubuser(ctx, user, subuser, tenant)
+	userInfo, _ = rados.GetUser(ctx, user, tenant, false)
 	t.Run("Delete Subuser", CheckErrs(t, nil, err, Equals(0, len(userInfo.SubUsers), "Wrong number of subusers")))
 
-	t.Run("Delete User", CheckErrs(t, nil, rados.DeleteUser(user, tenant)))
+	t.Run("Delete User", CheckErrs(t, nil, rados.DeleteUser(ctx, user, tenant)))
+}
+
+//The usage log is requested with times in the format of the radosgw
+func TestUsageLog(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+	fake.UsageEntries = []radosgwadmin.UsageEntry{{User: "tenant$user", Buckets: []radosgwadmin.UsageBucket{{Bucket: "bucket",
+		Time: radosgwadmin.RadosTime(time.Now().Truncate(time.Hour))}}}}
+
+	rados := rgw.Radosgw{}
+	if err := rados.Setup(fake.Server.URL, "admin", "key", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := rados.GetUsageLog(context.Background(), time.Now().Add(-time.Hour), time.Now())
+	t.Run("Get Usage Log", CheckErrs(t, nil, err))
+	if usage != nil {
+		t.Run("Usage Entries", CheckErrs(t, nil, Equals(1, len(usage.Entries), "Wrong number of usage entries")))
+	}
 }
@@ -0,0 +1,111 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-resty/resty"
+	"github.com/icclab/ceph-objectstore-broker/broker"
+	. "github.com/icclab/ceph-objectstore-broker/tests/testutils"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Returns the kinds of the discrepancies along with what they're about, sorted
+func discrepancies(report *broker.ReconcileReport) string {
+	found := []string{}
+	for _, d := range report.Discrepancies {
+		found = append(found, fmt.Sprintf("%s %s$%s %s %s removed=%t", d.Kind, d.Tenant, d.User, d.Subuser, d.AccessKey, d.Removed))
+	}
+	sort.Strings(found)
+	return strings.Join(found, "\n")
+}
+
+//Orphans of the broker are reported by dry runs and removed otherwise, while the key the broker manages the buckets of
+//an instance with and the users the broker doesn't own are left alone
+func TestReconcile(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+	b, _, baseUrl, closeServer := newLoggedBroker(t, fake)
+	defer closeServer()
+	ctx := context.Background()
+
+	for _, instID := range []string{"inst", "gone"} {
+		if _, err := provisionRequest(baseUrl, instID, "plan", "org")(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := resty.R().SetHeader("X-Broker-API-Version", "2.14").
+		SetBody(map[string]string{"service_id": "service", "plan_id": "plan", "app_guid": "app"}).Put(baseUrl + "inst/service_bindings/bind"); err != nil {
+		t.Fatal(err)
+	}
+	user, err := b.Rados.GetUser(ctx, "inst", "inst", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	managementKey := user.Keys[0].AccessKey
+	bind, err := b.Store.GetBinding(ctx, "inst", "bind")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Orphans: a key and a subuser of the instance user no binding references, and the user of a deleted instance
+	orphanKey, err := b.Rados.CreateS3Key(ctx, "inst", "inst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Rados.CreateSubuser(ctx, "inst", "stale", "inst", "read"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Rados.CreateSubuserS3Key(ctx, "inst", "stale", "inst"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Store.DeleteInstance(ctx, "gone"); err != nil {
+		t.Fatal(err)
+	}
+
+	//Users the broker doesn't own: one without tenant, and one whose tenant isn't derived from its name
+	if err := b.Rados.CreateUser(ctx, "operator", "operator", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Rados.CreateUser(ctx, "foreign", "foreign", "other", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Rados.CreateS3Key(ctx, "foreign", "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := func(removed bool) string {
+		return strings.Join([]string{
+			fmt.Sprintf("%s inst$inst  %s removed=%t", broker.OrphanedS3Key, orphanKey.AccessKey, removed),
+			fmt.Sprintf("%s inst$inst stale  removed=%t", broker.OrphanedSubuser, removed),
+			fmt.Sprintf("%s gone$gone   removed=%t", broker.OrphanedUser, removed),
+		}, "\n")
+	}
+
+	report, err := b.Reconcile(ctx, true, time.Hour)
+	t.Run("Recently Modified", CheckErrs(t, nil, err, Equals("", discrepancies(report), "Recently modified users not skipped"),
+		Equals(2, len(report.Skipped), "Wrong number of skipped users")))
+
+	report, err = b.Reconcile(ctx, true, 0)
+	t.Run("Dry Run", CheckErrs(t, nil, err, Equals(expected(false), discrepancies(report), "Wrong discrepancies"),
+		Equals(2, report.UsersChecked, "Wrong number of checked users"), Equals(4, len(fake.Users()), "Users removed")))
+
+	report, err = b.Reconcile(ctx, false, 0)
+	user, userErr := b.Rados.GetUser(ctx, "inst", "inst", false)
+	foreign, foreignErr := b.Rados.GetUser(ctx, "foreign", "other", false)
+	keys := []string{}
+	if userErr == nil {
+		for _, k := range user.Keys {
+			keys = append(keys, k.AccessKey)
+		}
+	}
+	t.Run("Removed", CheckErrs(t, nil, err, userErr, foreignErr, Equals(expected(true), discrepancies(report), "Wrong discrepancies"),
+		Equals(fmt.Sprint([]string{managementKey, bind.S3AccessKey}), fmt.Sprint(keys), "Wrong keys kept"),
+		Equals(1, len(user.SubUsers), "Orphaned subuser left"), Equals(2, len(foreign.Keys), "Keys of a foreign user removed"),
+		Equals(3, len(fake.Users()), "Wrong users removed")))
+
+	report, err = b.Reconcile(ctx, false, 0)
+	t.Run("Reconciled", CheckErrs(t, nil, err, Equals("", discrepancies(report), "Discrepancies left")))
+}
@@ -0,0 +1,167 @@
+package tests
+
+import (
+	"bytes"
+	"code.cloudfoundry.org/lager"
+	"context"
+	"github.com/go-resty/resty"
+	"github.com/icclab/ceph-objectstore-broker/broker"
+	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
+	. "github.com/icclab/ceph-objectstore-broker/tests/testutils"
+	"github.com/pivotal-cf/brokerapi"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//Log of the broker, which is written to by the handlers of the requests
+type logBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (l *logBuffer) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.buf.Write(p)
+}
+
+//Returns whether a line of the log has all the parts
+func (l *logBuffer) contains(parts ...string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, line := range strings.Split(l.buf.String(), "\n") {
+		found := true
+		for _, p := range parts {
+			found = found && strings.Contains(line, p)
+		}
+		if found && line != "" {
+			return true
+		}
+	}
+	return false
+}
+
+//Returns a broker from newFakeRadosgwBroker whose log is written to the returned buffer, and the URL of its instances
+func newLoggedBroker(t *testing.T, fake *FakeRadosgw) (*broker.Broker, *logBuffer, string, func()) {
+	log := &logBuffer{}
+	b := newFakeRadosgwBroker(t, fake, broker.NewMemoryStore(), &brokerConfig.BrokerConfig{InstanceLimit: 100})
+	b.Logger.RegisterSink(lager.NewWriterSink(log, lager.INFO))
+
+	server := httptest.NewServer(broker.NewAPIHandler(b, b, b.Logger, brokerapi.BrokerCredentials{Username: "user", Password: "pass"}))
+	return b, log, "http://user:pass@" + strings.TrimPrefix(server.URL, "http://") + "/v2/service_instances/", server.Close
+}
+
+//Matches requests on the admin API of a user by their method and the query parameter selecting what they change, which
+//is empty for the user itself
+func adminRequest(method string, param string) func(req *http.Request) bool {
+	return func(req *http.Request) bool {
+		q := req.URL.Query()
+		_, quota := q["quota"]
+		_, subuser := q["subuser"]
+		_, key := q["key"]
+		resource := ""
+		switch {
+		case key:
+			resource = "key"
+		case quota:
+			resource = "quota"
+		case subuser:
+			resource = "subuser"
+		}
+		return req.Method == method && req.URL.Path == "/admin/user" && resource == param
+	}
+}
+
+//The user created by a provision failing midway is deleted, and the instance stops being counted
+func TestProvisionRollback(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+	b, log, baseUrl, closeServer := newLoggedBroker(t, fake)
+	defer closeServer()
+
+	restore := fake.FailRequests(adminRequest(http.MethodPut, "quota"))
+	resp, err := provisionRequest(baseUrl, "inst", "plan", "org")()
+	restore()
+	_, storeErr := b.Store.GetInstance(context.Background(), "inst")
+	t.Run("Rolled Back", CheckErrs(t, nil, err, Equals(500, resp.StatusCode(), "Unexpected status"), Equals(0, len(fake.Users()), "User left"),
+		Equals(0, b.Counter.Count(), "Instance still counted"), Equals(broker.ErrStateNotFound, storeErr, "Instance recorded"),
+		Equals(true, log.contains("provision-rollback.cleaned-up", "delete-user"), "Cleanup not logged")))
+
+	restore = fake.FailRequests(func(req *http.Request) bool {
+		return adminRequest(http.MethodPut, "quota")(req) || adminRequest(http.MethodDelete, "")(req)
+	})
+	resp, err = provisionRequest(baseUrl, "inst", "plan", "org")()
+	restore()
+	t.Run("Failed Cleanup", CheckErrs(t, nil, err, Equals(500, resp.StatusCode(), "Unexpected status"), Equals(1, len(fake.Users()), "User deleted"),
+		Equals(0, b.Counter.Count(), "Instance still counted"),
+		Equals(true, log.contains("provision-rollback.cleanup-failed", "delete-user"), "Failure not logged")))
+}
+
+//The user created by an asynchronous provision failing midway is deleted, while the instance is kept for the
+//deprovision of the platform
+func TestAsyncProvisionRollback(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+	b, log, baseUrl, closeServer := newLoggedBroker(t, fake)
+	defer closeServer()
+
+	restore := fake.FailRequests(adminRequest(http.MethodPut, "quota"))
+	defer restore()
+	resp, err := resty.R().SetHeader("X-Broker-API-Version", "2.14").
+		SetBody(provisionBody{ServiceID: "service", PlanID: "plan", OrgGUID: "org", Space_guid: "space"}).Put(baseUrl + "inst?accepts_incomplete=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, state := waitForOperation(t, baseUrl+"inst/last_operation", "")
+	t.Run("Rolled Back", CheckErrs(t, nil, Equals(202, resp.StatusCode(), "Unexpected status"), Equals(200, status, "Unexpected status"),
+		Equals(string(brokerapi.Failed), state, "Unexpected state"), Equals(0, len(fake.Users()), "User left"),
+		Equals(1, b.Counter.Count(), "Instance not counted"),
+		Equals(true, log.contains("provision-rollback.cleaned-up", "delete-user"), "Cleanup not logged")))
+}
+
+//The subuser created by a bind failing midway is deleted, and no binding is recorded
+func TestBindRollback(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+	b, log, baseUrl, closeServer := newLoggedBroker(t, fake)
+	defer closeServer()
+
+	if _, err := provisionRequest(baseUrl, "inst", "plan", "org")(); err != nil {
+		t.Fatal(err)
+	}
+	inst, err := b.Store.GetInstance(context.Background(), "inst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bind := func() (*resty.Response, error) {
+		return resty.R().SetHeader("X-Broker-API-Version", "2.14").
+			SetBody(map[string]string{"service_id": "service", "plan_id": "plan", "app_guid": "app"}).Put(baseUrl + "inst/service_bindings/bind")
+	}
+	subusers := func() int {
+		user, err := b.Rados.GetUser(context.Background(), inst.User, inst.Tenant, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(user.SubUsers)
+	}
+
+	restore := fake.FailRequests(adminRequest(http.MethodPut, "key"))
+	resp, err := bind()
+	restore()
+	_, storeErr := b.Store.GetBinding(context.Background(), "inst", "bind")
+	t.Run("Rolled Back", CheckErrs(t, nil, err, Equals(500, resp.StatusCode(), "Unexpected status"), Equals(0, subusers(), "Subuser left"),
+		Equals(broker.ErrStateNotFound, storeErr, "Binding recorded"),
+		Equals(true, log.contains("bind-rollback.cleaned-up", "delete-subuser"), "Cleanup not logged")))
+
+	restore = fake.FailRequests(func(req *http.Request) bool {
+		return adminRequest(http.MethodPut, "key")(req) || adminRequest(http.MethodDelete, "subuser")(req)
+	})
+	resp, err = bind()
+	restore()
+	t.Run("Failed Cleanup", CheckErrs(t, nil, err, Equals(500, resp.StatusCode(), "Unexpected status"), Equals(1, subusers(), "Subuser deleted"),
+		Equals(true, log.contains("bind-rollback.cleanup-failed", "delete-subuser"), "Failure not logged")))
+}
@@ -0,0 +1,186 @@
+package tests
+
+import (
+	"code.cloudfoundry.org/lager"
+	"context"
+	"github.com/go-resty/resty"
+	"github.com/icclab/ceph-objectstore-broker/audit"
+	"github.com/icclab/ceph-objectstore-broker/broker"
+	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
+	. "github.com/icclab/ceph-objectstore-broker/tests/testutils"
+	"github.com/pivotal-cf/brokerapi"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//A state store counting the listings of instances and bindings
+type listCountingStore struct {
+	broker.StateStore
+	lists int32
+}
+
+func (s *listCountingStore) ListInstances(ctx context.Context) ([]string, error) {
+	atomic.AddInt32(&s.lists, 1)
+	return s.StateStore.ListInstances(ctx)
+}
+
+func (s *listCountingStore) ListBindings(ctx context.Context, instID string) ([]string, error) {
+	atomic.AddInt32(&s.lists, 1)
+	return s.StateStore.ListBindings(ctx, instID)
+}
+
+//Retired credentials are deleted once their grace period is over, without listing the state store
+func TestDeleteRetiredCredentials(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+
+	store := &listCountingStore{StateStore: broker.NewMemoryStore()}
+	b := newFakeRadosgwBroker(t, fake, store, &brokerConfig.BrokerConfig{InstanceLimit: 100})
+	server := httptest.NewServer(broker.NewAPIHandler(b, b, lager.NewLogger("test"), brokerapi.BrokerCredentials{Username: "user", Password: "pass"}))
+	defer server.Close()
+	baseUrl := "http://user:pass@" + strings.TrimPrefix(server.URL, "http://") + "/v2/service_instances/"
+
+	if _, err := provisionRequest(baseUrl, "inst", "plan", "org")(); err != nil {
+		t.Fatal(err)
+	}
+	for _, bindID := range []string{"kept", "deleted"} {
+		if _, err := resty.R().SetHeader("X-Broker-API-Version", "2.14").
+			SetBody(map[string]string{"service_id": "service", "plan_id": "plan", "app_guid": "app"}).Put(baseUrl + "inst/service_bindings/" + bindID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	err := b.DeleteRetiredCredentials(ctx)
+	t.Run("Nothing Rotated", CheckErrs(t, nil, err, Equals(int32(0), atomic.LoadInt32(&store.lists), "Store listed")))
+
+	old, err := store.GetBinding(ctx, "inst", "deleted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, keptErr := b.RotateBindingCredentials(ctx, "inst", "kept", time.Hour)
+	_, deletedErr := b.RotateBindingCredentials(ctx, "inst", "deleted", 0)
+	t.Run("Rotated", CheckErrs(t, nil, keptErr, deletedErr, Equals(2, b.Retirements.Len(), "Wrong pending bindings")))
+
+	err = b.DeleteRetiredCredentials(ctx)
+	kept, keptErr := store.GetBinding(ctx, "inst", "kept")
+	deleted, deletedErr := store.GetBinding(ctx, "inst", "deleted")
+	user, userErr := b.Rados.GetUser(ctx, old.User, old.Tenant, false)
+	oldKeyFound, oldSubuserFound := false, false
+	if userErr == nil {
+		for _, k := range user.Keys {
+			oldKeyFound = oldKeyFound || k.AccessKey == old.S3AccessKey
+		}
+		for _, su := range user.SubUsers {
+			oldSubuserFound = oldSubuserFound || strings.HasSuffix(su.ID, old.Subuser)
+		}
+	}
+	t.Run("Swept", CheckErrs(t, nil, err, keptErr, deletedErr, userErr, Equals(int32(0), atomic.LoadInt32(&store.lists), "Store listed"),
+		Equals(1, len(kept.Retired), "Credentials deleted before the grace period"), Equals(0, len(deleted.Retired), "Credentials not deleted"),
+		Equals(false, oldKeyFound, "Old key left"), Equals(false, oldSubuserFound, "Old subuser left"),
+		Equals(1, b.Retirements.Len(), "Wrong pending bindings")))
+
+	rebuilt := broker.NewRetirementIndex()
+	err = rebuilt.Rebuild(ctx, store)
+	t.Run("Rebuild", CheckErrs(t, nil, err, Equals(1, rebuilt.Len(), "Wrong pending bindings")))
+
+	if _, err := resty.R().SetHeader("X-Broker-API-Version", "2.14").
+		Delete(baseUrl + "inst/service_bindings/kept?service_id=service&plan_id=plan"); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("Unbound", CheckErrs(t, nil, Equals(0, b.Retirements.Len(), "Unbound binding still pending")))
+}
+
+//Sink keeping the audit records in memory
+type recordSink struct {
+	mutex   sync.Mutex
+	records []audit.Record
+}
+
+func (s *recordSink) Write(rec *audit.Record) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records = append(s.records, *rec)
+	return nil
+}
+
+func (s *recordSink) Close() error {
+	return nil
+}
+
+//Returns the results of the records of the operation by instance
+func (s *recordSink) results(operation string) map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	results := map[string]string{}
+	for _, rec := range s.records {
+		if rec.Operation == operation {
+			results[rec.InstanceID] = rec.Result
+		}
+	}
+	return results
+}
+
+//An instance whose retired credentials can't be deleted is retried by the next sweep, without holding up the others
+func TestDeleteRetiredCredentialsFailure(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+	b, log, baseUrl, closeServer := newLoggedBroker(t, fake)
+	defer closeServer()
+	sink := &recordSink{}
+	auditor, err := audit.New(lager.NewLogger("test"), nil, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Audit = auditor
+
+	ctx := context.Background()
+	instIDs := []string{"inst-a", "inst-b", "inst-c"}
+	for _, instID := range instIDs {
+		if _, err := provisionRequest(baseUrl, instID, "plan", "org")(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := resty.R().SetHeader("X-Broker-API-Version", "2.14").
+			SetBody(map[string]string{"service_id": "service", "plan_id": "plan", "app_guid": "app"}).Put(baseUrl + instID + "/service_bindings/bind"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.RotateBindingCredentials(ctx, instID, "bind", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	failing, err := b.Store.GetInstance(ctx, "inst-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restore := fake.FailRequests(func(req *http.Request) bool {
+		return adminRequest(http.MethodDelete, "key")(req) && strings.Contains(req.URL.RawQuery, failing.User)
+	})
+	err = b.DeleteRetiredCredentials(ctx)
+	restore()
+	retired := map[string]int{}
+	for _, instID := range instIDs {
+		bind, err := b.Store.GetBinding(ctx, instID, "bind")
+		if err != nil {
+			t.Fatal(err)
+		}
+		retired[instID] = len(bind.Retired)
+	}
+	t.Run("Partly Swept", CheckErrs(t, nil, Equals(true, err != nil && strings.Contains(err.Error(), "inst-b"), "Failure not returned"),
+		Equals(0, retired["inst-a"], "Credentials of the first instance not deleted"), Equals(1, retired["inst-b"], "Credentials deleted"),
+		Equals(0, retired["inst-c"], "Credentials of the last instance not deleted"), Equals(1, b.Retirements.Len(), "Failed binding not kept pending"),
+		Equals(true, log.contains("delete-retired-credentials-failed", "inst-b"), "Failure not logged"),
+		Equals(audit.ResultFailure, sink.results(audit.DeleteRetiredCredentials)["inst-b"], "Failure not audited"),
+		Equals(audit.ResultSuccess, sink.results(audit.DeleteRetiredCredentials)["inst-c"], "Sweep not audited")))
+
+	err = b.DeleteRetiredCredentials(ctx)
+	bind, bindErr := b.Store.GetBinding(ctx, "inst-b", "bind")
+	t.Run("Retried", CheckErrs(t, nil, err, bindErr, Equals(0, len(bind.Retired), "Credentials not deleted"),
+		Equals(0, b.Retirements.Len(), "Binding still pending"),
+		Equals(audit.ResultSuccess, sink.results(audit.DeleteRetiredCredentials)["inst-b"], "Retry not audited")))
+}
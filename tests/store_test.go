@@ -0,0 +1,302 @@
+package tests
+
+import (
+	"code.cloudfoundry.org/lager"
+	"context"
+	"errors"
+	"github.com/go-resty/resty"
+	"github.com/icclab/ceph-objectstore-broker/broker"
+	"github.com/icclab/ceph-objectstore-broker/brokerConfig"
+	rgw "github.com/icclab/ceph-objectstore-broker/radosgw"
+	"github.com/icclab/ceph-objectstore-broker/s3"
+	. "github.com/icclab/ceph-objectstore-broker/tests/testutils"
+	"github.com/pivotal-cf/brokerapi"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//Runs the same checks against any state store implementation
+func testStateStore(t *testing.T, store broker.StateStore) {
+	instID := "inst-1"
+	bindID := "bind-1"
+
+	t.Run("Create Instance", CheckErrs(t, nil, store.CreateInstance(context.Background(), &broker.Instance{ID: instID})))
+
+	exists, err := store.InstanceExists(context.Background(), instID)
+	t.Run("Instance Exists", CheckErrs(t, nil, err, Equals(true, exists, "Instance should exist")))
+
+	inst, err := store.GetInstance(context.Background(), instID)
+	t.Run("Get Instance", CheckErrs(t, nil, err))
+	if inst != nil {
+		t.Run("Get Instance ID", CheckErrs(t, nil, Equals(instID, inst.ID, "Wrong instance returned")))
+	}
+
+	t.Run("Update Instance", CheckErrs(t, nil, store.UpdateInstance(context.Background(), &broker.Instance{ID: instID, PlanID: "plan", QuotaMB: 100})))
+	inst, err = store.GetInstance(context.Background(), instID)
+	if inst != nil {
+		t.Run("Get Updated Instance", CheckErrs(t, nil, err, Equals("plan", inst.PlanID, "Instance not updated"),
+			Equals(100, inst.QuotaMB, "Instance not updated")))
+	}
+
+	t.Run("Update Missing Instance", CheckErrs(t, nil, Equals(broker.ErrStateNotFound, store.UpdateInstance(context.Background(), &broker.Instance{ID: instID + "x"}),
+		"Expected not found error")))
+
+	_, err = store.GetInstance(context.Background(), instID+"x")
+	t.Run("Get Missing Instance", CheckErrs(t, nil, Equals(broker.ErrStateNotFound, err, "Expected not found error")))
+
+	ids, err := store.ListInstances(context.Background())
+	t.Run("List Instances", CheckErrs(t, nil, err, Equals(1, len(ids), "Wrong number of instances")))
+
+	bind := &broker.Bind{User: instID, Subuser: bindID, Tenant: "tenant", S3AccessKey: "access", SwiftKey: "swift",
+		RawParameters: []byte(`{"key":"value"}`)}
+	t.Run("Put Binding", CheckErrs(t, nil, store.PutBinding(context.Background(), instID, bindID, bind)))
+
+	exists, err = store.BindingExists(context.Background(), instID, bindID)
+	t.Run("Binding Exists", CheckErrs(t, nil, err, Equals(true, exists, "Binding should exist")))
+
+	got, err := store.GetBinding(context.Background(), instID, bindID)
+	t.Run("Get Binding", CheckErrs(t, nil, err))
+	if got != nil {
+		t.Run("Get Binding Content", CheckErrs(t, nil, Equals(bind.S3AccessKey, got.S3AccessKey, "Stored binding differs"),
+			Equals(bind.SwiftKey, got.SwiftKey, "Stored binding differs"), Equals(bind.Tenant, got.Tenant, "Stored binding differs"),
+			Equals(string(bind.RawParameters), string(got.RawParameters), "Stored binding parameters differ")))
+	}
+
+	ids, err = store.ListBindings(context.Background(), instID)
+	t.Run("List Bindings", CheckErrs(t, nil, err, Equals(1, len(ids), "Wrong number of bindings")))
+
+	t.Run("Delete Binding", CheckErrs(t, nil, store.DeleteBinding(context.Background(), instID, bindID)))
+	ids, err = store.ListBindings(context.Background(), instID)
+	t.Run("List Bindings After Delete", CheckErrs(t, nil, err, Equals(0, len(ids), "Wrong number of bindings")))
+
+	op := &broker.Operation{ID: "op-1", InstanceID: instID, Type: broker.ProvisionOperation}
+	t.Run("Put Operation", CheckErrs(t, nil, store.PutOperation(context.Background(), op)))
+
+	gotOp, err := store.GetOperation(context.Background(), instID)
+	t.Run("Get Operation", CheckErrs(t, nil, err))
+	if gotOp != nil {
+		t.Run("Get Operation ID", CheckErrs(t, nil, Equals(op.ID, gotOp.ID, "Wrong operation returned")))
+	}
+
+	t.Run("Delete Operation", CheckErrs(t, nil, store.DeleteOperation(context.Background(), instID)))
+	_, err = store.GetOperation(context.Background(), instID)
+	t.Run("Get Deleted Operation", CheckErrs(t, nil, Equals(broker.ErrStateNotFound, err, "Expected not found error")))
+
+	t.Run("Delete Instance", CheckErrs(t, nil, store.DeleteInstance(context.Background(), instID)))
+	exists, err = store.InstanceExists(context.Background(), instID)
+	t.Run("Instance Deleted", CheckErrs(t, nil, err, Equals(false, exists, "Instance should not exist")))
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStateStore(t, broker.NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cosb-state")
+	if err != nil {
+		t.Fatal("Failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+	store, err := broker.NewFileStore(path)
+	if err != nil {
+		t.Fatal("Failed to create file store", err)
+	}
+	testStateStore(t, store)
+
+	//State must survive reopening the file
+	if err := store.CreateInstance(context.Background(), &broker.Instance{ID: "persisted"}); err != nil {
+		t.Fatal("Failed to create instance", err)
+	}
+
+	reopened, err := broker.NewFileStore(path)
+	if err != nil {
+		t.Fatal("Failed to reopen file store", err)
+	}
+
+	exists, err := reopened.InstanceExists(context.Background(), "persisted")
+	t.Run("Reopened File", CheckErrs(t, nil, err, Equals(true, exists, "Instance was not persisted")))
+}
+
+//Only missing objects are reported as missing state by the S3 store, while other S3 errors, e.g. denied requests, are returned
+func TestS3StoreErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		_, location := req.URL.Query()["location"]
+		switch {
+		case location:
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/"/>`))
+		case strings.Contains(req.URL.Path, "missing"):
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>No such key</Message></Error>`))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>Access denied</Message></Error>`))
+		}
+	}))
+	defer server.Close()
+
+	s := &s3.S3{}
+	if err := s.Connect(server.URL, "key", "secret", false); err != nil {
+		t.Fatal(err)
+	}
+	store := broker.NewS3Store(s, "bucket", "instances/", "operations/")
+
+	_, err := store.GetInstance(context.Background(), "missing")
+	t.Run("Missing Instance", CheckErrs(t, nil, Equals(broker.ErrStateNotFound, err, "Expected not found error")))
+	exists, err := store.InstanceExists(context.Background(), "missing")
+	t.Run("Missing Instance Exists", CheckErrs(t, nil, err, Equals(false, exists, "Missing instance exists")))
+	_, err = store.GetBinding(context.Background(), "missing", "bind")
+	t.Run("Missing Binding", CheckErrs(t, nil, Equals(broker.ErrStateNotFound, err, "Expected not found error")))
+
+	_, err = store.GetInstance(context.Background(), "denied")
+	t.Run("Denied Instance", CheckErrs(t, nil, Equals(true, err != nil && err != broker.ErrStateNotFound, "S3 error taken for a missing instance")))
+	_, err = store.InstanceExists(context.Background(), "denied")
+	t.Run("Denied Instance Exists", CheckErrs(t, nil, Equals(true, err != nil, "S3 error not returned")))
+	_, err = store.GetOperation(context.Background(), "denied")
+	t.Run("Denied Operation", CheckErrs(t, nil, Equals(true, err != nil && err != broker.ErrStateNotFound, "S3 error taken for a missing operation")))
+	err = store.UpdateInstance(context.Background(), &broker.Instance{ID: "denied"})
+	t.Run("Denied Update", CheckErrs(t, nil, Equals(true, err != nil && err != broker.ErrStateNotFound, "S3 error taken for a missing instance")))
+}
+
+//A state store failing the lookups of whether instances and bindings exist once fail is set
+type failingLookupStore struct {
+	broker.StateStore
+	fail bool
+}
+
+func (s *failingLookupStore) InstanceExists(ctx context.Context, instID string) (bool, error) {
+	if s.fail {
+		return false, errors.New("store unavailable")
+	}
+	return s.StateStore.InstanceExists(ctx, instID)
+}
+
+func (s *failingLookupStore) BindingExists(ctx context.Context, instID string, bindID string) (bool, error) {
+	if s.fail {
+		return false, errors.New("store unavailable")
+	}
+	return s.StateStore.BindingExists(ctx, instID, bindID)
+}
+
+//Errors of the state store are answered with 500 rather than taken for missing instances and bindings
+func TestStoreErrorResponses(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+
+	store := &failingLookupStore{StateStore: broker.NewMemoryStore()}
+	server := httptest.NewServer(newFakeBackedBroker(t, fake, store, &brokerConfig.BrokerConfig{InstanceLimit: 100}))
+	defer server.Close()
+	baseUrl := "http://user:pass@" + strings.TrimPrefix(server.URL, "http://") + "/v2/service_instances/"
+
+	bind := func() (*resty.Response, error) {
+		return resty.R().SetHeader("X-Broker-API-Version", "2.14").
+			SetBody(map[string]string{"service_id": "service", "plan_id": "plan", "app_guid": "app"}).Put(baseUrl + "inst/service_bindings/bind")
+	}
+	if _, err := provisionRequest(baseUrl, "inst", "plan", "org")(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bind(); err != nil {
+		t.Fatal(err)
+	}
+
+	store.fail = true
+	provisionResp, provisionErr := provisionRequest(baseUrl, "inst", "plan", "org")()
+	bindResp, bindErr := bind()
+	unbindResp, unbindErr := resty.R().SetHeader("X-Broker-API-Version", "2.14").
+		Delete(baseUrl + "inst/service_bindings/bind?service_id=service&plan_id=plan")
+	deprovisionResp, deprovisionErr := resty.R().SetHeader("X-Broker-API-Version", "2.14").
+		Delete(baseUrl + "inst?service_id=service&plan_id=plan")
+	store.fail = false
+	exists, existsErr := store.BindingExists(context.Background(), "inst", "bind")
+	t.Run("Failed Lookups", CheckErrs(t, nil, provisionErr, bindErr, unbindErr, deprovisionErr, existsErr,
+		Equals(500, provisionResp.StatusCode(), "Unexpected provision status"), Equals(500, bindResp.StatusCode(), "Unexpected bind status"),
+		Equals(500, unbindResp.StatusCode(), "Unexpected unbind status"),
+		Equals(500, deprovisionResp.StatusCode(), "Unexpected deprovision status"), Equals(true, exists, "Binding deleted")))
+}
+
+//Records from before versioned instance records are upgraded with the plan matching the quota of the user, and the
+//service that plan belongs to
+func TestLegacyInstanceUpgrade(t *testing.T) {
+	fake := NewFakeRadosgw()
+	defer fake.Close()
+
+	rados := &rgw.Radosgw{}
+	if err := rados.Setup(fake.Server.URL, "admin", "key", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rados.CreateUser(context.Background(), "legacy", "legacy", "legacy", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := rados.SetUserQuota(context.Background(), "legacy", "legacy", 500, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	bc := &brokerConfig.BrokerConfig{InstanceLimit: 100}
+	bc.Services = []brokerapi.Service{backendService("small", ""), backendService("large", "")}
+	bc.Services[1].Plans[0].Metadata.AdditionalMetadata["quotaMB"] = "500"
+	store := broker.NewMemoryStore()
+	if err := store.CreateInstance(context.Background(), &broker.Instance{ID: "legacy"}); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &broker.Broker{Logger: lager.NewLogger("test"), Rados: rados, Config: broker.NewConfig(bc), Store: store,
+		Locks: broker.NewInstanceLocks(), Counter: broker.NewInstanceCounter(), Retirements: broker.NewRetirementIndex()}
+	inst, err := b.GetInstance(context.Background(), "legacy")
+	t.Run("Upgraded", CheckErrs(t, nil, err, Equals("large-plan", inst.PlanID, "Wrong plan"), Equals("large", inst.ServiceID, "Wrong service")))
+}
+
+func TestStateExport(t *testing.T) {
+	src := broker.NewMemoryStore()
+	if err := src.CreateInstance(context.Background(), &broker.Instance{ID: "inst-1", PlanID: "plan"}); err != nil {
+		t.Fatal("Failed to create instance", err)
+	}
+	if err := src.PutBinding(context.Background(), "inst-1", "bind-1", &broker.Bind{User: "inst-1", S3AccessKey: "access"}); err != nil {
+		t.Fatal("Failed to put binding", err)
+	}
+	if err := src.PutOperation(context.Background(), &broker.Operation{ID: "op-1", InstanceID: "inst-1", Type: broker.ProvisionOperation}); err != nil {
+		t.Fatal("Failed to put operation", err)
+	}
+
+	exp, err := broker.ExportState(context.Background(), src)
+	t.Run("Export", CheckErrs(t, nil, err))
+	if exp == nil {
+		t.FailNow()
+	}
+	t.Run("Exported Instances", CheckErrs(t, nil, Equals(1, len(exp.Instances), "Wrong number of instances"),
+		Equals(1, len(exp.Instances[0].Bindings), "Wrong number of bindings")))
+
+	dst := broker.NewMemoryStore()
+	n, err := broker.ImportState(context.Background(), dst, exp, false)
+	t.Run("Import", CheckErrs(t, nil, err, Equals(1, n, "Wrong number of imported instances")))
+
+	bind, err := dst.GetBinding(context.Background(), "inst-1", "bind-1")
+	t.Run("Imported Binding", CheckErrs(t, nil, err))
+	if bind != nil {
+		t.Run("Imported Binding Content", CheckErrs(t, nil, Equals("access", bind.S3AccessKey, "Imported binding differs")))
+	}
+
+	op, err := dst.GetOperation(context.Background(), "inst-1")
+	t.Run("Imported Operation", CheckErrs(t, nil, err))
+	if op != nil {
+		t.Run("Imported Operation ID", CheckErrs(t, nil, Equals("op-1", op.ID, "Imported operation differs")))
+	}
+
+	//Existing instances are only replaced when overwriting
+	exp.Instances[0].Instance.PlanID = "other-plan"
+	n, err = broker.ImportState(context.Background(), dst, exp, false)
+	t.Run("Import Existing", CheckErrs(t, nil, err, Equals(0, n, "Existing instance imported")))
+
+	n, err = broker.ImportState(context.Background(), dst, exp, true)
+	inst, getErr := dst.GetInstance(context.Background(), "inst-1")
+	t.Run("Import Overwrite", CheckErrs(t, nil, err, getErr, Equals(1, n, "Existing instance not imported")))
+	if inst != nil {
+		t.Run("Import Overwrite Content", CheckErrs(t, nil, Equals("other-plan", inst.PlanID, "Instance not overwritten")))
+	}
+}
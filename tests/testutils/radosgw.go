@@ -0,0 +1,358 @@
+package testutils
+
+import (
+	"encoding/json"
+	"fmt"
+	rgw "github.com/myENA/radosgwadmin"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//FakeRadosgw serves the parts of the radosgw admin API and the bucket operations of the S3 API used by the broker from
+//memory, so the broker can be tested without a Ceph cluster. Requests are not authenticated
+type FakeRadosgw struct {
+	Server *httptest.Server
+	//Storage classes of the placement targets of the zonegroup by their name. Set before the first request
+	PlacementTargets map[string][]string
+	//Entries of the usage log, which are returned for any period. Set before the first request
+	UsageEntries []rgw.UsageEntry
+	mutex        sync.Mutex
+	users        map[string]*fakeUser
+	keys         int
+	buckets      map[string]*fakeBucket
+	s3Keys       []string
+	//Requests matched by hold wait until released is closed
+	hold     func(req *http.Request) bool
+	released chan struct{}
+	//Requests matched by fail are answered with an error
+	fail func(req *http.Request) bool
+}
+
+type fakeUser struct {
+	info         rgw.UserInfoResponse
+	quota        rgw.QuotaMeta
+	placement    string
+	storageClass string
+	mtime        time.Time
+}
+
+//NewFakeRadosgw starts the fake. The admin path is '/admin'
+func NewFakeRadosgw() *FakeRadosgw {
+	f := &FakeRadosgw{users: map[string]*fakeUser{}, buckets: map[string]*fakeBucket{}, PlacementTargets: map[string][]string{"default-placement": {"STANDARD"}}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *FakeRadosgw) Close() {
+	f.Server.Close()
+}
+
+//Placement returns the default placement of the user with the ID, which is prefixed by its tenant
+func (f *FakeRadosgw) Placement(uid string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if u := f.users[uid]; u != nil {
+		return u.placement
+	}
+	return ""
+}
+
+//StorageClass returns the default storage class of the user with the ID, which is prefixed by its tenant
+func (f *FakeRadosgw) StorageClass(uid string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if u := f.users[uid]; u != nil {
+		return u.storageClass
+	}
+	return ""
+}
+
+//Users returns the IDs of all users, prefixed by their tenant
+func (f *FakeRadosgw) Users() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.userIDs()
+}
+
+//HoldRequests makes the requests match returns true for wait until the returned function is called, e.g. to keep an
+//asynchronous operation in progress
+func (f *FakeRadosgw) HoldRequests(match func(req *http.Request) bool) func() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	released := make(chan struct{})
+	f.hold, f.released = match, released
+	return func() {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+
+		f.hold = nil
+		close(released)
+	}
+}
+
+//FailRequests makes the requests match returns true for fail with a server error until the returned function is called,
+//e.g. to fail an operation midway
+func (f *FakeRadosgw) FailRequests(match func(req *http.Request) bool) func() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.fail = match
+	return func() {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+
+		f.fail = nil
+	}
+}
+
+func (f *FakeRadosgw) serve(w http.ResponseWriter, req *http.Request) {
+	f.mutex.Lock()
+	if hold, released := f.hold, f.released; hold != nil && hold(req) {
+		f.mutex.Unlock()
+		<-released
+		f.mutex.Lock()
+	}
+	defer f.mutex.Unlock()
+
+	if f.fail != nil && f.fail(req) {
+		http.Error(w, `{"Code":"UnknownError"}`, http.StatusInternalServerError)
+		return
+	}
+
+	q := req.URL.Query()
+	if !strings.HasPrefix(req.URL.Path, "/admin/") {
+		f.serveS3(w, req)
+		return
+	}
+	if req.URL.Path == "/admin/metadata/user" {
+		f.serveMetadata(w, req)
+		return
+	}
+	if req.URL.Path == "/admin/config" && q.Get("type") == "zonegroup-map" {
+		f.serveZonegroupMap(w)
+		return
+	}
+	if req.URL.Path == "/admin/usage" && req.Method == http.MethodGet {
+		f.serveUsage(w, req)
+		return
+	}
+	if req.URL.Path != "/admin/user" {
+		http.NotFound(w, req)
+		return
+	}
+
+	uid := q.Get("uid")
+	if req.Method == http.MethodPut && !has(q, "quota") && !has(q, "subuser") && !has(q, "key") {
+		if q.Get("tenant") != "" {
+			uid = q.Get("tenant") + "$" + uid
+		}
+		if f.users[uid] != nil {
+			http.Error(w, `{"Code":"UserAlreadyExists"}`, http.StatusConflict)
+			return
+		}
+
+		maxBuckets, _ := strconv.Atoi(q.Get("max-buckets"))
+		u := &fakeUser{mtime: time.Now(), info: rgw.UserInfoResponse{Tenant: q.Get("tenant"), UserID: uid, DisplayName: q.Get("display-name"),
+			MaxBuckets: maxBuckets, SubUsers: []rgw.SubUser{}, Keys: []rgw.UserKey{}, SwiftKeys: []rgw.SwiftKey{}}}
+		u.info.Keys = append(u.info.Keys, f.newKey(uid))
+		f.users[uid] = u
+		respondJSON(w, u.info)
+		return
+	}
+
+	u := f.users[uid]
+	if u == nil {
+		http.Error(w, `{"Code":"NoSuchUser"}`, http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case has(q, "quota") && req.Method == http.MethodGet:
+		respondJSON(w, u.quota)
+	case has(q, "quota") && req.Method == http.MethodPut:
+		size, _ := strconv.ParseInt(q.Get("max-size-kb"), 10, 64)
+		objects, _ := strconv.ParseInt(q.Get("max-objects"), 10, 64)
+		u.quota = rgw.QuotaMeta{Enabled: q.Get("enabled") == "true", MaxSizeKb: size, MaxObjects: objects}
+	case has(q, "subuser") && !has(q, "key") && req.Method == http.MethodPut:
+		id := uid + ":" + param(q, "subuser")
+		u.info.SubUsers = append(u.info.SubUsers, rgw.SubUser{ID: id, Permissions: q.Get("access")})
+		u.info.SwiftKeys = append(u.info.SwiftKeys, rgw.SwiftKey{User: id, SecretKey: f.newKey(id).SecretKey})
+		respondJSON(w, u.info.SubUsers)
+	case has(q, "subuser") && !has(q, "key") && req.Method == http.MethodDelete:
+		id := uid + ":" + param(q, "subuser")
+		subusers, swiftKeys, keys := []rgw.SubUser{}, []rgw.SwiftKey{}, []rgw.UserKey{}
+		for _, s := range u.info.SubUsers {
+			if s.ID != id {
+				subusers = append(subusers, s)
+			}
+		}
+		for _, k := range u.info.SwiftKeys {
+			if k.User != id {
+				swiftKeys = append(swiftKeys, k)
+			}
+		}
+		for _, k := range u.info.Keys {
+			if k.User != id {
+				keys = append(keys, k)
+			}
+		}
+		if len(subusers) == len(u.info.SubUsers) {
+			http.Error(w, `{"Code":"NoSuchSubUser"}`, http.StatusNotFound)
+			return
+		}
+		u.info.SubUsers, u.info.SwiftKeys, u.info.Keys = subusers, swiftKeys, keys
+	case has(q, "key") && req.Method == http.MethodPut:
+		owner := uid
+		if param(q, "subuser") != "" {
+			owner = uid + ":" + param(q, "subuser")
+		}
+		u.info.Keys = append(u.info.Keys, f.newKey(owner))
+		respondJSON(w, u.info.Keys)
+	case has(q, "key") && req.Method == http.MethodDelete:
+		keys := []rgw.UserKey{}
+		for _, k := range u.info.Keys {
+			if k.AccessKey != q.Get("access-key") {
+				keys = append(keys, k)
+			}
+		}
+		if len(keys) == len(u.info.Keys) {
+			http.Error(w, `{"Code":"InvalidAccessKeyId"}`, http.StatusNotFound)
+			return
+		}
+		u.info.Keys = keys
+	case req.Method == http.MethodGet:
+		info := u.info
+		if q.Get("stats") == "true" {
+			info.Stats = &rgw.UserStats{}
+		}
+		respondJSON(w, info)
+	case req.Method == http.MethodPost:
+		if q.Get("max-buckets") != "" {
+			u.info.MaxBuckets, _ = strconv.Atoi(q.Get("max-buckets"))
+		}
+		respondJSON(w, u.info)
+	case req.Method == http.MethodDelete:
+		if q.Get("purge-data") == "true" {
+			f.purgeBuckets(uid)
+		}
+		delete(f.users, uid)
+	default:
+		http.Error(w, "Unsupported request", http.StatusBadRequest)
+	}
+}
+
+//Serves a zonegroup map with a single zonegroup holding the placement targets
+func (f *FakeRadosgw) serveZonegroupMap(w http.ResponseWriter) {
+	targets := []map[string]interface{}{}
+	for name, classes := range f.PlacementTargets {
+		targets = append(targets, map[string]interface{}{"name": name, "tags": []string{}, "storage_classes": classes})
+	}
+
+	respondJSON(w, map[string]interface{}{
+		"zonegroups": []map[string]interface{}{{"key": "zonegroup-id", "val": map[string]interface{}{
+			"id": "zonegroup-id", "name": "default", "default_placement": "default-placement", "placement_targets": targets}}},
+		"master_zonegroup": "zonegroup-id",
+	})
+}
+
+//Serves the usage log. Like the radosgw, periods whose start or end it can't parse are refused
+func (f *FakeRadosgw) serveUsage(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	for _, key := range []string{"start", "end"} {
+		if _, err := time.Parse("2006-01-02 15:04:05", q.Get(key)); err != nil {
+			http.Error(w, `{"Code":"InvalidArgument"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries := []rgw.UsageEntry{}
+	if q.Get("show-entries") == "true" {
+		entries = append(entries, f.UsageEntries...)
+	}
+	respondJSON(w, rgw.UsageResponse{Entries: entries, Summary: []rgw.UsageSummary{}})
+}
+
+//Serves the user metadata, of which only the default placement and storage class can be changed
+func (f *FakeRadosgw) serveMetadata(w http.ResponseWriter, req *http.Request) {
+	key := req.URL.Query().Get("key")
+	if key == "" && req.Method == http.MethodGet {
+		respondJSON(w, f.userIDs())
+		return
+	}
+
+	u := f.users[key]
+	if u == nil {
+		http.Error(w, `{"Code":"NoSuchKey"}`, http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		meta := rgw.MUserResponse{Data: u.info}
+		meta.Key = key
+		meta.Mtime = rgw.RadosTime(u.mtime)
+		data, _ := json.Marshal(meta)
+
+		fields := map[string]interface{}{}
+		json.Unmarshal(data, &fields)
+		fields["data"].(map[string]interface{})["default_placement"] = u.placement
+		fields["data"].(map[string]interface{})["default_storage_class"] = u.storageClass
+		respondJSON(w, fields)
+	case http.MethodPut:
+		meta := struct {
+			Data struct {
+				DefaultPlacement    string `json:"default_placement"`
+				DefaultStorageClass string `json:"default_storage_class"`
+			} `json:"data"`
+		}{}
+		if err := json.NewDecoder(req.Body).Decode(&meta); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		u.placement = meta.Data.DefaultPlacement
+		u.storageClass = meta.Data.DefaultStorageClass
+	default:
+		http.Error(w, "Unsupported request", http.StatusBadRequest)
+	}
+}
+
+func (f *FakeRadosgw) userIDs() []string {
+	ids := []string{}
+	for id := range f.users {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (f *FakeRadosgw) newKey(user string) rgw.UserKey {
+	f.keys++
+	return rgw.UserKey{User: user, AccessKey: fmt.Sprintf("ACCESS%014d", f.keys), SecretKey: fmt.Sprintf("secret%034d", f.keys)}
+}
+
+//Returns the last value of a query parameter, as the subresource of a request, e.g. 'subuser' in '/user?subuser', may come first
+func param(q url.Values, key string) string {
+	v := q[key]
+	if len(v) == 0 {
+		return ""
+	}
+	return v[len(v)-1]
+}
+
+func has(q url.Values, key string) bool {
+	_, ok := q[key]
+	return ok
+}
+
+func respondJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
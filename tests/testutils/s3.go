@@ -0,0 +1,224 @@
+package testutils
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+//Buckets are scoped to the tenant of their owner, like on the radosgw
+type fakeBucket struct {
+	owner   string
+	policy  string
+	objects map[string]string
+}
+
+var credentialPattern = regexp.MustCompile(`Credential=([^/]+)/`)
+
+//PutObject stores an object in a bucket of the tenant, without going through the S3 API
+func (f *FakeRadosgw) PutObject(tenant string, bucket string, name string, data string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if b := f.buckets[bucketID(tenant, bucket)]; b != nil {
+		b.objects[name] = data
+	}
+}
+
+//Buckets returns the names of all buckets, prefixed by their tenant like 'tenant:bucket'
+func (f *FakeRadosgw) Buckets() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	ids := []string{}
+	for id := range f.buckets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+//BucketPolicy returns the policy of a bucket of the tenant, which is empty if it has none
+func (f *FakeRadosgw) BucketPolicy(tenant string, bucket string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if b := f.buckets[bucketID(tenant, bucket)]; b != nil {
+		return b.policy
+	}
+	return ""
+}
+
+//SetBucketPolicy sets the policy of a bucket of the tenant, without going through the S3 API
+func (f *FakeRadosgw) SetBucketPolicy(tenant string, bucket string, policy string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if b := f.buckets[bucketID(tenant, bucket)]; b != nil {
+		b.policy = policy
+	}
+}
+
+//S3AccessKeys returns the access keys S3 requests were made with, in the order they were first used
+func (f *FakeRadosgw) S3AccessKeys() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([]string{}, f.s3Keys...)
+}
+
+//Serves the bucket operations of the S3 API with path style requests. Requests are made as the user owning the access
+//key they are signed with, though the signature itself isn't checked
+func (f *FakeRadosgw) serveS3(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	parts := strings.SplitN(strings.Trim(req.URL.Path, "/"), "/", 2)
+	if len(parts) != 1 || parts[0] == "" {
+		respondS3Error(w, "NotImplemented", http.StatusNotImplemented)
+		return
+	}
+
+	owner := f.keyOwner(req)
+	if owner == "" {
+		respondS3Error(w, "InvalidAccessKeyId", http.StatusForbidden)
+		return
+	}
+	tenant := ""
+	if i := strings.Index(owner, "$"); i >= 0 {
+		tenant = owner[:i]
+	}
+	id := bucketID(tenant, parts[0])
+	b := f.buckets[id]
+
+	if req.Method == http.MethodPut && len(q) == 0 {
+		if b != nil {
+			respondS3Error(w, "BucketAlreadyExists", http.StatusConflict)
+			return
+		}
+		f.buckets[id] = &fakeBucket{owner: owner, objects: map[string]string{}}
+		return
+	}
+	if has(q, "location") && req.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			Value   string   `xml:",chardata"`
+		}{Value: "us-east-1"})
+		return
+	}
+	if b == nil {
+		respondS3Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case has(q, "policy") && req.Method == http.MethodGet:
+		if b.policy == "" {
+			respondS3Error(w, "NoSuchBucketPolicy", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(b.policy))
+	case has(q, "policy") && req.Method == http.MethodPut:
+		policy, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			respondS3Error(w, "IncompleteBody", http.StatusBadRequest)
+			return
+		}
+		b.policy = string(policy)
+		w.WriteHeader(http.StatusNoContent)
+	case has(q, "policy") && req.Method == http.MethodDelete:
+		b.policy = ""
+		w.WriteHeader(http.StatusNoContent)
+	case q.Get("list-type") == "2" && req.Method == http.MethodGet:
+		f.serveObjectList(w, parts[0], b)
+	case req.Method == http.MethodHead && len(q) == 0:
+	case req.Method == http.MethodDelete && len(q) == 0:
+		if len(b.objects) > 0 {
+			respondS3Error(w, "BucketNotEmpty", http.StatusConflict)
+			return
+		}
+		delete(f.buckets, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		respondS3Error(w, "NotImplemented", http.StatusNotImplemented)
+	}
+}
+
+//Serves all objects of the bucket at once, as the broker only checks whether there are any
+func (f *FakeRadosgw) serveObjectList(w http.ResponseWriter, name string, b *fakeBucket) {
+	type object struct {
+		Key          string
+		Size         int64
+		LastModified string
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		IsTruncated bool
+		Contents    []object
+	}{Name: name}
+
+	keys := []string{}
+	for key := range b.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		result.Contents = append(result.Contents, object{Key: key, Size: int64(len(b.objects[key])), LastModified: time.Now().UTC().Format(time.RFC3339)})
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+//Returns the ID of the user or subuser owning the access key a request is signed with, and records that it was used.
+//The ID is empty for unknown keys
+func (f *FakeRadosgw) keyOwner(req *http.Request) string {
+	m := credentialPattern.FindStringSubmatch(req.Header.Get("Authorization"))
+	if m == nil {
+		return ""
+	}
+
+	for _, u := range f.users {
+		for _, k := range u.info.Keys {
+			if k.AccessKey != m[1] {
+				continue
+			}
+
+			used := false
+			for _, key := range f.s3Keys {
+				used = used || key == k.AccessKey
+			}
+			if !used {
+				f.s3Keys = append(f.s3Keys, k.AccessKey)
+			}
+			return u.info.UserID
+		}
+	}
+	return ""
+}
+
+//Deletes the buckets owned by the user, along with their objects
+func (f *FakeRadosgw) purgeBuckets(uid string) {
+	for id, b := range f.buckets {
+		if b.owner == uid {
+			delete(f.buckets, id)
+		}
+	}
+}
+
+func bucketID(tenant string, bucket string) string {
+	return tenant + ":" + bucket
+}
+
+func respondS3Error(w http.ResponseWriter, code string, status int) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+	}{Code: code})
+}